@@ -0,0 +1,127 @@
+package kiwi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type AccessLogFormat int
+
+const (
+	// like the Common Log Format, followed by the bytes received, the
+	// duration in milliseconds, the close code and the subprotocol. The
+	// host is the ClientIP if there is one:
+	// 127.0.0.1 - - [17/Oct/2026:10:00:00 +0000] "GET /chat HTTP/1.1" 101 2326 96 5012 1000 "chat.v2"
+	AccessLogCommon AccessLogFormat = iota
+	AccessLogJSON
+)
+
+// AccessLogEntry is logged once per conn, when its handshake fails or when
+// it's closed.
+type AccessLogEntry struct {
+	Time       time.Time `json:"time"`
+	RemoteAddr string    `json:"remote_addr"`
+	// the address of the client behind a trusted proxy, see Conn.ClientIP
+	ClientIP    string        `json:"client_ip,omitempty"`
+	Method      string        `json:"method"`
+	Path        string        `json:"path"`
+	Proto       string        `json:"proto"`
+	Status      int           `json:"status"`
+	Subprotocol string        `json:"subprotocol,omitempty"`
+	Extensions  string        `json:"extensions,omitempty"`
+	Duration    time.Duration `json:"duration_ns"`
+	BytesIn     uint64        `json:"bytes_in"`
+	BytesOut    uint64        `json:"bytes_out"`
+	CloseCode   uint16        `json:"close_code,omitempty"`
+	Error       string        `json:"error,omitempty"`
+}
+
+// AccessLog writes an entry per conn of the Server it's set to, the
+// WebSocket analogue of the HTTP access logs.
+type AccessLog struct {
+	w      io.Writer
+	format AccessLogFormat
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func NewAccessLog(w io.Writer, format AccessLogFormat) *AccessLog {
+	return &AccessLog{w: w, format: format}
+}
+
+func (l *AccessLog) Log(e *AccessLogEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.format == AccessLogJSON {
+		data, _ := json.Marshal(e)
+		l.buf = append(append(l.buf[:0], data...), '\n')
+	} else {
+		l.buf = appendCommonLog(l.buf[:0], e)
+	}
+	l.w.Write(l.buf)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func appendCommonLog(b []byte, e *AccessLogEntry) []byte {
+	if e.ClientIP != "" {
+		b = append(b, e.ClientIP...)
+	} else {
+		b = append(b, orDash(e.RemoteAddr)...)
+	}
+	b = append(b, " - - ["...)
+	b = e.Time.AppendFormat(b, "02/Jan/2006:15:04:05 -0700")
+	b = append(b, "] "...)
+	b = strconv.AppendQuote(b, fmt.Sprintf("%s %s %s", orDash(e.Method), orDash(e.Path), orDash(e.Proto)))
+	b = fmt.Appendf(b, " %03d %d %d %d %d ", e.Status, e.BytesOut, e.BytesIn, e.Duration.Milliseconds(), e.CloseCode)
+	b = strconv.AppendQuote(b, orDash(e.Subprotocol))
+	return append(b, '\n')
+}
+
+// logAccess logs the conn to the access log of the server, status is the
+// handshake status.
+func (c *Conn) logAccess(status int, code uint16, err error) {
+	al := c.Server.AccessLog
+	if al == nil {
+		return
+	}
+
+	e := &AccessLogEntry{
+		Time:        c.acceptedAt,
+		RemoteAddr:  c.rwc.RemoteAddr().String(),
+		Status:      status,
+		Subprotocol: c.Subprotocol(),
+		Extensions:  c.extensionsValue(),
+		Duration:    c.Server.clock().Now().Sub(c.acceptedAt),
+		BytesIn:     c.wireBytesRecv.Load(),
+		BytesOut:    c.wireBytesSent.Load(),
+		CloseCode:   code,
+	}
+	if c.Server.TrustedProxies != nil {
+		if ip := c.ClientIP(); ip.IsValid() {
+			e.ClientIP = ip.String()
+		}
+	}
+	if hsReq := c.HandshakeRequest; hsReq != nil {
+		e.Method = hsReq.Method
+		e.Proto = hsReq.Proto
+		if hsReq.RequestURL != nil {
+			e.Path = hsReq.RequestURL.Path
+		}
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	al.Log(e)
+}
@@ -0,0 +1,169 @@
+package kiwi
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrAckTimeout   = errors.New("ack timed out")
+	ErrAcksDisabled = errors.New("acks are not enabled by Server.Acks")
+)
+
+// the first bytes of the messages of the ack protocol, see Server.Acks. A
+// message sent by SendWithAck is prefixed by "\x05<id>\n", its ack is the
+// text message "\x06<id>". The other messages starting by one of these
+// bytes are prefixed by ackEscape, so are the fragmented ones of an empty
+// first frame.
+const (
+	ackRequestPrefix = '\x05'
+	ackPrefix        = '\x06'
+	ackEscape        = '\x07'
+)
+
+type ackState struct {
+	mu      sync.Mutex
+	lastID  uint64
+	pending map[uint64]chan struct{}
+}
+
+func (a *ackState) add() (uint64, chan struct{}) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.pending == nil {
+		a.pending = make(map[uint64]chan struct{})
+	}
+	a.lastID++
+	ch := make(chan struct{})
+	a.pending[a.lastID] = ch
+	return a.lastID, ch
+}
+
+func (a *ackState) remove(id uint64) {
+	a.mu.Lock()
+	delete(a.pending, id)
+	a.mu.Unlock()
+}
+
+func (a *ackState) resolve(id uint64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if ch, ok := a.pending[id]; ok {
+		close(ch)
+		delete(a.pending, id)
+	}
+}
+
+// SendWithAck sends msg asking the peer to ack it by Message.Ack, and waits
+// for the ack. It fails with ErrAckTimeout if the ack is not read in
+// timeout, zero means no timeout, and with the error of the conn if it's
+// closed first. The acks are read by the receiver of the conn, so it must
+// be reading meanwhile.
+func (s *DefaultMessageSender) SendWithAck(msg *Message, timeout time.Duration) error {
+	c := s.conn
+	if !c.Server.Acks {
+		return ErrAcksDisabled
+	}
+
+	id, acked := c.acks.add()
+	defer c.acks.remove(id)
+
+	data := strconv.AppendUint([]byte{ackRequestPrefix}, id, 10)
+	data = append(append(data, '\n'), msg.Data...)
+	if err := s.sendAckMessage(&Message{Opcode: msg.Opcode, Data: data}); err != nil {
+		return err
+	}
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		t := c.Server.clock().NewTimer(timeout)
+		defer t.Stop()
+		expired = t.C()
+	}
+
+	select {
+	case <-acked:
+		return nil
+	case <-expired:
+		return ErrAckTimeout
+	case <-c.ctx.Done():
+		return c.notOpenErr()
+	}
+}
+
+// Ack acks the message to its sender if it's been sent by SendWithAck, the
+// other messages and the ones acked before are ignored.
+func (m *Message) Ack() error {
+	c := m.ackConn
+	if c == nil {
+		return nil
+	}
+	m.ackConn = nil
+	s := &DefaultMessageSender{conn: c}
+	return s.sendAckMessage(&Message{Opcode: OpcodeText, Data: strconv.AppendUint([]byte{ackPrefix}, m.ackID, 10)})
+}
+
+// sendAckMessage sends a message of the ack protocol, unlike SendWhole it's
+// not escaped.
+func (s *DefaultMessageSender) sendAckMessage(msg *Message) error {
+	if s.conn.closed.Load() {
+		return s.conn.notOpenErr()
+	}
+	defer s.conn.sendMu.Unlock()
+	s.conn.sendMu.Lock()
+
+	_, err := s.sendWhole(msg, false)
+	return err
+}
+
+// escapeAck prefixes data by ackEscape if the peer could take it for a
+// message of the ack protocol. It's of a whole message if whole is set,
+// otherwise of the first frame of one, which is escaped if empty too since
+// the first byte of the message is unknown then.
+func (c *Conn) escapeAck(opcode uint8, data []byte, whole bool) []byte {
+	if !c.Server.Acks || (opcode != OpcodeText && opcode != OpcodeBinary) {
+		return data
+	}
+	if len(data) == 0 {
+		if whole {
+			return data
+		}
+	} else if b := data[0]; b != ackRequestPrefix && b != ackPrefix && b != ackEscape {
+		return data
+	}
+	return append([]byte{ackEscape}, data...)
+}
+
+// unwrapAck strips the ack request or the escape of msg, or resolves the
+// ack it is, it returns false for the acks, which are not given to the app.
+func (c *Conn) unwrapAck(msg *Message) bool {
+	if !c.Server.Acks || (!msg.IsText() && !msg.IsBinary()) || len(msg.Data) == 0 {
+		return true
+	}
+
+	switch msg.Data[0] {
+	case ackEscape:
+		msg.Data = msg.Data[:copy(msg.Data, msg.Data[1:])]
+	case ackPrefix:
+		if id, err := strconv.ParseUint(string(msg.Data[1:]), 10, 64); err == nil {
+			c.acks.resolve(id)
+			msg.Release()
+			return false
+		}
+	case ackRequestPrefix:
+		i := bytes.IndexByte(msg.Data, '\n')
+		if i < 0 {
+			break
+		}
+		if id, err := strconv.ParseUint(string(msg.Data[1:i]), 10, 64); err == nil {
+			msg.ackID, msg.ackConn = id, c
+			msg.Data = msg.Data[:copy(msg.Data, msg.Data[i+1:])]
+		}
+	}
+	return true
+}
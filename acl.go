@@ -0,0 +1,102 @@
+package kiwi
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+)
+
+type accessRules struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// AccessList filters the accepted conns by the CIDR ranges of their remote
+// addresses. A deny match always rejects, and if the allow list is not
+// empty only the matching addresses are accepted. The lists can be replaced
+// by Update while the server is running.
+type AccessList struct {
+	rules atomic.Pointer[accessRules]
+}
+
+// NewAccessList takes CIDRs like "10.0.0.0/8" or single addresses like
+// "192.168.1.1" and "::1".
+func NewAccessList(allow, deny []string) (*AccessList, error) {
+	al := &AccessList{}
+	if err := al.Update(allow, deny); err != nil {
+		return nil, err
+	}
+	return al, nil
+}
+
+func parsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, s := range cidrs {
+		s = strings.TrimSpace(s)
+
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, err
+			}
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// Update replaces the lists atomically, the lists in use are kept if any
+// of the new ones is invalid.
+func (al *AccessList) Update(allow, deny []string) error {
+	a, err := parsePrefixes(allow)
+	if err != nil {
+		return err
+	}
+	d, err := parsePrefixes(deny)
+	if err != nil {
+		return err
+	}
+
+	al.rules.Store(&accessRules{allow: a, deny: d})
+	return nil
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (al *AccessList) Allowed(addr netip.Addr) bool {
+	r := al.rules.Load()
+	addr = addr.Unmap()
+
+	if containsAddr(r.deny, addr) {
+		return false
+	}
+	return len(r.allow) == 0 || containsAddr(r.allow, addr)
+}
+
+// AllowConn checks the remote address of cn, conns without an IP address,
+// such as unix sockets, are allowed.
+func (al *AccessList) AllowConn(cn net.Conn) bool {
+	ta, ok := cn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+
+	addr, ok := netip.AddrFromSlice(ta.IP)
+	return !ok || al.Allowed(addr)
+}
@@ -0,0 +1,160 @@
+package kiwi
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// the first fd passed by systemd or by Restart, after stdin, stdout and
+// stderr
+const listenFDsStart = 3
+
+// set by Restart for the new process, whose pid is unknown before it starts
+// so LISTEN_PID can't be used
+const envRestartFDs = "KIWI_LISTEN_FDS"
+
+var ErrListenerNotInheritable = errors.New("listener has no file descriptor to pass")
+
+// InheritedListeners returns the listeners passed by systemd socket
+// activation, see sd_listen_fds(3), or by Restart of the previous process.
+// It's empty if there are none, and the variables of the environment are
+// unset so they are not passed again to the children.
+func InheritedListeners() ([]net.Listener, error) {
+	var n int
+	var err error
+
+	if v := os.Getenv(envRestartFDs); v != "" {
+		n, err = strconv.Atoi(v)
+	} else if v := os.Getenv("LISTEN_FDS"); v != "" && os.Getenv("LISTEN_PID") == strconv.Itoa(os.Getpid()) {
+		n, err = strconv.Atoi(v)
+	}
+	os.Unsetenv(envRestartFDs)
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid number of inherited fds: %w", err)
+	}
+
+	files := make([]*os.File, max(0, n))
+	for i := range files {
+		fd := listenFDsStart + i
+		files[i] = os.NewFile(uintptr(fd), "listener-"+strconv.Itoa(fd))
+	}
+	return listenersFromFiles(files)
+}
+
+// listenersFromFiles closes files, the listeners have their own copies of
+// the fds.
+func listenersFromFiles(files []*os.File) ([]net.Listener, error) {
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	var lns []net.Listener
+	for _, f := range files {
+		ln, err := net.FileListener(f)
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return nil, err
+		}
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
+
+type filer interface {
+	File() (*os.File, error)
+}
+
+// tlsListener keeps the tcp listener under the tls one for its fd, see
+// Restart.
+type tlsListener struct {
+	net.Listener
+	tcp net.Listener
+}
+
+func (ln tlsListener) File() (*os.File, error) {
+	if f, ok := ln.tcp.(filer); ok {
+		return f.File()
+	}
+	return nil, ErrListenerNotInheritable
+}
+
+func (srv *Server) wrapTLS(ln net.Listener) net.Listener {
+	if srv.TLSConfig == nil {
+		return ln
+	}
+	return tlsListener{tls.NewListener(ln, srv.tlsConfig()), ln}
+}
+
+// Restart starts a new process of the running executable with the same
+// arguments, which inherits the listeners of the server and serves them by
+// ListenAndServe. Then the server is drained until ctx is done, see Drain.
+// The new conns wait in the backlog of the shared listeners until the new
+// process accepts them, so none is refused during the restart.
+func (srv *Server) Restart(ctx context.Context) (*os.Process, error) {
+	files, err := srv.listenerFiles()
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "LISTEN_") && !strings.HasPrefix(kv, envRestartFDs+"=") {
+			cmd.Env = append(cmd.Env, kv)
+		}
+	}
+	cmd.Env = append(cmd.Env, envRestartFDs+"="+strconv.Itoa(len(files)))
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return cmd.Process, srv.Drain(ctx)
+}
+
+func (srv *Server) listenerFiles() ([]*os.File, error) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	var files []*os.File
+	for ln := range srv.listeners {
+		fl, ok := ln.(filer)
+		if !ok {
+			return files, ErrListenerNotInheritable
+		}
+		f, err := fl.File()
+		if err != nil {
+			return files, err
+		}
+		files = append(files, f)
+	}
+	if len(files) == 0 {
+		return nil, errors.New("no listener to pass")
+	}
+	return files, nil
+}
@@ -0,0 +1,202 @@
+package kiwi
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the max body of the messages sent by AdminHandler
+const maxAdminMessageBytes = 1 << 20
+
+// ConnInfo describes an open conn listed by AdminHandler.
+type ConnInfo struct {
+	ID          uint64    `json:"id"`
+	Path        string    `json:"path"`
+	RemoteAddr  string    `json:"remote_addr"`
+	ClientIP    string    `json:"client_ip,omitempty"`
+	Subprotocol string    `json:"subprotocol,omitempty"`
+	Extensions  string    `json:"extensions,omitempty"`
+	Key         string    `json:"key,omitempty"`
+	Tags        []string  `json:"tags"`
+	Bucket      string    `json:"bucket,omitempty"`
+	AcceptedAt  time.Time `json:"accepted_at"`
+	BytesSent   uint64    `json:"bytes_sent"`
+	BytesRecv   uint64    `json:"bytes_recv"`
+}
+
+func (c *Conn) info() *ConnInfo {
+	ci := &ConnInfo{
+		ID:          c.ID,
+		Path:        c.HandshakeRequest.RequestURL.Path,
+		RemoteAddr:  c.RemoteAddr().String(),
+		Subprotocol: c.Subprotocol(),
+		Extensions:  c.extensionsValue(),
+		Key:         c.Server.ConnPool.keyOf(c),
+		Tags:        c.Tags(),
+		Bucket:      c.Bucket,
+		AcceptedAt:  c.acceptedAt,
+		BytesSent:   c.SendStats().PayloadBytes,
+		BytesRecv:   c.RecvStats().PayloadBytes,
+	}
+	if ip := c.ClientIP(); ip.IsValid() {
+		ci.ClientIP = ip.String()
+	}
+	return ci
+}
+
+// AdminHandler serves the API managing the open conns to the requests
+// authorized by auth, the others get 401:
+//
+//	GET  /conns              lists the conns, filtered by the path, tag or key query params
+//	POST /conns/{id}/close   closes a conn with the code and reason query params
+//	POST /conns/{id}/send    sends the body to a conn
+//	POST /rooms/{tag}/send   sends the body to the conns tagged with tag
+//
+// The conns are closed with CloseCodeNormalClosure if there's no code, and
+// the messages are text unless the query param binary is set. It's meant
+// for an internal listener, or to be mounted under a prefix by
+// http.StripPrefix.
+func (srv *Server) AdminHandler(auth func(r *http.Request) bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth == nil || !auth(r) {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		switch {
+		case len(parts) == 1 && parts[0] == "conns":
+			if r.Method != http.MethodGet {
+				w.Header().Set("Allow", http.MethodGet)
+				http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+				return
+			}
+			srv.adminListConns(w, r)
+		case len(parts) == 3 && (parts[0] == "conns" || parts[0] == "rooms"):
+			if r.Method != http.MethodPost {
+				w.Header().Set("Allow", http.MethodPost)
+				http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+				return
+			}
+			switch parts[0] + "/" + parts[2] {
+			case "conns/close":
+				srv.adminCloseConn(w, r, parts[1])
+			case "conns/send":
+				srv.adminSendConn(w, r, parts[1])
+			case "rooms/send":
+				srv.adminSendRoom(w, r, parts[1])
+			default:
+				http.NotFound(w, r)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+func (srv *Server) adminListConns(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	path, tag, key := q.Get("path"), q.Get("tag"), q.Get("key")
+
+	conns := []*ConnInfo{}
+	srv.ConnPool.Range(func(c *Conn) bool {
+		if c.GetState() != StateOpen {
+			return true
+		}
+		ci := c.info()
+		if (path == "" || ci.Path == path) && (key == "" || ci.Key == key) && (tag == "" || srv.ConnPool.hasTag(c, tag)) {
+			conns = append(conns, ci)
+		}
+		return true
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(conns)
+}
+
+// adminConn returns the open conn of id, or fails with 404.
+func (srv *Server) adminConn(w http.ResponseWriter, r *http.Request, id string) (*Conn, bool) {
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err == nil {
+		if c, ok := srv.ConnPool.Get(n); ok && c.GetState() == StateOpen {
+			return c, true
+		}
+	}
+	http.Error(w, "no such conn", http.StatusNotFound)
+	return nil, false
+}
+
+func (srv *Server) adminCloseConn(w http.ResponseWriter, r *http.Request, id string) {
+	code := uint64(CloseCodeNormalClosure)
+	if v := r.URL.Query().Get("code"); v != "" {
+		var err error
+		if code, err = strconv.ParseUint(v, 10, 16); err != nil || !ValidCloseCode(uint16(code)) {
+			http.Error(w, "invalid close code", http.StatusBadRequest)
+			return
+		}
+	}
+
+	c, ok := srv.adminConn(w, r, id)
+	if !ok {
+		return
+	}
+	c.CloseWithCode(uint16(code), r.URL.Query().Get("reason"))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminMessage reads the message of the body of r, or fails with 400.
+func adminMessage(w http.ResponseWriter, r *http.Request) (*Message, bool) {
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxAdminMessageBytes))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+
+	msg := &Message{Opcode: OpcodeText, Data: data}
+	if r.URL.Query().Has("binary") {
+		msg.Opcode = OpcodeBinary
+	}
+	return msg, true
+}
+
+func (srv *Server) adminSendConn(w http.ResponseWriter, r *http.Request, id string) {
+	c, ok := srv.adminConn(w, r, id)
+	if !ok {
+		return
+	}
+	msg, ok := adminMessage(w, r)
+	if !ok {
+		return
+	}
+
+	if err := c.Send(msg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminSendRoom queues the message to each conn by TrySend, the conns whose
+// queues are full are counted as failed.
+func (srv *Server) adminSendRoom(w http.ResponseWriter, r *http.Request, tag string) {
+	msg, ok := adminMessage(w, r)
+	if !ok {
+		return
+	}
+
+	var sent, failed int
+	for _, c := range srv.ConnPool.ByTag(tag) {
+		if c.TrySend(msg) {
+			sent++
+		} else {
+			failed++
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"sent": sent, "failed": failed})
+}
@@ -0,0 +1,64 @@
+package kiwi
+
+import (
+	"encoding/binary"
+)
+
+// Broker carries the messages published to the hubs of several server
+// instances, so the members connected to any of them get all the messages
+// of their topics. See the redisbroker package for one backed by Redis pub/sub,
+// the others like NATS or Kafka can be plugged in the same way.
+type Broker interface {
+	// Publish sends data to all the subscribers of topic, including the
+	// one of the publisher itself.
+	Publish(topic string, data []byte) error
+
+	// Subscribe calls fn with the data published to topic until Unsubscribe,
+	// fn is called by a goroutine of the broker in the order of the
+	// publications. fn may keep data.
+	Subscribe(topic string, fn func(data []byte)) error
+	Unsubscribe(topic string) error
+}
+
+// the hub id and the opcode before the data
+const brokeredHeaderLen = 9
+
+func (h *Hub) encodeBrokered(msg *Message) []byte {
+	data := make([]byte, brokeredHeaderLen, brokeredHeaderLen+len(msg.Data))
+	binary.BigEndian.PutUint64(data, h.id)
+	data[8] = msg.Opcode
+	return append(data, msg.Data...)
+}
+
+// fromBroker delivers a message published by the hub of another instance,
+// the ones of h were delivered by Publish already.
+func (h *Hub) fromBroker(topic string, data []byte) {
+	if len(data) < brokeredHeaderLen || binary.BigEndian.Uint64(data) == h.id {
+		return
+	}
+	h.deliver(topic, &Message{Opcode: data[8], Data: data[brokeredHeaderLen:]})
+}
+
+func (h *Hub) brokerError(err error) {
+	if err != nil && h.OnBrokerError != nil {
+		h.OnBrokerError(err)
+	}
+}
+
+// Close unsubscribes the hub from the topics of Broker.
+func (h *Hub) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var first error
+	for name, t := range h.topics {
+		if !t.subscribed {
+			continue
+		}
+		t.subscribed = false
+		if err := h.Broker.Unsubscribe(name); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,56 @@
+package kiwi
+
+import (
+	"hash/fnv"
+	"strconv"
+)
+
+type Bucket struct {
+	Name   string
+	Weight int
+}
+
+// Bucketing assigns each conn to one of Buckets at upgrade time, in
+// proportion to their weights. The assignment is stable for a given key.
+type Bucketing struct {
+	Buckets []Bucket
+
+	// returns the key hashed to pick the bucket, usually a user ID, the
+	// conn ID is used if it's nil or returns an empty key
+	Key func(hsReq *HandshakeRequest, conn *Conn) string
+}
+
+func (b *Bucketing) Assign(hsReq *HandshakeRequest, conn *Conn) string {
+	total := 0
+	for _, bk := range b.Buckets {
+		if bk.Weight > 0 {
+			total += bk.Weight
+		}
+	}
+	if total == 0 {
+		return ""
+	}
+
+	var key string
+	if b.Key != nil {
+		key = b.Key(hsReq, conn)
+	}
+	if key == "" {
+		key = strconv.FormatUint(conn.ID, 10)
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	n := int(h.Sum32() % uint32(total))
+
+	for _, bk := range b.Buckets {
+		if bk.Weight <= 0 {
+			continue
+		}
+		if n < bk.Weight {
+			return bk.Name
+		}
+		n -= bk.Weight
+	}
+	return ""
+}
@@ -0,0 +1,126 @@
+package kiwi
+
+import (
+	"bufio"
+	"io"
+	"math/bits"
+	"sync"
+)
+
+const (
+	minBufferClassBits = 9  // 512B
+	maxBufferClassBits = 20 // 1MB
+)
+
+// BufferPool hands out byte slices from size-classed sync.Pools, slices
+// larger than the biggest class are allocated directly and never pooled.
+type BufferPool struct {
+	classes [maxBufferClassBits - minBufferClassBits + 1]sync.Pool
+}
+
+// DefaultBufferPool is shared by all the conns for frame payloads and
+// read buffers.
+var DefaultBufferPool = NewBufferPool()
+
+func NewBufferPool() *BufferPool {
+	p := &BufferPool{}
+	for i := range p.classes {
+		size := 1 << uint(i+minBufferClassBits)
+		p.classes[i].New = func() any {
+			b := make([]byte, size)
+			return &b
+		}
+	}
+	return p
+}
+
+func bufferClass(size int) int {
+	if size <= 1<<minBufferClassBits {
+		return 0
+	}
+	return bits.Len(uint(size-1)) - minBufferClassBits
+}
+
+// Get returns a slice of length size whose content is undefined.
+func (p *BufferPool) Get(size int) []byte {
+	class := bufferClass(size)
+	if class >= len(p.classes) {
+		return make([]byte, size)
+	}
+
+	b := p.classes[class].Get().(*[]byte)
+	return (*b)[:size]
+}
+
+// Put gives b back to the pool, b must not be used after that. Slices not
+// obtained from Get are ignored.
+func (p *BufferPool) Put(b []byte) {
+	c := cap(b)
+	if c < 1<<minBufferClassBits || c&(c-1) != 0 {
+		return
+	}
+
+	class := bufferClass(c)
+	if class >= len(p.classes) {
+		return
+	}
+
+	b = b[:c]
+	p.classes[class].Put(&b)
+}
+
+// appendPooled is like append but grows dst by the pool, the old dst is
+// given back to the pool if it's been replaced.
+func (p *BufferPool) appendPooled(dst, src []byte) []byte {
+	n := len(dst) + len(src)
+	if n <= cap(dst) {
+		return append(dst, src...)
+	}
+
+	b := p.Get(n)
+	copy(b, dst)
+	copy(b[len(dst):], src)
+	p.Put(dst)
+	return b
+}
+
+const defaultConnBufferSize = 4096
+
+var (
+	connReaderPools sync.Map // size -> *sync.Pool
+	connWriterPools sync.Map
+)
+
+func sizedPool(pools *sync.Map, size int) *sync.Pool {
+	if p, ok := pools.Load(size); ok {
+		return p.(*sync.Pool)
+	}
+	p, _ := pools.LoadOrStore(size, &sync.Pool{})
+	return p.(*sync.Pool)
+}
+
+func getConnReader(r io.Reader, size int) *bufio.Reader {
+	if br, ok := sizedPool(&connReaderPools, size).Get().(*bufio.Reader); ok {
+		br.Reset(r)
+		return br
+	}
+	return bufio.NewReaderSize(r, size)
+}
+
+func putConnReader(br *bufio.Reader, size int) {
+	br.Reset(nil)
+	sizedPool(&connReaderPools, size).Put(br)
+}
+
+func getConnWriter(w io.Writer, size int) *bufio.Writer {
+	if bw, ok := sizedPool(&connWriterPools, size).Get().(*bufio.Writer); ok {
+		bw.Reset(w)
+		return bw
+	}
+	return bufio.NewWriterSize(w, size)
+}
+
+func putConnWriter(bw *bufio.Writer, size int) {
+	bw.Reset(nil)
+	sizedPool(&connWriterPools, size).Put(bw)
+}
@@ -0,0 +1,175 @@
+package kiwi
+
+import "errors"
+
+// callbacks are the handlers of a route of the callback API, the read pump
+// of its conns is run by kiwi, see OnMessage.
+type callbacks struct {
+	onMessage func(*Conn, *Message)
+	onClose   func(*Conn, *CloseError)
+	onError   func(*Conn, error)
+}
+
+// OnMessage registers fn to be called with each text or binary message read
+// from the conns opened on pattern, instead of a read loop registered by
+// OnConnOpenFunc. kiwi reads the messages within the conn limits, answers
+// the pings and the close frame of the peer, and fn replies by Conn.Send.
+// The messages are handled one at a time in the order they are read, on
+// the read goroutine of the conn or by Server.Workers if it's set.
+func (rt *routes) OnMessage(pattern string, fn func(c *Conn, msg *Message)) {
+	rt.callbacksFor(pattern).onMessage = fn
+}
+
+// OnClose registers fn to be called once the conns opened on pattern by the
+// callback API are closed, with the close frame of the peer, or
+// CloseCodeAbnormalClosure if there's none.
+func (rt *routes) OnClose(pattern string, fn func(c *Conn, ce *CloseError)) {
+	rt.callbacksFor(pattern).onClose = fn
+}
+
+// OnError registers fn to be called with the errors failing the conns opened
+// on pattern by the callback API, before they're closed. The peer going away
+// without a close frame is reported too, see IsPeerClosed.
+func (rt *routes) OnError(pattern string, fn func(c *Conn, err error)) {
+	rt.callbacksFor(pattern).onError = fn
+}
+
+func (rt *routes) callbacksFor(pattern string) *callbacks {
+	if cb, ok := rt.callbacks[pattern]; ok {
+		return cb
+	}
+
+	if rt.callbacks == nil {
+		rt.callbacks = make(map[string]*callbacks)
+	}
+
+	cb := &callbacks{}
+	rt.callbacks[pattern] = cb
+	rt.OnConnOpenFunc(pattern, cb.serve)
+	return cb
+}
+
+func (cb *callbacks) serve(r MessageReceiver, s MessageSender) {
+	p := cb.newPump(r, s)
+	if p.c.Server.EventLoop && p.c.Server.pollConn(p) {
+		return
+	}
+
+	for !p.step() {
+	}
+}
+
+// Handler handles the events of a conn run by Conn.Run.
+type Handler interface {
+	OnOpen(c *Conn)
+	OnMessage(c *Conn, msg *Message)
+	OnClose(c *Conn, ce *CloseError)
+	OnError(c *Conn, err error)
+}
+
+// Run reads the messages of the open conn c for h until it's closed, like
+// the callback API. OnOpen is called first, then OnMessage with each text or
+// binary message, the pings and the close of the peer are answered by kiwi.
+// OnError is called with the error failing c before it's closed, and
+// OnClose once it's closed. It's called by the handler of OnConnOpenFunc or
+// on a dialed conn, and returns after OnClose.
+func (c *Conn) Run(h Handler) {
+	cb := &callbacks{onMessage: h.OnMessage, onClose: h.OnClose, onError: h.OnError}
+	p := cb.newPump((&DefaultMessageReceiver{}).SetConn(c), (&DefaultMessageSender{}).SetConn(c))
+
+	h.OnOpen(c)
+	for !p.step() {
+	}
+}
+
+// pump reads the messages of a conn for its callbacks, on the goroutine of
+// the conn or when it's readable in the event loop mode.
+type pump struct {
+	cb *callbacks
+	c  *Conn
+	r  MessageReceiver
+	s  MessageSender
+	ce *CloseError
+
+	handle func(*Message)
+	mb     *mailbox
+}
+
+func (cb *callbacks) newPump(r MessageReceiver, s MessageSender) *pump {
+	p := &pump{cb: cb, c: r.GetConn(), r: r, s: s, ce: &CloseError{Code: CloseCodeAbnormalClosure}}
+
+	p.handle = func(msg *Message) {
+		if cb.onMessage != nil {
+			cb.onMessage(p.c, msg)
+		}
+	}
+
+	if workers := p.c.Server.Workers; workers != nil {
+		p.mb = workers.newMailbox(p.handle)
+		p.handle = p.mb.put
+	}
+	return p
+}
+
+// step reads and handles a message, it reports whether the conn is done.
+func (p *pump) step() (done bool) {
+	msg, err := p.r.ReadWhole(0)
+	if err != nil {
+		// the close of the peer answered by an AutoControl receiver
+		var ce *CloseError
+		if errors.As(err, &ce) {
+			p.ce = ce
+		}
+		if p.cb.onError != nil && !errors.Is(err, ErrConnIsNotOpen) {
+			p.cb.onError(p.c, err)
+		}
+		if IsProtocolError(err) {
+			p.c.closeWithCode(CloseCodeProtocolError)
+		}
+		p.finish()
+		return true
+	}
+
+	switch {
+	case msg.IsPing():
+		p.c.Send(&Message{Opcode: OpcodePong, Data: msg.Data})
+	case msg.IsPong():
+	case msg.IsClose():
+		p.ce = msg.CloseError()
+		code := p.ce.Code
+		if p.mb != nil {
+			p.mb.wait()
+		}
+		if code == CloseCodeNoStatusRcvd {
+			code = CloseCodeNormalClosure
+		}
+		p.s.SendClose(code, "", false, false)
+		p.finish()
+		return true
+	default:
+		p.handle(msg)
+	}
+	return false
+}
+
+func (p *pump) finish() {
+	if r, ok := p.r.(*DefaultMessageReceiver); ok {
+		r.endMsgSpan()
+	}
+
+	// the messages read before are handled before the close
+	if p.mb != nil {
+		p.mb.wait()
+	}
+	p.c.Close()
+	if p.cb.onClose != nil {
+		p.cb.onClose(p.c, p.ce)
+	}
+}
+
+// Send sends msg as a whole, it's for the handlers of the callback API which
+// get the conn only.
+func (c *Conn) Send(msg *Message) error {
+	_, err := (&DefaultMessageSender{conn: c}).SendWhole(msg, false)
+	return err
+}
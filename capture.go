@@ -0,0 +1,283 @@
+package kiwi
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// the capture format begins with captureMagic and the uvarint length
+// prefixed request uri of the conn, each frame is then recorded as:
+//
+//	direction (1) | unix nano (varint) | fin, rsv and opcode (1) |
+//	payload length (uvarint) | unmasked payload
+const captureMagic = "KIWICAP1"
+
+var ErrBadCapture = errors.New("not a kiwi capture")
+
+type Direction uint8
+
+const (
+	DirIn Direction = iota
+	DirOut
+)
+
+func (d Direction) String() string {
+	if d == DirIn {
+		return "in"
+	}
+	return "out"
+}
+
+type CapturedFrame struct {
+	Time  time.Time
+	Dir   Direction
+	Frame *Frame
+}
+
+// Recorder writes the frames of a conn to a capture, see Attach. Each
+// frame is written by a single Write so w needs no flushing.
+type Recorder struct {
+	w   io.Writer
+	mu  sync.Mutex
+	buf []byte
+	err error
+}
+
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{w: w}
+}
+
+// Attach writes the capture header for c and records its frames from now
+// on, by chaining its TraceFrameIn and TraceFrameOut. It's usually called
+// by Server.OnHandshakeComplete, a recorder should be attached to one conn
+// only. The headers of the handshake, such as cookies, are not recorded.
+func (r *Recorder) Attach(c *Conn) error {
+	uri := "/"
+	if c.HandshakeRequest != nil && c.HandshakeRequest.RequestURL != nil {
+		uri = c.HandshakeRequest.RequestURL.RequestURI()
+	}
+
+	r.mu.Lock()
+	r.buf = append(r.buf[:0], captureMagic...)
+	r.buf = binary.AppendUvarint(r.buf, uint64(len(uri)))
+	r.buf = append(r.buf, uri...)
+	r.write()
+	err := r.err
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	in, out := c.TraceFrameIn, c.TraceFrameOut
+	c.TraceFrameIn = func(f *Frame) {
+		r.record(DirIn, f)
+		if in != nil {
+			in(f)
+		}
+	}
+	c.TraceFrameOut = func(f *Frame) {
+		r.record(DirOut, f)
+		if out != nil {
+			out(f)
+		}
+	}
+	return nil
+}
+
+// Err returns the first write error, the frames are no longer recorded
+// after it.
+func (r *Recorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+func (r *Recorder) record(dir Direction, f *Frame) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.err != nil {
+		return
+	}
+
+	r.buf = append(r.buf[:0], byte(dir))
+	r.buf = binary.AppendVarint(r.buf, time.Now().UnixNano())
+	r.buf = append(r.buf, f.FIN<<7|f.RSV1<<6|f.RSV2<<5|f.RSV3<<4|f.Opcode)
+	r.buf = binary.AppendUvarint(r.buf, uint64(len(f.PayloadData)))
+	r.buf = append(r.buf, f.PayloadData...)
+	r.write()
+}
+
+func (r *Recorder) write() {
+	if _, err := r.w.Write(r.buf); err != nil {
+		r.err = err
+	}
+}
+
+// CaptureReader reads the frames of a capture written by a Recorder.
+type CaptureReader struct {
+	// the request uri of the captured conn
+	RequestURI string
+
+	br *bufio.Reader
+}
+
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	br := bufio.NewReader(r)
+
+	magic := make([]byte, len(captureMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != captureMagic {
+		return nil, ErrBadCapture
+	}
+
+	uri, err := readCaptureBytes(br)
+	if err != nil {
+		return nil, err
+	}
+	return &CaptureReader{RequestURI: string(uri), br: br}, nil
+}
+
+func readCaptureBytes(br *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, n)
+	_, err = io.ReadFull(br, b)
+	return b, err
+}
+
+// Next returns the next captured frame, or io.EOF at the end of the capture.
+func (cr *CaptureReader) Next() (*CapturedFrame, error) {
+	dir, err := cr.br.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	unexpected := func(err error) error {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	nano, err := binary.ReadVarint(cr.br)
+	if err != nil {
+		return nil, unexpected(err)
+	}
+	b0, err := cr.br.ReadByte()
+	if err != nil {
+		return nil, unexpected(err)
+	}
+	payload, err := readCaptureBytes(cr.br)
+	if err != nil {
+		return nil, unexpected(err)
+	}
+
+	f := &Frame{
+		FIN:         b0 >> 7,
+		RSV1:        b0 >> 6 & 1,
+		RSV2:        b0 >> 5 & 1,
+		RSV3:        b0 >> 4 & 1,
+		Opcode:      b0 & 0xF,
+		PayloadLen:  uint64(len(payload)),
+		PayloadData: payload,
+	}
+	return &CapturedFrame{Time: time.Unix(0, nano), Dir: Direction(dir), Frame: f}, nil
+}
+
+// Replay feeds the inbound frames of capture to srv over an in-memory pipe,
+// as a client of the captured request uri, and returns the frames sent back
+// by the handler. The timing of the capture is not kept. A normal close is
+// sent after the frames if the capture has no inbound close, the replay then
+// ends once srv closes the conn or ctx is done.
+func Replay(ctx context.Context, srv *Server, capture io.Reader) ([]*CapturedFrame, error) {
+	cr, err := NewCaptureReader(capture)
+	if err != nil {
+		return nil, err
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	stop := context.AfterFunc(ctx, func() {
+		client.Close()
+	})
+	defer stop()
+
+	conn := newConn(srv, server)
+	srv.ConnPool.Add(conn)
+	go conn.serve()
+
+	req := "GET " + cr.RequestURI + " HTTP/1.1\r\nHost: replay\r\n" +
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n"
+	if _, err := io.WriteString(client, req); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(client)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, &HandshakeError{ErrorString: "replay handshake failed", Status: resp.StatusCode}
+	}
+
+	var out []*CapturedFrame
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			// the frames of srv are trusted
+			f := &Frame{}
+			if f.FromBufReader(br, math.MaxInt32) != nil {
+				return
+			}
+			out = append(out, &CapturedFrame{Time: time.Now(), Dir: DirOut, Frame: f})
+		}
+	}()
+
+	var closed bool
+	for {
+		cf, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			client.Close()
+			<-done
+			return out, err
+		}
+		if cf.Dir != DirIn {
+			continue
+		}
+
+		b, _ := cf.Frame.ToBytes(true)
+		if _, err := client.Write(b); err != nil {
+			break
+		}
+		if cf.Frame.Opcode == OpcodeClose {
+			closed = true
+			break
+		}
+	}
+
+	if !closed {
+		b, _ := MakeCloseFrame(CloseCodeNormalClosure, "", false).ToBytes(true)
+		client.Write(b)
+	}
+
+	<-done
+	return out, ctx.Err()
+}
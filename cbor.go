@@ -0,0 +1,250 @@
+package kiwi
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+)
+
+// CBORCodec encodes the values as CBOR (RFC 8949) in binary messages, the
+// struct fields are named by their cbor tags. The tags of the items are
+// skipped when decoding, and the indefinite lengths are not supported.
+type CBORCodec struct{}
+
+func (CBORCodec) Marshal(v any) ([]byte, error) {
+	w := &cborWriter{}
+	if err := encodeValue(w, reflect.ValueOf(v), "cbor"); err != nil {
+		return nil, err
+	}
+	return w.buf, nil
+}
+
+func (CBORCodec) Unmarshal(data []byte, v any) error {
+	return decodeTop(&cborReader{data: data}, v, "cbor")
+}
+
+func (CBORCodec) Opcode() uint8 {
+	return OpcodeBinary
+}
+
+// the major types
+const (
+	cborUint = iota << 5
+	cborNegInt
+	cborBytes
+	cborText
+	cborArray
+	cborMap
+	cborTag
+	cborSimple
+)
+
+var errCBORIndefinite = errors.New("cbor: indefinite lengths are not supported")
+
+type cborWriter struct {
+	buf []byte
+}
+
+func (w *cborWriter) writeHead(major byte, n uint64) {
+	switch {
+	case n < 24:
+		w.buf = append(w.buf, major|byte(n))
+	case n <= math.MaxUint8:
+		w.buf = append(w.buf, major|24, byte(n))
+	case n <= math.MaxUint16:
+		w.buf = binary.BigEndian.AppendUint16(append(w.buf, major|25), uint16(n))
+	case n <= math.MaxUint32:
+		w.buf = binary.BigEndian.AppendUint32(append(w.buf, major|26), uint32(n))
+	default:
+		w.buf = binary.BigEndian.AppendUint64(append(w.buf, major|27), n)
+	}
+}
+
+func (w *cborWriter) writeNil() {
+	w.buf = append(w.buf, cborSimple|22)
+}
+
+func (w *cborWriter) writeBool(b bool) {
+	if b {
+		w.buf = append(w.buf, cborSimple|21)
+	} else {
+		w.buf = append(w.buf, cborSimple|20)
+	}
+}
+
+func (w *cborWriter) writeInt(i int64) {
+	if i >= 0 {
+		w.writeHead(cborUint, uint64(i))
+	} else {
+		w.writeHead(cborNegInt, uint64(-1-i))
+	}
+}
+
+func (w *cborWriter) writeUint(u uint64) {
+	w.writeHead(cborUint, u)
+}
+
+func (w *cborWriter) writeFloat32(f float32) {
+	w.buf = binary.BigEndian.AppendUint32(append(w.buf, cborSimple|26), math.Float32bits(f))
+}
+
+func (w *cborWriter) writeFloat64(f float64) {
+	w.buf = binary.BigEndian.AppendUint64(append(w.buf, cborSimple|27), math.Float64bits(f))
+}
+
+func (w *cborWriter) writeString(s string) {
+	w.writeHead(cborText, uint64(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+func (w *cborWriter) writeBytes(b []byte) {
+	w.writeHead(cborBytes, uint64(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+func (w *cborWriter) writeArrayLen(n int) {
+	w.writeHead(cborArray, uint64(n))
+}
+
+func (w *cborWriter) writeMapLen(n int) {
+	w.writeHead(cborMap, uint64(n))
+}
+
+type cborReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *cborReader) remaining() int {
+	return len(r.data) - r.pos
+}
+
+func (r *cborReader) next(n uint64) ([]byte, error) {
+	if n > uint64(r.remaining()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := r.data[r.pos : r.pos+int(n)]
+	r.pos += int(n)
+	return b, nil
+}
+
+// arg reads the argument of the head of additional info ai.
+func (r *cborReader) arg(ai byte) (uint64, error) {
+	switch {
+	case ai < 24:
+		return uint64(ai), nil
+	case ai <= 27:
+		b, err := r.next(1 << (ai - 24))
+		if err != nil {
+			return 0, err
+		}
+		var u uint64
+		for _, c := range b {
+			u = u<<8 | uint64(c)
+		}
+		return u, nil
+	case ai == 31:
+		return 0, errCBORIndefinite
+	}
+	return 0, fmt.Errorf("cbor: invalid additional info %d", ai)
+}
+
+func (r *cborReader) readToken() (token, error) {
+	for {
+		b, err := r.next(1)
+		if err != nil {
+			return token{}, err
+		}
+		major, ai := b[0]&0xe0, b[0]&0x1f
+
+		if major == cborSimple {
+			return r.simple(ai)
+		}
+
+		n, err := r.arg(ai)
+		if err != nil {
+			return token{}, err
+		}
+
+		switch major {
+		case cborUint:
+			return token{kind: tokUint, u: n}, nil
+		case cborNegInt:
+			if n > math.MaxInt64 {
+				return token{}, errors.New("cbor: negative integer overflows int64")
+			}
+			return token{kind: tokInt, i: -1 - int64(n)}, nil
+		case cborBytes, cborText:
+			s, err := r.next(n)
+			kind := tokBytes
+			if major == cborText {
+				kind = tokString
+			}
+			return token{kind: kind, s: s}, err
+		case cborArray, cborMap:
+			if n > uint64(r.remaining()) {
+				return token{}, io.ErrUnexpectedEOF
+			}
+			kind := tokArray
+			if major == cborMap {
+				kind = tokMap
+			}
+			return token{kind: kind, n: int(n)}, nil
+		}
+		// a tag, its item is read instead
+	}
+}
+
+func (r *cborReader) simple(ai byte) (token, error) {
+	switch ai {
+	case 20, 21:
+		return token{kind: tokBool, b: ai == 21}, nil
+	case 22, 23:
+		return token{kind: tokNil}, nil
+	case 25:
+		b, err := r.next(2)
+		if err != nil {
+			return token{}, err
+		}
+		return token{kind: tokFloat, f: halfToFloat64(binary.BigEndian.Uint16(b))}, nil
+	case 26:
+		b, err := r.next(4)
+		if err != nil {
+			return token{}, err
+		}
+		return token{kind: tokFloat, f: float64(math.Float32frombits(binary.BigEndian.Uint32(b)))}, nil
+	case 27:
+		b, err := r.next(8)
+		if err != nil {
+			return token{}, err
+		}
+		return token{kind: tokFloat, f: math.Float64frombits(binary.BigEndian.Uint64(b))}, nil
+	case 31:
+		return token{}, errCBORIndefinite
+	}
+	return token{}, fmt.Errorf("cbor: unsupported simple value %d", ai)
+}
+
+// halfToFloat64 converts an IEEE 754 half-precision float.
+func halfToFloat64(h uint16) float64 {
+	sign := 1.0
+	if h&0x8000 != 0 {
+		sign = -1
+	}
+	exp := int(h>>10) & 0x1f
+	frac := float64(h & 0x3ff)
+
+	switch exp {
+	case 0:
+		return sign * math.Ldexp(frac, -24)
+	case 0x1f:
+		if frac == 0 {
+			return math.Inf(int(sign))
+		}
+		return math.NaN()
+	}
+	return sign * math.Ldexp(frac+1024, exp-25)
+}
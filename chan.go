@@ -0,0 +1,88 @@
+package kiwi
+
+// Incoming decodes each data message read by r into a T and delivers it on
+// the returned channel, which is closed once the conn stops being readable.
+// Messages that fail to decode are dropped. A close message from the peer is
+// replied and the conn gets closed, so its Context is canceled.
+func Incoming[T any](r MessageReceiver, codec Codec, maxMsgDataLen uint64) <-chan T {
+	ch := make(chan T)
+	conn := r.GetConn()
+	ctx := conn.Context()
+
+	go func() {
+		defer close(ch)
+
+		for msg, err := range r.Messages(maxMsgDataLen) {
+			if err != nil {
+				conn.Server.logf("[Incoming] %s\n", err.Error())
+				conn.closeWithCode(CloseCodeProtocolError)
+				return
+			}
+
+			if msg.IsClose() {
+				conn.closeWithCode(CloseCodeNormalClosure)
+				return
+			}
+
+			if !msg.IsText() && !msg.IsBinary() {
+				continue
+			}
+
+			var v T
+			if err := codec.Unmarshal(msg.Data, &v); err != nil {
+				if conn.Server.LogSampler.Sample() {
+					conn.Server.logf("[Incoming] %s\n", err.Error())
+				}
+				continue
+			}
+
+			select {
+			case ch <- v:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ch
+}
+
+// Outgoing encodes each value sent on the returned channel and sends it as
+// a whole message by s. The channel is no longer received from once the conn
+// is closed, so senders should also select on the conn's Context().Done()
+// rather than blocking on the channel alone. A failed send closes the conn.
+func Outgoing[T any](s MessageSender, codec Codec) chan<- T {
+	ch := make(chan T)
+	conn := s.GetConn()
+	ctx := conn.Context()
+
+	go func() {
+		for {
+			select {
+			case v, ok := <-ch:
+				if !ok {
+					return
+				}
+
+				data, err := codec.Marshal(v)
+				if err != nil {
+					if conn.Server.LogSampler.Sample() {
+						conn.Server.logf("[Outgoing] %s\n", err.Error())
+					}
+					continue
+				}
+
+				msg := &Message{Opcode: codec.Opcode(), Data: data}
+				if _, err := s.SendWhole(msg, false); err != nil {
+					conn.Server.logf("[Outgoing] %s\n", err.Error())
+					conn.Close()
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ch
+}
@@ -0,0 +1,271 @@
+package kiwi
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+var (
+	ErrBadScheme        = &HandshakeError{ErrorString: "url scheme is not ws or wss"}
+	ErrBadHandshakeResp = &HandshakeError{ErrorString: "invalid handshake response"}
+)
+
+// Dialer opens client conns to websocket servers. The dialed conns are read
+// and written by DefaultMessageReceiver and DefaultMessageSender like the
+// ones of a server, the frames sent by them are always masked.
+type Dialer struct {
+	// the config of the dialed conns, such as the limits and the buffer
+	// sizes, a default one is used if it's nil
+	Config *Server
+
+	// extra headers of the handshake request, such as Authorization
+	Header http.Header
+
+	// cookies of the handshake request are taken from Jar, and the ones set
+	// by the response are stored to it
+	Jar http.CookieJar
+
+	// the subprotocols asked by Sec-WebSocket-Protocol, in preference order
+	Subprotocols []string
+
+	// offered by Sec-WebSocket-Extensions, in preference order
+	Extensions []Extension
+
+	// used for wss, the ServerName is set from the url if it's empty
+	TLSConfig *tls.Config
+
+	// dials the tcp conns, a zero net.Dialer is used if it's nil
+	NetDialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// returns the proxy of the request, whose url has the http or https
+	// scheme of the target, no proxy is used if it or the returned url is
+	// nil. The proxy url schemes are http, https, socks5 and socks5h
+	Proxy func(*http.Request) (*url.URL, error)
+
+	// if it's set, the conns are bootstrapped by the extended CONNECT of
+	// RFC 8441 through it instead of the HTTP/1.1 upgrade. It must speak
+	// HTTP/2 and pass the :protocol pseudo-header on, like the Transport of
+	// golang.org/x/net/http2, the http.Transport rejects it for now. The
+	// conns don't support the deadlines then
+	HTTP2 http.RoundTripper
+}
+
+// DefaultDialer honors the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment
+// variables like http.DefaultTransport.
+var DefaultDialer = &Dialer{Proxy: http.ProxyFromEnvironment}
+
+// Dial dials rawURL by the DefaultDialer.
+func Dial(ctx context.Context, rawURL string) (*Conn, error) {
+	return DefaultDialer.Dial(ctx, rawURL)
+}
+
+func (d *Dialer) config() *Server {
+	if d.Config != nil {
+		return d.Config
+	}
+
+	srv := NewServer()
+	srv.ApplyDefaultCfg()
+	return srv
+}
+
+// Dial connects to rawURL, like ws://host/path or wss://host/path, and does
+// the handshake. The returned conn is open.
+func (d *Dialer) Dial(ctx context.Context, rawURL string) (*Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var useTLS bool
+	switch u.Scheme {
+	case "ws":
+	case "wss":
+		useTLS = true
+	default:
+		return nil, ErrBadScheme
+	}
+
+	if d.HTTP2 != nil {
+		return d.dialHTTP2(ctx, u)
+	}
+
+	addr := u.Host
+	if u.Port() == "" {
+		if useTLS {
+			addr = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			addr = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+
+	nc, err := d.dial(ctx, u, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if useTLS {
+		cfg := &tls.Config{}
+		if d.TLSConfig != nil {
+			cfg = d.TLSConfig.Clone()
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName = u.Hostname()
+		}
+
+		tc := tls.Client(nc, cfg)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			nc.Close()
+			return nil, err
+		}
+		nc = tc
+	}
+
+	conn := newConn(d.config(), nc)
+	conn.client = true
+	// there is no serve to release its reference of the pooled buffers
+	conn.releaseBuf()
+
+	// the handshake is interrupted by ctx
+	stop := context.AfterFunc(ctx, func() {
+		nc.Close()
+	})
+	err = d.handshake(conn, u)
+	if !stop() {
+		err = ctx.Err()
+	}
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetState(StateOpen)
+	conn.startPings()
+	return conn, nil
+}
+
+func (d *Dialer) handshake(c *Conn, u *url.URL) error {
+	nonce := make([]byte, 16)
+	if _, err := io.ReadFull(c.Server.rand(), nonce); err != nil {
+		return err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	// an http.Request is used only to write the header
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       u.Host,
+	}
+	for k, vs := range d.Header {
+		req.Header[k] = append([]string(nil), vs...)
+	}
+	// the keys are set as is since the ones of kiwi.Header are case-sensitive
+	req.Header["Upgrade"] = []string{"websocket"}
+	req.Header["Connection"] = []string{"Upgrade"}
+	req.Header["Sec-WebSocket-Key"] = []string{key}
+	req.Header["Sec-WebSocket-Version"] = []string{"13"}
+	if len(d.Subprotocols) > 0 {
+		req.Header["Sec-WebSocket-Protocol"] = []string{strings.Join(d.Subprotocols, ", ")}
+	}
+	if len(d.Extensions) > 0 {
+		req.Header["Sec-WebSocket-Extensions"] = []string{offerExtensions(d.Extensions)}
+	}
+	if d.Jar != nil {
+		for _, cookie := range d.Jar.Cookies(httpURL(u)) {
+			req.AddCookie(cookie)
+		}
+	}
+
+	buf := c.Buf
+	buf.WriteString("GET " + u.RequestURI() + " HTTP/1.1\r\n")
+	buf.WriteString("Host: " + u.Host + "\r\n")
+	if err := req.Header.Write(buf); err != nil {
+		return err
+	}
+	buf.WriteString("\r\n")
+	if err := buf.Flush(); err != nil {
+		return err
+	}
+
+	resp, err := http.ReadResponse(buf.Reader, req)
+	if err != nil {
+		return &HandshakeError{ErrorString: "unable to read handshake response", Err: err}
+	}
+	c.HandshakeResponse = resp
+
+	if d.Jar != nil {
+		if cookies := resp.Cookies(); len(cookies) > 0 {
+			d.Jar.SetCookies(httpURL(u), cookies)
+		}
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return &HandshakeError{Status: resp.StatusCode, Err: ErrBadHandshakeResp}
+	}
+
+	lenient := c.Server.protocolMode() == ProtocolLenient
+	if !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") ||
+		!headerHasToken(resp.Header.Get("Connection"), "upgrade") && !lenient ||
+		resp.Header.Get("Sec-WebSocket-Accept") != MakeAcceptKey(key) {
+		return ErrBadHandshakeResp
+	}
+
+	if p := resp.Header.Get("Sec-WebSocket-Protocol"); p != "" && !slices.Contains(d.Subprotocols, p) {
+		return &HandshakeError{ErrorString: "unexpected subprotocol: " + p}
+	}
+	return c.acceptExtensions(d.Extensions, resp.Header.Values("Sec-WebSocket-Extensions")...)
+}
+
+// Subprotocol returns the subprotocol selected by the server, empty if
+// none.
+func (c *Conn) Subprotocol() string {
+	if c.HandshakeResponse == nil {
+		return c.subprotocol
+	}
+	return c.HandshakeResponse.Header.Get("Sec-WebSocket-Protocol")
+}
+
+// SetSubprotocol records the subprotocol selected by the handshake func of a
+// server conn, which writes it in the response itself. The one of a response
+// written by WriteHandshakeResponse is recorded by it.
+func (c *Conn) SetSubprotocol(p string) {
+	c.subprotocol = p
+}
+
+// IsClient reports whether the conn is dialed by a Dialer.
+func (c *Conn) IsClient() bool {
+	return c.client
+}
+
+// httpURL returns the http url of u for the cookies.
+func httpURL(u *url.URL) *url.URL {
+	hu := *u
+	if u.Scheme == "wss" {
+		hu.Scheme = "https"
+	} else {
+		hu.Scheme = "http"
+	}
+	return &hu
+}
+
+func headerHasToken(v, token string) bool {
+	for _, t := range strings.Split(v, ",") {
+		if strings.EqualFold(strings.TrimSpace(t), token) {
+			return true
+		}
+	}
+	return false
+}
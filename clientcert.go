@@ -0,0 +1,60 @@
+package kiwi
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+)
+
+// TLSState returns the state of the tls conn of a wss conn, nil if the conn
+// is not over tls. The handshake of tls is done once the handshake request
+// has been read.
+func (c *Conn) TLSState() *tls.ConnectionState {
+	if sc, ok := c.rwc.(*streamConn); ok {
+		return sc.tlsState
+	}
+
+	nc := c.rwc
+	for {
+		if tc, ok := nc.(interface{ ConnectionState() tls.ConnectionState }); ok {
+			st := tc.ConnectionState()
+			return &st
+		}
+
+		u, ok := nc.(interface{ NetConn() net.Conn })
+		if !ok {
+			return nil
+		}
+		nc = u.NetConn()
+	}
+}
+
+// VerifiedChains returns the chains of the client certificate verified by
+// the tls handshake, see Server.ClientCAs.
+func (c *Conn) VerifiedChains() [][]*x509.Certificate {
+	if st := c.TLSState(); st != nil {
+		return st.VerifiedChains
+	}
+	return nil
+}
+
+// verifyClientCert rejects the conn by Server.VerifyClientCert.
+func (c *Conn) verifyClientCert() error {
+	if fn := c.Server.VerifyClientCert; fn != nil {
+		return fn(c, c.VerifiedChains())
+	}
+	return nil
+}
+
+// tlsConfig returns TLSConfig requiring the client certificates if
+// ClientCAs is set.
+func (srv *Server) tlsConfig() *tls.Config {
+	if srv.ClientCAs == nil {
+		return srv.TLSConfig
+	}
+
+	cfg := srv.TLSConfig.Clone()
+	cfg.ClientCAs = srv.ClientCAs
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	return cfg
+}
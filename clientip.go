@@ -0,0 +1,123 @@
+package kiwi
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+)
+
+var ErrClientNotAllowed = errors.New("client address not allowed")
+
+// TrustedProxies holds the CIDR ranges of the proxies whose X-Forwarded-For
+// and Forwarded headers are believed by Conn.ClientIP, see
+// Server.TrustedProxies. The ranges can be replaced by Update while the
+// server is running.
+type TrustedProxies struct {
+	prefixes atomic.Pointer[[]netip.Prefix]
+}
+
+// NewTrustedProxies takes CIDRs and single addresses like NewAccessList.
+func NewTrustedProxies(cidrs []string) (*TrustedProxies, error) {
+	tp := &TrustedProxies{}
+	if err := tp.Update(cidrs); err != nil {
+		return nil, err
+	}
+	return tp, nil
+}
+
+// Update replaces the ranges atomically, the ones in use are kept if the
+// new ones are invalid.
+func (tp *TrustedProxies) Update(cidrs []string) error {
+	p, err := parsePrefixes(cidrs)
+	if err != nil {
+		return err
+	}
+	tp.prefixes.Store(&p)
+	return nil
+}
+
+// Trusted reports whether addr is of a trusted proxy, none is if tp is nil.
+func (tp *TrustedProxies) Trusted(addr netip.Addr) bool {
+	if tp == nil || !addr.IsValid() {
+		return false
+	}
+	p := tp.prefixes.Load()
+	return p != nil && containsAddr(*p, addr.Unmap())
+}
+
+// ClientIP returns the address of the client of the conn. It's the remote
+// address unless that's a trusted proxy, then the hops of the Forwarded or
+// else the X-Forwarded-For headers are walked from the nearest one, and the
+// first hop not trusted is the client. It's invalid if the remote address
+// is not an IP one, like the one of a unix socket.
+func (c *Conn) ClientIP() netip.Addr {
+	ip := addrIP(c.rwc.RemoteAddr())
+	tp := c.Server.TrustedProxies
+	if !tp.Trusted(ip) || c.HandshakeRequest == nil {
+		return ip
+	}
+
+	hops := forwardedHops(c.HandshakeRequest.Header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := parseHop(hops[i])
+		if err != nil {
+			// the hops before an obfuscated or invalid one can't be told
+			break
+		}
+		ip = hop
+		if !tp.Trusted(ip) {
+			break
+		}
+	}
+	return ip
+}
+
+func addrIP(a net.Addr) netip.Addr {
+	if ta, ok := a.(*net.TCPAddr); ok {
+		ip, _ := netip.AddrFromSlice(ta.IP)
+		return ip.Unmap()
+	}
+
+	ap, err := netip.ParseAddrPort(a.String())
+	if err != nil {
+		return netip.Addr{}
+	}
+	return ap.Addr().Unmap()
+}
+
+// forwardedHops returns the for nodes of the Forwarded header of RFC 7239,
+// or the addresses of X-Forwarded-For if there is none, the nearest last.
+func forwardedHops(h Header) []string {
+	var hops []string
+	if vs, ok := h.getFold("Forwarded"); ok {
+		for _, elem := range strings.Split(strings.Join(vs, ","), ",") {
+			for _, pair := range strings.Split(elem, ";") {
+				k, v, _ := strings.Cut(strings.TrimSpace(pair), "=")
+				if strings.EqualFold(k, "for") {
+					hops = append(hops, strings.Trim(v, `"`))
+				}
+			}
+		}
+		return hops
+	}
+
+	if vs, ok := h.getFold("X-Forwarded-For"); ok {
+		for _, hop := range strings.Split(strings.Join(vs, ","), ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	return hops
+}
+
+// parseHop parses a hop like 192.0.2.1, 192.0.2.1:4711, 2001:db8::1 or
+// [2001:db8::1]:4711.
+func parseHop(hop string) (netip.Addr, error) {
+	if ap, err := netip.ParseAddrPort(hop); err == nil {
+		return ap.Addr().Unmap(), nil
+	}
+
+	ip, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(hop, "["), "]"))
+	return ip.Unmap(), err
+}
@@ -0,0 +1,108 @@
+package kiwi
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// Clock tells the time and makes the timers of the conns, such as the ones of
+// the pings, the connection age, the ack timeouts, the write retries, the
+// memory budget waits and the expiry of the detached sessions. The deadlines
+// of the net.Conns always follow the real time, so do the types not tied to
+// a server: Tickets, RateLimiter, ClientRateLimiter and the ticker of
+// Hub.PushPresence. See Server.Clock.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) ClockTimer
+	NewTicker(d time.Duration) ClockTicker
+}
+
+type ClockTimer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+type ClockTicker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// SystemClock is the Clock of the time package.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTimer(d time.Duration) ClockTimer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+func (systemClock) NewTicker(d time.Duration) ClockTicker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+type systemTimer struct{ t *time.Timer }
+
+func (t systemTimer) C() <-chan time.Time { return t.t.C }
+func (t systemTimer) Stop() bool          { return t.t.Stop() }
+
+type systemTicker struct{ t *time.Ticker }
+
+func (t systemTicker) C() <-chan time.Time { return t.t.C }
+func (t systemTicker) Stop()               { t.t.Stop() }
+
+// afterFunc calls f in its own goroutine once d has elapsed on clk, unless
+// stop is called before.
+func afterFunc(clk Clock, d time.Duration, f func()) (stop func()) {
+	t := clk.NewTimer(d)
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-t.C():
+			f()
+		case <-stopped:
+		}
+	}()
+	return func() {
+		t.Stop()
+		close(stopped)
+	}
+}
+
+func (srv *Server) clock() Clock {
+	if srv.Clock == nil {
+		return SystemClock
+	}
+	return srv.Clock
+}
+
+func (srv *Server) rand() io.Reader {
+	if srv.Rand == nil {
+		return rand.Reader
+	}
+	return srv.Rand
+}
+
+// randN returns a random duration in [0, n) read from srv.Rand, n must be
+// positive.
+func (srv *Server) randN(n time.Duration) (time.Duration, error) {
+	var b [8]byte
+	if _, err := io.ReadFull(srv.rand(), b[:]); err != nil {
+		return 0, err
+	}
+	return time.Duration(binary.BigEndian.Uint64(b[:]) % uint64(n)), nil
+}
+
+// maskingKey reads a masking key from srv.Rand.
+func (srv *Server) maskingKey() ([]byte, error) {
+	mkb := make([]byte, 4)
+	if _, err := io.ReadFull(srv.rand(), mkb); err != nil {
+		return nil, err
+	}
+	return mkb, nil
+}
@@ -0,0 +1,105 @@
+package kiwi
+
+import (
+	"strconv"
+	"unicode/utf8"
+)
+
+// ErrInvalidClosePayload fails the conn with CloseCodeProtocolError, it's
+// returned for a close frame with a 1 byte payload or an invalid code. A
+// reason not in UTF-8 fails the conn with ErrInvalidUTF8.
+var ErrInvalidClosePayload = &ProtocolError{"invalid close frame payload"}
+
+// CloseError is returned by the reads after the close frame of the peer, and
+// by the sends once the conn is closed after it. Use errors.As to get the
+// code and the reason, it also matches ErrConnIsNotOpen by errors.Is.
+type CloseError struct {
+	// CloseCodeNoStatusRcvd if the close frame has no payload
+	Code   uint16
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	s := "closed by peer: " + strconv.Itoa(int(e.Code))
+	if text := CloseCodeText(e.Code); text != "" {
+		s += " " + text
+	}
+	if e.Reason != "" {
+		s += ": " + e.Reason
+	}
+	return s
+}
+
+func (e *CloseError) Unwrap() error {
+	return ErrConnIsNotOpen
+}
+
+func newCloseError(payload []byte) *CloseError {
+	code, ok := ParseCloseCode(payload)
+	if !ok {
+		return &CloseError{Code: CloseCodeNoStatusRcvd}
+	}
+	return &CloseError{Code: code, Reason: string(payload[2:])}
+}
+
+// CloseError returns the code and reason of a close message, or nil if msg
+// is not one.
+func (m *Message) CloseError() *CloseError {
+	if !m.IsClose() {
+		return nil
+	}
+	return newCloseError(m.Data)
+}
+
+// ValidCloseCode reports whether code may be received in a close frame.
+func ValidCloseCode(code uint16) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+// MaxCloseReasonLen is the longest reason of a close frame, whose payload
+// is limited to 125 bytes like the other control frames.
+const MaxCloseReasonLen = maxControlFramePayloadLen - 2
+
+// TruncateCloseReason cuts reason to MaxCloseReasonLen bytes, at the start
+// of a UTF-8 sequence so it stays valid.
+func TruncateCloseReason(reason string) string {
+	if len(reason) <= MaxCloseReasonLen {
+		return reason
+	}
+
+	n := MaxCloseReasonLen
+	for n > 0 && !utf8.RuneStart(reason[n]) {
+		n--
+	}
+	return reason[:n]
+}
+
+func checkClosePayload(payload []byte) error {
+	if len(payload) == 0 {
+		return nil
+	}
+
+	code, ok := ParseCloseCode(payload)
+	if !ok || !ValidCloseCode(code) {
+		return ErrInvalidClosePayload
+	}
+	if !utf8.Valid(payload[2:]) {
+		return ErrInvalidUTF8
+	}
+	return nil
+}
+
+// notOpenErr is the error of reading or sending on a conn not open, the
+// CloseError if the peer has sent a close frame.
+func (c *Conn) notOpenErr() error {
+	if ce := c.peerClose.Load(); ce != nil {
+		return ce
+	}
+	return ErrConnIsNotOpen
+}
@@ -0,0 +1,134 @@
+// Command autobahn-server is an echo server to be tested by the fuzzingclient
+// of the Autobahn test suite, it runs kiwi in the strict mode:
+//
+//	autobahn-server -addr :9001 &
+//	docker run --rm --net=host -v "$PWD:/config" -v "$PWD/reports:/reports" \
+//		crossbario/autobahn-testsuite wstest -m fuzzingclient -s /config/fuzzingclient.json
+//
+// The results can then be summarized, the exit status is 1 if any case
+// failed:
+//
+//	autobahn-server -summarize reports/servers/index.json
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+
+	"github.com/mconintet/kiwi"
+)
+
+const maxMessageBytes = 64 << 20
+
+func main() {
+	addr := flag.String("addr", ":9001", "address to listen on")
+	summarize := flag.String("summarize", "", "index.json of the reports to summarize")
+	deflate := flag.Bool("deflate", false, "negotiate permessage-deflate for the 12.* and 13.* cases")
+	flag.Parse()
+
+	if *summarize != "" {
+		failed, err := summarizeReport(*summarize)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if failed {
+			os.Exit(1)
+		}
+		return
+	}
+
+	srv := kiwi.NewServer(kiwi.WithLimits(kiwi.Limits{
+		MaxFramePayloadBytes: maxMessageBytes,
+		MaxMessageBytes:      maxMessageBytes,
+	}))
+	srv.Strict = true
+	if *deflate {
+		srv.Extensions = []kiwi.Extension{&kiwi.PerMessageDeflate{}}
+	}
+	srv.OnConnOpenFunc("/", echo)
+
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("[Autobahn] listening on %s\n", ln.Addr())
+	log.Fatal(srv.Serve(ln))
+}
+
+func echo(r kiwi.MessageReceiver, s kiwi.MessageSender) {
+	for {
+		msg, err := r.ReadWhole(0)
+		if err != nil {
+			return
+		}
+
+		switch msg.Opcode {
+		case kiwi.OpcodePing:
+			s.SendWhole(&kiwi.Message{Opcode: kiwi.OpcodePong, Data: msg.Data}, false)
+		case kiwi.OpcodePong:
+		case kiwi.OpcodeClose:
+			code, ok := kiwi.ParseCloseCode(msg.Data)
+			if !ok {
+				code = kiwi.CloseCodeNormalClosure
+			}
+			s.SendClose(code, "", false, false)
+			return
+		default:
+			s.SendWhole(msg, false)
+		}
+		msg.Release()
+	}
+}
+
+type caseResult struct {
+	Behavior      string `json:"behavior"`
+	BehaviorClose string `json:"behaviorClose"`
+}
+
+// summarizeReport prints the count of each behavior in the index.json
+// written by the fuzzingclient, and the cases failed.
+func summarizeReport(name string) (failed bool, err error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return false, err
+	}
+
+	index := make(map[string]map[string]*caseResult)
+	if err := json.Unmarshal(data, &index); err != nil {
+		return false, err
+	}
+
+	for agent, cases := range index {
+		counts := make(map[string]int)
+		var failures []string
+
+		for id, res := range cases {
+			counts[res.Behavior]++
+			if res.Behavior == "FAILED" || res.BehaviorClose == "FAILED" {
+				failures = append(failures, id)
+			}
+		}
+
+		fmt.Printf("%s: %d cases\n", agent, len(cases))
+		behaviors := make([]string, 0, len(counts))
+		for b := range counts {
+			behaviors = append(behaviors, b)
+		}
+		sort.Strings(behaviors)
+		for _, b := range behaviors {
+			fmt.Printf("  %-14s %d\n", b, counts[b])
+		}
+
+		sort.Strings(failures)
+		for _, id := range failures {
+			fmt.Printf("  failed: %s\n", id)
+		}
+		failed = failed || len(failures) > 0
+	}
+	return failed, nil
+}
@@ -0,0 +1,93 @@
+// Command kiwi-chat is a broadcast server, each message read is sent to all
+// the conns of the same room:
+//
+//	kiwi-chat -addr :8080
+//
+// Clients connect to /chat?room=lobby&user=alice, the room is "lobby" if
+// it's not given. The joins and leaves are announced to the room.
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"log"
+	"net"
+
+	"github.com/mconintet/kiwi"
+)
+
+func main() {
+	addr := flag.String("addr", ":8080", "address to listen on")
+	cert := flag.String("cert", "", "TLS certificate file, serves wss with -key")
+	key := flag.String("key", "", "TLS key file")
+	deflate := flag.Bool("deflate", false, "negotiate permessage-deflate")
+	maxMessage := flag.Uint64("max-message", 64<<10, "max bytes of a message")
+	flag.Parse()
+
+	opts := []kiwi.Option{kiwi.WithLimits(kiwi.Limits{
+		MaxFramePayloadBytes: *maxMessage,
+		MaxMessageBytes:      *maxMessage,
+	})}
+	if *cert != "" {
+		pair, err := tls.LoadX509KeyPair(*cert, *key)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, kiwi.WithTLSConfig(&tls.Config{Certificates: []tls.Certificate{pair}}))
+	}
+
+	srv := kiwi.NewServer(opts...)
+	if *deflate {
+		srv.Extensions = []kiwi.Extension{&kiwi.PerMessageDeflate{}}
+	}
+	srv.FallbackHandler = srv.StatusHandler(nil)
+
+	hub := kiwi.NewHub()
+	hub.HistorySize = -1
+	srv.OnConnOpenFunc("/chat", func(r kiwi.MessageReceiver, s kiwi.MessageSender) {
+		chat(hub, r, s)
+	})
+
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("[Chat] listening on %s\n", ln.Addr())
+	log.Fatal(srv.Serve(ln))
+}
+
+func chat(hub *kiwi.Hub, r kiwi.MessageReceiver, s kiwi.MessageSender) {
+	q := r.GetConn().HandshakeRequest.RequestURL.Query()
+	room, user := q.Get("room"), q.Get("user")
+	if room == "" {
+		room = "lobby"
+	}
+	if user == "" {
+		user = r.GetConn().RemoteAddr().String()
+	}
+
+	hub.Join(room, user, s)
+	hub.Publish(room, &kiwi.Message{Opcode: kiwi.OpcodeText, Data: []byte(user + " joined")})
+	defer func() {
+		hub.Leave(room, s)
+		hub.Publish(room, &kiwi.Message{Opcode: kiwi.OpcodeText, Data: []byte(user + " left")})
+	}()
+
+	for msg, err := range r.Messages(0) {
+		if err != nil {
+			return
+		}
+
+		switch {
+		case msg.IsPing():
+			s.SendWhole(&kiwi.Message{Opcode: kiwi.OpcodePong, Data: msg.Data}, false)
+		case msg.IsClose():
+			s.SendClose(kiwi.CloseCodeNormalClosure, "", false, false)
+			return
+		case msg.IsText():
+			data := append([]byte(user+": "), msg.Data...)
+			hub.Publish(room, &kiwi.Message{Opcode: kiwi.OpcodeText, Data: data})
+		}
+		msg.Release()
+	}
+}
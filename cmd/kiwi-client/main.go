@@ -0,0 +1,131 @@
+// Command kiwi-client dials a websocket server, sends each line of stdin as
+// a message and prints the messages read, like a minimal wscat:
+//
+//	kiwi-client ws://localhost:8080/chat?user=alice
+//	kiwi-client -insecure -deflate wss://localhost:8443/
+//
+// It's closed with CloseCodeNormalClosure after the -wait at the end of
+// stdin, for the replies of the last messages.
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mconintet/kiwi"
+)
+
+func main() {
+	insecure := flag.Bool("insecure", false, "skip the verification of the TLS certificate")
+	deflate := flag.Bool("deflate", false, "offer permessage-deflate")
+	binary := flag.Bool("binary", false, "send binary messages instead of text")
+	subprotocol := flag.String("subprotocol", "", "subprotocols to offer, comma separated")
+	origin := flag.String("origin", "", "Origin header of the handshake")
+	maxMessage := flag.Uint64("max-message", 1<<20, "max bytes of a message read")
+	ping := flag.Duration("ping", 0, "ping interval, the RTT is printed on exit")
+	timeout := flag.Duration("timeout", 10*time.Second, "timeout of the handshake")
+	wait := flag.Duration("wait", time.Second, "how long the messages are read after the end of stdin")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: kiwi-client [flags] url")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	cfg := kiwi.NewServer(kiwi.WithLimits(kiwi.Limits{
+		MaxFramePayloadBytes: *maxMessage,
+		MaxMessageBytes:      *maxMessage,
+	}))
+	cfg.PingInterval = *ping
+
+	d := &kiwi.Dialer{
+		Config:    cfg,
+		Proxy:     http.ProxyFromEnvironment,
+		TLSConfig: &tls.Config{InsecureSkipVerify: *insecure},
+	}
+	if *deflate {
+		d.Extensions = []kiwi.Extension{&kiwi.PerMessageDeflate{}}
+	}
+	if *subprotocol != "" {
+		d.Subprotocols = strings.Split(*subprotocol, ",")
+	}
+	if *origin != "" {
+		d.Header = http.Header{"Origin": {*origin}}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	c, err := d.Dial(ctx, flag.Arg(0))
+	cancel()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer c.Close()
+	if p := c.Subprotocol(); p != "" {
+		log.Printf("[Client] subprotocol %s\n", p)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		read(c)
+	}()
+
+	opcode := kiwi.OpcodeText
+	if *binary {
+		opcode = kiwi.OpcodeBinary
+	}
+	sc := bufio.NewScanner(os.Stdin)
+	for sc.Scan() {
+		if err := c.Send(&kiwi.Message{Opcode: opcode, Data: []byte(sc.Text())}); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	select {
+	case <-done:
+	case <-time.After(*wait):
+		c.CloseWithCode(kiwi.CloseCodeNormalClosure, "")
+		<-done
+	}
+	if st := c.Stats(); st.RTT > 0 {
+		log.Printf("[Client] rtt %s\n", st.RTT)
+	}
+}
+
+func read(c *kiwi.Conn) {
+	r := (&kiwi.DefaultMessageReceiver{}).SetConn(c)
+	for msg, err := range r.Messages(0) {
+		if err != nil {
+			// not the closing by main
+			if c.Context().Err() == nil {
+				log.Printf("[Client] %s\n", err)
+			}
+			return
+		}
+
+		switch {
+		case msg.IsPing():
+			c.Send(&kiwi.Message{Opcode: kiwi.OpcodePong, Data: msg.Data})
+		case msg.IsPong():
+		case msg.IsClose():
+			ce := msg.CloseError()
+			log.Printf("[Client] closed by the server: %d %s\n", ce.Code, ce.Reason)
+			c.CloseWithCode(kiwi.CloseCodeNormalClosure, "")
+			return
+		case msg.IsBinary():
+			fmt.Printf("< [%d bytes] %x\n", len(msg.Data), msg.Data)
+		default:
+			fmt.Printf("< %s\n", msg.Data)
+		}
+		msg.Release()
+	}
+}
@@ -0,0 +1,84 @@
+// Command kiwi-echo is an echo server, each message read is sent back. It's
+// for trying out the clients and for debugging them:
+//
+//	kiwi-echo -addr :8080 -deflate
+//	kiwi-echo -addr :8443 -cert cert.pem -key key.pem -max-message 16777216
+//
+// The status of the server is served on /statusz.
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"log"
+	"net"
+	"time"
+
+	"github.com/mconintet/kiwi"
+)
+
+func main() {
+	addr := flag.String("addr", ":8080", "address to listen on")
+	path := flag.String("path", "/", "path of the echo route")
+	cert := flag.String("cert", "", "TLS certificate file, serves wss with -key")
+	key := flag.String("key", "", "TLS key file")
+	deflate := flag.Bool("deflate", false, "negotiate permessage-deflate")
+	maxMessage := flag.Uint64("max-message", 1<<20, "max bytes of a message")
+	ping := flag.Duration("ping", 0, "ping interval, zero for no pings")
+	flag.Parse()
+
+	opts := []kiwi.Option{kiwi.WithLimits(kiwi.Limits{
+		MaxFramePayloadBytes: *maxMessage,
+		MaxMessageBytes:      *maxMessage,
+	})}
+	if *cert != "" {
+		pair, err := tls.LoadX509KeyPair(*cert, *key)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, kiwi.WithTLSConfig(&tls.Config{Certificates: []tls.Certificate{pair}}))
+	}
+
+	srv := kiwi.NewServer(opts...)
+	srv.PingInterval = *ping
+	if *deflate {
+		srv.Extensions = []kiwi.Extension{&kiwi.PerMessageDeflate{}}
+	}
+	srv.FallbackHandler = srv.StatusHandler(nil)
+	srv.OnConnOpenFunc(*path, echo)
+
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("[Echo] listening on %s\n", ln.Addr())
+	log.Fatal(srv.Serve(ln))
+}
+
+func echo(r kiwi.MessageReceiver, s kiwi.MessageSender) {
+	c := r.GetConn()
+	start := time.Now()
+	log.Printf("[Echo] %s opened\n", c.RemoteAddr())
+
+	for msg, err := range r.Messages(0) {
+		if err != nil {
+			log.Printf("[Echo] %s: %s\n", c.RemoteAddr(), err)
+			return
+		}
+
+		switch {
+		case msg.IsPing():
+			s.SendWhole(&kiwi.Message{Opcode: kiwi.OpcodePong, Data: msg.Data}, false)
+		case msg.IsPong():
+		case msg.IsClose():
+			s.SendClose(kiwi.CloseCodeNormalClosure, "", false, false)
+			st := c.Stats()
+			log.Printf("[Echo] %s closed after %s, %d bytes read, %d sent\n",
+				c.RemoteAddr(), time.Since(start).Round(time.Millisecond), st.Recv.PayloadBytes, st.Sent.PayloadBytes)
+			return
+		default:
+			s.SendWhole(msg, false)
+		}
+		msg.Release()
+	}
+}
@@ -0,0 +1,65 @@
+// Command kiwibench load tests a websocket echo server, like kiwi-echo,
+// and prints the round trip percentiles and the errors:
+//
+//	kiwibench -conns 1000 -duration 30s -rate 10 -size 256 ws://localhost:8080/
+//
+// Without -rate each conn sends its next message once the last one is
+// echoed. See the kiwibench package.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/mconintet/kiwi"
+	"github.com/mconintet/kiwi/kiwibench"
+)
+
+func main() {
+	conns := flag.Int("conns", 10, "conns opened concurrently")
+	duration := flag.Duration("duration", 10*time.Second, "how long the messages are sent")
+	rate := flag.Float64("rate", 0, "messages per second of each conn, zero for a closed loop")
+	size := flag.Int("size", 64, "bytes of each message, at least 16")
+	binary := flag.Bool("binary", false, "send binary messages instead of text")
+	deflate := flag.Bool("deflate", false, "offer permessage-deflate")
+	insecure := flag.Bool("insecure", false, "skip the verification of the TLS certificate")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: kiwibench [flags] url")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	d := &kiwi.Dialer{TLSConfig: &tls.Config{InsecureSkipVerify: *insecure}}
+	if *deflate {
+		d.Extensions = []kiwi.Extension{&kiwi.PerMessageDeflate{}}
+	}
+
+	// an interrupt ends the run early with its report
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	rep, err := kiwibench.Run(ctx, &kiwibench.Config{
+		URL:      flag.Arg(0),
+		Conns:    *conns,
+		Duration: *duration,
+		Rate:     *rate,
+		Size:     *size,
+		Binary:   *binary,
+		Dialer:   d,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	rep.WriteTo(os.Stdout)
+	if rep.Errors > 0 || rep.DialErrors > 0 {
+		os.Exit(1)
+	}
+}
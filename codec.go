@@ -0,0 +1,126 @@
+package kiwi
+
+import (
+	"encoding"
+	"encoding/json"
+	"errors"
+)
+
+type Codec interface {
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+
+	// opcode of the messages carrying the marshaled data
+	Opcode() uint8
+}
+
+type JSONCodec struct{}
+
+func (JSONCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+func (JSONCodec) Opcode() uint8 {
+	return OpcodeText
+}
+
+// ProtobufCodec sends the protobuf messages in binary messages. The values
+// must have the Marshal and Unmarshal methods of the generated code of
+// gogo/protobuf or vtprotobuf, or else implement encoding.BinaryMarshaler
+// and encoding.BinaryUnmarshaler, e.g. by wrapping proto.Marshal.
+type ProtobufCodec struct{}
+
+var errNotProtobuf = errors.New("codec: value is not a protobuf message")
+
+func (ProtobufCodec) Marshal(v any) ([]byte, error) {
+	switch m := v.(type) {
+	case interface{ Marshal() ([]byte, error) }:
+		return m.Marshal()
+	case encoding.BinaryMarshaler:
+		return m.MarshalBinary()
+	}
+	return nil, errNotProtobuf
+}
+
+func (ProtobufCodec) Unmarshal(data []byte, v any) error {
+	switch m := v.(type) {
+	case interface{ Unmarshal([]byte) error }:
+		return m.Unmarshal(data)
+	case encoding.BinaryUnmarshaler:
+		return m.UnmarshalBinary(data)
+	}
+	return errNotProtobuf
+}
+
+func (ProtobufCodec) Opcode() uint8 {
+	return OpcodeBinary
+}
+
+// SetCodec sets the codec of ReadMsg and SendMsg for the conns opened on
+// pattern.
+func (rt *routes) SetCodec(pattern string, codec Codec) {
+	if rt.routeCodecs == nil {
+		rt.routeCodecs = make(map[string]Codec)
+	}
+
+	rt.routeCodecs[pattern] = codec
+
+	if pattern[len(pattern)-1] != '/' {
+		rt.routeCodecs[pattern+"/"] = codec
+	}
+}
+
+// Codec returns the codec of the route of c, or else the one of its server,
+// JSONCodec if neither is set.
+func (c *Conn) Codec() Codec {
+	if c.HandshakeRequest != nil {
+		if codec, ok := c.routes().routeCodecs[c.HandshakeRequest.RequestURL.Path]; ok {
+			return codec
+		}
+	}
+	if c.Server.Codec != nil {
+		return c.Server.Codec
+	}
+	return JSONCodec{}
+}
+
+// ReadMsg reads the next data message and decodes it into v by the codec of
+// the conn. The pings and pongs are skipped, the close of the peer is
+// replied and its CloseError returned. A message failing to be decoded
+// returns the error of the codec, the conn is kept open.
+func (r *DefaultMessageReceiver) ReadMsg(v any) error {
+	for {
+		msg, err := r.ReadWhole(0)
+		if err != nil {
+			return err
+		}
+
+		if msg.IsClose() {
+			r.conn.closeWithCode(CloseCodeNormalClosure)
+			return r.conn.notOpenErr()
+		}
+		if !msg.IsText() && !msg.IsBinary() {
+			continue
+		}
+
+		err = r.conn.Codec().Unmarshal(msg.Data, v)
+		msg.Release()
+		return err
+	}
+}
+
+// SendMsg encodes v by the codec of the conn and sends it as a whole
+// message.
+func (s *DefaultMessageSender) SendMsg(v any) error {
+	codec := s.conn.Codec()
+	data, err := codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = s.SendWhole(&Message{Opcode: codec.Opcode(), Data: data}, false)
+	return err
+}
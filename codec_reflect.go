@@ -0,0 +1,582 @@
+package kiwi
+
+import (
+	"encoding"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// the binary codecs share the mapping of the Go values, their formats only
+// differ by the encoding of the tokens, see valueWriter and tokenReader.
+//
+// The structs are maps keyed by the field names, taken from the tag of the
+// codec, then from the json one, then the field name itself, "omitempty" and
+// "-" are supported. The values implementing encoding.TextMarshaler are
+// strings. Decoded into an any, the maps are map[string]any, their other
+// keys being formatted by fmt.Sprint, the integers are int64 unless they're
+// over math.MaxInt64.
+
+// nesting deeper than this fails the decoding, so a small message can't
+// exhaust the stack
+const maxCodecDepth = 512
+
+var (
+	errCodecTrailingData = errors.New("codec: trailing data")
+	errCodecTooDeep      = errors.New("codec: nesting too deep")
+)
+
+type valueWriter interface {
+	writeNil()
+	writeBool(b bool)
+	writeInt(i int64)
+	writeUint(u uint64)
+	writeFloat32(f float32)
+	writeFloat64(f float64)
+	writeString(s string)
+	writeBytes(b []byte)
+	writeArrayLen(n int)
+	writeMapLen(n int)
+}
+
+type tokenKind uint8
+
+const (
+	tokNil tokenKind = iota
+	tokBool
+	tokInt
+	tokUint
+	tokFloat
+	tokString
+	tokBytes
+	tokArray
+	tokMap
+)
+
+var tokenKindText = [...]string{"nil", "bool", "int", "uint", "float", "string", "bytes", "array", "map"}
+
+type token struct {
+	kind tokenKind
+	b    bool
+	i    int64
+	u    uint64
+	f    float64
+	// the string or bytes, in the buffer being decoded
+	s []byte
+	// the length of the array or the map
+	n int
+}
+
+type tokenReader interface {
+	readToken() (token, error)
+	// the bytes left, which bound the lengths of the arrays and the maps
+	remaining() int
+}
+
+var textMarshalerType = reflect.TypeFor[encoding.TextMarshaler]()
+var textUnmarshalerType = reflect.TypeFor[encoding.TextUnmarshaler]()
+
+func encodeValue(w valueWriter, v reflect.Value, tagKey string) error {
+	if !v.IsValid() {
+		w.writeNil()
+		return nil
+	}
+
+	if v.Type().Implements(textMarshalerType) {
+		if v.Kind() == reflect.Pointer && v.IsNil() {
+			w.writeNil()
+			return nil
+		}
+		text, err := v.Interface().(encoding.TextMarshaler).MarshalText()
+		if err != nil {
+			return err
+		}
+		w.writeString(string(text))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		w.writeBool(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		w.writeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		w.writeUint(v.Uint())
+	case reflect.Float32:
+		w.writeFloat32(float32(v.Float()))
+	case reflect.Float64:
+		w.writeFloat64(v.Float())
+	case reflect.String:
+		w.writeString(v.String())
+
+	case reflect.Slice:
+		if v.IsNil() {
+			w.writeNil()
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			w.writeBytes(v.Bytes())
+			return nil
+		}
+		fallthrough
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			w.writeBytes(b)
+			return nil
+		}
+		w.writeArrayLen(v.Len())
+		for i := range v.Len() {
+			if err := encodeValue(w, v.Index(i), tagKey); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Map:
+		if v.IsNil() {
+			w.writeNil()
+			return nil
+		}
+		keys := v.MapKeys()
+		// the string keys are sorted so the encoding is deterministic
+		if v.Type().Key().Kind() == reflect.String {
+			sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		}
+		w.writeMapLen(len(keys))
+		for _, k := range keys {
+			if err := encodeValue(w, k, tagKey); err != nil {
+				return err
+			}
+			if err := encodeValue(w, v.MapIndex(k), tagKey); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Struct:
+		fields := structFields(v.Type(), tagKey)
+		present := make([]reflect.Value, len(fields))
+		n := 0
+		for i, f := range fields {
+			fv, ok := fieldByIndex(v, f.index)
+			if !ok || f.omitEmpty && fv.IsZero() {
+				continue
+			}
+			present[i] = fv
+			n++
+		}
+		w.writeMapLen(n)
+		for i, f := range fields {
+			if !present[i].IsValid() {
+				continue
+			}
+			w.writeString(f.name)
+			if err := encodeValue(w, present[i], tagKey); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			w.writeNil()
+			return nil
+		}
+		return encodeValue(w, v.Elem(), tagKey)
+
+	default:
+		return fmt.Errorf("codec: unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// fieldByIndex is like v.FieldByIndex but reports the nil embedded pointers.
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+type fieldInfo struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+type fieldsKey struct {
+	t      reflect.Type
+	tagKey string
+}
+
+var fieldsCache sync.Map
+
+func structFields(t reflect.Type, tagKey string) []fieldInfo {
+	key := fieldsKey{t, tagKey}
+	if fields, ok := fieldsCache.Load(key); ok {
+		return fields.([]fieldInfo)
+	}
+
+	var fields []fieldInfo
+	for i := range t.NumField() {
+		sf := t.Field(i)
+
+		tag, ok := sf.Tag.Lookup(tagKey)
+		if !ok {
+			tag = sf.Tag.Get("json")
+		}
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+
+		ft := sf.Type
+		if ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+		// the fields of the untagged embedded structs are promoted
+		if sf.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+			for _, f := range structFields(ft, tagKey) {
+				f.index = append([]int{i}, f.index...)
+				fields = append(fields, f)
+			}
+			continue
+		}
+		if !sf.IsExported() {
+			continue
+		}
+
+		if name == "" {
+			name = sf.Name
+		}
+		fields = append(fields, fieldInfo{name, []int{i}, strings.Contains(opts, "omitempty")})
+	}
+
+	fieldsCache.Store(key, fields)
+	return fields
+}
+
+// decodeTop decodes a whole message into v, which must be a non-nil pointer.
+func decodeTop(r tokenReader, v any, tagKey string) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return errors.New("codec: decoding into a non-pointer or nil")
+	}
+
+	if err := decodeValue(r, rv.Elem(), tagKey, 0); err != nil {
+		return err
+	}
+	if r.remaining() > 0 {
+		return errCodecTrailingData
+	}
+	return nil
+}
+
+func decodeValue(r tokenReader, v reflect.Value, tagKey string, depth int) error {
+	if depth > maxCodecDepth {
+		return errCodecTooDeep
+	}
+
+	tok, err := r.readToken()
+	if err != nil {
+		return err
+	}
+	if (tok.kind == tokArray || tok.kind == tokMap) && (tok.n < 0 || tok.n > r.remaining()) {
+		return io.ErrUnexpectedEOF
+	}
+	return decodeToken(r, tok, v, tagKey, depth)
+}
+
+func decodeToken(r tokenReader, tok token, v reflect.Value, tagKey string, depth int) error {
+	if tok.kind == tokNil {
+		switch v.Kind() {
+		case reflect.Pointer, reflect.Interface, reflect.Map, reflect.Slice:
+			v.SetZero()
+		}
+		return nil
+	}
+
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return decodeToken(r, tok, v.Elem(), tagKey, depth)
+	}
+
+	if tok.kind == tokString && v.CanAddr() && v.Addr().Type().Implements(textUnmarshalerType) {
+		return v.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText(tok.s)
+	}
+
+	mismatch := func() error {
+		return fmt.Errorf("codec: cannot decode %s into %s", tokenKindText[tok.kind], v.Type())
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		if tok.kind != tokBool {
+			return mismatch()
+		}
+		v.SetBool(tok.b)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var i int64
+		switch {
+		case tok.kind == tokInt:
+			i = tok.i
+		case tok.kind == tokUint && tok.u <= math.MaxInt64:
+			i = int64(tok.u)
+		default:
+			return mismatch()
+		}
+		if v.OverflowInt(i) {
+			return fmt.Errorf("codec: %d overflows %s", i, v.Type())
+		}
+		v.SetInt(i)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		var u uint64
+		switch {
+		case tok.kind == tokUint:
+			u = tok.u
+		case tok.kind == tokInt && tok.i >= 0:
+			u = uint64(tok.i)
+		default:
+			return mismatch()
+		}
+		if v.OverflowUint(u) {
+			return fmt.Errorf("codec: %d overflows %s", u, v.Type())
+		}
+		v.SetUint(u)
+
+	case reflect.Float32, reflect.Float64:
+		switch tok.kind {
+		case tokFloat:
+			v.SetFloat(tok.f)
+		case tokInt:
+			v.SetFloat(float64(tok.i))
+		case tokUint:
+			v.SetFloat(float64(tok.u))
+		default:
+			return mismatch()
+		}
+
+	case reflect.String:
+		if tok.kind != tokString && tok.kind != tokBytes {
+			return mismatch()
+		}
+		v.SetString(string(tok.s))
+
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 && (tok.kind == tokBytes || tok.kind == tokString) {
+			v.SetBytes(append([]byte(nil), tok.s...))
+			return nil
+		}
+		if tok.kind != tokArray {
+			return mismatch()
+		}
+		s := reflect.MakeSlice(v.Type(), tok.n, tok.n)
+		for i := range tok.n {
+			if err := decodeValue(r, s.Index(i), tagKey, depth+1); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 && tok.kind == tokBytes {
+			if len(tok.s) != v.Len() {
+				return mismatch()
+			}
+			reflect.Copy(v, reflect.ValueOf(tok.s))
+			return nil
+		}
+		if tok.kind != tokArray || tok.n != v.Len() {
+			return mismatch()
+		}
+		for i := range tok.n {
+			if err := decodeValue(r, v.Index(i), tagKey, depth+1); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Map:
+		if tok.kind != tokMap {
+			return mismatch()
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMapWithSize(v.Type(), tok.n))
+		}
+		kt, vt := v.Type().Key(), v.Type().Elem()
+		for range tok.n {
+			k := reflect.New(kt).Elem()
+			if err := decodeValue(r, k, tagKey, depth+1); err != nil {
+				return err
+			}
+			e := reflect.New(vt).Elem()
+			if err := decodeValue(r, e, tagKey, depth+1); err != nil {
+				return err
+			}
+			v.SetMapIndex(k, e)
+		}
+
+	case reflect.Struct:
+		if tok.kind != tokMap {
+			return mismatch()
+		}
+		fields := structFields(v.Type(), tagKey)
+		for range tok.n {
+			var name string
+			if err := decodeValue(r, reflect.ValueOf(&name).Elem(), tagKey, depth+1); err != nil {
+				return err
+			}
+
+			f := findField(fields, name)
+			if f == nil {
+				if err := skipValue(r, depth+1); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := decodeValue(r, fieldByIndexAlloc(v, f.index), tagKey, depth+1); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return mismatch()
+		}
+		x, err := decodeAny(r, tok, depth)
+		if err != nil {
+			return err
+		}
+		if x == nil {
+			v.SetZero()
+		} else {
+			v.Set(reflect.ValueOf(x))
+		}
+
+	default:
+		return fmt.Errorf("codec: unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// findField matches the name exactly first, then case-insensitively.
+func findField(fields []fieldInfo, name string) *fieldInfo {
+	for i := range fields {
+		if fields[i].name == name {
+			return &fields[i]
+		}
+	}
+	for i := range fields {
+		if strings.EqualFold(fields[i].name, name) {
+			return &fields[i]
+		}
+	}
+	return nil
+}
+
+// fieldByIndexAlloc is like v.FieldByIndex but allocates the nil embedded
+// pointers.
+func fieldByIndexAlloc(v reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v
+}
+
+func decodeAny(r tokenReader, tok token, depth int) (any, error) {
+	switch tok.kind {
+	case tokNil:
+		return nil, nil
+	case tokBool:
+		return tok.b, nil
+	case tokInt:
+		return tok.i, nil
+	case tokUint:
+		if tok.u <= math.MaxInt64 {
+			return int64(tok.u), nil
+		}
+		return tok.u, nil
+	case tokFloat:
+		return tok.f, nil
+	case tokString:
+		return string(tok.s), nil
+	case tokBytes:
+		return append([]byte(nil), tok.s...), nil
+	}
+
+	if depth+1 > maxCodecDepth {
+		return nil, errCodecTooDeep
+	}
+
+	next := func() (any, error) {
+		t, err := r.readToken()
+		if err != nil {
+			return nil, err
+		}
+		if (t.kind == tokArray || t.kind == tokMap) && (t.n < 0 || t.n > r.remaining()) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return decodeAny(r, t, depth+1)
+	}
+
+	if tok.kind == tokArray {
+		arr := make([]any, tok.n)
+		for i := range arr {
+			x, err := next()
+			if err != nil {
+				return nil, err
+			}
+			arr[i] = x
+		}
+		return arr, nil
+	}
+
+	m := make(map[string]any, tok.n)
+	for range tok.n {
+		k, err := next()
+		if err != nil {
+			return nil, err
+		}
+		x, err := next()
+		if err != nil {
+			return nil, err
+		}
+		if s, ok := k.(string); ok {
+			m[s] = x
+		} else {
+			m[fmt.Sprint(k)] = x
+		}
+	}
+	return m, nil
+}
+
+func skipValue(r tokenReader, depth int) error {
+	tok, err := r.readToken()
+	if err != nil {
+		return err
+	}
+	if (tok.kind == tokArray || tok.kind == tokMap) && (tok.n < 0 || tok.n > r.remaining()) {
+		return io.ErrUnexpectedEOF
+	}
+	_, err = decodeAny(r, tok, depth)
+	return err
+}
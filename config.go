@@ -0,0 +1,241 @@
+package kiwi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Duration is a time.Duration written like "5s" or "1m30s" in the config
+// files.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return errors.New("duration must be a string like \"5s\"")
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Config holds the server settings of a config file. The zero fields keep
+// the defaults of the server.
+type Config struct {
+	// not applied by Reload, a restart is needed to change them
+	Addr                   string   `json:"addr"`
+	MaxHandshakeBytes      int      `json:"max_handshake_bytes"`
+	MaxRequestLineBytes    int      `json:"max_request_line_bytes"`
+	MaxHeaderLineBytes     int      `json:"max_header_line_bytes"`
+	MaxHeaders             int      `json:"max_headers"`
+	MaxFramePayloadBytes   uint64   `json:"max_frame_payload_bytes"`
+	MaxMessageBytes        uint64   `json:"max_message_bytes"`
+	MaxMessageFragments    int      `json:"max_message_fragments"`
+	MinAvgFragmentBytes    uint64   `json:"min_avg_fragment_bytes"`
+	HandshakeTimeout       Duration `json:"handshake_timeout"`
+	MaxConnectionAge       Duration `json:"max_connection_age"`
+	MaxConnectionAgeJitter Duration `json:"max_connection_age_jitter"`
+	// a close code like 1001, 1012 if it's zero
+	MaxConnectionAgeCloseCode uint16   `json:"max_connection_age_close_code"`
+	PingInterval              Duration `json:"ping_interval"`
+
+	// also applied by Reload
+	AllowedOrigins []string `json:"allowed_origins"`
+	HandshakeRate  float64  `json:"handshake_rate"`
+	HandshakeBurst int      `json:"handshake_burst"`
+	AllowCIDRs     []string `json:"allow_cidrs"`
+	DenyCIDRs      []string `json:"deny_cidrs"`
+}
+
+// LoadConfig reads a JSON config file, or a YAML one if its extension is
+// .yaml or .yml. Only a subset of YAML is supported, see parseYAML.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		v, err := parseYAML(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if data, err = json.Marshal(v); err != nil {
+			return nil, err
+		}
+	}
+
+	cfg := &Config{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// Apply applies all the settings to srv, which should not be serving yet.
+func (cfg *Config) Apply(srv *Server) error {
+	if cfg.Addr != "" {
+		WithAddr(cfg.Addr)(srv)
+	}
+	WithLimits(Limits{
+		MaxFramePayloadBytes: cfg.MaxFramePayloadBytes,
+		MaxMessageBytes:      cfg.MaxMessageBytes,
+		MaxMessageFragments:  cfg.MaxMessageFragments,
+		MinAvgFragmentBytes:  cfg.MinAvgFragmentBytes,
+	})(srv)
+	if cfg.MaxHandshakeBytes > 0 {
+		srv.MaxHandshakeBytes = cfg.MaxHandshakeBytes
+	}
+	if cfg.MaxRequestLineBytes > 0 {
+		srv.MaxRequestLineBytes = cfg.MaxRequestLineBytes
+	}
+	if cfg.MaxHeaderLineBytes > 0 {
+		srv.MaxHeaderLineBytes = cfg.MaxHeaderLineBytes
+	}
+	if cfg.MaxHeaders > 0 {
+		srv.MaxHeaders = cfg.MaxHeaders
+	}
+	if cfg.HandshakeTimeout != 0 {
+		srv.HandshakeTimeout = time.Duration(cfg.HandshakeTimeout)
+	}
+	if cfg.PingInterval != 0 {
+		srv.PingInterval = time.Duration(cfg.PingInterval)
+	}
+	if cfg.MaxConnectionAge != 0 {
+		srv.MaxConnectionAge = time.Duration(cfg.MaxConnectionAge)
+		srv.MaxConnectionAgeJitter = time.Duration(cfg.MaxConnectionAgeJitter)
+		srv.MaxConnectionAgeCloseCode = cfg.MaxConnectionAgeCloseCode
+	}
+
+	// created even if unused so Reload only has to update them
+	if srv.AccessList == nil {
+		srv.AccessList, _ = NewAccessList(nil, nil)
+	}
+	if srv.Origins == nil {
+		srv.Origins = NewOriginPolicy()
+	}
+	if srv.HandshakeLimiter == nil {
+		srv.HandshakeLimiter = NewRateLimiter(0, 0)
+	}
+
+	if err := cfg.applyReloadable(srv); err != nil {
+		return err
+	}
+	return srv.Validate()
+}
+
+func (cfg *Config) applyReloadable(srv *Server) error {
+	if err := srv.AccessList.Update(cfg.AllowCIDRs, cfg.DenyCIDRs); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+	}
+	srv.Origins.Update(cfg.AllowedOrigins)
+	srv.HandshakeLimiter.SetRate(cfg.HandshakeRate, cfg.HandshakeBurst)
+	return nil
+}
+
+// static returns the settings which are not applied by Reload.
+func (cfg Config) static() Config {
+	cfg.AllowedOrigins = nil
+	cfg.HandshakeRate = 0
+	cfg.HandshakeBurst = 0
+	cfg.AllowCIDRs = nil
+	cfg.DenyCIDRs = nil
+	return cfg
+}
+
+// ConfigLoader keeps a server configured by a config file, see Reload.
+type ConfigLoader struct {
+	Path   string
+	Server *Server
+
+	mu  sync.Mutex
+	cfg *Config
+}
+
+// NewConfigLoader loads path and applies it to srv before it's serving.
+func NewConfigLoader(path string, srv *Server) (*ConfigLoader, error) {
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Apply(srv); err != nil {
+		return nil, err
+	}
+	return &ConfigLoader{Path: path, Server: srv, cfg: cfg}, nil
+}
+
+// Config returns the config loaded last.
+func (l *ConfigLoader) Config() *Config {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.cfg
+}
+
+// Reload loads the file again and applies the origins, the handshake rate
+// and the CIDR lists to the running server, the existing conns are kept.
+// The changes of the other settings are logged and wait for a restart. The
+// config in use is kept if the file is invalid.
+func (l *ConfigLoader) Reload() error {
+	cfg, err := LoadConfig(l.Path)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := cfg.applyReloadable(l.Server); err != nil {
+		return err
+	}
+
+	if !reflect.DeepEqual(cfg.static(), l.cfg.static()) {
+		l.Server.logf("[Config] addr, limits and timeouts of %s are applied on restart only\n", l.Path)
+	}
+	l.cfg = cfg
+	return nil
+}
+
+// ReloadOnSignal reloads the file on each of sigs, SIGHUP if none, until ctx
+// is done. The reload errors are logged.
+func (l *ConfigLoader) ReloadOnSignal(ctx context.Context, sigs ...os.Signal) {
+	if len(sigs) == 0 {
+		sigs = []os.Signal{syscall.SIGHUP}
+	}
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sigs...)
+	defer signal.Stop(ch)
+
+	for {
+		select {
+		case <-ch:
+			if err := l.Reload(); err != nil {
+				l.Server.logf("[Config] reload failed: %s\n", err.Error())
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -2,11 +2,14 @@ package kiwi
 
 import (
 	"bufio"
-	"fmt"
-	"log"
+	"context"
+	"encoding/base64"
 	"net"
 	"net/http"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 const (
@@ -68,7 +71,7 @@ func (r DefaultOnConnOpenRouter) Serve(reqPath string, conn *Conn) {
 		return
 	}
 
-	receiver := &DefaultMessageReceiver{}
+	receiver := &DefaultMessageReceiver{AutoControl: conn.Server.AutoControlFrames}
 	receiver.SetConn(conn)
 
 	sender := &DefaultMessageSender{}
@@ -113,6 +116,10 @@ func (r DefaultOnConnCloseRouter) Serve(reqPath string, conn *Conn) {
 	handler.ServerConn(conn)
 }
 
+// Conn can be used where a net.Conn is expected, e.g. to be wrapped by a rate
+// limiter, the raw bytes are read and written without framing.
+var _ net.Conn = (*Conn)(nil)
+
 type Conn struct {
 	ID uint64
 
@@ -123,13 +130,316 @@ type Conn struct {
 	Buf    *bufio.ReadWriter
 
 	HandshakeRequest *HandshakeRequest
+
+	// the response of the handshake of a client conn
+	HandshakeResponse *http.Response
+
+	// index keys in ConnPool, guarded by its mu
+	poolPath string
+	poolKey  string
+	tags     map[string]bool
+
+	// experiment bucket assigned by Server.Bucketing
+	Bucket string
+
+	// verified by Tickets.HandshakeFunc, see Ticket
+	ticket *Ticket
+
+	// matched by the Host header of the handshake, nil for the handlers of
+	// the server itself
+	vhost *VirtualHost
+
+	// traces the conn from its opening to its close
+	span Span
+
+	// called with every frame read from or written to the conn, the frame
+	// must not be kept after the call. They're set from the Server ones and
+	// may be replaced by OnHandshakeComplete
+	TraceFrameIn  func(*Frame)
+	TraceFrameOut func(*Frame)
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// serializes writes from the senders and the server itself
+	wmu sync.Mutex
+	// serializes the data messages of all the senders of the conn, the
+	// frames of one are not interleaved with another's
+	sendMu sync.Mutex
+
+	// unix nanoseconds of the write deadline set by the user, 0 for none
+	userWriteDeadline atomic.Int64
+
+	// set once the close frame of the peer is read, see CloseError
+	peerClose atomic.Pointer[CloseError]
+
+	// see SendStats and RecvStats
+	payloadBytesSent atomic.Uint64
+	wireBytesSent    atomic.Uint64
+	payloadBytesRecv atomic.Uint64
+	wireBytesRecv    atomic.Uint64
+
+	acceptedAt time.Time
+
+	// see Stats, the times are unix nanoseconds of Server.Clock
+	lastPing atomic.Int64
+	lastPong atomic.Int64
+	srtt     atomic.Int64
+	lastRTT  atomic.Int64
+
+	// a handshake response has been written by WriteHandshakeResponse
+	wroteHandshake bool
+
+	// selected by the handshake of a server conn, see SetSubprotocol
+	subprotocol string
+
+	// negotiated by the handshake, see Extension
+	extensions   []NegotiatedExtension
+	extensionRSV uint8
+	// serializes the encoding of the data frames with their writes
+	extensionMu sync.Mutex
+
+	// the messages sent by SendWithAck waiting for their acks
+	acks ackState
+
+	// see TrySend
+	sendq     chan *Message
+	sendqOnce sync.Once
+
+	// for the coalesced writes, guarded by wmu
+	coalesceDelay time.Duration
+	flushTimer    *time.Timer
+
+	// for the pooled Buf
+	bufRefs int32
+
+	// the bytes of the last message read held in Server.Memory
+	memHeld atomic.Int64
+
+	// set in the event loop mode, see Server.EventLoop
+	poll atomic.Pointer[pollConn]
+
+	// for the SLO tracking
+	opened    bool
+	closeCode uint32
+
+	// dialed by a Dialer, the frames it sends are masked
+	client bool
+
+	// set by the first Close and the first close frame sent
+	closed    atomic.Bool
+	closeSent atomic.Bool
+
+	// the error of the write which cut a frame, see Broken
+	broken atomic.Pointer[writeFailure]
+
+	// the bytes written to the socket and the spans of the frames not
+	// written out yet, guarded by wmu
+	wireOut    int64
+	frameSpans []frameSpan
+	// the conn is closed once wmu is released, see unlockWrites
+	closeOnUnlock bool
+}
+
+type writeFailure struct{ err error }
+
+// frameSpan is the offsets of a frame in the bytes written to the socket.
+type frameSpan struct{ start, end int64 }
+
+// Broken returns the error of the write which failed after writing a part
+// of a frame, nil if there is none. The conn has been closed by it.
+func (c *Conn) Broken() error {
+	if wf := c.broken.Load(); wf != nil {
+		return wf.err
+	}
+	return nil
+}
+
+// queueFrame records the span of a frame of size bytes about to be written
+// after the buffered ones. c.wmu is held.
+func (c *Conn) queueFrame(size int64) {
+	start := c.wireOut + int64(c.Buf.Writer.Buffered())
+	c.frameSpans = append(c.frameSpans, frameSpan{start, start + size})
+}
+
+// wrote counts n bytes written to the socket by a write failed with err if
+// it's not nil, the conn is broken if it stopped in the middle of a frame.
+// c.wmu is held.
+func (c *Conn) wrote(n int64, err error) {
+	c.wireOut += n
+	i := 0
+	for i < len(c.frameSpans) && c.frameSpans[i].end <= c.wireOut {
+		i++
+	}
+	c.frameSpans = append(c.frameSpans[:0], c.frameSpans[i:]...)
+
+	if err != nil && len(c.frameSpans) > 0 && c.frameSpans[0].start < c.wireOut {
+		c.broken.CompareAndSwap(nil, &writeFailure{err})
+		c.closeOnUnlock = true
+	}
+}
+
+// unlockWrites releases c.wmu, then closes the conn if a write asked for
+// it, so the close handlers can write.
+func (c *Conn) unlockWrites() {
+	closing := c.closeOnUnlock
+	c.closeOnUnlock = false
+	c.wmu.Unlock()
+
+	if closing {
+		c.Close()
+	}
+}
+
+func (c *Conn) Limits() Limits {
+	var reqPath string
+	if c.HandshakeRequest != nil {
+		reqPath = c.HandshakeRequest.RequestURL.Path
+	}
+	return c.Server.limitsFor(c.vhost, reqPath)
+}
+
+// VirtualHost returns the virtual host serving c, or nil if it's served by
+// the handlers of the server itself.
+func (c *Conn) VirtualHost() *VirtualHost {
+	return c.vhost
+}
+
+func (c *Conn) routes() *routes {
+	if c.vhost != nil {
+		return &c.vhost.routes
+	}
+	return &c.Server.routes
+}
+
+func (c *Conn) origins() *OriginPolicy {
+	if c.vhost != nil && c.vhost.Origins != nil {
+		return c.vhost.Origins
+	}
+	return c.Server.Origins
+}
+
+func (c *Conn) closeWithCode(code uint16) {
+	c.CloseWithCode(code, CloseCodeText(code))
+}
+
+// CloseWithCode sends a close frame with code and reason and closes the
+// conn, it's just closed if it's not open. Nothing is done if a close frame
+// has been sent already, the conn is closed by the sender of it.
+func (c *Conn) CloseWithCode(code uint16, reason string) error {
+	if c.GetState() == StateOpen {
+		if _, err := c.sendClose(code, reason, false, false); err != ErrCloseSent {
+			return err
+		}
+		return nil
+	}
+	if c.closeSent.Load() {
+		return nil
+	}
+	return c.Close()
+}
+
+// Context is canceled when the conn is closed.
+func (c *Conn) Context() context.Context {
+	return c.ctx
 }
 
 func (c *Conn) Write(p []byte) (n int, err error) {
+	c.wmu.Lock()
+	defer c.unlockWrites()
+
+	if c.broken.Load() != nil {
+		return 0, ErrConnBroken
+	}
+
+	c.queueFrame(int64(len(p)))
 	if n, err = c.Buf.Write(p); err != nil {
 		return n, err
 	}
-	return n, c.Buf.Flush()
+	return n, c.flushOrDefer()
+}
+
+// flushOrDefer flushes the written data right away unless the writes are
+// coalesced, then the flush is deferred by at most coalesceDelay. The data
+// is also written out whenever the write buffer gets full.
+func (c *Conn) flushOrDefer() error {
+	if c.coalesceDelay <= 0 {
+		return c.Buf.Flush()
+	}
+
+	if c.Buf.Writer.Buffered() > 0 && c.flushTimer == nil {
+		c.flushTimer = time.AfterFunc(c.coalesceDelay, func() {
+			c.Flush()
+		})
+	}
+	return nil
+}
+
+// Flush writes out the data buffered by the coalesced writes.
+func (c *Conn) Flush() error {
+	c.wmu.Lock()
+	defer c.unlockWrites()
+
+	return c.flushLocked()
+}
+
+func (c *Conn) flushLocked() error {
+	if c.flushTimer != nil {
+		c.flushTimer.Stop()
+		c.flushTimer = nil
+	}
+	return c.Buf.Flush()
+}
+
+// SetWriteCoalescing makes the writes of the conn buffered and flushed after
+// at most delay, by Flush or once the write buffer gets full. It's disabled
+// if delay is not positive and the buffered data is flushed.
+func (c *Conn) SetWriteCoalescing(delay time.Duration) error {
+	c.wmu.Lock()
+	defer c.unlockWrites()
+
+	c.coalesceDelay = delay
+	if delay <= 0 {
+		return c.flushLocked()
+	}
+	return nil
+}
+
+// WriteBuffers writes bufs by one vectored write on the underlying conn if
+// possible, data buffered by Write is flushed before.
+func (c *Conn) WriteBuffers(bufs net.Buffers) (n int64, err error) {
+	c.wmu.Lock()
+	defer c.unlockWrites()
+
+	if c.broken.Load() != nil {
+		return 0, ErrConnBroken
+	}
+
+	var size int64
+	for _, b := range bufs {
+		size += int64(len(b))
+	}
+
+	// go through the retrying writer or the write buffer of coalescing
+	if c.Server.WriteRetry != nil || c.coalesceDelay > 0 {
+		c.queueFrame(size)
+		for _, b := range bufs {
+			i, err := c.Buf.Write(b)
+			n += int64(i)
+			if err != nil {
+				return n, err
+			}
+		}
+		return n, c.flushOrDefer()
+	}
+
+	if err = c.Buf.Flush(); err != nil {
+		return 0, err
+	}
+	c.queueFrame(size)
+	n, err = bufs.WriteTo(c.rwc)
+	c.wrote(n, err)
+	return n, err
 }
 
 func (c *Conn) SetState(state int32) {
@@ -146,74 +456,375 @@ func newConn(srv *Server, c net.Conn) *Conn {
 	conn.Server = srv
 	conn.rwc = c
 
-	br := bufio.NewReader(c)
-	bw := bufio.NewWriter(c)
+	var (
+		br *bufio.Reader
+		bw *bufio.Writer
+	)
+
+	rs, ws := srv.connBufferSizes()
+	if srv.PoolConnBuffers {
+		// released when both serve and Close are done with them
+		conn.bufRefs = 2
+		br = getConnReader(c, rs)
+		bw = getConnWriter(&connWriter{conn}, ws)
+	} else {
+		br = bufio.NewReaderSize(c, rs)
+		bw = bufio.NewWriterSize(&connWriter{conn}, ws)
+	}
 	conn.Buf = bufio.NewReadWriter(br, bw)
 
+	conn.ctx, conn.cancel = context.WithCancel(context.Background())
+	conn.acceptedAt = srv.clock().Now()
+	conn.coalesceDelay = srv.WriteCoalesceDelay
+	conn.span = noopSpan{}
+	if fn := srv.TraceFrameIn; fn != nil {
+		conn.TraceFrameIn = func(f *Frame) { fn(conn, f) }
+	}
+	if fn := srv.TraceFrameOut; fn != nil {
+		conn.TraceFrameOut = func(f *Frame) { fn(conn, f) }
+	}
 	conn.SetState(StateConnecting)
 
 	return conn
 }
 
-func (c *Conn) doHandshake() (errCode int, err error) {
+// readFrame reads a frame from the conn and passes it to TraceFrameIn.
+func (c *Conn) readFrame(f *Frame, maxPayloadLen uint64) error {
+	if err := f.FromBufReader(c.Buf, maxPayloadLen); err != nil {
+		return err
+	}
+	c.payloadBytesRecv.Add(uint64(len(f.PayloadData)))
+	c.wireBytesRecv.Add(uint64(f.headerLen(f.MASK == 1) + len(f.PayloadData)))
+	if f.Opcode == OpcodePong {
+		c.measureRTT(f)
+	}
+
+	if c.TraceFrameIn != nil {
+		c.TraceFrameIn(f)
+	}
+	return nil
+}
+
+func (c *Conn) readHandshake() error {
+	srv := c.Server
 	hsReq := &HandshakeRequest{}
-	if err := hsReq.ReadFrom(c.Buf, c.Server.MaxHandshakeBytes); err != nil {
-		return 400, err
+	read := hsReq.readFrom
+	if srv.StdHandshakeParser {
+		read = hsReq.readFromStd
+	}
+	lim := headerLimits{srv.MaxRequestLineBytes, srv.MaxHeaderLineBytes, srv.MaxHeaders}
+	if err := read(c.Buf, srv.MaxHandshakeBytes, lim); err != nil {
+		return err
+	}
+
+	if c.Server.protocolMode() == ProtocolLenient {
+		hsReq.Header.canonicalize()
 	}
 
 	c.HandshakeRequest = hsReq
-	return c.Server.handshakeReqRouter.Serve(hsReq, c)
+	return nil
+}
+
+func (c *Conn) doHandshake() (errCode int, err error) {
+	return c.routes().handshakeReqRouter.Serve(c.HandshakeRequest, c)
 }
 
-func (c *Conn) Close() {
-	c.Server.onConnCloseRouter.Serve(c.HandshakeRequest.RequestURL.Path, c)
-	c.rwc.Close()
+func (c *Conn) closeWhenAged(age time.Duration) {
+	t := c.Server.clock().NewTimer(age)
+	defer t.Stop()
+
+	select {
+	case <-t.C():
+		code := c.Server.MaxConnectionAgeCloseCode
+		if code == 0 {
+			code = CloseCodeServiceRestart
+		}
+		c.closeWithCode(code)
+	case <-c.ctx.Done():
+	}
+}
+
+// Close closes the conn and the underlying net.Conn, it returns the error of
+// the latter. Only the first call does the closing, so the conn leaves the
+// ConnPool and the OnConnClose handler is called once, the other calls
+// return nil without waiting for it.
+func (c *Conn) Close() error {
+	if !c.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+
+	if c.opened {
+		code := uint16(atomic.LoadUint32(&c.closeCode))
+		if code == 0 {
+			code = CloseCodeAbnormalClosure
+		}
+		if slo := c.Server.SLO; slo != nil {
+			slo.RecordClose(code)
+		}
+		c.emit(&Event{Type: EventConnClosed, CloseCode: code, Outcome: CloseCodeOutcome(code)})
+		c.span.SetAttributes(Attr{"websocket.close.code", int(code)})
+		c.span.End()
+		c.logAccess(http.StatusSwitchingProtocols, code, nil)
+	}
+
+	if c.HandshakeRequest != nil {
+		c.routes().onConnCloseRouter.Serve(c.HandshakeRequest.RequestURL.Path, c)
+	}
+	c.SetState(StateClosed)
+	c.cancel()
+
+	if pc := c.poll.Load(); pc != nil {
+		pc.detach()
+	}
+	err := c.rwc.Close()
 	c.Server.ConnPool.Del(c)
+
+	c.releaseBuf()
+	c.releaseMemory()
+	return err
+}
+
+// SendStats counts the bytes sent by the message senders of a conn.
+type SendStats struct {
+	// the payload bytes of the frames
+	PayloadBytes uint64
+	// the bytes of the frames including their headers
+	WireBytes uint64
+}
+
+func (c *Conn) SendStats() SendStats {
+	return SendStats{
+		PayloadBytes: c.payloadBytesSent.Load(),
+		WireBytes:    c.wireBytesSent.Load(),
+	}
+}
+
+func (c *Conn) countSent(payload, wire int) {
+	c.payloadBytesSent.Add(uint64(payload))
+	c.wireBytesSent.Add(uint64(wire))
+}
+
+// RecvStats counts the bytes of the frames read from a conn.
+type RecvStats struct {
+	PayloadBytes uint64
+	WireBytes    uint64
+}
+
+func (c *Conn) RecvStats() RecvStats {
+	return RecvStats{
+		PayloadBytes: c.payloadBytesRecv.Load(),
+		WireBytes:    c.wireBytesRecv.Load(),
+	}
+}
+
+// AddTag tags the conn to group it with others, such as by tenant, user or
+// room, the conns with a tag are found by ConnPool.ByTag.
+func (c *Conn) AddTag(tag string) {
+	c.Server.ConnPool.tag(c, tag, true)
+}
+
+func (c *Conn) RemoveTag(tag string) {
+	c.Server.ConnPool.tag(c, tag, false)
+}
+
+// Tags returns the tags of the conn in sorted order.
+func (c *Conn) Tags() []string {
+	return c.Server.ConnPool.tagsOf(c)
+}
+
+// Read reads the raw bytes of the conn through its read buffer, so the bytes
+// already buffered are not skipped.
+func (c *Conn) Read(p []byte) (n int, err error) {
+	return c.Buf.Read(p)
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.rwc.LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.rwc.RemoteAddr()
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.storeWriteDeadline(t)
+	return c.rwc.SetDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.rwc.SetReadDeadline(t)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.storeWriteDeadline(t)
+	return c.rwc.SetWriteDeadline(t)
+}
+
+func (c *Conn) storeWriteDeadline(t time.Time) {
+	var ns int64
+	if !t.IsZero() {
+		ns = t.UnixNano()
+	}
+	c.userWriteDeadline.Store(ns)
+}
+
+// writeDeadline is the last one set by SetWriteDeadline or SetDeadline, it's
+// restored by SendWholeTimeout.
+func (c *Conn) writeDeadline() time.Time {
+	if ns := c.userWriteDeadline.Load(); ns != 0 {
+		return time.Unix(0, ns)
+	}
+	return time.Time{}
+}
+
+func (c *Conn) releaseBuf() {
+	if !c.Server.PoolConnBuffers || atomic.AddInt32(&c.bufRefs, -1) != 0 {
+		return
+	}
+
+	rs, ws := c.Server.connBufferSizes()
+	// the small read buffer of a conn parked by the event loop is not pooled
+	if c.Buf.Reader.Size() == rs {
+		putConnReader(c.Buf.Reader, rs)
+	}
+	putConnWriter(c.Buf.Writer, ws)
 }
 
 func (c *Conn) FailHandshake(code int, err error) {
-	buf := c.Buf
-	fmt.Fprintf(buf, "HTTP/1.1 %03d %s\r\n", code, http.StatusText(code))
-	buf.WriteString("\r\n")
-	buf.WriteString(err.Error() + "\n")
-	buf.Flush()
+	if slo := c.Server.SLO; slo != nil {
+		slo.RecordHandshake(false)
+	}
+	c.emit(&Event{Type: EventHandshakeFailed, Err: &HandshakeError{Status: code, Err: err}})
+	c.logAccess(code, 0, err)
+
+	if !c.wroteHandshake {
+		c.WriteHandshakeResponse(&HandshakeResponse{StatusCode: code, Body: []byte(err.Error() + "\n")})
+	}
 	c.Close()
 
-	log.Printf("[Handshake] %s\n", err.Error())
+	c.Server.logf("[Handshake] %s\n", err.Error())
 }
 
 func (c *Conn) serve() {
+	defer c.releaseBuf()
+
+	c.emit(&Event{Type: EventConnAccepted})
+
+	if timeout := c.Server.HandshakeTimeout; timeout > 0 {
+		c.rwc.SetDeadline(time.Now().Add(timeout))
+	}
+
+	if err := c.readHandshake(); err != nil {
+		code := http.StatusBadRequest
+		if he, ok := err.(*HandshakeError); ok && he.Status != 0 {
+			code = he.Status
+		}
+		c.FailHandshake(code, err)
+		return
+	}
+
+	// plain http request without upgrade
+	if !c.HandshakeRequest.IsUpgrade() {
+		c.serveNonUpgrade()
+		return
+	}
+
+	c.vhost = c.Server.virtualHost(headerValue(c.HandshakeRequest.Header, "Host"))
+
+	if !c.Server.HandshakeLimiter.Allow() {
+		c.FailHandshake(http.StatusTooManyRequests, ErrRateLimited)
+		return
+	}
+
+	if cl := c.Server.ClientHandshakeLimiter; cl != nil && !cl.Allow(c.ClientIP()) {
+		c.FailHandshake(http.StatusTooManyRequests, ErrRateLimited)
+		return
+	}
+
+	if al := c.Server.AccessList; al != nil && c.Server.TrustedProxies != nil {
+		if ip := c.ClientIP(); ip.IsValid() && !al.Allowed(ip) {
+			c.FailHandshake(http.StatusForbidden, ErrClientNotAllowed)
+			return
+		}
+	}
+
+	if err := c.verifyClientCert(); err != nil {
+		c.FailHandshake(http.StatusForbidden, err)
+		return
+	}
+
+	c.extractTraceContext()
+	_, span := c.startSpan("kiwi.handshake", c.spanAttrs()...)
+
 	// do handshake
 	if errCode, err := c.doHandshake(); err != nil {
+		span.SetAttributes(Attr{"http.response.status_code", errCode})
+		span.RecordError(err)
+		span.End()
 		c.FailHandshake(errCode, err)
 		return
 	}
+	span.SetAttributes(Attr{"http.response.status_code", http.StatusSwitchingProtocols})
+	span.End()
+
+	if c.Server.HandshakeTimeout > 0 {
+		c.rwc.SetDeadline(time.Time{})
+	}
+
+	if c.Server.Bucketing != nil {
+		c.Bucket = c.Server.Bucketing.Assign(c.HandshakeRequest, c)
+	}
+
+	if slo := c.Server.SLO; slo != nil {
+		slo.RecordHandshake(true)
+	}
 
+	// the handlers can start their spans under the conn one by Context
+	c.ctx, c.span = c.startSpan("kiwi.conn", c.spanAttrs()...)
+	c.opened = true
 	c.SetState(StateOpen)
+	c.Server.ConnPool.IndexPath(c)
+	c.emit(&Event{Type: EventConnOpened})
+
+	if fn := c.Server.OnHandshakeComplete; fn != nil {
+		fn(c)
+	}
+
+	if age := c.Server.connectionAge(); age > 0 {
+		go c.closeWhenAged(age)
+	}
+	c.startPings()
 
 	// data transform
-	c.Server.onConnOpenRouter.Serve(c.HandshakeRequest.RequestURL.Path, c)
+	c.routes().onConnOpenRouter.Serve(c.HandshakeRequest.RequestURL.Path, c)
 }
 
 var ErrNotSupportedVersion = &ProtocolError{"not supported version"}
 
 func DefaultServerHandshakeCheck(hsReq *HandshakeRequest, conn *Conn) (errCode int, err error) {
 	header := hsReq.Header
+	mode := conn.Server.protocolMode()
+	lenient := mode == ProtocolLenient
 
-	if hsReq.ProtoVer != "1.1" {
+	if hsReq.ProtoVer != "1.1" && !(lenient && hsReq.ProtoVer == "1.0") {
 		return http.StatusBadRequest, &ProtocolError{"invalid http proto ver"}
 	}
 
-	if !header.HasKey("Host") {
+	if mode == ProtocolStrict && hsReq.Method != http.MethodGet {
+		return http.StatusBadRequest, &ProtocolError{"invalid handshake method"}
+	}
+
+	if !header.HasKey("Host") && !lenient {
 		return http.StatusBadRequest, &ProtocolError{"missing header 'Host'"}
 	}
 
 	// ff 40.0.3 gives "keep-alive, Upgrade"
-	if !header.HasKeyAndValContains("Connection", "Upgrade") {
+	if !header.HasKeyAndValContains("Connection", "Upgrade") &&
+		!(lenient && headerHasToken(strings.Join(header.Get("Connection"), ","), "upgrade")) {
 		return http.StatusBadRequest, &ProtocolError{"missing or invalid header 'Connection'"}
 	}
 
-	if !header.HasKeyAndValEqual("Upgrade", "websocket") {
+	if !header.HasKeyAndValEqual("Upgrade", "websocket") && !(lenient && hsReq.IsUpgrade()) {
 		return http.StatusBadRequest, &ProtocolError{"missing or invalid header 'Upgrade'"}
 	}
 
@@ -231,10 +842,20 @@ func DefaultServerHandshakeCheck(hsReq *HandshakeRequest, conn *Conn) (errCode i
 		return http.StatusBadRequest, &ProtocolError{"missing header 'Sec-WebSocket-Key"}
 	}
 
-	if !conn.Server.onConnOpenRouter.HasHandler(hsReq.RequestURL.Path) {
+	if mode == ProtocolStrict {
+		if key, err := base64.StdEncoding.DecodeString(header.GetOne("Sec-WebSocket-Key")); err != nil || len(key) != 16 {
+			return http.StatusBadRequest, &ProtocolError{"invalid header 'Sec-WebSocket-Key'"}
+		}
+	}
+
+	if !conn.routes().onConnOpenRouter.HasHandler(hsReq.RequestURL.Path) {
 		return http.StatusNotFound, &ProtocolError{"service not found for: " + hsReq.RequestURL.Path}
 	}
 
+	if op := conn.origins(); op != nil && header.HasKey("Origin") && !op.Allowed(header.GetOne("Origin")) {
+		return http.StatusForbidden, ErrOriginNotAllowed
+	}
+
 	return 0, nil
 }
 
@@ -246,13 +867,41 @@ func DefaultServerHandshakeFunc(hsReq *HandshakeRequest, conn *Conn) (errCode in
 	key := hsReq.Header.GetOne("Sec-WebSocket-Key")
 	respKey := MakeAcceptKey(key)
 
-	buf := conn.Buf
-	buf.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
-	buf.WriteString("Upgrade: websocket\r\n")
-	buf.WriteString("Connection: Upgrade\r\n")
-	buf.WriteString("Sec-WebSocket-Accept: " + string(respKey) + "\r\n")
-	buf.WriteString("\r\n")
-	buf.Flush()
+	resp := &HandshakeResponse{StatusCode: http.StatusSwitchingProtocols}
+	resp.AddHeader("Upgrade", "websocket")
+	resp.AddHeader("Connection", "Upgrade")
+	resp.AddHeader("Sec-WebSocket-Accept", string(respKey))
+	if ext := conn.negotiateExtensions(hsReq); ext != "" {
+		resp.AddHeader("Sec-WebSocket-Extensions", ext)
+	}
+	conn.WriteHandshakeResponse(resp)
 
 	return
 }
+
+// WriteHandshakeResponse writes resp for a handshake func, with the Date
+// header unless Server.NoDateHeader is set and the Server header of
+// Server.ServerHeader if resp has none. A handshake func rejecting the
+// handshake by its own response returns an error after it, FailHandshake
+// doesn't write another one then.
+func (c *Conn) WriteHandshakeResponse(resp *HandshakeResponse) error {
+	c.wroteHandshake = true
+	if resp.StatusCode == http.StatusSwitchingProtocols && c.subprotocol == "" {
+		if p := resp.Header.Get("Sec-WebSocket-Protocol"); len(p) > 0 {
+			c.subprotocol = p[0]
+		}
+	}
+
+	srv := c.Server
+	if !srv.NoDateHeader && !resp.Header.HasKey("Date") {
+		resp.AddHeader("Date", srv.clock().Now().UTC().Format(http.TimeFormat))
+	}
+	if srv.ServerHeader != "" && !resp.Header.HasKey("Server") {
+		resp.AddHeader("Server", srv.ServerHeader)
+	}
+
+	if _, err := resp.WriteTo(c.Buf); err != nil {
+		return err
+	}
+	return c.Buf.Flush()
+}
@@ -0,0 +1,349 @@
+package kiwi
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+)
+
+// the empty stored blocks appended to a compressed message, the final one
+// ends the stream for the reader
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+// PerMessageDeflate is the permessage-deflate extension of RFC 7692, the
+// text and binary messages are compressed by it. The compressors have
+// windows of 15 bits, they're of flate.HuffmanOnly if the peer asks smaller
+// ones, which doesn't refer back to the data compressed before.
+type PerMessageDeflate struct {
+	// of compress/flate, flate.DefaultCompression if it's zero
+	Level int
+
+	// the messages compressed, all of them by default. It's overridden per
+	// route by SetCompression
+	Policy CompressionPolicy
+
+	// the compressor of the server or the client doesn't keep the context
+	// of the messages sent before, it's given back to a pool after each
+	// message so the idle conns don't hold one, trading the ratio for the
+	// memory. A server asks them in its responses, a client in its offers
+	ServerNoContextTakeover bool
+	ClientNoContextTakeover bool
+
+	// the window bits, 8 to 15, asked of the compressor of the peer, it
+	// bounds the window of the messages read kept for the context takeover,
+	// 15 if it's zero. A server uses ClientMaxWindowBits for the clients
+	// offering client_max_window_bits, a client offers ServerMaxWindowBits
+	ClientMaxWindowBits int
+	ServerMaxWindowBits int
+}
+
+// CompressionPolicy chooses the messages sent compressed by
+// PerMessageDeflate, the others are sent as is.
+type CompressionPolicy struct {
+	// the messages of a single frame shorter than it are not compressed,
+	// the overhead outweighs the gain for them. The fragmented messages are
+	// always compressed
+	Threshold int
+
+	// the text or the binary messages are never compressed, such as the
+	// binary ones already compressed by the app
+	SkipText   bool
+	SkipBinary bool
+}
+
+// compresses tells if the message starting with f is compressed.
+func (p *CompressionPolicy) compresses(f *Frame) bool {
+	switch {
+	case f.Opcode == OpcodeText && p.SkipText, f.Opcode == OpcodeBinary && p.SkipBinary:
+		return false
+	case f.FIN == 1 && len(f.PayloadData) < p.Threshold:
+		return false
+	}
+	return true
+}
+
+// SetCompression overrides PerMessageDeflate.Policy for the conns opened
+// on pattern.
+func (rt *routes) SetCompression(pattern string, policy CompressionPolicy) {
+	if rt.routeCompression == nil {
+		rt.routeCompression = make(map[string]CompressionPolicy)
+	}
+
+	rt.routeCompression[pattern] = policy
+
+	if pattern[len(pattern)-1] != '/' {
+		rt.routeCompression[pattern+"/"] = policy
+	}
+}
+
+func (pmd *PerMessageDeflate) Name() string {
+	return "permessage-deflate"
+}
+
+func (pmd *PerMessageDeflate) RSV() uint8 {
+	return ExtensionRSV1
+}
+
+func (pmd *PerMessageDeflate) Accept(offer ExtensionParams) (ExtensionParams, ExtensionConn, bool) {
+	resp := make(ExtensionParams)
+	window := 15
+	for k, v := range offer {
+		switch k {
+		case "server_no_context_takeover", "client_no_context_takeover":
+			if v != "" {
+				return nil, nil, false
+			}
+			resp[k] = ""
+		case "server_max_window_bits":
+			if !validWindowBits(v) {
+				return nil, nil, false
+			}
+			resp[k] = v
+		case "client_max_window_bits":
+			if v != "" && !validWindowBits(v) {
+				return nil, nil, false
+			}
+			if v != "" {
+				window, _ = strconv.Atoi(v)
+			}
+			if bits := pmd.ClientMaxWindowBits; bits != 0 && bits < window {
+				window = bits
+				resp[k] = strconv.Itoa(bits)
+			}
+		default:
+			return nil, nil, false
+		}
+	}
+	if pmd.ServerNoContextTakeover {
+		resp["server_no_context_takeover"] = ""
+	}
+	if pmd.ClientNoContextTakeover {
+		resp["client_no_context_takeover"] = ""
+	}
+
+	_, noCompressTakeover := resp["server_no_context_takeover"]
+	_, noDecompressTakeover := resp["client_no_context_takeover"]
+	dc := pmd.newConn(noCompressTakeover, noDecompressTakeover, window)
+	if v, ok := resp["server_max_window_bits"]; ok && v != "15" {
+		dc.level = flate.HuffmanOnly
+	}
+	return resp, dc, true
+}
+
+func (pmd *PerMessageDeflate) Offer() ExtensionParams {
+	offer := ExtensionParams{"client_max_window_bits": ""}
+	if pmd.ServerNoContextTakeover {
+		offer["server_no_context_takeover"] = ""
+	}
+	if pmd.ClientNoContextTakeover {
+		offer["client_no_context_takeover"] = ""
+	}
+	if pmd.ServerMaxWindowBits != 0 {
+		offer["server_max_window_bits"] = strconv.Itoa(pmd.ServerMaxWindowBits)
+	}
+	return offer
+}
+
+func (pmd *PerMessageDeflate) Accepted(resp ExtensionParams) (ExtensionConn, error) {
+	window := 15
+	for k, v := range resp {
+		switch k {
+		case "server_no_context_takeover", "client_no_context_takeover":
+		case "server_max_window_bits":
+			if !validWindowBits(v) {
+				return nil, errors.New("invalid server_max_window_bits: " + v)
+			}
+			window, _ = strconv.Atoi(v)
+		case "client_max_window_bits":
+			if !validWindowBits(v) {
+				return nil, errors.New("invalid client_max_window_bits: " + v)
+			}
+		default:
+			return nil, errors.New("unknown parameter: " + k)
+		}
+	}
+
+	// the ones offered must be in the response
+	if _, ok := resp["server_no_context_takeover"]; pmd.ServerNoContextTakeover && !ok {
+		return nil, errors.New("server_no_context_takeover not accepted")
+	}
+	if bits := pmd.ServerMaxWindowBits; bits != 0 && window > bits {
+		return nil, errors.New("server_max_window_bits not accepted")
+	}
+
+	_, noCompressTakeover := resp["client_no_context_takeover"]
+	_, noDecompressTakeover := resp["server_no_context_takeover"]
+	dc := pmd.newConn(noCompressTakeover || pmd.ClientNoContextTakeover, noDecompressTakeover, window)
+	if v, ok := resp["client_max_window_bits"]; ok && v != "15" {
+		dc.level = flate.HuffmanOnly
+	}
+	return dc, nil
+}
+
+func validWindowBits(v string) bool {
+	n, err := strconv.Atoi(v)
+	return err == nil && n >= 8 && n <= 15
+}
+
+func (pmd *PerMessageDeflate) newConn(noCompressTakeover, noDecompressTakeover bool, windowBits int) *deflateConn {
+	level := pmd.Level
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+	return &deflateConn{
+		level:                level,
+		policy:               pmd.Policy,
+		noCompressTakeover:   noCompressTakeover,
+		noDecompressTakeover: noDecompressTakeover,
+		window:               1 << windowBits,
+	}
+}
+
+// the compressors of the conns without the context takeover, by the level
+// from flate.HuffmanOnly
+var flateWriterPools [flate.BestCompression - flate.HuffmanOnly + 1]sync.Pool
+
+func getFlateWriter(w io.Writer, level int) (*flate.Writer, error) {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return flate.NewWriter(w, level)
+	}
+	if fw, ok := flateWriterPools[level-flate.HuffmanOnly].Get().(*flate.Writer); ok {
+		fw.Reset(w)
+		return fw, nil
+	}
+	return flate.NewWriter(w, level)
+}
+
+var errCompressedContinuation = errors.New("RSV1 set on a continuation frame")
+
+type deflateConn struct {
+	level                int
+	noCompressTakeover   bool
+	noDecompressTakeover bool
+	// of the messages read kept for the context takeover
+	window int
+
+	policy CompressionPolicy
+	// the message being sent is not compressed
+	skipping bool
+
+	// the writer and its output are created by the first message sent, the
+	// writer is pooled between the messages without the context takeover
+	fw  *flate.Writer
+	out bytes.Buffer
+
+	// the compressed frames of the message being read
+	in        bytes.Buffer
+	inflating bool
+	fr        io.ReadCloser
+	// the last window of the messages read, for the context takeover
+	dict []byte
+}
+
+func (d *deflateConn) EncodeFrame(f *Frame) error {
+	if f.Opcode != OpcodeContinue {
+		d.skipping = !d.policy.compresses(f)
+		if d.skipping {
+			return nil
+		}
+		f.RSV1 = 1
+	} else if d.skipping {
+		return nil
+	}
+
+	d.out.Reset()
+	if d.fw == nil {
+		fw, err := getFlateWriter(&d.out, d.level)
+		if err != nil {
+			return err
+		}
+		d.fw = fw
+	}
+
+	if _, err := d.fw.Write(f.PayloadData); err != nil {
+		return err
+	}
+	if err := d.fw.Flush(); err != nil {
+		return err
+	}
+
+	b := d.out.Bytes()
+	if f.FIN == 1 {
+		// the flush ends with the first block of the tail
+		b = b[:len(b)-4]
+		if len(b) == 0 {
+			b = append(b, 0x00)
+		}
+		if d.noCompressTakeover {
+			flateWriterPools[d.level-flate.HuffmanOnly].Put(d.fw)
+			d.fw = nil
+		}
+	}
+	f.PayloadData = b
+	return nil
+}
+
+func (d *deflateConn) DecodeFrame(f *Frame, maxLen uint64) error {
+	if f.Opcode == OpcodeContinue {
+		if f.RSV1 == 1 {
+			return errCompressedContinuation
+		}
+	} else {
+		d.inflating = f.RSV1 == 1
+		f.RSV1 = 0
+	}
+	if !d.inflating {
+		return nil
+	}
+
+	d.in.Write(f.PayloadData)
+	if f.FIN == 0 {
+		f.PayloadData = nil
+		return nil
+	}
+	d.in.Write(deflateTail)
+	defer d.in.Reset()
+
+	if d.fr == nil {
+		d.fr = flate.NewReaderDict(&d.in, d.dict)
+	} else if err := d.fr.(flate.Resetter).Reset(&d.in, d.dict); err != nil {
+		return err
+	}
+
+	buf := DefaultBufferPool.Get(1 << minBufferClassBits)
+	n := 0
+	for {
+		if n == len(buf) {
+			grown := DefaultBufferPool.Get(2 * len(buf))
+			copy(grown, buf)
+			DefaultBufferPool.Put(buf)
+			buf = grown
+		}
+
+		m, err := d.fr.Read(buf[n:])
+		n += m
+		if uint64(n) > maxLen {
+			DefaultBufferPool.Put(buf)
+			return &SizeError{ErrMessageTooLarge, uint64(n), maxLen}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			DefaultBufferPool.Put(buf)
+			return err
+		}
+	}
+	f.PayloadData = buf[:n]
+
+	if !d.noDecompressTakeover {
+		d.dict = append(d.dict, f.PayloadData...)
+		if len(d.dict) > d.window {
+			d.dict = append(d.dict[:0], d.dict[len(d.dict)-d.window:]...)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package kiwi
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// SizeError is returned if a frame or a message is over its limit, it
+// matches ErrFrameTooLarge or ErrMessageTooLarge by errors.Is.
+type SizeError struct {
+	// ErrFrameTooLarge or ErrMessageTooLarge
+	Kind error
+
+	// the size seen and the limit it's over
+	Size  uint64
+	Limit uint64
+}
+
+func (e *SizeError) Error() string {
+	return e.Kind.Error() + ": " + strconv.FormatUint(e.Size, 10) + " bytes over the limit of " +
+		strconv.FormatUint(e.Limit, 10)
+}
+
+func (e *SizeError) Unwrap() error {
+	return e.Kind
+}
+
+// FrameReadError is returned if reading a part of a frame fails on the
+// underlying reader. It matches the ErrDeformed error of the part by
+// errors.Is, but it's not a ProtocolError and unwraps to the error of the
+// reader, e.g. io.EOF or a timeout.
+type FrameReadError struct {
+	Part error
+	Err  error
+}
+
+func (e *FrameReadError) Error() string {
+	return e.Part.Error() + ": " + e.Err.Error()
+}
+
+func (e *FrameReadError) Unwrap() error {
+	return e.Err
+}
+
+func (e *FrameReadError) Is(target error) bool {
+	return target == e.Part
+}
+
+// IsTimeout reports whether err is caused by a deadline of the conn.
+func IsTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// IsPeerClosed reports whether err is caused by the peer closing the conn,
+// by a close frame or by closing or resetting the underlying conn.
+func IsPeerClosed(err error) bool {
+	var ce *CloseError
+	return errors.As(err, &ce) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.ErrClosedPipe) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE)
+}
+
+// IsProtocolError reports whether err is a violation of the protocol by the
+// peer.
+func IsProtocolError(err error) bool {
+	var pe *ProtocolError
+	return errors.As(err, &pe)
+}
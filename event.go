@@ -0,0 +1,88 @@
+package kiwi
+
+import (
+	"net"
+	"time"
+)
+
+type EventType int
+
+const (
+	EventConnAccepted EventType = iota
+	EventHandshakeFailed
+	EventConnOpened
+	EventMessageRead
+	EventConnClosed
+)
+
+var eventTypeText = map[EventType]string{
+	EventConnAccepted:    "conn_accepted",
+	EventHandshakeFailed: "handshake_failed",
+	EventConnOpened:      "conn_opened",
+	EventMessageRead:     "message_read",
+	EventConnClosed:      "conn_closed",
+}
+
+func (t EventType) String() string {
+	return eventTypeText[t]
+}
+
+// Event describes something that happened to a conn, the fields not
+// relevant to the type are left zero.
+type Event struct {
+	Type       EventType
+	Time       time.Time
+	ConnID     uint64
+	RemoteAddr net.Addr
+	Path       string
+
+	// the error the handshake failed with
+	Err error
+
+	// the opcode and data length of the message read
+	Opcode  uint8
+	DataLen int
+
+	// the close code sent or received, CloseCodeAbnormalClosure if the conn
+	// was closed without one, and its outcome
+	CloseCode uint16
+	Outcome   Outcome
+}
+
+// EventSink receives the events of a server, HandleEvent is called on the
+// goroutine of the conn so it should not block.
+type EventSink interface {
+	HandleEvent(e *Event)
+}
+
+type EventSinkFunc func(e *Event)
+
+func (f EventSinkFunc) HandleEvent(e *Event) {
+	f(e)
+}
+
+// EventChan is an EventSink delivering the events on a channel, the events
+// are dropped if the channel is not ready to receive them.
+type EventChan chan<- *Event
+
+func (ch EventChan) HandleEvent(e *Event) {
+	select {
+	case ch <- e:
+	default:
+	}
+}
+
+func (c *Conn) emit(e *Event) {
+	sink := c.Server.Events
+	if sink == nil {
+		return
+	}
+
+	e.Time = time.Now()
+	e.ConnID = c.ID
+	e.RemoteAddr = c.rwc.RemoteAddr()
+	if c.HandshakeRequest != nil && c.HandshakeRequest.RequestURL != nil {
+		e.Path = c.HandshakeRequest.RequestURL.Path
+	}
+	sink.HandleEvent(e)
+}
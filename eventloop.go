@@ -0,0 +1,156 @@
+package kiwi
+
+import (
+	"bufio"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// the read buffer of a parked conn, the smallest of bufio
+const idleReadBufferSize = 16
+
+// pollConn is a conn of the event loop mode, it has no goroutine while it's
+// parked in the poller and its read buffer is given back to the pool, see
+// Server.EventLoop.
+type pollConn struct {
+	p  *pump
+	fd int
+
+	// swapped in as the read buffer while parked
+	idle *bufio.Reader
+
+	mu       sync.Mutex
+	parked   bool
+	detached bool
+}
+
+func (srv *Server) getPoller() (*poller, error) {
+	srv.pollerOnce.Do(func() {
+		if srv.poller, srv.pollerErr = newPoller(); srv.pollerErr != nil {
+			srv.logf("[EventLoop] %s, the conns are served by their goroutines\n", srv.pollerErr.Error())
+		}
+	})
+	if srv.poller == nil && srv.pollerErr == nil {
+		// closed before the first conn
+		return nil, ErrServerClosed
+	}
+	return srv.poller, srv.pollerErr
+}
+
+// closePoller stops the poller, no poller is started after it.
+func (srv *Server) closePoller() {
+	srv.pollerOnce.Do(func() {})
+	if srv.poller != nil {
+		srv.poller.close()
+	}
+}
+
+// pollConn runs the pump of p by the poller of the server, it reports false
+// if the conn can't be polled, e.g. over tls, so it's run by the goroutine
+// of the conn.
+func (srv *Server) pollConn(p *pump) bool {
+	sc, ok := p.c.rwc.(syscall.Conn)
+	if !ok {
+		return false
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return false
+	}
+	if _, err := srv.getPoller(); err != nil {
+		return false
+	}
+
+	pc := &pollConn{p: p, idle: bufio.NewReaderSize(p.c.rwc, idleReadBufferSize)}
+	raw.Control(func(fd uintptr) {
+		pc.fd = int(fd)
+	})
+
+	// the pump holds the buffers until it ends, see releaseBuf
+	atomic.AddInt32(&p.c.bufRefs, 1)
+	p.c.poll.Store(pc)
+
+	pc.run()
+	return true
+}
+
+// run handles the messages buffered or readable without blocking, then
+// parks the conn.
+func (pc *pollConn) run() {
+	for {
+		if pc.p.step() {
+			pc.end()
+			return
+		}
+		if pc.p.c.Buf.Reader.Buffered() == 0 {
+			break
+		}
+	}
+	pc.park()
+}
+
+func (pc *pollConn) park() {
+	c := pc.p.c
+
+	pc.mu.Lock()
+	if pc.detached {
+		pc.mu.Unlock()
+		pc.end()
+		return
+	}
+
+	rs, _ := c.Server.connBufferSizes()
+	putConnReader(c.Buf.Reader, rs)
+	c.Buf.Reader = pc.idle
+	pc.parked = true
+
+	err := c.Server.poller.arm(pc)
+	pc.mu.Unlock()
+
+	if err != nil {
+		c.Server.logf("[EventLoop] %s\n", err.Error())
+		c.Close()
+	}
+}
+
+// wake is called by the poller once the parked conn is readable.
+func (pc *pollConn) wake() {
+	c := pc.p.c
+
+	pc.mu.Lock()
+	if pc.detached || !pc.parked {
+		pc.mu.Unlock()
+		return
+	}
+	pc.parked = false
+
+	rs, _ := c.Server.connBufferSizes()
+	c.Buf.Reader = getConnReader(c.rwc, rs)
+	pc.mu.Unlock()
+
+	pc.run()
+}
+
+// detach removes the conn from the poller before it's closed, the pump of
+// a parked conn is ended since it won't be woken up.
+func (pc *pollConn) detach() {
+	pc.mu.Lock()
+	if pc.detached {
+		pc.mu.Unlock()
+		return
+	}
+	pc.detached = true
+	parked := pc.parked
+	pc.p.c.Server.poller.remove(pc)
+	pc.mu.Unlock()
+
+	if parked {
+		go pc.end()
+	}
+}
+
+func (pc *pollConn) end() {
+	pc.p.finish()
+	pc.p.c.releaseBuf()
+}
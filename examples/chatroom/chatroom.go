@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mconintet/kiwi"
+)
+
+const chatPath = "/chat"
+
+// chatMsg is the JSON message exchanged with the clients. The clients send
+// "join", "leave" and "say", the server sends "say" for the chat lines of
+// the rooms joined and "presence" once the members of a room change.
+type chatMsg struct {
+	Type  string    `json:"type"`
+	Room  string    `json:"room,omitempty"`
+	User  string    `json:"user,omitempty"`
+	Text  string    `json:"text,omitempty"`
+	Users []string  `json:"users,omitempty"`
+	Time  time.Time `json:"time,omitzero"`
+}
+
+var errUnauthorized = &kiwi.ProtocolError{ErrorString: "unauthorized"}
+
+// chatroom serves the chat rooms as topics of a kiwi.Hub, the history of
+// each room is replayed to its new members. The user names are the hub
+// member keys, so a user reconnecting after a restart is resumed into the
+// rooms restored from the snapshot.
+type chatroom struct {
+	hub   *kiwi.Hub
+	token string
+
+	mu sync.Mutex
+	// user name of each conn, set by the handshake
+	users map[uint64]string
+}
+
+func newChatroom(hub *kiwi.Hub, token string) *chatroom {
+	cr := &chatroom{
+		hub:   hub,
+		token: token,
+		users: make(map[uint64]string),
+	}
+	hub.OnJoin = func(room, user string) { cr.announce(room) }
+	hub.OnLeave = func(room, user string) { cr.announce(room) }
+	return cr
+}
+
+func (cr *chatroom) register(srv *kiwi.Server) {
+	srv.OnHandshakeRequestFunc(chatPath, cr.authenticate)
+	srv.OnConnOpenFunc(chatPath, cr.serve)
+}
+
+// authenticate requires the token and a user name in the query of the
+// handshake request, like /chat?token=secret&user=alice.
+func (cr *chatroom) authenticate(hsReq *kiwi.HandshakeRequest, conn *kiwi.Conn) (errCode int, err error) {
+	q := hsReq.RequestURL.Query()
+
+	user := q.Get("user")
+	if q.Get("token") != cr.token || user == "" {
+		return http.StatusUnauthorized, errUnauthorized
+	}
+
+	if errCode, err = kiwi.DefaultServerHandshakeFunc(hsReq, conn); err != nil {
+		return
+	}
+
+	cr.mu.Lock()
+	cr.users[conn.ID] = user
+	cr.mu.Unlock()
+	return
+}
+
+func (cr *chatroom) serve(r kiwi.MessageReceiver, s kiwi.MessageSender) {
+	conn := s.GetConn()
+
+	cr.mu.Lock()
+	user := cr.users[conn.ID]
+	cr.mu.Unlock()
+
+	defer cr.leaveAll(s)
+
+	for _, room := range cr.hub.Resume(user, s) {
+		cr.replay(room, s)
+	}
+
+	for msg := range kiwi.Incoming[chatMsg](r, kiwi.JSONCodec{}, 0) {
+		if msg.Room == "" {
+			continue
+		}
+
+		switch msg.Type {
+		case "join":
+			cr.replay(msg.Room, s)
+			cr.hub.Join(msg.Room, user, s)
+		case "leave":
+			cr.hub.Leave(msg.Room, s)
+		case "say":
+			cr.publish(&chatMsg{Type: "say", Room: msg.Room, User: user, Text: msg.Text, Time: time.Now()})
+		}
+	}
+}
+
+// replay sends the history of room to s.
+func (cr *chatroom) replay(room string, s kiwi.MessageSender) {
+	for _, msg := range cr.hub.History(room) {
+		s.SendWhole(msg, false)
+	}
+}
+
+// leaveAll removes s from its rooms, the presence is announced by the
+// OnLeave of the hub.
+func (cr *chatroom) leaveAll(s kiwi.MessageSender) {
+	cr.hub.LeaveAll(s)
+
+	cr.mu.Lock()
+	delete(cr.users, s.GetConn().ID)
+	cr.mu.Unlock()
+}
+
+// announce sends the present users of room to its members, the presence is
+// not kept in the room history.
+func (cr *chatroom) announce(room string) {
+	cr.hub.Notify(room, marshal(&chatMsg{Type: "presence", Room: room, Users: cr.hub.Members(room)}))
+}
+
+func (cr *chatroom) publish(m *chatMsg) {
+	cr.hub.Publish(m.Room, marshal(m))
+}
+
+func marshal(m *chatMsg) *kiwi.Message {
+	data, _ := json.Marshal(m)
+	return &kiwi.Message{Opcode: kiwi.OpcodeText, Data: data}
+}
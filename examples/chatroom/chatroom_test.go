@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mconintet/kiwi"
+)
+
+type testClient struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func dialChat(t *testing.T, addr, query string) (*testClient, int) {
+	cn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	io.WriteString(cn, "GET "+chatPath+"?"+query+" HTTP/1.1\r\nHost: localhost\r\n"+
+		"Connection: Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: M/A=\r\n\r\n")
+
+	br := bufio.NewReader(cn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testClient{cn, br}, resp.StatusCode
+}
+
+func (c *testClient) send(t *testing.T, m *chatMsg) {
+	data, _ := json.Marshal(m)
+	f := &kiwi.Frame{FIN: 1, Opcode: kiwi.OpcodeText, PayloadData: data}
+	if _, err := f.WriteTo(c, true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (c *testClient) frame(t *testing.T) *kiwi.Frame {
+	f := &kiwi.Frame{}
+	if err := f.FromBufReader(c.br, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func (c *testClient) expect(t *testing.T, want *chatMsg) {
+	got := &chatMsg{}
+	if err := json.Unmarshal(c.frame(t).PayloadData, got); err != nil {
+		t.Fatal(err)
+	}
+	got.Time = time.Time{}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v; want %+v", got, want)
+	}
+}
+
+func TestChatroom(t *testing.T) {
+	hub := kiwi.NewHub()
+
+	srv := kiwi.NewServer()
+	srv.ApplyDefaultCfg()
+	newChatroom(hub, "secret").register(srv)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	addr := ln.Addr().String()
+
+	if c, code := dialChat(t, addr, "token=wrong&user=eve"); code != http.StatusUnauthorized {
+		t.Fatalf("got status %d; want 401", code)
+	} else {
+		c.Close()
+	}
+
+	alice, _ := dialChat(t, addr, "token=secret&user=alice")
+	defer alice.Close()
+
+	alice.send(t, &chatMsg{Type: "join", Room: "lobby"})
+	alice.expect(t, &chatMsg{Type: "presence", Room: "lobby", Users: []string{"alice"}})
+
+	alice.send(t, &chatMsg{Type: "say", Room: "lobby", Text: "hi"})
+	said := &chatMsg{Type: "say", Room: "lobby", User: "alice", Text: "hi"}
+	alice.expect(t, said)
+
+	bob, _ := dialChat(t, addr, "token=secret&user=bob")
+	defer bob.Close()
+
+	// the history is replayed before the presence
+	bob.send(t, &chatMsg{Type: "join", Room: "lobby"})
+	bob.expect(t, said)
+	both := &chatMsg{Type: "presence", Room: "lobby", Users: []string{"alice", "bob"}}
+	bob.expect(t, both)
+	alice.expect(t, both)
+
+	// the rooms are kept across restarts by the snapshot
+	restored := kiwi.NewHub()
+	restored.Restore(hub.Snapshot())
+	if ts := restored.Snapshot().Topics["lobby"]; ts == nil || !reflect.DeepEqual(ts.Members, []string{"alice", "bob"}) {
+		t.Fatalf("unexpected restored lobby: %+v", ts)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go srv.Shutdown(ctx)
+
+	for _, c := range []*testClient{alice, bob} {
+		// skip the presence updates sent while the others are leaving
+		f := c.frame(t)
+		for f.Opcode != kiwi.OpcodeClose {
+			f = c.frame(t)
+		}
+		if code, _ := kiwi.ParseCloseCode(f.PayloadData); code != kiwi.CloseCodeGoingAway {
+			t.Fatalf("got close code %d; want %d", code, kiwi.CloseCodeGoingAway)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+// Command chatroom is a reference chat server built on kiwi. It serves chat
+// rooms over websocket with presence, history replay and token based auth,
+// and keeps the rooms across restarts in a snapshot file:
+//
+//	chatroom -addr :9876 -token secret -data chatroom.json
+//
+// Clients connect to /chat?token=secret&user=alice and send JSON messages
+// like {"type":"join","room":"lobby"} and {"type":"say","room":"lobby","text":"hi"}.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/mconintet/kiwi"
+)
+
+func main() {
+	addr := flag.String("addr", ":9876", "address to listen on")
+	token := flag.String("token", "", "token required from the clients")
+	data := flag.String("data", "chatroom.json", "snapshot file of the rooms")
+	flag.Parse()
+
+	hub := kiwi.NewHub()
+	if err := loadSnapshot(hub, *data); err != nil {
+		log.Fatal(err)
+	}
+
+	srv := kiwi.NewServer()
+	srv.FallbackHandler = srv.StatusHandler(nil)
+	newChatroom(hub, *token).register(srv)
+
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Serve(ln)
+	}()
+	log.Printf("[Chatroom] listening on %s\n", ln.Addr())
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+
+	select {
+	case <-sig:
+	case err := <-done:
+		log.Fatal(err)
+	}
+
+	// take the snapshot before the members leave the rooms by the shutdown
+	snap := hub.Snapshot()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("[Chatroom] shutdown: %s\n", err.Error())
+	}
+
+	if err := saveSnapshot(snap, *data); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func loadSnapshot(hub *kiwi.Hub, name string) error {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	snap := &kiwi.HubSnapshot{}
+	if err := json.NewDecoder(f).Decode(snap); err != nil {
+		return err
+	}
+	hub.Restore(snap)
+	return nil
+}
+
+func saveSnapshot(snap *kiwi.HubSnapshot, name string) error {
+	tmp := name + ".tmp"
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(snap); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
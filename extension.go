@@ -0,0 +1,432 @@
+package kiwi
+
+import (
+	"errors"
+	"slices"
+	"strings"
+)
+
+// the reserved bits of the frames claimed by an Extension
+const (
+	ExtensionRSV1 uint8 = 1 << 2
+	ExtensionRSV2 uint8 = 1 << 1
+	ExtensionRSV3 uint8 = 1
+)
+
+// ExtensionParams are the parameters of an extension in the
+// Sec-WebSocket-Extensions header, the ones without a value map to "".
+type ExtensionParams map[string]string
+
+// Extension is negotiated by the Sec-WebSocket-Extensions header of the
+// handshake, see Server.Extensions and Dialer.Extensions. The negotiated
+// ones encode the data frames sent in the order of the response and decode
+// the ones read in the reverse order, the reserved bits they claim are
+// allowed by the strict mode.
+type Extension interface {
+	// the token of the extension in the header, like permessage-deflate
+	Name() string
+
+	// the reserved bits used by the extension, an offer is declined if
+	// they're claimed by an extension accepted before
+	RSV() uint8
+
+	// called by the server with the params of each offer of the client in
+	// order, it returns the params of the response and the extension of the
+	// conn, ok is false for declining the offer
+	Accept(offer ExtensionParams) (resp ExtensionParams, ec ExtensionConn, ok bool)
+
+	// the params offered by the client
+	Offer() ExtensionParams
+
+	// called by the client with the params of the response, an error fails
+	// the handshake
+	Accepted(resp ExtensionParams) (ExtensionConn, error)
+}
+
+// ExtensionConn is an extension negotiated on a conn. It's called with the
+// data frames sent by the senders and read by ReadWhole, the frames read by
+// ReadFrame are not decoded.
+type ExtensionConn interface {
+	// encodes the payload of a frame being sent and sets its reserved bits,
+	// the new payload must stay valid until the next call
+	EncodeFrame(f *Frame) error
+
+	// decodes the payload of a frame read and clears its reserved bits, the
+	// decoded message must be no more than maxLen. The new payload is owned
+	// by the conn, it and the replaced one are given back to
+	// DefaultBufferPool
+	DecodeFrame(f *Frame, maxLen uint64) error
+}
+
+// ExtensionError is returned by the reads of a message failing to be
+// decoded by an extension, the conn has been closed with
+// CloseCodeProtocolError, or CloseCodeMessageTooBig for a SizeError.
+type ExtensionError struct {
+	Name string
+	Err  error
+}
+
+func (e *ExtensionError) Error() string {
+	return "extension " + e.Name + ": " + e.Err.Error()
+}
+
+func (e *ExtensionError) Unwrap() error {
+	return e.Err
+}
+
+// NegotiatedExtension is an extension agreed by the handshake of a conn,
+// with the params of the response.
+type NegotiatedExtension struct {
+	Name   string
+	Params ExtensionParams
+
+	ec ExtensionConn
+}
+
+// Extensions returns the extensions negotiated by the handshake in the order
+// of the response, the params must not be modified.
+func (c *Conn) Extensions() []NegotiatedExtension {
+	return slices.Clone(c.extensions)
+}
+
+// Extension returns the negotiated extension named name, like
+// permessage-deflate.
+func (c *Conn) Extension(name string) (NegotiatedExtension, bool) {
+	i := slices.IndexFunc(c.extensions, func(ne NegotiatedExtension) bool {
+		return ne.Name == name
+	})
+	if i < 0 {
+		return NegotiatedExtension{}, false
+	}
+	return c.extensions[i], true
+}
+
+// extensionsValue formats the negotiated extensions like the response
+// header, for the logs.
+func (c *Conn) extensionsValue() string {
+	offers := make([]ExtensionOffer, len(c.extensions))
+	for i, ne := range c.extensions {
+		offers[i] = ExtensionOffer{ne.Name, ne.Params}
+	}
+	return FormatExtensions(offers)
+}
+
+// ExtensionOffer is an extension listed in the Sec-WebSocket-Extensions
+// header, by the offers of a client or the response of a server.
+type ExtensionOffer struct {
+	Name   string
+	Params ExtensionParams
+}
+
+// String formats o like FormatExtensions.
+func (o ExtensionOffer) String() string {
+	return formatExtension(o.Name, o.Params)
+}
+
+// ParseExtensions parses the values of the Sec-WebSocket-Extensions headers
+// in order, the quoted values of the params are unquoted. An error is
+// returned for a malformed value.
+func ParseExtensions(values ...string) ([]ExtensionOffer, error) {
+	var offers []ExtensionOffer
+	for _, v := range values {
+		p := extensionParser{s: v}
+		for {
+			p.skipSpace()
+			if p.eof() {
+				break
+			}
+			if p.s[p.i] == ',' {
+				// the empty elements of the list are allowed
+				p.i++
+				continue
+			}
+
+			offer, err := p.offer()
+			if err != nil {
+				return nil, err
+			}
+			offers = append(offers, offer)
+
+			p.skipSpace()
+			if p.eof() {
+				break
+			}
+			if p.s[p.i] != ',' {
+				return nil, p.errorf("expecting a comma")
+			}
+			p.i++
+		}
+	}
+	return offers, nil
+}
+
+// FormatExtensions formats offers as the value of Sec-WebSocket-Extensions,
+// the params are sorted and the values which are not tokens are quoted.
+func FormatExtensions(offers []ExtensionOffer) string {
+	s := make([]string, len(offers))
+	for i, o := range offers {
+		s[i] = o.String()
+	}
+	return strings.Join(s, ", ")
+}
+
+// ExtensionOffers parses the Sec-WebSocket-Extensions headers of hsReq.
+func (hsReq *HandshakeRequest) ExtensionOffers() ([]ExtensionOffer, error) {
+	return ParseExtensions(hsReq.Header.Get("Sec-WebSocket-Extensions")...)
+}
+
+type extensionParser struct {
+	s string
+	i int
+}
+
+func (p *extensionParser) eof() bool {
+	return p.i >= len(p.s)
+}
+
+func (p *extensionParser) errorf(msg string) error {
+	return errors.New("malformed extensions: " + msg + ": " + p.s)
+}
+
+func (p *extensionParser) skipSpace() {
+	for !p.eof() && (p.s[p.i] == ' ' || p.s[p.i] == '\t') {
+		p.i++
+	}
+}
+
+func (p *extensionParser) token() string {
+	start := p.i
+	for !p.eof() && isTokenChar(p.s[p.i]) {
+		p.i++
+	}
+	return p.s[start:p.i]
+}
+
+func (p *extensionParser) offer() (ExtensionOffer, error) {
+	name := p.token()
+	if name == "" {
+		return ExtensionOffer{}, p.errorf("expecting an extension name")
+	}
+
+	params := make(ExtensionParams)
+	for {
+		p.skipSpace()
+		if p.eof() || p.s[p.i] != ';' {
+			return ExtensionOffer{name, params}, nil
+		}
+		p.i++
+		p.skipSpace()
+
+		k := p.token()
+		if k == "" {
+			return ExtensionOffer{}, p.errorf("expecting a param name")
+		}
+		p.skipSpace()
+		if p.eof() || p.s[p.i] != '=' {
+			params[k] = ""
+			continue
+		}
+		p.i++
+		p.skipSpace()
+
+		v, err := p.value()
+		if err != nil {
+			return ExtensionOffer{}, err
+		}
+		params[k] = v
+	}
+}
+
+// value reads a token or a quoted string.
+func (p *extensionParser) value() (string, error) {
+	if p.eof() || p.s[p.i] != '"' {
+		v := p.token()
+		if v == "" {
+			return "", p.errorf("expecting a param value")
+		}
+		return v, nil
+	}
+
+	var b strings.Builder
+	for p.i++; !p.eof(); p.i++ {
+		switch c := p.s[p.i]; c {
+		case '"':
+			p.i++
+			return b.String(), nil
+		case '\\':
+			p.i++
+			if p.eof() {
+				return "", p.errorf("unterminated quoted string")
+			}
+			b.WriteByte(p.s[p.i])
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", p.errorf("unterminated quoted string")
+}
+
+// isTokenChar tells if c is a tchar of RFC 7230.
+func isTokenChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isTokenChar(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+var quoteReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+func formatExtension(name string, params ExtensionParams) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	var b strings.Builder
+	b.WriteString(name)
+	for _, k := range keys {
+		b.WriteString("; " + k)
+		v := params[k]
+		switch {
+		case v == "":
+		case isToken(v):
+			b.WriteString("=" + v)
+		default:
+			b.WriteString(`="` + quoteReplacer.Replace(v) + `"`)
+		}
+	}
+	return b.String()
+}
+
+func (c *Conn) addExtension(ext Extension, params ExtensionParams, ec ExtensionConn) {
+	c.extensions = append(c.extensions, NegotiatedExtension{ext.Name(), params, ec})
+	c.extensionRSV |= ext.RSV()
+
+	// the policy of the route of a server conn
+	if d, ok := ec.(*deflateConn); ok && c.HandshakeRequest != nil {
+		if policy, ok := c.routes().routeCompression[c.HandshakeRequest.RequestURL.Path]; ok {
+			d.policy = policy
+		}
+	}
+}
+
+// acceptable tells if ext can be negotiated after the ones of c.
+func (c *Conn) acceptable(ext Extension) bool {
+	if ext.RSV()&c.extensionRSV != 0 {
+		return false
+	}
+	return !slices.ContainsFunc(c.extensions, func(ne NegotiatedExtension) bool {
+		return ne.Name == ext.Name()
+	})
+}
+
+// negotiateExtensions accepts the offers of hsReq by Server.Extensions, it
+// returns the value of the response header, empty if none is accepted.
+func (c *Conn) negotiateExtensions(hsReq *HandshakeRequest) string {
+	if len(c.Server.Extensions) == 0 || !hsReq.Header.HasKey("Sec-WebSocket-Extensions") {
+		return ""
+	}
+
+	// a malformed header declines all the offers
+	offers, err := hsReq.ExtensionOffers()
+	if err != nil {
+		return ""
+	}
+
+	var resp []ExtensionOffer
+	for _, offer := range offers {
+		for _, ext := range c.Server.Extensions {
+			if ext.Name() != offer.Name || !c.acceptable(ext) {
+				continue
+			}
+
+			params, ec, ok := ext.Accept(offer.Params)
+			if !ok {
+				continue
+			}
+			c.addExtension(ext, params, ec)
+			resp = append(resp, ExtensionOffer{offer.Name, params})
+			break
+		}
+	}
+	return FormatExtensions(resp)
+}
+
+// offerExtensions returns the value of the request header offering exts.
+func offerExtensions(exts []Extension) string {
+	offers := make([]ExtensionOffer, len(exts))
+	for i, ext := range exts {
+		offers[i] = ExtensionOffer{ext.Name(), ext.Offer()}
+	}
+	return FormatExtensions(offers)
+}
+
+// acceptExtensions negotiates the extensions of the response values by
+// exts, the ones offered by the client.
+func (c *Conn) acceptExtensions(exts []Extension, values ...string) error {
+	resps, err := ParseExtensions(values...)
+	if err != nil {
+		return &HandshakeError{ErrorString: "invalid extension response", Err: err}
+	}
+	for _, resp := range resps {
+		i := slices.IndexFunc(exts, func(ext Extension) bool {
+			return ext.Name() == resp.Name
+		})
+		if i < 0 || !c.acceptable(exts[i]) {
+			return &HandshakeError{ErrorString: "unexpected extension: " + resp.Name}
+		}
+
+		ec, err := exts[i].Accepted(resp.Params)
+		if err != nil {
+			return &HandshakeError{ErrorString: "invalid extension response: " + resp.Name, Err: err}
+		}
+		c.addExtension(exts[i], resp.Params, ec)
+	}
+	return nil
+}
+
+// encodeFrame encodes f by the negotiated extensions, c.extensionMu is
+// held.
+func (c *Conn) encodeFrame(f *Frame) error {
+	for _, ne := range c.extensions {
+		if err := ne.ec.EncodeFrame(f); err != nil {
+			return &ExtensionError{ne.Name, err}
+		}
+	}
+	return nil
+}
+
+// decodeFrame decodes the data frame f by the negotiated extensions.
+func (c *Conn) decodeFrame(f *Frame, maxLen uint64) error {
+	for _, ne := range slices.Backward(c.extensions) {
+		old := f.PayloadData
+		err := ne.ec.DecodeFrame(f, maxLen)
+		if cap(old) > 0 && (cap(f.PayloadData) == 0 || &old[:1][0] != &f.PayloadData[:1][0]) {
+			DefaultBufferPool.Put(old)
+		}
+		f.PayloadLen = uint64(len(f.PayloadData))
+		if err != nil {
+			return &ExtensionError{ne.Name, err}
+		}
+	}
+	return nil
+}
+
+// rsvBits returns the reserved bits of f like Extension.RSV.
+func (f *Frame) rsvBits() uint8 {
+	return f.RSV1<<2 | f.RSV2<<1 | f.RSV3
+}
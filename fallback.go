@@ -0,0 +1,130 @@
+package kiwi
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+func (c *Conn) serveNonUpgrade() {
+	if c.Server.FallbackHandler == nil {
+		c.RequireUpgrade()
+		return
+	}
+
+	w := newFallbackResponseWriter()
+	c.serveFallback(w)
+	w.writeTo(c.Buf, c.HandshakeRequest.Method == http.MethodHead)
+	c.Buf.Flush()
+	c.Close()
+}
+
+func (c *Conn) serveFallback(w *fallbackResponseWriter) {
+	defer func() {
+		if err := recover(); err != nil {
+			c.Server.logf("[Fallback] panic serving %s: %v\n", c.HandshakeRequest.RequestURI, err)
+
+			w.reset()
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}()
+
+	c.Server.FallbackHandler.ServeHTTP(w, c.HandshakeRequest.toHTTPRequest(c))
+}
+
+func (c *Conn) RequireUpgrade() {
+	resp := &HandshakeResponse{
+		StatusCode: http.StatusUpgradeRequired,
+		Body:       []byte("websocket upgrade required\n"),
+	}
+	resp.AddHeader("Upgrade", "websocket")
+	resp.AddHeader("Connection", "Upgrade, close")
+	resp.AddHeader("Sec-WebSocket-Version", "13")
+
+	c.WriteHandshakeResponse(resp)
+	c.Close()
+}
+
+func (h *HandshakeRequest) toHTTPRequest(c *Conn) *http.Request {
+	proto := h.Proto + "/" + h.ProtoVer
+	major, minor, _ := http.ParseHTTPVersion(proto)
+
+	header := make(http.Header, len(h.Header))
+	for k, vs := range h.Header {
+		for _, v := range vs {
+			header.Add(k, v)
+		}
+	}
+
+	return &http.Request{
+		Method:     h.Method,
+		URL:        h.RequestURL,
+		Proto:      proto,
+		ProtoMajor: major,
+		ProtoMinor: minor,
+		Header:     header,
+		Body:       http.NoBody,
+		Host:       header.Get("Host"),
+		RequestURI: h.RequestURI,
+		RemoteAddr: c.rwc.RemoteAddr().String(),
+	}
+}
+
+type fallbackResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newFallbackResponseWriter() *fallbackResponseWriter {
+	return &fallbackResponseWriter{header: make(http.Header)}
+}
+
+func (w *fallbackResponseWriter) reset() {
+	w.header = make(http.Header)
+	w.status = 0
+	w.body.Reset()
+}
+
+func (w *fallbackResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *fallbackResponseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+}
+
+func (w *fallbackResponseWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(p)
+}
+
+func (w *fallbackResponseWriter) writeTo(out io.Writer, omitBody bool) error {
+	w.WriteHeader(http.StatusOK)
+
+	if w.header.Get("Content-Type") == "" && w.body.Len() > 0 {
+		w.header.Set("Content-Type", http.DetectContentType(w.body.Bytes()))
+	}
+	w.header.Set("Content-Length", strconv.Itoa(w.body.Len()))
+	w.header.Set("Connection", "close")
+
+	if _, err := fmt.Fprintf(out, "HTTP/1.1 %03d %s\r\n", w.status, http.StatusText(w.status)); err != nil {
+		return err
+	}
+	if err := w.header.Write(out); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(out, "\r\n"); err != nil {
+		return err
+	}
+
+	if omitBody {
+		return nil
+	}
+	_, err := out.Write(w.body.Bytes())
+	return err
+}
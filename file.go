@@ -0,0 +1,157 @@
+package kiwi
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+const defaultFileChunkSize = 32 << 10
+
+// SendFileOptions tunes SendFile, the zero value sends as fast as the peer
+// reads.
+type SendFileOptions struct {
+	// paces the sending to this many bytes per second, zero means no pacing
+	Rate int
+
+	// called after each frame with the bytes sent and the size of the file
+	Progress func(sent, total int64)
+}
+
+// SendFile sends the file of path as a binary message fragmented in frames
+// of chunkSize bytes, 32KB if it's zero, opts may be nil. Each frame is
+// flushed before the next one is read from the file, so the sending is held
+// by a peer reading slowly rather than buffered. The other senders wait for
+// the whole file, the conn is closed if it's interrupted by an error since
+// the message can't be finished. See ReceiveFile for the other side.
+func (s *DefaultMessageSender) SendFile(path string, chunkSize int, opts *SendFileOptions) (n int64, err error) {
+	if opts == nil {
+		opts = &SendFileOptions{}
+	}
+	if chunkSize <= 0 {
+		chunkSize = defaultFileChunkSize
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	total := fi.Size()
+
+	s.BeginSendFrame()
+	defer s.EndSendFrame()
+
+	if s.conn.GetState() != StateOpen {
+		return 0, s.conn.notOpenErr()
+	}
+
+	cur, next := DefaultBufferPool.Get(chunkSize), DefaultBufferPool.Get(chunkSize)
+	defer func() {
+		DefaultBufferPool.Put(cur)
+		DefaultBufferPool.Put(next)
+	}()
+
+	// a chunk is read ahead to tell the last frame
+	m, err := io.ReadFull(f, cur)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return 0, err
+	}
+
+	start := s.conn.Server.clock().Now()
+	for begin := true; ; begin = false {
+		k, err := io.ReadFull(f, next)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return n, s.abortMessage(err)
+		}
+		end := k == 0
+
+		sent, err := s.SendFrame(cur[:m], OpcodeBinary, begin, end, false)
+		n += int64(sent)
+		if err == nil {
+			err = s.conn.Flush()
+		}
+		if err != nil {
+			return n, s.abortMessage(err)
+		}
+		if opts.Progress != nil {
+			opts.Progress(n, total)
+		}
+		if end {
+			return n, nil
+		}
+
+		if opts.Rate > 0 {
+			due := start.Add(time.Duration(n) * time.Second / time.Duration(opts.Rate))
+			if err := s.pace(due); err != nil {
+				return n, s.abortMessage(err)
+			}
+		}
+		cur, next, m = next, cur, k
+	}
+}
+
+// pace waits until due, or the conn is closed.
+func (s *DefaultMessageSender) pace(due time.Time) error {
+	clock := s.conn.Server.clock()
+	d := due.Sub(clock.Now())
+	if d <= 0 {
+		return nil
+	}
+
+	t := clock.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C():
+		return nil
+	case <-s.conn.ctx.Done():
+		return s.conn.notOpenErr()
+	}
+}
+
+// ReceiveFile reads the next data message into w frame by frame, like the
+// one sent by SendFile, so a file over the memory of the server can be
+// received. maxLen bounds the message like ReadWhole, progress is called
+// with the bytes received after each frame if it's not nil. The pings and
+// pongs before the message are answered and skipped, a close fails it with
+// the CloseError of the peer, which is left to the caller to reply.
+func (r *DefaultMessageReceiver) ReceiveFile(w io.Writer, maxLen uint64, progress func(received int64)) (n int64, err error) {
+	defer r.mu.Unlock()
+	r.mu.Lock()
+
+	cw := &countWriter{w: w}
+	for {
+		_, ctrl, err := r.readStream(cw, maxLen, progress)
+		if err != nil {
+			r.failOnError(nil, err)
+			return cw.n, err
+		}
+		if ctrl == nil {
+			return cw.n, nil
+		}
+
+		switch {
+		case ctrl.IsPing():
+			r.conn.Send(&Message{Opcode: OpcodePong, Data: ctrl.Data})
+		case ctrl.IsClose():
+			return cw.n, r.conn.notOpenErr()
+		}
+		ctrl.Release()
+	}
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
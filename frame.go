@@ -1,10 +1,17 @@
 package kiwi
 
 import (
+	"crypto/rand"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"math"
-	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
 )
 
 // 0                   1                   2                   3
@@ -49,6 +56,29 @@ type Frame struct {
 	PayloadData []byte
 }
 
+var framePool = sync.Pool{
+	New: func() any {
+		return &Frame{}
+	},
+}
+
+// AcquireFrame returns an empty frame from the frame pool, it should be
+// given back by ReleaseFrame once it's no longer used.
+func AcquireFrame() *Frame {
+	return framePool.Get().(*Frame)
+}
+
+// ReleaseFrame resets f and puts it back to the frame pool, neither f nor
+// its fields should be used after that. The payload is left to the caller.
+func ReleaseFrame(f *Frame) {
+	f.Reset()
+	framePool.Put(f)
+}
+
+func (f *Frame) Reset() {
+	*f = Frame{}
+}
+
 var (
 	ErrDeformedFirstTwoBytes         = &ProtocolError{"deformed first two bytes of frame"}
 	ErrDeformedOpcode                = &ProtocolError{"deformed opcode"}
@@ -64,15 +94,13 @@ func CheckOpcode(code uint8) bool {
 		code == OpcodeBinary ||
 		code == OpcodeClose ||
 		code == OpcodePing ||
-		code == OpcodePing ||
 		code == OpcodePong
 }
 
 func (f *Frame) FromBufReader(r io.Reader, maxPayloadLen uint64) error {
 	byt2 := make([]byte, 2)
-	i, err := r.Read(byt2)
-	if err != nil || i != 2 {
-		return ErrDeformedFirstTwoBytes
+	if _, err := io.ReadFull(r, byt2); err != nil {
+		return &FrameReadError{ErrDeformedFirstTwoBytes, err}
 	}
 
 	f.FIN = byt2[0] >> 7
@@ -91,65 +119,42 @@ func (f *Frame) FromBufReader(r io.Reader, maxPayloadLen uint64) error {
 	if pLen <= 125 {
 		f.PayloadLen = uint64(pLen)
 	} else if pLen == 126 {
-		var (
-			p16  uint16
-			byt2 = make([]byte, 2)
-		)
-
-		i, err := r.Read(byt2)
-		if err != nil || i != 2 {
-			return ErrDeformedExtendedPayloadLength
+		byt2 := make([]byte, 2)
+		if _, err := io.ReadFull(r, byt2); err != nil {
+			return &FrameReadError{ErrDeformedExtendedPayloadLength, err}
 		}
 
-		p16 = (uint16(byt2[0]) << 8) | uint16(byt2[1])
-		f.PayloadLen = uint64(p16)
+		f.PayloadLen = uint64(binary.BigEndian.Uint16(byt2))
 	} else if pLen == 127 {
-		var (
-			p64  uint64
-			byt8 = make([]byte, 8)
-		)
-
-		i, err := r.Read(byt8)
-		if err != nil || i != 8 {
-			return ErrDeformedExtendedPayloadLength
+		byt8 := make([]byte, 8)
+		if _, err := io.ReadFull(r, byt8); err != nil {
+			return &FrameReadError{ErrDeformedExtendedPayloadLength, err}
 		}
 
-		p64 = uint64(byt8[0])<<56 |
-			uint64(byt8[1])<<48 |
-			uint64(byt8[2])<<40 |
-			uint64(byt8[3])<<32 |
-			uint64(byt8[4])<<24 |
-			uint64(byt8[5])<<16 |
-			uint64(byt8[6])<<8 |
-			uint64(byt8[7])
-
-		f.PayloadLen = p64
+		f.PayloadLen = binary.BigEndian.Uint64(byt8)
 	} else {
 		return &ProtocolError{"deformed payload length"}
 	}
 
 	if f.PayloadLen > maxPayloadLen {
-		return ErrFrameTooLarge
+		return &SizeError{ErrFrameTooLarge, f.PayloadLen, maxPayloadLen}
 	}
 
 	var mkb []byte
 	if f.MASK == 1 {
 		mkb = make([]byte, 4)
-		i, err := r.Read(mkb)
-		if err != nil || i != 4 {
-			return ErrDeformedMaskingKey
+		if _, err := io.ReadFull(r, mkb); err != nil {
+			return &FrameReadError{ErrDeformedMaskingKey, err}
 		}
 
-		f.MaskingKey = uint32(mkb[0])<<24 |
-			uint32(mkb[1])<<16 |
-			uint32(mkb[2])<<8 |
-			uint32(mkb[3])
+		f.MaskingKey = MaskingKeyFromBytes(mkb)
 	}
 
 	if pLen > 0 {
-		pld, err := ReadBytesAsMath(r, f.PayloadLen)
-		if err != nil {
-			return ErrDeformedPayloadData
+		pld := DefaultBufferPool.Get(int(f.PayloadLen))
+		if _, err := io.ReadFull(r, pld); err != nil {
+			DefaultBufferPool.Put(pld)
+			return &FrameReadError{ErrDeformedPayloadData, err}
 		}
 
 		if f.MASK == 1 {
@@ -162,93 +167,228 @@ func (f *Frame) FromBufReader(r io.Reader, maxPayloadLen uint64) error {
 	return nil
 }
 
-func (f *Frame) ToBytes(mask bool) (byts []byte, err error) {
-	byts = make([]byte, 2)
-	byts[0] = byte(f.FIN<<7 | f.RSV1<<6 | f.RSV2<<5 | f.RSV3<<4 | f.Opcode)
+// 2 bytes header + 8 bytes extended payload length + 4 bytes masking key
+const maxFrameHeaderLen = 14
 
-	pLength := len(f.PayloadData)
-	pLen := 0
-	var extPLen []byte
+func (f *Frame) encodeHeader(hdr *[maxFrameHeaderLen]byte, maskingKey []byte) int {
+	hdr[0] = byte(f.FIN<<7 | f.RSV1<<6 | f.RSV2<<5 | f.RSV3<<4 | f.Opcode)
+
+	pLength := uint64(len(f.PayloadData))
+	n := 2
 
 	if pLength <= 125 {
-		pLen = pLength
+		hdr[1] = byte(pLength)
 	} else if pLength <= math.MaxUint16 {
-		pLen = 126
-		extPLen = []byte{
-			byte(pLength >> 8),
-			byte(pLength),
-		}
-	} else if uint64(pLength) <= math.MaxUint64 {
-		pLen = 127
-		extPLen = []byte{
-			byte(pLength >> 56),
-			byte(pLength >> 48),
-			byte(pLength >> 40),
-			byte(pLength >> 32),
-			byte(pLength >> 24),
-			byte(pLength >> 16),
-			byte(pLength >> 8),
-			byte(pLength),
-		}
+		hdr[1] = 126
+		binary.BigEndian.PutUint16(hdr[2:], uint16(pLength))
+		n += 2
 	} else {
-		return nil, errors.New("too large frame")
+		hdr[1] = 127
+		binary.BigEndian.PutUint64(hdr[2:], pLength)
+		n += 8
 	}
 
-	if mask {
-		f.MASK = uint8(1)
+	f.MASK = 0
+	if maskingKey != nil {
+		f.MASK = 1
+		f.MaskingKey = MaskingKeyFromBytes(maskingKey)
+		hdr[1] |= 0x80
+		n += copy(hdr[n:], maskingKey)
 	}
-	byts[1] = byte(f.MASK<<7 | uint8(pLen))
 
-	if extPLen != nil {
-		byts = append(byts, extPLen...)
-	}
+	return n
+}
 
+func (f *Frame) ToBytes(mask bool) (byts []byte, err error) {
+	var mkb []byte
 	if mask {
-		mkb := MakeMaskingKey()
-		byts = append(byts, mkb...)
+		mkb = MakeMaskingKey()
 	}
 
-	byts = append(byts, f.PayloadData...)
+	var hdr [maxFrameHeaderLen]byte
+	n := f.encodeHeader(&hdr, mkb)
+
+	byts = make([]byte, n+len(f.PayloadData))
+	copy(byts, hdr[:n])
+	copy(byts[n:], f.PayloadData)
+
+	if mask {
+		MaskData(byts[n:], mkb)
+	}
 	return byts, nil
 }
 
+// headerLen returns the length of the encoded header of the frame.
+func (f *Frame) headerLen(mask bool) int {
+	n := 2
+	if pLength := len(f.PayloadData); pLength > math.MaxUint16 {
+		n += 8
+	} else if pLength > 125 {
+		n += 2
+	}
+
+	if mask {
+		n += 4
+	}
+	return n
+}
+
+// WriteTo writes the header and the payload of the frame by one vectored
+// write if w supports it, so the payload isn't copied unless it's masked.
+// n is the wire bytes written including the header.
 func (f *Frame) WriteTo(w io.Writer, mask bool) (n int, err error) {
-	if byts, err := f.ToBytes(mask); err != nil {
-		return 0, err
+	var mkb []byte
+	if mask {
+		mkb = MakeMaskingKey()
+	}
+	return f.writeMasked(w, mkb)
+}
+
+// writeMasked is WriteTo masking the payload by mkb, it's not masked if mkb
+// is nil.
+func (f *Frame) writeMasked(w io.Writer, mkb []byte) (n int, err error) {
+	mask := mkb != nil
+
+	var hdr [maxFrameHeaderLen]byte
+	hl := f.encodeHeader(&hdr, mkb)
+
+	payload := f.PayloadData
+	if mask {
+		payload = DefaultBufferPool.Get(len(f.PayloadData))
+		defer DefaultBufferPool.Put(payload)
+
+		copy(payload, f.PayloadData)
+		MaskData(payload, mkb)
+	}
+
+	bufs := net.Buffers{hdr[:hl]}
+	if len(payload) > 0 {
+		// an empty write may block on some conns, like the ones of net.Pipe
+		bufs = append(bufs, payload)
+	}
+
+	var n64 int64
+	if c, ok := w.(*Conn); ok {
+		n64, err = c.WriteBuffers(bufs)
 	} else {
-		return w.Write(byts)
+		n64, err = bufs.WriteTo(w)
 	}
+	return int(n64), err
 }
 
+// max payload bytes shown by Frame.String
+const frameStringPayloadLen = 64
+
+func opcodeName(op uint8) string {
+	switch op {
+	case OpcodeContinue:
+		return "continue"
+	case OpcodeText:
+		return "text"
+	case OpcodeBinary:
+		return "binary"
+	case OpcodeClose:
+		return "close"
+	case OpcodePing:
+		return "ping"
+	case OpcodePong:
+		return "pong"
+	}
+	return "0x" + strconv.FormatUint(uint64(op), 16)
+}
+
+// String dumps the header and the beginning of the payload of the frame,
+// like: fin=1 rsv=000 op=text mask=0 len=5 "hello".
+func (f *Frame) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "fin=%d rsv=%d%d%d op=%s mask=%d", f.FIN, f.RSV1, f.RSV2, f.RSV3, opcodeName(f.Opcode), f.MASK)
+	if f.MASK == 1 {
+		fmt.Fprintf(&b, " key=%08x", f.MaskingKey)
+	}
+	fmt.Fprintf(&b, " len=%d", len(f.PayloadData))
+
+	payload := f.PayloadData
+	if f.Opcode == OpcodeClose {
+		if code, ok := ParseCloseCode(payload); ok {
+			fmt.Fprintf(&b, " code=%d", code)
+			payload = payload[2:]
+		}
+	}
+
+	if len(payload) == 0 {
+		return b.String()
+	}
+
+	text := f.Opcode != OpcodeBinary && utf8.Valid(payload)
+	more := ""
+	if len(payload) > frameStringPayloadLen {
+		payload, more = payload[:frameStringPayloadLen], "..."
+	}
+	if !text {
+		fmt.Fprintf(&b, " %x%s", payload, more)
+	} else {
+		fmt.Fprintf(&b, " %q%s", payload, more)
+	}
+	return b.String()
+}
+
+// MakeCloseFrame makes a close frame of code and reason, the reason is cut
+// by TruncateCloseReason to fit the frame.
 func MakeCloseFrame(code uint16, reason string, useCodeText bool) *Frame {
 	if reason == "" && useCodeText {
 		reason = CloseCodeText(code)
 	}
+	reason = TruncateCloseReason(reason)
 
 	f := &Frame{}
 	f.FIN = uint8(1)
 	f.Opcode = OpcodeClose
-	f.PayloadData = []byte{byte(code >> 8), byte(code)}
+	f.PayloadData = AppendCloseCode(nil, code)
 	f.PayloadData = append(f.PayloadData, reason...)
 
 	return f
 }
 
+// MakeMaskingKey returns a masking key read from crypto/rand, the conns use
+// the one of Server.Rand.
 func MakeMaskingKey() []byte {
-	r := rand.New(rand.NewSource(35))
-	mk := r.Uint32()
+	mkb := make([]byte, 4)
+	rand.Read(mkb)
+	return mkb
+}
 
-	return []byte{
-		byte(mk >> 24),
-		byte(mk >> 16),
-		byte(mk >> 8),
-		byte(mk),
+// the multi-byte fields of frames are in network byte order, these helpers
+// are shared by the frame codec and the code built on it
+
+func MaskingKeyFromBytes(b []byte) uint32 {
+	return binary.BigEndian.Uint32(b)
+}
+
+func MaskingKeyToBytes(key uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, key)
+}
+
+func AppendCloseCode(dst []byte, code uint16) []byte {
+	return binary.BigEndian.AppendUint16(dst, code)
+}
+
+// ParseCloseCode returns the status code of a close frame payload, ok is
+// false if the payload has no code.
+func ParseCloseCode(payload []byte) (code uint16, ok bool) {
+	if len(payload) < 2 {
+		return 0, false
 	}
+	return binary.BigEndian.Uint16(payload), true
 }
 
+// MaskData masks or unmasks data in place by the 4 bytes maskingKey, it
+// works on 8 bytes at a time, see maskWords.
 func MaskData(data, maskingKey []byte) {
-	for i := 0; i < len(data); i++ {
-		j := i % 4
-		data[i] = data[i] ^ maskingKey[j]
+	key := [4]byte{maskingKey[0], maskingKey[1], maskingKey[2], maskingKey[3]}
+
+	// the key repeats every 4 bytes so it's still aligned after the words
+	n := maskWords(data, key)
+	for i := n; i < len(data); i++ {
+		data[i] ^= key[i&3]
 	}
 }
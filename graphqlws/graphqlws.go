@@ -0,0 +1,313 @@
+// Package graphqlws implements the server side of the graphql-transport-ws
+// protocol over kiwi conns, the execution of the operations is left to a
+// GraphQL library plugged in by Server.Execute.
+package graphqlws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/mconintet/kiwi"
+)
+
+// Subprotocol should be selected by the handshake of the conns.
+const Subprotocol = "graphql-transport-ws"
+
+// the close codes of the protocol
+const (
+	CloseCodeBadRequest         = uint16(4400)
+	CloseCodeUnauthorized       = uint16(4401)
+	CloseCodeForbidden          = uint16(4403)
+	CloseCodeInitTimeout        = uint16(4408)
+	CloseCodeSubscriberExists   = uint16(4409)
+	CloseCodeTooManyInitRequest = uint16(4429)
+)
+
+const defaultInitTimeout = 3 * time.Second
+
+// the types of the messages
+const (
+	typeConnectionInit = "connection_init"
+	typeConnectionAck  = "connection_ack"
+	typePing           = "ping"
+	typePong           = "pong"
+	typeSubscribe      = "subscribe"
+	typeNext           = "next"
+	typeError          = "error"
+	typeComplete       = "complete"
+)
+
+type message struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// SubscribePayload is the operation requested by a subscribe message.
+type SubscribePayload struct {
+	OperationName string         `json:"operationName,omitempty"`
+	Query         string         `json:"query"`
+	Variables     map[string]any `json:"variables,omitempty"`
+	Extensions    map[string]any `json:"extensions,omitempty"`
+}
+
+// Error is a GraphQL error.
+type Error struct {
+	Message    string         `json:"message"`
+	Path       []any          `json:"path,omitempty"`
+	Extensions map[string]any `json:"extensions,omitempty"`
+}
+
+// Errors may be returned by Server.Execute to send the errors of an
+// operation which failed before its execution, like a validation.
+type Errors []*Error
+
+func (errs Errors) Error() string {
+	if len(errs) == 0 {
+		return "graphqlws: no errors"
+	}
+	return "graphqlws: " + errs[0].Message
+}
+
+// Result is an execution result sent by a next message.
+type Result struct {
+	Data       any            `json:"data,omitempty"`
+	Errors     []*Error       `json:"errors,omitempty"`
+	Extensions map[string]any `json:"extensions,omitempty"`
+}
+
+// Server serves the protocol on the conns by Serve.
+type Server struct {
+	// called with the payload of connection_init, the conn is closed with
+	// CloseCodeForbidden if it returns an error, ack is the payload of the
+	// connection_ack and may be nil
+	OnConnect func(ctx context.Context, c *kiwi.Conn, payload json.RawMessage) (ack any, err error)
+
+	// executes an operation, its results are sent in order until the
+	// returned channel is closed, then the operation is completed. ctx is
+	// canceled once the client completes the operation or the conn is
+	// closed, the channel should be closed after that
+	Execute func(ctx context.Context, payload *SubscribePayload) (<-chan *Result, error)
+
+	// the conns not sending connection_init in time are closed with
+	// CloseCodeInitTimeout, defaultInitTimeout if it's zero
+	InitTimeout time.Duration
+}
+
+type connState struct {
+	srv  *Server
+	s    kiwi.MessageSender
+	conn *kiwi.Conn
+
+	mu     sync.Mutex
+	inited bool
+	acked  bool
+	ops    map[string]context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// Serve serves the messages read by r until the conn is no longer readable,
+// the conn is closed once it returns and the operations are canceled.
+func (srv *Server) Serve(r kiwi.MessageReceiver, s kiwi.MessageSender) error {
+	conn := r.GetConn()
+	cs := &connState{srv: srv, s: s, conn: conn, ops: make(map[string]context.CancelFunc)}
+	defer cs.wg.Wait()
+	defer conn.Close()
+
+	timeout := srv.InitTimeout
+	if timeout == 0 {
+		timeout = defaultInitTimeout
+	}
+	timer := time.AfterFunc(timeout, func() {
+		cs.mu.Lock()
+		inited := cs.inited
+		cs.mu.Unlock()
+		if !inited {
+			conn.CloseWithCode(CloseCodeInitTimeout, "Connection initialisation timeout")
+		}
+	})
+	defer timer.Stop()
+
+	for msg, err := range r.Messages(0) {
+		if err != nil {
+			return err
+		}
+
+		if msg.IsClose() {
+			conn.CloseWithCode(kiwi.CloseCodeNormalClosure, "")
+			return nil
+		}
+		if !msg.IsText() && !msg.IsBinary() {
+			continue
+		}
+
+		m := &message{}
+		if err := json.Unmarshal(msg.Data, m); err != nil || m.Type == "" {
+			conn.CloseWithCode(CloseCodeBadRequest, "Invalid message received")
+			return errors.New("graphqlws: invalid message")
+		}
+		if err := cs.handle(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cs *connState) send(m *message) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = cs.s.SendWhole(&kiwi.Message{Opcode: kiwi.OpcodeText, Data: data}, false)
+	return err
+}
+
+func (cs *connState) sendPayload(id, typ string, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return cs.send(&message{ID: id, Type: typ, Payload: data})
+}
+
+// fail closes the conn with code and returns the reason as an error.
+func (cs *connState) fail(code uint16, reason string) error {
+	cs.conn.CloseWithCode(code, reason)
+	return errors.New("graphqlws: " + reason)
+}
+
+func (cs *connState) handle(m *message) error {
+	switch m.Type {
+	case typeConnectionInit:
+		return cs.init(m)
+
+	case typePing:
+		return cs.send(&message{Type: typePong, Payload: m.Payload})
+
+	case typePong:
+		return nil
+
+	case typeSubscribe:
+		return cs.subscribe(m)
+
+	case typeComplete:
+		cs.mu.Lock()
+		cancel, ok := cs.ops[m.ID]
+		delete(cs.ops, m.ID)
+		cs.mu.Unlock()
+		if ok {
+			cancel()
+		}
+		return nil
+	}
+	return cs.fail(CloseCodeBadRequest, "Invalid message received")
+}
+
+func (cs *connState) init(m *message) error {
+	cs.mu.Lock()
+	inited := cs.inited
+	cs.inited = true
+	cs.mu.Unlock()
+	if inited {
+		return cs.fail(CloseCodeTooManyInitRequest, "Too many initialisation requests")
+	}
+
+	var ack any
+	if fn := cs.srv.OnConnect; fn != nil {
+		var err error
+		if ack, err = fn(cs.conn.Context(), cs.conn, m.Payload); err != nil {
+			return cs.fail(CloseCodeForbidden, "Forbidden")
+		}
+	}
+
+	ackMsg := &message{Type: typeConnectionAck}
+	if ack != nil {
+		data, err := json.Marshal(ack)
+		if err != nil {
+			return err
+		}
+		ackMsg.Payload = data
+	}
+
+	cs.mu.Lock()
+	cs.acked = true
+	cs.mu.Unlock()
+	return cs.send(ackMsg)
+}
+
+func (cs *connState) subscribe(m *message) error {
+	payload := &SubscribePayload{}
+	if m.ID == "" || json.Unmarshal(m.Payload, payload) != nil {
+		return cs.fail(CloseCodeBadRequest, "Invalid message received")
+	}
+
+	cs.mu.Lock()
+	if !cs.acked {
+		cs.mu.Unlock()
+		return cs.fail(CloseCodeUnauthorized, "Unauthorized")
+	}
+	if _, ok := cs.ops[m.ID]; ok {
+		cs.mu.Unlock()
+		return cs.fail(CloseCodeSubscriberExists, "Subscriber for "+m.ID+" already exists")
+	}
+	ctx, cancel := context.WithCancel(cs.conn.Context())
+	cs.ops[m.ID] = cancel
+	cs.wg.Add(1)
+	cs.mu.Unlock()
+
+	go cs.run(ctx, m.ID, payload)
+	return nil
+}
+
+// run executes an operation and sends its results.
+func (cs *connState) run(ctx context.Context, id string, payload *SubscribePayload) {
+	defer cs.wg.Done()
+	defer cs.end(ctx, id)
+
+	results, err := cs.srv.Execute(ctx, payload)
+	if err != nil {
+		var errs Errors
+		if !errors.As(err, &errs) {
+			errs = Errors{{Message: err.Error()}}
+		}
+		if cs.end(ctx, id) {
+			cs.sendPayload(id, typeError, errs)
+		}
+		return
+	}
+
+	for {
+		select {
+		case res, ok := <-results:
+			if !ok {
+				if cs.end(ctx, id) {
+					cs.send(&message{ID: id, Type: typeComplete})
+				}
+				return
+			}
+			cs.sendPayload(id, typeNext, res)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// end removes the operation id of ctx, it reports if it was running, so it
+// was not completed by the client.
+func (cs *connState) end(ctx context.Context, id string) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if ctx.Err() != nil {
+		return false
+	}
+	if cancel, ok := cs.ops[id]; ok {
+		delete(cs.ops, id)
+		cancel()
+		return true
+	}
+	return false
+}
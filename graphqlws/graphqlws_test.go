@@ -0,0 +1,172 @@
+package graphqlws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mconintet/kiwi"
+)
+
+type testClient struct {
+	t *testing.T
+	r kiwi.MessageReceiver
+	s kiwi.MessageSender
+}
+
+func dial(t *testing.T, gs *Server) *testClient {
+	srv := kiwi.NewServer()
+	srv.ApplyDefaultCfg()
+	srv.OnConnOpenFunc("/graphql", func(r kiwi.MessageReceiver, s kiwi.MessageSender) {
+		gs.Serve(r, s)
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go srv.Serve(ln)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := kiwi.Dial(ctx, "ws://"+ln.Addr().String()+"/graphql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	return &testClient{t, (&kiwi.DefaultMessageReceiver{}).SetConn(c), (&kiwi.DefaultMessageSender{}).SetConn(c)}
+}
+
+func (c *testClient) send(m string) {
+	if _, err := c.s.SendWholeBytes([]byte(m), false); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *testClient) expect(want string) {
+	c.t.Helper()
+	msg, err := c.r.ReadWhole(0)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if string(msg.Data) != want {
+		c.t.Fatalf("got %s; want %s", msg.Data, want)
+	}
+}
+
+func (c *testClient) expectClose(code uint16) {
+	c.t.Helper()
+	msg, err := c.r.ReadWhole(0)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if got, _ := kiwi.ParseCloseCode(msg.Data); !msg.IsClose() || got != code {
+		c.t.Fatalf("got %s; want close %d", msg.Data, code)
+	}
+}
+
+func newTestServer() *Server {
+	return &Server{
+		OnConnect: func(ctx context.Context, c *kiwi.Conn, payload json.RawMessage) (any, error) {
+			var p struct{ Token string }
+			json.Unmarshal(payload, &p)
+			if p.Token != "secret" {
+				return nil, errors.New("bad token")
+			}
+			return map[string]string{"user": "alice"}, nil
+		},
+		Execute: func(ctx context.Context, payload *SubscribePayload) (<-chan *Result, error) {
+			switch payload.Query {
+			case "subscription { count }":
+				ch := make(chan *Result)
+				go func() {
+					defer close(ch)
+					for i := 1; i <= 2; i++ {
+						select {
+						case ch <- &Result{Data: map[string]int{"count": i}}:
+						case <-ctx.Done():
+							return
+						}
+					}
+				}()
+				return ch, nil
+			case "subscription { forever }":
+				ch := make(chan *Result)
+				go func() {
+					<-ctx.Done()
+					close(ch)
+				}()
+				return ch, nil
+			}
+			return nil, errors.New("unknown field")
+		},
+		InitTimeout: 50 * time.Millisecond,
+	}
+}
+
+func TestLifecycle(t *testing.T) {
+	c := dial(t, newTestServer())
+
+	c.send(`{"type":"connection_init","payload":{"token":"secret"}}`)
+	c.expect(`{"type":"connection_ack","payload":{"user":"alice"}}`)
+
+	c.send(`{"type":"ping","payload":{"t":1}}`)
+	c.expect(`{"type":"pong","payload":{"t":1}}`)
+
+	c.send(`{"id":"1","type":"subscribe","payload":{"query":"subscription { count }"}}`)
+	c.expect(`{"id":"1","type":"next","payload":{"data":{"count":1}}}`)
+	c.expect(`{"id":"1","type":"next","payload":{"data":{"count":2}}}`)
+	c.expect(`{"id":"1","type":"complete"}`)
+
+	c.send(`{"id":"2","type":"subscribe","payload":{"query":"{ nope }"}}`)
+	c.expect(`{"id":"2","type":"error","payload":[{"message":"unknown field"}]}`)
+
+	// completed by the client, no complete is sent back
+	c.send(`{"id":"3","type":"subscribe","payload":{"query":"subscription { forever }"}}`)
+	c.send(`{"id":"3","type":"complete"}`)
+	c.send(`{"id":"3","type":"subscribe","payload":{"query":"subscription { count }"}}`)
+	c.expect(`{"id":"3","type":"next","payload":{"data":{"count":1}}}`)
+	c.expect(`{"id":"3","type":"next","payload":{"data":{"count":2}}}`)
+	c.expect(`{"id":"3","type":"complete"}`)
+
+	c.send(`{"id":"4","type":"subscribe","payload":{"query":"subscription { forever }"}}`)
+	c.send(`{"id":"4","type":"subscribe","payload":{"query":"subscription { forever }"}}`)
+	c.expectClose(CloseCodeSubscriberExists)
+}
+
+func TestCloseCodes(t *testing.T) {
+	cases := []struct {
+		name     string
+		messages []string
+		code     uint16
+	}{
+		{"timeout", nil, CloseCodeInitTimeout},
+		{"forbidden", []string{`{"type":"connection_init","payload":{"token":"wrong"}}`}, CloseCodeForbidden},
+		{"unauthorized", []string{`{"id":"1","type":"subscribe","payload":{"query":"{ a }"}}`}, CloseCodeUnauthorized},
+		{"invalid", []string{`not json`}, CloseCodeBadRequest},
+		{"unknown type", []string{`{"type":"hello"}`}, CloseCodeBadRequest},
+		{"init twice", []string{
+			`{"type":"connection_init","payload":{"token":"secret"}}`,
+			`{"type":"connection_init","payload":{"token":"secret"}}`,
+		}, CloseCodeTooManyInitRequest},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := dial(t, newTestServer())
+			for _, m := range tc.messages {
+				c.send(m)
+			}
+			if len(tc.messages) == 2 {
+				c.expect(`{"type":"connection_ack","payload":{"user":"alice"}}`)
+			}
+			c.expectClose(tc.code)
+		})
+	}
+}
@@ -1,20 +1,45 @@
 package kiwi
 
 import (
+	"bufio"
 	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"slices"
+	"strconv"
+	"strings"
 )
 
+// HandshakeError is an invalid handshake request. Once the handshake is
+// failed by Conn.FailHandshake, the error is wrapped in a HandshakeError
+// with the HTTP status it's responded with.
 type HandshakeError struct {
 	ErrorString string
+
+	Status int
+	Err    error
 }
 
 func (err *HandshakeError) Error() string {
-	return err.ErrorString
+	s := err.ErrorString
+	if err.Err != nil {
+		if s != "" {
+			s += ": "
+		}
+		s += err.Err.Error()
+	}
+
+	if err.Status != 0 {
+		s = "handshake failed with " + strconv.Itoa(err.Status) + ": " + s
+	}
+	return s
+}
+
+func (err *HandshakeError) Unwrap() error {
+	return err.Err
 }
 
 type HandshakeRequest struct {
@@ -73,22 +98,26 @@ func parseRequestLine(bs []byte, isCRLF bool) (lineLen int, method, requestUri,
 	return newline, string(line[:s1]), string(line[s1+1 : s2]), string(p[:ps]), string(p[ps+1:]), nil
 }
 
+type lineReader interface {
+	ReadSlice(delim byte) (line []byte, err error)
+}
+
+// ReadFrom reads the request up to its last empty line, anything after that
+// is left unread in r if it's buffered, e.g. a *bufio.Reader.
 func (h *HandshakeRequest) ReadFrom(r io.Reader, maxSize int) error {
-	// read one more byte to check if request is too large
-	maxHandshakeBytes := maxSize + 1
-	hs := make([]byte, maxHandshakeBytes)
+	return h.readFrom(r, maxSize, headerLimits{})
+}
 
-	reqSize, err := r.Read(hs)
+func (h *HandshakeRequest) readFrom(r io.Reader, maxSize int, lim headerLimits) error {
+	hs, err := readHandshakeHead(r, maxSize, lim)
 	if err != nil {
-		return &HandshakeError{"unable to read handshake"}
-	} else if reqSize == maxHandshakeBytes {
-		return &HandshakeError{"too large handshake"}
+		return err
 	}
 
-	hs = hs[0:reqSize]
+	reqSize := len(hs)
 	isCRLF, ok := checkLastEmptyLine(hs)
 	if !ok {
-		return &HandshakeError{"missing last empty line"}
+		return &HandshakeError{ErrorString: "missing last empty line"}
 	}
 
 	// remove last empty line
@@ -100,17 +129,23 @@ func (h *HandshakeRequest) ReadFrom(r io.Reader, maxSize int) error {
 
 	reqLineLen, method, requestUri, proto, protoVer, err := parseRequestLine(hs, isCRLF)
 	if err != nil {
-		return &HandshakeError{"invalid request line: " + err.Error()}
+		return &HandshakeError{ErrorString: "invalid request line: " + err.Error()}
 	}
 
 	header := make(Header, 5)
 	if err := header.FromBytes(hs[reqLineLen+1:], isCRLF); err != nil {
-		return &HandshakeError{err.Error()}
+		return &HandshakeError{ErrorString: err.Error()}
+	}
+
+	// the bytes after the header would be taken as frames
+	_, chunked := header.getFold("Transfer-Encoding")
+	if cl, ok := header.getFold("Content-Length"); chunked || ok && cl[0] != "0" {
+		return &HandshakeError{ErrorString: "unexpected handshake request body"}
 	}
 
 	reqUrl, err := url.Parse(requestUri)
 	if err != nil {
-		return &HandshakeError{"deformed requestUri: " + requestUri}
+		return &HandshakeError{ErrorString: "deformed requestUri: " + requestUri}
 	}
 
 	h.Method = method
@@ -123,18 +158,167 @@ func (h *HandshakeRequest) ReadFrom(r io.Reader, maxSize int) error {
 	return nil
 }
 
+// headerLimits bound the lines of a handshake request, see
+// Server.MaxRequestLineBytes. Zero means no limit.
+type headerLimits struct {
+	requestLine int
+	line        int
+	count       int
+}
+
+var errHeaderFieldsTooLarge = &HandshakeError{ErrorString: "request header fields too large", Status: http.StatusRequestHeaderFieldsTooLarge}
+
+// readHandshakeHead reads the request line and the header up to the last
+// empty line, which is no more than maxSize.
+func readHandshakeHead(r io.Reader, maxSize int, lim headerLimits) ([]byte, error) {
+	lr, ok := r.(lineReader)
+	if !ok {
+		lr = bufio.NewReader(r)
+	}
+
+	var hs []byte
+	lineStart, lines := 0, 0
+	for {
+		line, err := lr.ReadSlice('\n')
+		hs = append(hs, line...)
+
+		if len(hs) > maxSize {
+			return nil, &HandshakeError{ErrorString: "too large handshake", Status: http.StatusRequestHeaderFieldsTooLarge}
+		}
+		// checked before the line ends, so a long one isn't buffered
+		maxLine := lim.line
+		if lines == 0 {
+			maxLine = lim.requestLine
+		}
+		if maxLine > 0 && len(hs)-lineStart > maxLine+2 {
+			return nil, errHeaderFieldsTooLarge
+		}
+
+		if err == bufio.ErrBufferFull {
+			continue
+		} else if err != nil {
+			return nil, &HandshakeError{ErrorString: "unable to read handshake", Err: err}
+		}
+
+		if l := len(hs) - lineStart; lineStart > 0 && (l == 1 || l == 2 && hs[lineStart] == '\r') {
+			break
+		}
+		lineStart = len(hs)
+		lines++
+		// the request line and the header lines
+		if lim.count > 0 && lines > lim.count+1 {
+			return nil, errHeaderFieldsTooLarge
+		}
+	}
+	return hs, nil
+}
+
+// ReadFromStd is ReadFrom parsing the request by http.ReadRequest, which
+// also takes the obsolete line folding and validates the header. The keys
+// of the header are canonicalized like the ones of ProtocolLenient, and the
+// Host header is kept. See Server.StdHandshakeParser.
+func (h *HandshakeRequest) ReadFromStd(r io.Reader, maxSize int) error {
+	return h.readFromStd(r, maxSize, headerLimits{})
+}
+
+func (h *HandshakeRequest) readFromStd(r io.Reader, maxSize int, lim headerLimits) error {
+	hs, err := readHandshakeHead(r, maxSize, lim)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(hs)))
+	if err != nil {
+		return &HandshakeError{ErrorString: "invalid request", Err: err}
+	}
+	if req.ContentLength > 0 || len(req.TransferEncoding) > 0 {
+		return &HandshakeError{ErrorString: "unexpected handshake request body"}
+	}
+
+	header := Header(req.Header)
+	if req.Host != "" {
+		header["Host"] = []string{req.Host}
+	}
+	header.canonicalize()
+
+	h.Method = req.Method
+	h.Proto = "HTTP"
+	h.ProtoVer = strconv.Itoa(req.ProtoMajor) + "." + strconv.Itoa(req.ProtoMinor)
+	h.RequestURI = req.RequestURI
+	h.RequestURL = req.URL
+	h.Header = header
+	return nil
+}
+
+// IsUpgrade reports whether the request asks for an upgrade to websocket,
+// requests upgrading to other protocols are treated as plain http ones.
+func (h *HandshakeRequest) IsUpgrade() bool {
+	for _, v := range h.Header.Get("Upgrade") {
+		for _, proto := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(proto), "websocket") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// HandshakeResponse is an HTTP/1.1 response of a handshake func, such as a
+// redirect or an error with a body, see Conn.WriteHandshakeResponse. The
+// keys added by AddHeader and SetHeader are written in the order they're
+// added, the other keys of Header after them in sorted order.
 type HandshakeResponse struct {
 	StatusCode int
 	Header     Header
+
+	// written after the header with its Content-Length if it's not nil
+	Body []byte
+
+	order []string
 }
 
-func (h *HandshakeResponse) WriteTo(w io.Writer) (err error) {
-	if _, err = fmt.Fprintf(w, "HTTP/1.1 %03d %s\r\n", h.StatusCode, http.StatusText(h.StatusCode)); err != nil {
-		return err
+// AddHeader adds value to the ones of key.
+func (h *HandshakeResponse) AddHeader(key, value string) {
+	if h.Header == nil {
+		h.Header = make(Header)
 	}
+	if _, ok := h.Header[key]; !ok {
+		h.order = append(h.order, key)
+	}
+	h.Header[key] = append(h.Header[key], value)
+}
 
-	if err = h.Header.WriteTo(w); err != nil {
-		return err
+// SetHeader replaces the values of key by value.
+func (h *HandshakeResponse) SetHeader(key, value string) {
+	if _, ok := h.Header[key]; ok {
+		h.Header[key] = []string{value}
+		return
 	}
-	return nil
+	h.AddHeader(key, value)
+}
+
+// WriteTo writes the status line, the header, the empty line and the body.
+func (h *HandshakeResponse) WriteTo(w io.Writer) (n int64, err error) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "HTTP/1.1 %03d %s\r\n", h.StatusCode, http.StatusText(h.StatusCode))
+
+	keys := make([]string, 0, len(h.Header))
+	for _, k := range h.order {
+		if _, ok := h.Header[k]; ok && !slices.Contains(keys, k) {
+			keys = append(keys, k)
+		}
+	}
+	for _, k := range h.Header.sortedKeys() {
+		if !slices.Contains(keys, k) {
+			keys = append(keys, k)
+		}
+	}
+	h.Header.writeKeys(&b, keys)
+
+	if h.Body != nil && !h.Header.HasKey("Content-Length") {
+		b.WriteString("Content-Length: " + strconv.Itoa(len(h.Body)) + "\r\n")
+	}
+	b.WriteString("\r\n")
+	b.Write(h.Body)
+	return b.WriteTo(w)
 }
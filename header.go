@@ -3,8 +3,10 @@ package kiwi
 import (
 	"bytes"
 	"errors"
-	"fmt"
 	"io"
+	"maps"
+	"net/http"
+	"slices"
 	"strings"
 )
 
@@ -65,13 +67,56 @@ func (h Header) HasKeyAndValContains(key, val string) bool {
 	}
 }
 
-func (h Header) WriteTo(w io.Writer) (err error) {
+// the names of the headers looked up by the handshake whose canonical form
+// differs from the one of http.CanonicalHeaderKey
+var handshakeHeaderKeys = []string{
+	"Sec-WebSocket-Key", "Sec-WebSocket-Version", "Sec-WebSocket-Protocol", "Sec-WebSocket-Extensions",
+}
+
+// canonicalize renames the keys of h as they're looked up, so the headers
+// of the peers writing them in another case are found.
+func (h Header) canonicalize() {
 	for k, vs := range h {
-		for _, v := range vs {
-			if _, err = fmt.Fprintf(w, "%s: %v\r\n", k, v); err != nil {
-				return err
+		ck := http.CanonicalHeaderKey(k)
+		for _, hk := range handshakeHeaderKeys {
+			if strings.EqualFold(k, hk) {
+				ck = hk
+				break
 			}
 		}
+
+		if ck != k {
+			delete(h, k)
+			h[ck] = append(h[ck], vs...)
+		}
+	}
+}
+
+// getFold returns the values of key in any case.
+func (h Header) getFold(key string) ([]string, bool) {
+	for k, vs := range h {
+		if strings.EqualFold(k, key) {
+			return vs, true
+		}
+	}
+	return nil, false
+}
+
+// WriteTo writes the header lines of h in the sorted order of the keys.
+func (h Header) WriteTo(w io.Writer) (n int64, err error) {
+	var b bytes.Buffer
+	h.writeKeys(&b, h.sortedKeys())
+	return b.WriteTo(w)
+}
+
+func (h Header) sortedKeys() []string {
+	return slices.Sorted(maps.Keys(h))
+}
+
+func (h Header) writeKeys(b *bytes.Buffer, keys []string) {
+	for _, k := range keys {
+		for _, v := range h[k] {
+			b.WriteString(k + ": " + v + "\r\n")
+		}
 	}
-	return nil
 }
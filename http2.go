@@ -0,0 +1,414 @@
+package kiwi
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrDeadlineNotSupported = errors.New("deadlines are not supported on the stream")
+
+// ServeHTTP serves the conns of srv from an http.Server, they're opened on
+// the routes of srv like the accepted ones. The HTTP/1.1 requests are
+// hijacked, and the websockets bootstrapped by the extended CONNECT of RFC
+// 8441 on HTTP/2 are served on the stream of the request. The http.Server
+// enables the extended CONNECT only if GODEBUG has http2xconnect=1 for now.
+// The other HTTP/2 requests go to the FallbackHandler.
+func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor == 1 {
+		srv.serveHijacked(w, r)
+		return
+	}
+
+	if r.Method != http.MethodConnect || r.Header.Get(":protocol") != "websocket" {
+		if srv.FallbackHandler != nil {
+			srv.FallbackHandler.ServeHTTP(w, r)
+			return
+		}
+		http.Error(w, "websocket extended CONNECT required", http.StatusBadRequest)
+		return
+	}
+
+	nonce := make([]byte, 16)
+	io.ReadFull(srv.rand(), nonce)
+
+	rc := http.NewResponseController(w)
+	resp := &streamResponse{w: w, rc: rc}
+	sc := &streamConn{
+		r:             io.MultiReader(bytes.NewReader(handshakeHead(r, base64.StdEncoding.EncodeToString(nonce))), r.Body),
+		w:             resp,
+		closeFn:       r.Body.Close,
+		readDeadline:  rc.SetReadDeadline,
+		writeDeadline: rc.SetWriteDeadline,
+		remote:        addrOf(r.RemoteAddr),
+		tlsState:      r.TLS,
+		done:          make(chan struct{}),
+	}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		sc.local = addr
+	}
+
+	if !srv.accepts(sc) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	conn := newConn(srv, sc)
+	srv.ConnPool.Add(conn)
+	go conn.serve()
+
+	// the stream is written until the conn is closed
+	select {
+	case <-sc.done:
+	case <-r.Context().Done():
+		conn.Close()
+	}
+
+	sc.mu.Lock()
+	if !resp.wroteHeader {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	sc.mu.Unlock()
+}
+
+func (srv *Server) serveHijacked(w http.ResponseWriter, r *http.Request) {
+	nc, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// the request is read again by the conn
+	hc := &hijackedConn{nc, io.MultiReader(bytes.NewReader(handshakeHead(r, "")), brw.Reader)}
+	if !srv.accepts(hc) {
+		hc.Close()
+		return
+	}
+
+	conn := newConn(srv, hc)
+	srv.ConnPool.Add(conn)
+	conn.serve()
+}
+
+// handshakeHead writes r back as an HTTP/1.1 request, the one of the
+// extended CONNECT gets the upgrade headers and the key.
+func handshakeHead(r *http.Request, key string) []byte {
+	method := r.Method
+	if key != "" {
+		method = http.MethodGet
+	}
+
+	var b bytes.Buffer
+	b.WriteString(method + " " + r.URL.RequestURI() + " HTTP/1.1\r\n")
+	b.WriteString("Host: " + r.Host + "\r\n")
+	for k, vs := range r.Header {
+		if strings.HasPrefix(k, ":") || k == "Host" {
+			continue
+		}
+		// the handshake funcs look the headers up as written by the browsers
+		if rest, ok := strings.CutPrefix(k, "Sec-Websocket-"); ok {
+			k = "Sec-WebSocket-" + rest
+		}
+		for _, v := range vs {
+			b.WriteString(k + ": " + v + "\r\n")
+		}
+	}
+	if key != "" {
+		b.WriteString("Connection: Upgrade\r\n")
+		b.WriteString("Upgrade: websocket\r\n")
+		b.WriteString("Sec-WebSocket-Key: " + key + "\r\n")
+	}
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
+
+func addrOf(hostport string) net.Addr {
+	ap, err := netip.ParseAddrPort(hostport)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	return net.TCPAddrFromAddrPort(ap)
+}
+
+// accepts checks cn by the AccessList and OnConnAccept.
+func (srv *Server) accepts(cn net.Conn) bool {
+	if srv.AccessList != nil && !srv.AccessList.AllowConn(cn) {
+		return false
+	}
+	return srv.OnConnAccept == nil || srv.OnConnAccept(cn)
+}
+
+// hijackedConn reads the request of the http.Server again before the rest
+// of its conn.
+type hijackedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *hijackedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *hijackedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// streamConn is a net.Conn over the bodies of the request and the response
+// of an HTTP/2 stream.
+type streamConn struct {
+	r       io.Reader
+	w       io.Writer
+	closeFn func() error
+
+	// nil if the deadlines are not supported
+	readDeadline  func(time.Time) error
+	writeDeadline func(time.Time) error
+
+	local, remote net.Addr
+	// of the request, nil if it's not over tls
+	tlsState *tls.ConnectionState
+
+	mu     sync.Mutex
+	closed bool
+	done   chan struct{}
+}
+
+func (c *streamConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *streamConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	return c.w.Write(p)
+}
+
+func (c *streamConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	return c.closeFn()
+}
+
+func (c *streamConn) LocalAddr() net.Addr {
+	if c.local == nil {
+		return &net.TCPAddr{}
+	}
+	return c.local
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	if c.remote == nil {
+		return &net.TCPAddr{}
+	}
+	return c.remote
+}
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	if c.readDeadline == nil {
+		if t.IsZero() {
+			return nil
+		}
+		return ErrDeadlineNotSupported
+	}
+	return c.readDeadline(t)
+}
+
+func (c *streamConn) SetWriteDeadline(t time.Time) error {
+	if c.writeDeadline == nil {
+		if t.IsZero() {
+			return nil
+		}
+		return ErrDeadlineNotSupported
+	}
+	return c.writeDeadline(t)
+}
+
+// streamResponse turns the HTTP/1.1 response of the handshake written by
+// the conn into the one of the extended CONNECT, the frames after it are
+// written to the stream.
+type streamResponse struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+
+	head        []byte
+	wroteHeader bool
+}
+
+func (sr *streamResponse) Write(p []byte) (int, error) {
+	if sr.wroteHeader {
+		if _, err := sr.w.Write(p); err != nil {
+			return 0, err
+		}
+		return len(p), sr.rc.Flush()
+	}
+
+	sr.head = append(sr.head, p...)
+	end := bytes.Index(sr.head, emptyLine2)
+	if end < 0 {
+		return len(p), nil
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(sr.head[:end+4])), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	status := resp.StatusCode
+	if status == http.StatusSwitchingProtocols {
+		status = http.StatusOK
+	}
+	for k, vs := range resp.Header {
+		switch k {
+		case "Upgrade", "Connection", "Sec-Websocket-Accept", "Content-Length", "Transfer-Encoding":
+			continue
+		}
+		sr.w.Header()[k] = vs
+	}
+	sr.w.WriteHeader(status)
+	sr.wroteHeader = true
+
+	rest := sr.head[end+4:]
+	sr.head = nil
+	if len(rest) > 0 {
+		if _, err := sr.w.Write(rest); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), sr.rc.Flush()
+}
+
+// dialHTTP2 bootstraps a conn to u by the extended CONNECT of RFC 8441
+// through d.HTTP2.
+func (d *Dialer) dialHTTP2(ctx context.Context, u *url.URL) (*Conn, error) {
+	// the stream lasts until the conn is closed rather than ctx
+	streamCtx, cancel := context.WithCancel(context.Background())
+
+	var local, remote net.Addr
+	streamCtx = httptrace.WithClientTrace(streamCtx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			local, remote = info.Conn.LocalAddr(), info.Conn.RemoteAddr()
+		},
+	})
+
+	pr, pw := io.Pipe()
+	req, err := http.NewRequestWithContext(streamCtx, http.MethodConnect, httpURL(u).String(), pr)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	for k, vs := range d.Header {
+		req.Header[k] = append([]string(nil), vs...)
+	}
+	req.Header[":protocol"] = []string{"websocket"}
+	req.Header["Sec-WebSocket-Version"] = []string{"13"}
+	if len(d.Subprotocols) > 0 {
+		req.Header["Sec-WebSocket-Protocol"] = []string{strings.Join(d.Subprotocols, ", ")}
+	}
+	if len(d.Extensions) > 0 {
+		req.Header["Sec-WebSocket-Extensions"] = []string{offerExtensions(d.Extensions)}
+	}
+	if d.Jar != nil {
+		for _, cookie := range d.Jar.Cookies(httpURL(u)) {
+			req.AddCookie(cookie)
+		}
+	}
+
+	type result struct {
+		resp *http.Response
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := d.HTTP2.RoundTrip(req)
+		done <- result{resp, err}
+	}()
+
+	var res result
+	select {
+	case res = <-done:
+	case <-ctx.Done():
+		cancel()
+		pw.Close()
+		return nil, ctx.Err()
+	}
+	if res.err != nil {
+		cancel()
+		return nil, res.err
+	}
+	resp := res.resp
+
+	if d.Jar != nil {
+		if cookies := resp.Cookies(); len(cookies) > 0 {
+			d.Jar.SetCookies(httpURL(u), cookies)
+		}
+	}
+
+	fail := func(err error) (*Conn, error) {
+		resp.Body.Close()
+		pw.Close()
+		cancel()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fail(&HandshakeError{Status: resp.StatusCode, Err: ErrBadHandshakeResp})
+	}
+	if p := resp.Header.Get("Sec-WebSocket-Protocol"); p != "" && !slices.Contains(d.Subprotocols, p) {
+		return fail(&HandshakeError{ErrorString: "unexpected subprotocol: " + p})
+	}
+
+	sc := &streamConn{
+		r: resp.Body,
+		w: pw,
+		closeFn: func() error {
+			pw.Close()
+			cancel()
+			return resp.Body.Close()
+		},
+		local:  local,
+		remote: remote,
+		done:   make(chan struct{}),
+	}
+
+	conn := newConn(d.config(), sc)
+	conn.client = true
+	// there is no serve to release its reference of the pooled buffers
+	conn.releaseBuf()
+	conn.HandshakeResponse = resp
+	if err := conn.acceptExtensions(d.Extensions, resp.Header.Values("Sec-WebSocket-Extensions")...); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetState(StateOpen)
+	conn.startPings()
+	return conn, nil
+}
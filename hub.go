@@ -0,0 +1,309 @@
+package kiwi
+
+import (
+	"math/rand/v2"
+	"sort"
+	"sync"
+)
+
+const defaultHubHistorySize = 64
+
+type hubMember struct {
+	key    string
+	sender MessageSender
+}
+
+type hubTopic struct {
+	members map[uint64]*hubMember
+	history []*Message
+
+	// keys of the members restored from a snapshot but not resumed yet
+	pending map[string]bool
+
+	// to the topic of Hub.Broker
+	subscribed bool
+
+	// the conns of each non-empty key among the members
+	presence map[string]int
+}
+
+func newHubTopic() *hubTopic {
+	return &hubTopic{
+		members:  make(map[uint64]*hubMember),
+		pending:  make(map[string]bool),
+		presence: make(map[string]int),
+	}
+}
+
+// add adds the member of conn id, and appends the join of its key to events
+// if it's the first conn of it. A conn joining again by another key leaves
+// the former one.
+func (t *hubTopic) add(topic string, id uint64, m *hubMember, events []presenceEvent) []presenceEvent {
+	if old, ok := t.members[id]; ok {
+		if old.key == m.key {
+			t.members[id] = m
+			return events
+		}
+		events = t.remove(topic, id, events)
+	}
+
+	t.members[id] = m
+	if m.key == "" {
+		return events
+	}
+	if t.presence[m.key]++; t.presence[m.key] == 1 {
+		events = append(events, presenceEvent{topic, m.key, true})
+	}
+	return events
+}
+
+// remove removes the member of conn id, and appends the leave of its key to
+// events if it was the last conn of it.
+func (t *hubTopic) remove(topic string, id uint64, events []presenceEvent) []presenceEvent {
+	m, ok := t.members[id]
+	if !ok {
+		return events
+	}
+
+	delete(t.members, id)
+	if t.unref(m.key) {
+		events = append(events, presenceEvent{topic, m.key, false})
+	}
+	return events
+}
+
+func (t *hubTopic) unref(key string) (left bool) {
+	if key == "" {
+		return false
+	}
+	if t.presence[key]--; t.presence[key] > 0 {
+		return false
+	}
+	delete(t.presence, key)
+	return true
+}
+
+// openSenders returns the senders of the open members, the closed ones are
+// removed.
+func (t *hubTopic) openSenders(topic string) ([]MessageSender, []presenceEvent) {
+	var events []presenceEvent
+	senders := make([]MessageSender, 0, len(t.members))
+	for id, m := range t.members {
+		if !m.sender.IsConnOpen() {
+			events = t.remove(topic, id, events)
+			continue
+		}
+		senders = append(senders, m.sender)
+	}
+	return senders, events
+}
+
+func (t *hubTopic) appendHistory(msg *Message, size int) {
+	t.history = append(t.history, msg)
+	if over := len(t.history) - size; over > 0 {
+		t.history = append(t.history[:0:0], t.history[over:]...)
+	}
+}
+
+// Hub groups conns into topics, messages published to a topic are sent to
+// all its members and kept in a bounded history.
+type Hub struct {
+	// max messages kept per topic, defaultHubHistorySize is used if it's
+	// zero and no history is kept if it's negative
+	HistorySize int
+
+	// fans the messages out to the hubs of the other instances if it's not
+	// nil, it must be set before the hub is used
+	Broker Broker
+
+	// called with the errors of Broker, which are otherwise ignored
+	OnBrokerError func(err error)
+
+	// called once the first conn of a member key joins a topic and once the
+	// last one leaves it, the members joined with an empty key are not
+	// tracked. They're not called with the lock of the hub held
+	OnJoin  func(topic, key string)
+	OnLeave func(topic, key string)
+
+	// makes the messages sent by PushPresence, presenceJSON if it's nil
+	PresenceMessage func(topic string, keys []string) *Message
+
+	topics map[string]*hubTopic
+	mu     sync.Mutex
+
+	// tells the messages of this hub coming back from Broker
+	id uint64
+}
+
+func NewHub() *Hub {
+	return &Hub{topics: make(map[string]*hubTopic), id: rand.Uint64()}
+}
+
+func (h *Hub) historySize() int {
+	if h.HistorySize == 0 {
+		return defaultHubHistorySize
+	}
+	return h.HistorySize
+}
+
+func (h *Hub) topic(name string) *hubTopic {
+	t, ok := h.topics[name]
+	if !ok {
+		t = newHubTopic()
+		h.topics[name] = t
+	}
+	if h.Broker != nil && !t.subscribed {
+		err := h.Broker.Subscribe(name, func(data []byte) { h.fromBroker(name, data) })
+		h.brokerError(err)
+		t.subscribed = err == nil
+	}
+	return t
+}
+
+// Join adds the conn of s to topic, key identifies the member across
+// reconnects and may be empty if that's not needed.
+func (h *Hub) Join(topic, key string, s MessageSender) {
+	h.mu.Lock()
+	t := h.topic(topic)
+	events := t.add(topic, s.GetConn().ID, &hubMember{key, s}, nil)
+	delete(t.pending, key)
+	h.mu.Unlock()
+
+	h.firePresence(events)
+}
+
+func (h *Hub) Leave(topic string, s MessageSender) {
+	h.mu.Lock()
+	var events []presenceEvent
+	if t, ok := h.topics[topic]; ok {
+		events = t.remove(topic, s.GetConn().ID, events)
+	}
+	h.mu.Unlock()
+
+	h.firePresence(events)
+}
+
+// LeaveAll removes the conn of s from every topic, it's usually called
+// when the conn is closing.
+func (h *Hub) LeaveAll(s MessageSender) {
+	h.mu.Lock()
+	var events []presenceEvent
+	for name, t := range h.topics {
+		events = t.remove(name, s.GetConn().ID, events)
+	}
+	h.mu.Unlock()
+
+	h.firePresence(events)
+}
+
+// Resume joins s to all the topics key was a member of in the restored
+// snapshot, and returns their names.
+func (h *Hub) Resume(key string, s MessageSender) []string {
+	h.mu.Lock()
+	var topics []string
+	var events []presenceEvent
+	for name, t := range h.topics {
+		if t.pending[key] {
+			delete(t.pending, key)
+			events = t.add(name, s.GetConn().ID, &hubMember{key, s}, events)
+			topics = append(topics, name)
+		}
+	}
+	h.mu.Unlock()
+
+	h.firePresence(events)
+	sort.Strings(topics)
+	return topics
+}
+
+// Publish sends msg to the members of topic, and to the ones of the other
+// instances through Broker.
+func (h *Hub) Publish(topic string, msg *Message) {
+	h.deliver(topic, msg)
+	if h.Broker != nil {
+		h.brokerError(h.Broker.Publish(topic, h.encodeBrokered(msg)))
+	}
+}
+
+func (h *Hub) deliver(topic string, msg *Message) {
+	h.mu.Lock()
+
+	t := h.topic(topic)
+	if size := h.historySize(); size > 0 {
+		t.appendHistory(msg, size)
+	}
+
+	senders, events := t.openSenders(topic)
+	h.mu.Unlock()
+
+	h.firePresence(events)
+	for _, s := range senders {
+		s.SendWhole(msg, false)
+	}
+}
+
+func (h *Hub) History(topic string) []*Message {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if t, ok := h.topics[topic]; ok {
+		return append([]*Message(nil), t.history...)
+	}
+	return nil
+}
+
+type TopicSnapshot struct {
+	Members []string   `json:"members"`
+	History []*Message `json:"history"`
+}
+
+// HubSnapshot holds the topic membership by member keys and the history
+// buffers of a Hub, it can be encoded as JSON to be moved to other instances.
+type HubSnapshot struct {
+	Topics map[string]*TopicSnapshot `json:"topics"`
+}
+
+// Snapshot exports the hub state, members joined with an empty key are
+// not included.
+func (h *Hub) Snapshot() *HubSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	snap := &HubSnapshot{Topics: make(map[string]*TopicSnapshot, len(h.topics))}
+	for name, t := range h.topics {
+		ts := &TopicSnapshot{History: append([]*Message(nil), t.history...)}
+
+		for _, m := range t.members {
+			if m.key != "" {
+				ts.Members = append(ts.Members, m.key)
+			}
+		}
+		for key := range t.pending {
+			ts.Members = append(ts.Members, key)
+		}
+
+		sort.Strings(ts.Members)
+		snap.Topics[name] = ts
+	}
+	return snap
+}
+
+// Restore imports snap into the hub, the restored members are pending until
+// they are resumed by Resume or Join with the same key.
+func (h *Hub) Restore(snap *HubSnapshot) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for name, ts := range snap.Topics {
+		t := h.topic(name)
+		if size := h.historySize(); size > 0 {
+			for _, msg := range ts.History {
+				t.appendHistory(msg, size)
+			}
+		}
+
+		for _, key := range ts.Members {
+			t.pending[key] = true
+		}
+	}
+}
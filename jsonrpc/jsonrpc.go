@@ -0,0 +1,339 @@
+// Package jsonrpc layers JSON-RPC 2.0 over kiwi conns. Both peers of a Conn
+// can call the methods of the other, the requests and the responses are
+// correlated by their id, and the batches of requests are served
+// concurrently.
+package jsonrpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+
+	"github.com/mconintet/kiwi"
+)
+
+// Subprotocol may be negotiated by the handshake of the JSON-RPC conns.
+const Subprotocol = "jsonrpc-2.0"
+
+const version = "2.0"
+
+// the error codes defined by the spec
+const (
+	CodeParseError     = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	CodeInternalError  = -32603
+)
+
+var ErrClosed = errors.New("jsonrpc: conn closed")
+
+// Error is the error object of a response. The handlers may return one to
+// choose its code, the other errors are sent with CodeInternalError.
+type Error struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return "jsonrpc: " + e.Message + " (" + strconv.Itoa(e.Code) + ")"
+}
+
+// Handler serves a method, params is null if the request has none. ctx is
+// canceled once the conn is closed.
+type Handler func(ctx context.Context, params json.RawMessage) (result any, err error)
+
+// Mux holds the methods served by the conns, it must not be changed once
+// they are serving.
+type Mux struct {
+	methods map[string]Handler
+}
+
+func NewMux() *Mux {
+	return &Mux{methods: make(map[string]Handler)}
+}
+
+func (m *Mux) Handle(method string, h Handler) {
+	m.methods[method] = h
+}
+
+type message struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+}
+
+func (msg *message) isRequest() bool {
+	return msg.Method != ""
+}
+
+// Conn is a JSON-RPC peer over a kiwi conn.
+type Conn struct {
+	r   kiwi.MessageReceiver
+	s   kiwi.MessageSender
+	mux *Mux
+
+	mu      sync.Mutex
+	lastID  int64
+	pending map[string]chan *message
+	closed  bool
+}
+
+// NewConn makes a peer serving the methods of mux, which may be nil for a
+// peer only calling. Serve must be running for the calls to get their
+// responses.
+func NewConn(r kiwi.MessageReceiver, s kiwi.MessageSender, mux *Mux) *Conn {
+	if mux == nil {
+		mux = NewMux()
+	}
+	return &Conn{r: r, s: s, mux: mux, pending: make(map[string]chan *message)}
+}
+
+// Serve reads the requests and the responses until the conn is no longer
+// readable, the close of the peer is replied. The conn is closed once it
+// returns, after that the calls still waiting for their responses fail with
+// ErrClosed and Serve waits for the handlers to return.
+func (c *Conn) Serve() error {
+	defer c.close()
+
+	conn := c.r.GetConn()
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	// cancels the context of the handlers
+	defer conn.Close()
+
+	for msg, err := range c.r.Messages(0) {
+		if err != nil {
+			return err
+		}
+
+		if msg.IsClose() {
+			conn.CloseWithCode(kiwi.CloseCodeNormalClosure, "")
+			return nil
+		}
+		if !msg.IsText() && !msg.IsBinary() {
+			continue
+		}
+
+		// the message is released by the next read
+		data := bytes.Clone(msg.Data)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.handle(conn.Context(), data)
+		}()
+	}
+	return nil
+}
+
+func (c *Conn) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+}
+
+// handle serves a message or a batch of them.
+func (c *Conn) handle(ctx context.Context, data []byte) {
+	data = bytes.TrimSpace(data)
+
+	if len(data) > 0 && data[0] == '[' {
+		var batch []*message
+		if err := json.Unmarshal(data, &batch); err != nil {
+			c.send(errorResponse(nil, CodeParseError, err.Error()))
+			return
+		}
+		if len(batch) == 0 {
+			c.send(errorResponse(nil, CodeInvalidRequest, "empty batch"))
+			return
+		}
+
+		responses := make([]*message, len(batch))
+		var wg sync.WaitGroup
+		for i, msg := range batch {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				responses[i] = c.dispatch(ctx, msg)
+			}()
+		}
+		wg.Wait()
+
+		// no response is sent for a batch of notifications
+		var replies []*message
+		for _, resp := range responses {
+			if resp != nil {
+				replies = append(replies, resp)
+			}
+		}
+		if len(replies) > 0 {
+			c.send(replies)
+		}
+		return
+	}
+
+	msg := &message{}
+	if err := json.Unmarshal(data, msg); err != nil {
+		c.send(errorResponse(nil, CodeParseError, err.Error()))
+		return
+	}
+	if resp := c.dispatch(ctx, msg); resp != nil {
+		c.send(resp)
+	}
+}
+
+// dispatch serves a request and returns its response, nil for the
+// notifications. A response is delivered to its call.
+func (c *Conn) dispatch(ctx context.Context, msg *message) *message {
+	if msg == nil {
+		return errorResponse(nil, CodeInvalidRequest, "invalid request")
+	}
+	if msg.JSONRPC != version {
+		return errorResponse(msg.ID, CodeInvalidRequest, "invalid request")
+	}
+
+	if !msg.isRequest() {
+		c.deliver(msg)
+		return nil
+	}
+
+	h, ok := c.mux.methods[msg.Method]
+	if !ok {
+		if msg.ID == nil {
+			return nil
+		}
+		return errorResponse(msg.ID, CodeMethodNotFound, "method not found: "+msg.Method)
+	}
+
+	params := msg.Params
+	if params == nil {
+		params = json.RawMessage("null")
+	}
+	result, err := h(ctx, params)
+	if msg.ID == nil {
+		return nil
+	}
+
+	if err != nil {
+		var re *Error
+		if errors.As(err, &re) {
+			return &message{JSONRPC: version, ID: msg.ID, Error: re}
+		}
+		return errorResponse(msg.ID, CodeInternalError, err.Error())
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return errorResponse(msg.ID, CodeInternalError, err.Error())
+	}
+	return &message{JSONRPC: version, ID: msg.ID, Result: data}
+}
+
+func errorResponse(id json.RawMessage, code int, text string) *message {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	return &message{JSONRPC: version, ID: id, Error: &Error{Code: code, Message: text}}
+}
+
+// deliver passes a response to its call, the unknown ones are dropped.
+func (c *Conn) deliver(resp *message) {
+	c.mu.Lock()
+	ch, ok := c.pending[string(resp.ID)]
+	delete(c.pending, string(resp.ID))
+	c.mu.Unlock()
+
+	if ok {
+		ch <- resp
+	}
+}
+
+func (c *Conn) send(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = c.s.SendWhole(&kiwi.Message{Opcode: kiwi.OpcodeText, Data: data}, false)
+	return err
+}
+
+// Call calls method with params and decodes its result into result, which
+// may be nil to ignore it. It returns an *Error if the peer responds with
+// one, and ctx.Err() if ctx is done before the response.
+func (c *Conn) Call(ctx context.Context, method string, params, result any) error {
+	req, err := newRequest(method, params)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrClosed
+	}
+	c.lastID++
+	req.ID = strconv.AppendInt(nil, c.lastID, 10)
+	ch := make(chan *message, 1)
+	c.pending[string(req.ID)] = ch
+	c.mu.Unlock()
+
+	if err := c.send(req); err != nil {
+		c.forget(req.ID)
+		return err
+	}
+
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			return ErrClosed
+		}
+		if resp.Error != nil {
+			return resp.Error
+		}
+		if result == nil {
+			return nil
+		}
+		return json.Unmarshal(resp.Result, result)
+	case <-ctx.Done():
+		c.forget(req.ID)
+		return ctx.Err()
+	}
+}
+
+func (c *Conn) forget(id json.RawMessage) {
+	c.mu.Lock()
+	delete(c.pending, string(id))
+	c.mu.Unlock()
+}
+
+// Notify calls method without waiting for a response, none is sent.
+func (c *Conn) Notify(method string, params any) error {
+	req, err := newRequest(method, params)
+	if err != nil {
+		return err
+	}
+	return c.send(req)
+}
+
+func newRequest(method string, params any) (*message, error) {
+	req := &message{JSONRPC: version, Method: method}
+	if params != nil {
+		data, err := json.Marshal(params)
+		if err != nil {
+			return nil, err
+		}
+		req.Params = data
+	}
+	return req, nil
+}
@@ -0,0 +1,168 @@
+package jsonrpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mconintet/kiwi"
+)
+
+func newTestConn(t *testing.T, mux *Mux) *Conn {
+	srv := kiwi.NewServer()
+	srv.ApplyDefaultCfg()
+	srv.OnConnOpenFunc("/rpc", func(r kiwi.MessageReceiver, s kiwi.MessageSender) {
+		NewConn(r, s, mux).Serve()
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go srv.Serve(ln)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	kc, err := kiwi.Dial(ctx, "ws://"+ln.Addr().String()+"/rpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { kc.Close() })
+
+	c := NewConn((&kiwi.DefaultMessageReceiver{}).SetConn(kc), (&kiwi.DefaultMessageSender{}).SetConn(kc), nil)
+	go c.Serve()
+	return c
+}
+
+func TestCall(t *testing.T) {
+	notified := make(chan string, 1)
+
+	mux := NewMux()
+	mux.Handle("add", func(ctx context.Context, params json.RawMessage) (any, error) {
+		var nums []int
+		if err := json.Unmarshal(params, &nums); err != nil {
+			return nil, &Error{Code: CodeInvalidParams, Message: err.Error()}
+		}
+		sum := 0
+		for _, n := range nums {
+			sum += n
+		}
+		return sum, nil
+	})
+	mux.Handle("log", func(ctx context.Context, params json.RawMessage) (any, error) {
+		notified <- string(params)
+		return nil, nil
+	})
+	mux.Handle("slow", func(ctx context.Context, params json.RawMessage) (any, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+
+	c := newTestConn(t, mux)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var sum int
+	if err := c.Call(ctx, "add", []int{1, 2, 3}, &sum); err != nil || sum != 6 {
+		t.Fatalf("got %d, %v; want 6", sum, err)
+	}
+
+	var re *Error
+	if err := c.Call(ctx, "add", "x", nil); !errors.As(err, &re) || re.Code != CodeInvalidParams {
+		t.Fatalf("got %v; want invalid params", err)
+	}
+	if err := c.Call(ctx, "nope", nil, nil); !errors.As(err, &re) || re.Code != CodeMethodNotFound {
+		t.Fatalf("got %v; want method not found", err)
+	}
+
+	if err := c.Notify("log", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-notified; got != `"hello"` {
+		t.Fatalf("got %s", got)
+	}
+
+	short, cancelShort := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancelShort()
+	if err := c.Call(short, "slow", nil, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v; want the deadline", err)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	mux := NewMux()
+	mux.Handle("double", func(ctx context.Context, params json.RawMessage) (any, error) {
+		var n int
+		json.Unmarshal(params, &n)
+		return 2 * n, nil
+	})
+
+	var replies []message
+	c := NewConn(nil, &captureSender{got: func(data []byte) { json.Unmarshal(data, &replies) }}, mux)
+
+	batch := `[
+		{"jsonrpc":"2.0","id":1,"method":"double","params":1},
+		{"jsonrpc":"2.0","method":"double","params":2},
+		{"jsonrpc":"2.0","id":"b","method":"missing"},
+		{"jsonrpc":"1.0","id":3,"method":"double"}
+	]`
+
+	c.handle(context.Background(), []byte(batch))
+
+	if len(replies) != 3 {
+		t.Fatalf("got %d replies; want 3", len(replies))
+	}
+	byID := map[string]message{}
+	for _, r := range replies {
+		byID[string(r.ID)] = r
+	}
+	if r := byID["1"]; string(r.Result) != "2" {
+		t.Fatalf("got %+v for 1", r)
+	}
+	if r := byID[`"b"`]; r.Error == nil || r.Error.Code != CodeMethodNotFound {
+		t.Fatalf("got %+v for b", r)
+	}
+	if r := byID["3"]; r.Error == nil || r.Error.Code != CodeInvalidRequest {
+		t.Fatalf("got %+v for the invalid request", r)
+	}
+
+	// a batch of notifications gets no response
+	replies = nil
+	c.handle(context.Background(), []byte(`[{"jsonrpc":"2.0","method":"double","params":1}]`))
+	if replies != nil {
+		t.Fatalf("got %+v", replies)
+	}
+}
+
+// captureSender passes the data sent to got.
+type captureSender struct {
+	kiwi.DefaultMessageSender
+	got func(data []byte)
+}
+
+func (s *captureSender) SendWhole(msg *kiwi.Message, mask bool) (int, error) {
+	s.got(msg.Data)
+	return len(msg.Data), nil
+}
+
+func TestClosed(t *testing.T) {
+	mux := NewMux()
+	mux.Handle("hang", func(ctx context.Context, params json.RawMessage) (any, error) {
+		<-ctx.Done()
+		return nil, nil
+	})
+
+	c := newTestConn(t, mux)
+	done := make(chan error, 1)
+	go func() { done <- c.Call(context.Background(), "hang", nil, nil) }()
+
+	time.Sleep(20 * time.Millisecond)
+	c.r.GetConn().Close()
+	if err := <-done; !errors.Is(err, ErrClosed) {
+		t.Fatalf("got %v; want ErrClosed", err)
+	}
+}
@@ -46,6 +46,9 @@ const (
 	CloseCodeMessageTooBig           = uint16(1009)
 	CloseCodeMandatoryExt            = uint16(1010)
 	CloseCodeInternalServerError     = uint16(1011)
+	CloseCodeServiceRestart          = uint16(1012)
+	CloseCodeTryAgainLater           = uint16(1013)
+	CloseCodeBadGateway              = uint16(1014)
 	CloseCodeTLSHandshake            = uint16(1015)
 )
 
@@ -61,6 +64,9 @@ var closeCodeText = map[uint16]string{
 	CloseCodeMessageTooBig:           "Message Too Big",
 	CloseCodeMandatoryExt:            "Mandatory Ext",
 	CloseCodeInternalServerError:     "Internal Server Error",
+	CloseCodeServiceRestart:          "Service Restart",
+	CloseCodeTryAgainLater:           "Try Again Later",
+	CloseCodeBadGateway:              "Bad Gateway",
 	CloseCodeTLSHandshake:            "TLS handshake",
 }
 
@@ -0,0 +1,314 @@
+// Package kiwibench load tests a websocket echo server, like the
+// kiwi-echo command: it opens many client conns, sends messages of a
+// given size and rate on each of them, and reports the percentiles of
+// the round trips and the errors. See cmd/kiwibench for the command.
+package kiwibench
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mconintet/kiwi"
+)
+
+// the round trip time is carried by the first bytes of each message, in
+// hex so the text messages stay valid UTF-8
+const stampLen = 16
+
+// Config of a run, the zero fields are replaced by the defaults.
+type Config struct {
+	// of the echo server, like ws://localhost:8080/
+	URL string
+
+	// the conns opened concurrently, 1 by default
+	Conns int
+
+	// how long the messages are sent, 10 seconds by default
+	Duration time.Duration
+
+	// messages per second of each conn, zero sends the next message once
+	// the echo of the last one is read
+	Rate float64
+
+	// bytes of each message, 64 by default and at least 16
+	Size int
+
+	// sends binary messages instead of text
+	Binary bool
+
+	// dials the conns, kiwi.DefaultDialer if it's nil
+	Dialer *kiwi.Dialer
+}
+
+// Report is the result of a run.
+type Report struct {
+	Conns      int
+	DialErrors int
+
+	Sent     uint64
+	Received uint64
+	// the failed sends and reads, each ends its conn
+	Errors uint64
+
+	// from the first message sent to the last echo read
+	Duration time.Duration
+
+	// the round trips of the messages echoed, sorted
+	latencies []time.Duration
+}
+
+// Percentile returns the round trip under which p percent of the messages
+// were echoed, zero if none was.
+func (r *Report) Percentile(p float64) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	i := int(float64(len(r.latencies)-1) * p / 100)
+	return r.latencies[min(max(i, 0), len(r.latencies)-1)]
+}
+
+// Mean returns the mean round trip.
+func (r *Report) Mean() time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	var sum time.Duration
+	for _, d := range r.latencies {
+		sum += d
+	}
+	return sum / time.Duration(len(r.latencies))
+}
+
+// WriteTo writes the report in a human readable form.
+func (r *Report) WriteTo(w io.Writer) (int64, error) {
+	secs := r.Duration.Seconds()
+	if secs == 0 {
+		secs = 1
+	}
+	n, err := fmt.Fprintf(w, "conns:     %d (%d failed to dial)\n"+
+		"messages:  %d sent, %d received, %d errors\n"+
+		"rate:      %.1f msg/s\n"+
+		"latency:   mean %s, p50 %s, p90 %s, p99 %s, max %s\n",
+		r.Conns, r.DialErrors,
+		r.Sent, r.Received, r.Errors,
+		float64(r.Received)/secs,
+		r.Mean(), r.Percentile(50), r.Percentile(90), r.Percentile(99), r.Percentile(100))
+	return int64(n), err
+}
+
+// Run dials the conns and drives them until cfg.Duration has passed or ctx
+// is done, the echoes still in flight then are waited for a second. It
+// fails only if no conn could be dialed.
+func Run(ctx context.Context, cfg *Config) (*Report, error) {
+	c := *cfg
+	if c.Conns <= 0 {
+		c.Conns = 1
+	}
+	if c.Duration <= 0 {
+		c.Duration = 10 * time.Second
+	}
+	if c.Size <= 0 {
+		c.Size = 64
+	}
+	c.Size = max(c.Size, stampLen)
+	if c.Dialer == nil {
+		c.Dialer = kiwi.DefaultDialer
+	}
+
+	conns := make([]*kiwi.Conn, c.Conns)
+	var dialErr error
+	rep := &Report{}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for i := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			kc, err := c.Dialer.Dial(ctx, c.URL)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				rep.DialErrors++
+				dialErr = err
+				return
+			}
+			conns[i] = kc
+			rep.Conns++
+		}()
+	}
+	wg.Wait()
+	if rep.Conns == 0 {
+		return nil, fmt.Errorf("kiwibench: no conn dialed: %w", dialErr)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.Duration)
+	defer cancel()
+
+	start := time.Now()
+	workers := make([]*worker, 0, rep.Conns)
+	for _, kc := range conns {
+		if kc == nil {
+			continue
+		}
+		w := &worker{cfg: &c, conn: kc, start: start, echoed: make(chan struct{}, 1)}
+		workers = append(workers, w)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.run(ctx)
+		}()
+	}
+	wg.Wait()
+	rep.Duration = time.Since(start)
+
+	for _, w := range workers {
+		rep.Sent += w.sent
+		rep.Received += w.received.Load()
+		rep.Errors += w.errors
+		rep.latencies = append(rep.latencies, w.latencies...)
+	}
+	slices.Sort(rep.latencies)
+	return rep, nil
+}
+
+type worker struct {
+	cfg   *Config
+	conn  *kiwi.Conn
+	start time.Time
+
+	// signals the sender of the closed loop
+	echoed chan struct{}
+
+	// owned by the sender and the reader until run returns
+	sent      uint64
+	errors    uint64
+	received  atomic.Uint64
+	latencies []time.Duration
+	readErr   error
+}
+
+func (w *worker) run(ctx context.Context) {
+	defer w.conn.Close()
+
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		w.read()
+	}()
+
+	sendErr := w.send(ctx)
+	if sendErr != nil {
+		w.errors++
+	}
+
+	// the echoes in flight
+	t := time.NewTimer(time.Second)
+	defer t.Stop()
+wait:
+	for sendErr == nil && w.received.Load() < w.sent {
+		select {
+		case <-w.echoed:
+		case <-readDone:
+			break wait
+		case <-t.C:
+			break wait
+		}
+	}
+	w.conn.CloseWithCode(kiwi.CloseCodeNormalClosure, "")
+	<-readDone
+
+	if w.readErr != nil && !errors.Is(w.readErr, kiwi.ErrConnIsNotOpen) && !w.closedByUs() {
+		w.errors++
+	}
+}
+
+// closedByUs tells if the read error is of the conn closed by run.
+func (w *worker) closedByUs() bool {
+	return w.conn.Context().Err() != nil
+}
+
+func (w *worker) send(ctx context.Context) error {
+	opcode := kiwi.OpcodeText
+	if w.cfg.Binary {
+		opcode = kiwi.OpcodeBinary
+	}
+
+	var tick <-chan time.Time
+	if w.cfg.Rate > 0 {
+		t := time.NewTicker(time.Duration(float64(time.Second) / w.cfg.Rate))
+		defer t.Stop()
+		tick = t.C
+	}
+
+	data := make([]byte, w.cfg.Size)
+	for i := stampLen; i < len(data); i++ {
+		data[i] = 'x'
+	}
+
+	for {
+		if tick != nil {
+			select {
+			case <-tick:
+			case <-ctx.Done():
+				return nil
+			}
+		} else if ctx.Err() != nil {
+			return nil
+		}
+
+		stamp := strconv.AppendUint(nil, uint64(time.Since(w.start)), 16)
+		for i := range stampLen {
+			data[i] = '0'
+		}
+		copy(data[stampLen-len(stamp):], stamp)
+
+		if err := w.conn.Send(&kiwi.Message{Opcode: opcode, Data: data}); err != nil {
+			return err
+		}
+		w.sent++
+
+		if tick == nil {
+			select {
+			case <-w.echoed:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}
+}
+
+func (w *worker) read() {
+	r := (&kiwi.DefaultMessageReceiver{}).SetConn(w.conn)
+	for msg, err := range r.Messages(0) {
+		if err != nil {
+			w.readErr = err
+			return
+		}
+
+		switch {
+		case msg.IsPing():
+			w.conn.Send(&kiwi.Message{Opcode: kiwi.OpcodePong, Data: msg.Data})
+		case msg.IsClose():
+			return
+		case len(msg.Data) >= stampLen:
+			sent, err := strconv.ParseUint(string(msg.Data[:stampLen]), 16, 64)
+			if err == nil {
+				w.latencies = append(w.latencies, time.Since(w.start)-time.Duration(sent))
+				w.received.Add(1)
+				select {
+				case w.echoed <- struct{}{}:
+				default:
+				}
+			}
+		}
+		msg.Release()
+	}
+}
@@ -0,0 +1,79 @@
+package kiwibench
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mconintet/kiwi"
+)
+
+func listenEcho(t *testing.T) string {
+	srv := kiwi.NewServer()
+	srv.ApplyDefaultCfg()
+	srv.OnConnOpenFunc("/", func(r kiwi.MessageReceiver, s kiwi.MessageSender) {
+		for msg, err := range r.Messages(0) {
+			if err != nil {
+				return
+			}
+			if msg.IsClose() {
+				s.SendClose(kiwi.CloseCodeNormalClosure, "", false, false)
+				return
+			}
+			s.SendWhole(msg, false)
+			msg.Release()
+		}
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go srv.Serve(ln)
+	return "ws://" + ln.Addr().String() + "/"
+}
+
+func TestRun(t *testing.T) {
+	url := listenEcho(t)
+
+	for _, cfg := range []*Config{
+		{URL: url, Conns: 4, Duration: 200 * time.Millisecond},
+		{URL: url, Conns: 2, Duration: 200 * time.Millisecond, Rate: 100, Size: 1024, Binary: true},
+	} {
+		rep, err := Run(context.Background(), cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rep.Conns != cfg.Conns || rep.Errors != 0 || rep.Sent == 0 || rep.Received != rep.Sent {
+			t.Fatalf("got %+v; want all the messages echoed", rep)
+		}
+		if p50, p99 := rep.Percentile(50), rep.Percentile(99); p50 <= 0 || p99 < p50 || rep.Percentile(100) < p99 {
+			t.Fatalf("got p50 %v and p99 %v", p50, p99)
+		}
+		if cfg.Rate > 0 && (rep.Sent < 20 || rep.Sent > 60) {
+			t.Fatalf("got %d sent; want about 40 at 100/s on 2 conns", rep.Sent)
+		}
+
+		var buf bytes.Buffer
+		rep.WriteTo(&buf)
+		if !bytes.Contains(buf.Bytes(), []byte("p99")) {
+			t.Fatalf("got %q", buf.String())
+		}
+	}
+}
+
+func TestRunDialErrors(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "ws://" + ln.Addr().String() + "/"
+	ln.Close()
+
+	if _, err := Run(context.Background(), &Config{URL: url, Conns: 2, Duration: time.Millisecond}); err == nil {
+		t.Fatal("got no error without any conn")
+	}
+}
@@ -0,0 +1,132 @@
+package kiwitest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mconintet/kiwi"
+)
+
+// Clock is a fake kiwi.Clock whose time only moves by Advance, so the pings,
+// the connection ages and the timeouts of a kiwi.Server using it fire when
+// the test tells them to.
+type Clock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+var _ kiwi.Clock = (*Clock)(nil)
+
+// NewClock returns a Clock set at now.
+func NewClock(now time.Time) *Clock {
+	return &Clock{now: now}
+}
+
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the time forward by d and fires the timers and the tickers
+// due by then, a ticker due several times fires once like a time.Ticker
+// whose receiver is late.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+	live := c.timers[:0]
+	for _, t := range c.timers {
+		if t.stopped {
+			continue
+		}
+		if !t.when.After(c.now) {
+			select {
+			case t.c <- c.now:
+			default:
+			}
+			if t.period == 0 {
+				t.stopped = true
+				continue
+			}
+			for !t.when.After(c.now) {
+				t.when = t.when.Add(t.period)
+			}
+		}
+		live = append(live, t)
+	}
+	c.timers = live
+}
+
+// Timers returns the number of the timers and the tickers not fired or
+// stopped yet, a test can wait for the code under test to arm one before
+// it advances the time.
+func (c *Clock) Timers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 0
+	for _, t := range c.timers {
+		if !t.stopped {
+			n++
+		}
+	}
+	return n
+}
+
+func (c *Clock) NewTimer(d time.Duration) kiwi.ClockTimer {
+	return c.add(d, 0)
+}
+
+func (c *Clock) NewTicker(d time.Duration) kiwi.ClockTicker {
+	if d <= 0 {
+		panic("kiwitest: non-positive interval for NewTicker")
+	}
+	return fakeTicker{c.add(d, d)}
+}
+
+func (c *Clock) add(d, period time.Duration) *fakeTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &fakeTimer{clock: c, when: c.now.Add(d), period: period, c: make(chan time.Time, 1)}
+	if d <= 0 && period == 0 {
+		t.c <- c.now
+		t.stopped = true
+		return t
+	}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+type fakeTimer struct {
+	clock  *Clock
+	when   time.Time
+	period time.Duration
+	c      chan time.Time
+
+	// guarded by clock.mu
+	stopped bool
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+// Stop reports whether it stopped the timer before it fired.
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	active := !t.stopped
+	t.stopped = true
+	return active
+}
+
+type fakeTicker struct{ *fakeTimer }
+
+func (t fakeTicker) Stop() {
+	t.fakeTimer.Stop()
+}
@@ -0,0 +1,335 @@
+// Package kiwitest provides an in-memory transport built on net.Pipe and a
+// scriptable fake peer, so the kiwi servers and clients can be tested
+// without binding ports.
+package kiwitest
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mconintet/kiwi"
+)
+
+// URL is the base url of the servers bound to a Listener, the host is
+// ignored by its dialer.
+const URL = "ws://kiwitest"
+
+const (
+	defaultTimeout    = 5 * time.Second
+	maxPeerPayloadLen = 1 << 26
+)
+
+var ErrListenerClosed = errors.New("kiwitest: listener closed")
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "kiwitest" }
+
+// Listener is an in-memory net.Listener, the conns accepted by it are the
+// server ends of the pipes opened by its Dial.
+type Listener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func NewListener() *Listener {
+	return &Listener{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, ErrListenerClosed
+	}
+}
+
+func (l *Listener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+func (l *Listener) Dial() (net.Conn, error) {
+	return l.DialContext(context.Background(), "pipe", "kiwitest")
+}
+
+// DialContext opens a pipe to the listener, network and addr are ignored.
+// It blocks until the pipe is accepted.
+func (l *Listener) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		client.Close()
+		server.Close()
+		return nil, ErrListenerClosed
+	case <-ctx.Done():
+		client.Close()
+		server.Close()
+		return nil, ctx.Err()
+	}
+}
+
+// Dialer returns a kiwi.Dialer dialing the listener, whatever the host of
+// the dialed url.
+func (l *Listener) Dialer() *kiwi.Dialer {
+	return &kiwi.Dialer{NetDialContext: l.DialContext}
+}
+
+// Serve serves srv on a new Listener, which is closed at the end of the
+// test. srv should be configured before.
+func Serve(tb testing.TB, srv *kiwi.Server) *Listener {
+	tb.Helper()
+
+	ln := NewListener()
+	go srv.Serve(ln)
+	tb.Cleanup(func() { ln.Close() })
+	return ln
+}
+
+// Peer is a fake client driven step by step by the test. It writes raw
+// bytes or frames as they are, and buffers the frames received so the
+// server never blocks on writing to it. Its methods fail the test on errors.
+type Peer struct {
+	// bounds the waits of ReadFrame, defaultTimeout is used if it's zero
+	Timeout time.Duration
+
+	// the handshake response of the server
+	Response *http.Response
+
+	tb   testing.TB
+	conn net.Conn
+	br   *bufio.Reader
+
+	mu      sync.Mutex
+	frames  []*kiwi.Frame
+	readErr error
+	notify  chan struct{}
+}
+
+// Connect opens a pipe to ln without a handshake.
+func Connect(tb testing.TB, ln *Listener) *Peer {
+	tb.Helper()
+
+	conn, err := ln.Dial()
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	p := &Peer{
+		tb:     tb,
+		conn:   conn,
+		br:     bufio.NewReader(conn),
+		notify: make(chan struct{}, 1),
+	}
+	tb.Cleanup(func() { conn.Close() })
+	return p
+}
+
+// DialPeer connects to ln and does the handshake of path, the test fails if
+// the server does not switch the protocols.
+func DialPeer(tb testing.TB, ln *Listener, path string) *Peer {
+	tb.Helper()
+
+	p := Connect(tb, ln)
+	if resp := p.Handshake(path, nil); resp.StatusCode != http.StatusSwitchingProtocols {
+		tb.Fatalf("kiwitest: handshake of %s failed with %d", path, resp.StatusCode)
+	}
+	return p
+}
+
+// Handshake sends the handshake request of path with the extra header, and
+// returns the response. The frames are read in the background once the
+// protocols are switched.
+func (p *Peer) Handshake(path string, header http.Header) *http.Response {
+	p.tb.Helper()
+
+	var b strings.Builder
+	b.WriteString("GET " + path + " HTTP/1.1\r\nHost: kiwitest\r\n")
+	b.WriteString("Upgrade: websocket\r\nConnection: Upgrade\r\n")
+	b.WriteString("Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n")
+	for k, vs := range header {
+		for _, v := range vs {
+			b.WriteString(k + ": " + v + "\r\n")
+		}
+	}
+	b.WriteString("\r\n")
+	p.WriteRaw([]byte(b.String()))
+
+	p.conn.SetReadDeadline(time.Now().Add(p.timeout()))
+	resp, err := http.ReadResponse(p.br, nil)
+	p.conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		p.tb.Fatal(err)
+	}
+	p.Response = resp
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		go p.readFrames()
+	}
+	return resp
+}
+
+func (p *Peer) timeout() time.Duration {
+	if p.Timeout > 0 {
+		return p.Timeout
+	}
+	return defaultTimeout
+}
+
+func (p *Peer) readFrames() {
+	for {
+		f := &kiwi.Frame{}
+		err := f.FromBufReader(p.br, maxPeerPayloadLen)
+
+		p.mu.Lock()
+		if err != nil {
+			p.readErr = err
+		} else {
+			p.frames = append(p.frames, f)
+		}
+		p.mu.Unlock()
+
+		select {
+		case p.notify <- struct{}{}:
+		default:
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// WriteRaw writes b as it is, such as deformed frames or handshakes.
+func (p *Peer) WriteRaw(b []byte) {
+	p.tb.Helper()
+
+	p.conn.SetWriteDeadline(time.Now().Add(p.timeout()))
+	defer p.conn.SetWriteDeadline(time.Time{})
+	if _, err := p.conn.Write(b); err != nil {
+		p.tb.Fatal(err)
+	}
+}
+
+// WriteFrame writes f masked as the frames of a client, f is not checked so
+// it may break the protocol on purpose.
+func (p *Peer) WriteFrame(f *kiwi.Frame) {
+	p.tb.Helper()
+
+	b, err := f.ToBytes(true)
+	if err != nil {
+		p.tb.Fatal(err)
+	}
+	p.WriteRaw(b)
+}
+
+// Send writes data as a single final frame of opcode.
+func (p *Peer) Send(opcode uint8, data []byte) {
+	p.tb.Helper()
+	p.WriteFrame(&kiwi.Frame{FIN: 1, Opcode: opcode, PayloadData: data})
+}
+
+func (p *Peer) SendText(s string) {
+	p.tb.Helper()
+	p.Send(kiwi.OpcodeText, []byte(s))
+}
+
+// SendClose writes a close frame of code and reason.
+func (p *Peer) SendClose(code uint16, reason string) {
+	p.tb.Helper()
+	p.WriteFrame(kiwi.MakeCloseFrame(code, reason, false))
+}
+
+// ReadFrame returns the next frame received, it fails the test if there is
+// none within the timeout. io.EOF is returned once the server closed the
+// conn and all the frames are read.
+func (p *Peer) ReadFrame() (*kiwi.Frame, error) {
+	p.tb.Helper()
+
+	timer := time.NewTimer(p.timeout())
+	defer timer.Stop()
+
+	for {
+		p.mu.Lock()
+		if len(p.frames) > 0 {
+			f := p.frames[0]
+			p.frames = p.frames[1:]
+			p.mu.Unlock()
+			return f, nil
+		}
+		err := p.readErr
+		p.mu.Unlock()
+
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe) {
+				err = io.EOF
+			}
+			return nil, err
+		}
+
+		select {
+		case <-p.notify:
+		case <-timer.C:
+			p.tb.Fatal("kiwitest: timed out reading a frame")
+		}
+	}
+}
+
+// Expect reads the next frame and fails the test if it's not a final frame
+// of opcode with data.
+func (p *Peer) Expect(opcode uint8, data []byte) {
+	p.tb.Helper()
+
+	f, err := p.ReadFrame()
+	if err != nil {
+		p.tb.Fatalf("kiwitest: expected a frame of opcode %d: %v", opcode, err)
+	}
+	if f.FIN != 1 || f.Opcode != opcode || string(f.PayloadData) != string(data) {
+		p.tb.Fatalf("kiwitest: got frame fin=%d opcode=%d %q; want opcode=%d %q",
+			f.FIN, f.Opcode, f.PayloadData, opcode, data)
+	}
+}
+
+func (p *Peer) ExpectText(s string) {
+	p.tb.Helper()
+	p.Expect(kiwi.OpcodeText, []byte(s))
+}
+
+// ExpectClose reads the next frame and fails the test if it's not a close
+// frame of code.
+func (p *Peer) ExpectClose(code uint16) {
+	p.tb.Helper()
+
+	f, err := p.ReadFrame()
+	if err != nil {
+		p.tb.Fatalf("kiwitest: expected a close frame of %d: %v", code, err)
+	}
+	if got, _ := kiwi.ParseCloseCode(f.PayloadData); f.Opcode != kiwi.OpcodeClose || got != code {
+		p.tb.Fatalf("kiwitest: got frame opcode=%d code=%d; want a close of %d", f.Opcode, got, code)
+	}
+}
+
+// Close closes the pipe without a close frame.
+func (p *Peer) Close() error {
+	return p.conn.Close()
+}
@@ -0,0 +1,162 @@
+package kiwitest
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mconintet/kiwi"
+)
+
+func newEchoServer(t *testing.T) *Listener {
+	srv := kiwi.NewServer()
+	srv.ApplyDefaultCfg()
+	srv.OnConnOpenFunc("/echo", func(r kiwi.MessageReceiver, s kiwi.MessageSender) {
+		for msg, err := range r.Messages(0) {
+			if err != nil {
+				return
+			}
+			if msg.IsClose() {
+				s.SendClose(kiwi.CloseCodeNormalClosure, "", false, false)
+				return
+			}
+			s.SendWhole(msg, false)
+		}
+	})
+	return Serve(t, srv)
+}
+
+func TestPeer(t *testing.T) {
+	ln := newEchoServer(t)
+
+	if resp := Connect(t, ln).Handshake("/missing", nil); resp.StatusCode == http.StatusSwitchingProtocols {
+		t.Fatal("expected the handshake of /missing to fail")
+	}
+
+	p := DialPeer(t, ln, "/echo")
+
+	// the echoes are buffered while the peer keeps writing
+	for _, s := range []string{"a", "b", "c"} {
+		p.SendText(s)
+	}
+	for _, s := range []string{"a", "b", "c"} {
+		p.ExpectText(s)
+	}
+
+	// a message fragmented by hand
+	p.WriteFrame(&kiwi.Frame{Opcode: kiwi.OpcodeText, PayloadData: []byte("hel")})
+	p.WriteFrame(&kiwi.Frame{FIN: 1, Opcode: kiwi.OpcodeContinue, PayloadData: []byte("lo")})
+	p.ExpectText("hello")
+
+	p.SendClose(kiwi.CloseCodeNormalClosure, "")
+	p.ExpectClose(kiwi.CloseCodeNormalClosure)
+	if _, err := p.ReadFrame(); err != io.EOF {
+		t.Fatalf("got %v; want io.EOF", err)
+	}
+}
+
+func TestListenerDialer(t *testing.T) {
+	ln := newEchoServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c, err := ln.Dialer().Dial(ctx, URL+"/echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	r := (&kiwi.DefaultMessageReceiver{}).SetConn(c)
+	s := (&kiwi.DefaultMessageSender{}).SetConn(c)
+	s.SendWholeBytes([]byte("in memory"), false)
+	if msg, err := r.ReadWhole(0); err != nil || string(msg.Data) != "in memory" {
+		t.Fatalf("got %v, %v; want the echo", msg, err)
+	}
+
+	ln.Close()
+	if _, err := ln.Dial(); err != ErrListenerClosed {
+		t.Fatalf("got %v; want ErrListenerClosed", err)
+	}
+}
+
+func TestClock(t *testing.T) {
+	clock := NewClock(time.Unix(0, 0))
+	srv := kiwi.NewServer()
+	srv.ApplyDefaultCfg()
+	srv.Clock = clock
+	srv.PingInterval = time.Second
+	srv.MaxConnectionAge = time.Minute
+	srv.OnConnOpenFunc("/", func(r kiwi.MessageReceiver, s kiwi.MessageSender) {
+		<-s.GetConn().Context().Done()
+	})
+
+	p := DialPeer(t, Serve(t, srv), "/")
+
+	// the ticker of the pings and the timer of the age
+	for clock.Timers() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	clock.Advance(time.Second)
+	if f, err := p.ReadFrame(); err != nil || f.Opcode != kiwi.OpcodePing {
+		t.Fatalf("got %v, %v; want a ping", f, err)
+	}
+
+	clock.Advance(time.Minute)
+	for {
+		f, err := p.ReadFrame()
+		if err != nil {
+			t.Fatalf("got %v; want the close of the age", err)
+		}
+		if f.Opcode == kiwi.OpcodePing {
+			continue
+		}
+		if code, _ := kiwi.ParseCloseCode(f.PayloadData); f.Opcode != kiwi.OpcodeClose || code != kiwi.CloseCodeServiceRestart {
+			t.Fatalf("got frame opcode=%d code=%d; want a close of %d", f.Opcode, code, kiwi.CloseCodeServiceRestart)
+		}
+		break
+	}
+}
+
+func TestClockSessionExpiry(t *testing.T) {
+	clock := NewClock(time.Unix(0, 0))
+	store := kiwi.NewSessionStore()
+	store.TTL = time.Minute
+
+	srv := kiwi.NewServer()
+	srv.ApplyDefaultCfg()
+	srv.Clock = clock
+	srv.OnConnOpenFunc("/", func(r kiwi.MessageReceiver, s kiwi.MessageSender) {
+		defer s.GetConn().Close()
+		if _, err := store.Attach(s); err != nil {
+			t.Error(err)
+		}
+		for range r.Messages(0) {
+		}
+	})
+
+	p := DialPeer(t, Serve(t, srv), "/")
+	if _, err := p.ReadFrame(); err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+
+	// the expiry of the detached session
+	for clock.Timers() < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if store.Len() != 1 {
+		t.Fatal("expected the session kept until it expires")
+	}
+
+	clock.Advance(time.Minute)
+	for i := 0; store.Len() != 0; i++ {
+		if i == 1000 {
+			t.Fatal("expected the session expired by the clock")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,639 @@
+// Package longpoll serves the routes of a kiwi.Server over HTTP long-polling
+// or server-sent events, for the clients whose websockets are blocked by
+// the middleboxes on their way. The handlers get the usual MessageReceiver
+// and MessageSender, each session being a conn opened on the route through
+// an in-memory pipe.
+//
+// A session is opened by a POST to the path of the route, which returns
+// {"sid": "..."} once the handshake of the route passes, or its status.
+// Then with the sid query param:
+//
+//   - a POST sends its body as a message, a binary one if its Content-Type
+//     is application/octet-stream, a text one otherwise
+//   - a GET waits for the messages and returns them as a JSON array of
+//     events, an empty one after Server.PollTimeout
+//   - a GET accepting text/event-stream streams the events, one per data
+//   - a DELETE closes the session with CloseCodeNormalClosure
+//   - a websocket upgrade carries on the session over the websocket, the
+//     pending messages are sent on it and the polls get an upgrade event
+//
+// The events are {"type": "text", "data": "..."}, {"type": "binary",
+// "data": "<base64>"}, {"type": "close", "code": 1000, "reason": "..."} and
+// {"type": "upgrade"}. The messages should be sent one at a time to keep
+// their order.
+package longpoll
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mconintet/kiwi"
+)
+
+const (
+	defaultPollTimeout    = 25 * time.Second
+	defaultSessionTimeout = time.Minute
+	defaultMaxPending     = 1024
+)
+
+var (
+	ErrListenerClosed = errors.New("longpoll: listener closed")
+	errTooManyPending = errors.New("longpoll: too many pending messages")
+)
+
+// Server is an http.Handler serving the fallback of the routes of a
+// kiwi.Server, see the package doc for the protocol.
+type Server struct {
+	// the empty polls are answered after it, the event streams get a
+	// heartbeat comment at this interval. defaultPollTimeout if it's zero
+	PollTimeout time.Duration
+
+	// the sessions no request has been made for are closed with
+	// CloseCodeGoingAway after it, defaultSessionTimeout if it's zero
+	SessionTimeout time.Duration
+
+	// the sessions whose client doesn't take its messages are closed with
+	// CloseCodePolicyViolation once they have that many pending,
+	// defaultMaxPending if it's zero
+	MaxPending int
+
+	ws       *kiwi.Server
+	client   *kiwi.Server
+	upgrader *kiwi.Server
+	ln       *listener
+
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+// NewServer serves ws on an in-memory listener for the sessions, it's
+// closed by Close or the shutdown of ws.
+func NewServer(ws *kiwi.Server) *Server {
+	s := &Server{ws: ws, ln: newListener(), sessions: make(map[string]*session)}
+
+	// the bridges read what the routes send
+	s.client = kiwi.NewServer()
+	s.client.ApplyDefaultCfg()
+	s.upgrader = kiwi.NewServer()
+	s.upgrader.ApplyDefaultCfg()
+	for _, srv := range []*kiwi.Server{s.client, s.upgrader} {
+		if ws.MaxFramePayloadBytes > 0 {
+			srv.MaxFramePayloadBytes = ws.MaxFramePayloadBytes
+		}
+		if ws.MaxMessageBytes > 0 {
+			srv.MaxMessageBytes = ws.MaxMessageBytes
+		}
+	}
+	s.upgrader.OnHandshakeRequestFunc("/", s.checkUpgrade)
+	s.upgrader.OnConnOpenFunc("/", s.serveUpgrade)
+
+	go ws.Serve(s.ln)
+	return s
+}
+
+// Close stops opening the sessions, the open ones are left to their routes.
+func (s *Server) Close() error {
+	return s.ln.Close()
+}
+
+func (s *Server) pollTimeout() time.Duration {
+	if s.PollTimeout > 0 {
+		return s.PollTimeout
+	}
+	return defaultPollTimeout
+}
+
+func (s *Server) sessionTimeout() time.Duration {
+	if s.SessionTimeout > 0 {
+		return s.SessionTimeout
+	}
+	return defaultSessionTimeout
+}
+
+func (s *Server) maxPending() int {
+	if s.MaxPending > 0 {
+		return s.MaxPending
+	}
+	return defaultMaxPending
+}
+
+func (s *Server) session(sid string) *session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sessions[sid]
+}
+
+func (s *Server) remove(sid string) {
+	s.mu.Lock()
+	delete(s.sessions, sid)
+	s.mu.Unlock()
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	sid := r.URL.Query().Get("sid")
+	if sid == "" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "session not opened", http.StatusBadRequest)
+			return
+		}
+		s.open(w, r)
+		return
+	}
+
+	sess := s.session(sid)
+	if sess == nil {
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case strings.EqualFold(r.Header.Get("Upgrade"), "websocket"):
+		ur := r.Clone(r.Context())
+		ur.URL.Path, ur.URL.RawPath = "/", ""
+		s.upgrader.ServeHTTP(w, ur)
+	case r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/event-stream"):
+		sess.stream(w, r)
+	case r.Method == http.MethodGet:
+		sess.poll(w, r)
+	case r.Method == http.MethodPost:
+		sess.send(w, r)
+	case r.Method == http.MethodDelete:
+		sess.close(kiwi.CloseCodeNormalClosure, "")
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// the headers of the requests not passed on to the handshakes
+var hopHeaders = []string{"Connection", "Upgrade", "Content-Length", "Content-Type", "Accept", "Transfer-Encoding"}
+
+// open dials the route of r through the pipes, the handshake sees the
+// headers and the address of r.
+func (s *Server) open(w http.ResponseWriter, r *http.Request) {
+	header := r.Header.Clone()
+	for _, k := range hopHeaders {
+		header.Del(k)
+	}
+	for k := range header {
+		if strings.HasPrefix(k, "Sec-Websocket-") {
+			delete(header, k)
+		}
+	}
+
+	remote := addrOf(r.RemoteAddr)
+	d := &kiwi.Dialer{
+		Config: s.client,
+		Header: header,
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return s.ln.dial(ctx, remote)
+		},
+	}
+
+	u := url.URL{Scheme: "ws", Host: r.Host, Path: r.URL.Path, RawQuery: r.URL.RawQuery}
+	conn, err := d.Dial(r.Context(), u.String())
+	if err != nil {
+		var he *kiwi.HandshakeError
+		if errors.As(err, &he) && he.Status != 0 {
+			http.Error(w, http.StatusText(he.Status), he.Status)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	sess := &session{
+		srv:    s,
+		id:     newSessionID(),
+		conn:   conn,
+		sender: (&kiwi.DefaultMessageSender{}).SetConn(conn),
+		notify: make(chan struct{}),
+	}
+	sess.expiry = time.AfterFunc(s.sessionTimeout(), sess.expire)
+
+	s.mu.Lock()
+	s.sessions[sess.id] = sess
+	s.mu.Unlock()
+	go sess.run()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"sid": sess.id})
+}
+
+func newSessionID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func addrOf(hostport string) net.Addr {
+	ap, err := netip.ParseAddrPort(hostport)
+	if err != nil {
+		return pipeAddr{}
+	}
+	return net.TCPAddrFromAddrPort(ap)
+}
+
+type event struct {
+	Type   string `json:"type"`
+	Data   string `json:"data,omitempty"`
+	Code   uint16 `json:"code,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+func eventOf(msg *kiwi.Message) event {
+	if msg.IsBinary() {
+		return event{Type: "binary", Data: base64.StdEncoding.EncodeToString(msg.Data)}
+	}
+	return event{Type: "text", Data: string(msg.Data)}
+}
+
+// session bridges the HTTP requests of a client and the conn opened for it
+// on the route.
+type session struct {
+	srv    *Server
+	id     string
+	conn   *kiwi.Conn
+	sender kiwi.MessageSender
+	expiry *time.Timer
+
+	mu      sync.Mutex
+	pending []event
+	closed  bool
+	// the close sent to the route by the session
+	sentClose *kiwi.CloseError
+	// the websocket the session is upgraded to
+	ws       kiwi.MessageSender
+	requests int
+	// closed and replaced once there are events
+	notify chan struct{}
+}
+
+// close closes the conn of the route, the close reported to the client is
+// this one since the reply of the route is not read.
+func (sess *session) close(code uint16, reason string) {
+	sess.mu.Lock()
+	if sess.sentClose == nil {
+		sess.sentClose = &kiwi.CloseError{Code: code, Reason: reason}
+	}
+	sess.mu.Unlock()
+	sess.conn.CloseWithCode(code, reason)
+}
+
+func (sess *session) wakeLocked() {
+	close(sess.notify)
+	sess.notify = make(chan struct{})
+}
+
+// run reads the messages sent by the route until its conn is closed.
+func (sess *session) run() {
+	r := (&kiwi.DefaultMessageReceiver{}).SetConn(sess.conn)
+	ce := &kiwi.CloseError{Code: kiwi.CloseCodeAbnormalClosure}
+
+	for msg, err := range r.Messages(0) {
+		if err != nil {
+			break
+		}
+
+		switch {
+		case msg.IsClose():
+			ce = msg.CloseError()
+			sess.conn.CloseWithCode(replyCode(ce.Code), ce.Reason)
+		case msg.Opcode == kiwi.OpcodePing:
+			sess.sender.SendWhole(&kiwi.Message{Opcode: kiwi.OpcodePong, Data: msg.Data}, false)
+		case msg.IsText(), msg.IsBinary():
+			if err := sess.deliver(msg); err != nil {
+				sess.close(kiwi.CloseCodePolicyViolation, err.Error())
+			}
+		}
+	}
+	sess.conn.Close()
+	sess.end(ce)
+}
+
+// replyCode is the code replying to a close frame of code.
+func replyCode(code uint16) uint16 {
+	if code == kiwi.CloseCodeNoStatusRcvd || code == kiwi.CloseCodeAbnormalClosure {
+		return kiwi.CloseCodeNormalClosure
+	}
+	return code
+}
+
+func (sess *session) deliver(msg *kiwi.Message) error {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	if sess.ws != nil {
+		_, err := sess.ws.SendWhole(msg, false)
+		return err
+	}
+
+	if len(sess.pending) >= sess.srv.maxPending() {
+		return errTooManyPending
+	}
+	sess.pending = append(sess.pending, eventOf(msg))
+	sess.wakeLocked()
+	return nil
+}
+
+// end queues the close of the route, the upgraded websocket is closed.
+func (sess *session) end(ce *kiwi.CloseError) {
+	sess.mu.Lock()
+	if ce.Code == kiwi.CloseCodeAbnormalClosure && sess.sentClose != nil {
+		ce = sess.sentClose
+	}
+	sess.closed = true
+	sess.pending = append(sess.pending, event{Type: "close", Code: ce.Code, Reason: ce.Reason})
+	sess.wakeLocked()
+	ws := sess.ws
+	sess.mu.Unlock()
+
+	if ws != nil {
+		ws.GetConn().CloseWithCode(replyCode(ce.Code), ce.Reason)
+	}
+}
+
+// begin keeps the session from expiring until the request is done.
+func (sess *session) begin() {
+	sess.mu.Lock()
+	sess.requests++
+	sess.expiry.Stop()
+	sess.mu.Unlock()
+}
+
+func (sess *session) done() {
+	sess.mu.Lock()
+	sess.requests--
+	if sess.requests == 0 {
+		sess.expiry.Reset(sess.srv.sessionTimeout())
+	}
+	sess.mu.Unlock()
+}
+
+func (sess *session) expire() {
+	sess.mu.Lock()
+	idle := sess.requests == 0
+	sess.mu.Unlock()
+	if !idle {
+		return
+	}
+
+	sess.srv.remove(sess.id)
+	sess.close(kiwi.CloseCodeGoingAway, "")
+}
+
+// take returns the pending events, or the upgrade one if the session has
+// been upgraded, and the channel notifying the next ones.
+func (sess *session) take() ([]event, <-chan struct{}) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	if sess.ws != nil {
+		return []event{{Type: "upgrade"}}, sess.notify
+	}
+	evs := sess.pending
+	sess.pending = nil
+	return evs, sess.notify
+}
+
+// last reports if evs ends the session, which is removed then.
+func (sess *session) last(evs []event) bool {
+	if n := len(evs); n > 0 && (evs[n-1].Type == "close" || evs[n-1].Type == "upgrade") {
+		if evs[n-1].Type == "close" {
+			sess.srv.remove(sess.id)
+		}
+		return true
+	}
+	return false
+}
+
+func (sess *session) poll(w http.ResponseWriter, r *http.Request) {
+	sess.begin()
+	defer sess.done()
+
+	timer := time.NewTimer(sess.srv.pollTimeout())
+	defer timer.Stop()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	for {
+		evs, notify := sess.take()
+		if len(evs) > 0 {
+			sess.last(evs)
+			json.NewEncoder(w).Encode(evs)
+			return
+		}
+
+		select {
+		case <-notify:
+		case <-timer.C:
+			io.WriteString(w, "[]\n")
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (sess *session) stream(w http.ResponseWriter, r *http.Request) {
+	sess.begin()
+	defer sess.done()
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+
+	heartbeat := time.NewTicker(sess.srv.pollTimeout())
+	defer heartbeat.Stop()
+
+	for {
+		evs, notify := sess.take()
+		for _, ev := range evs {
+			data, _ := json.Marshal(ev)
+			if _, err := io.WriteString(w, "data: "+string(data)+"\n\n"); err != nil {
+				return
+			}
+		}
+		if len(evs) > 0 {
+			if err := rc.Flush(); err != nil || sess.last(evs) {
+				return
+			}
+		}
+
+		select {
+		case <-notify:
+		case <-heartbeat.C:
+			io.WriteString(w, ": heartbeat\n\n")
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (sess *session) send(w http.ResponseWriter, r *http.Request) {
+	sess.begin()
+	defer sess.done()
+
+	limit := int64(sess.srv.client.MaxMessageBytes)
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	msg := &kiwi.Message{Opcode: kiwi.OpcodeText, Data: data}
+	if r.Header.Get("Content-Type") == "application/octet-stream" {
+		msg.Opcode = kiwi.OpcodeBinary
+	}
+	if _, err := sess.sender.SendWhole(msg, false); err != nil {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkUpgrade lets the websockets of the open sessions be upgraded to.
+func (s *Server) checkUpgrade(hsReq *kiwi.HandshakeRequest, conn *kiwi.Conn) (int, error) {
+	sess := s.session(hsReq.RequestURL.Query().Get("sid"))
+	if sess == nil {
+		return http.StatusNotFound, errors.New("longpoll: unknown session")
+	}
+	return kiwi.DefaultServerHandshakeFunc(hsReq, conn)
+}
+
+// serveUpgrade carries on a session over the websocket r.
+func (s *Server) serveUpgrade(r kiwi.MessageReceiver, ws kiwi.MessageSender) {
+	conn := r.GetConn()
+	sess := s.session(conn.HandshakeRequest.RequestURL.Query().Get("sid"))
+	if sess == nil || !sess.upgrade(ws) {
+		conn.CloseWithCode(kiwi.CloseCodePolicyViolation, "session not upgradable")
+		return
+	}
+	defer sess.done()
+
+	ce := &kiwi.CloseError{Code: kiwi.CloseCodeGoingAway}
+	for msg, err := range r.Messages(0) {
+		if err != nil {
+			break
+		}
+
+		switch {
+		case msg.IsClose():
+			ce = msg.CloseError()
+		case msg.Opcode == kiwi.OpcodePing:
+			ws.SendWhole(&kiwi.Message{Opcode: kiwi.OpcodePong, Data: msg.Data}, false)
+		case msg.IsText(), msg.IsBinary():
+			if _, err := sess.sender.SendWhole(msg, false); err != nil {
+				conn.Close()
+			}
+		}
+	}
+
+	conn.CloseWithCode(replyCode(ce.Code), ce.Reason)
+	sess.close(replyCode(ce.Code), ce.Reason)
+}
+
+// upgrade sends the pending messages on ws and the next ones are sent on it
+// too, the session doesn't expire while it's open.
+func (sess *session) upgrade(ws kiwi.MessageSender) bool {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	if sess.closed || sess.ws != nil {
+		return false
+	}
+
+	for _, ev := range sess.pending {
+		msg := &kiwi.Message{Opcode: kiwi.OpcodeText, Data: []byte(ev.Data)}
+		if ev.Type == "binary" {
+			msg.Opcode = kiwi.OpcodeBinary
+			msg.Data, _ = base64.StdEncoding.DecodeString(ev.Data)
+		}
+		if _, err := ws.SendWhole(msg, false); err != nil {
+			return false
+		}
+	}
+	sess.pending = nil
+	sess.ws = ws
+	sess.requests++
+	sess.expiry.Stop()
+	sess.wakeLocked()
+	return true
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "longpoll" }
+
+// pipeConn is the route end of a pipe, its remote address is the one of the
+// client opening the session.
+type pipeConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *pipeConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// listener is the in-memory net.Listener the routes are served on.
+type listener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newListener() *listener {
+	return &listener{conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, ErrListenerClosed
+	}
+}
+
+func (l *listener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *listener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+func (l *listener) dial(ctx context.Context, remote net.Addr) (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- &pipeConn{server, remote}:
+		return client, nil
+	case <-l.done:
+	case <-ctx.Done():
+	}
+	client.Close()
+	server.Close()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return nil, ErrListenerClosed
+}
@@ -0,0 +1,205 @@
+package longpoll
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mconintet/kiwi"
+)
+
+func newTestServer(t *testing.T) (*Server, string) {
+	ws := kiwi.NewServer()
+	ws.ApplyDefaultCfg()
+	ws.OnHandshakeRequestFunc("/echo", func(hsReq *kiwi.HandshakeRequest, conn *kiwi.Conn) (int, error) {
+		if !hsReq.Header.HasKeyAndValEqual("Authorization", "Bearer x") {
+			return http.StatusUnauthorized, kiwi.ErrBadHandshakeResp
+		}
+		return kiwi.DefaultServerHandshakeFunc(hsReq, conn)
+	})
+	ws.OnConnOpenFunc("/echo", func(r kiwi.MessageReceiver, s kiwi.MessageSender) {
+		conn := r.GetConn()
+		defer conn.Close()
+		for msg, err := range r.Messages(0) {
+			if err != nil {
+				return
+			}
+			if msg.IsClose() {
+				conn.CloseWithCode(msg.CloseError().Code, "")
+				return
+			}
+			s.SendWhole(msg, false)
+		}
+	})
+
+	lp := NewServer(ws)
+	lp.PollTimeout = 100 * time.Millisecond
+	hs := httptest.NewServer(lp)
+	t.Cleanup(func() {
+		hs.Close()
+		lp.Close()
+	})
+	return lp, hs.URL + "/echo"
+}
+
+func do(t *testing.T, method, url, contentType, body string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer x")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func open(t *testing.T, url string) string {
+	t.Helper()
+	resp := do(t, http.MethodPost, url, "", "")
+	defer resp.Body.Close()
+
+	var v struct{ Sid string }
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil || v.Sid == "" {
+		t.Fatalf("got %d, %v; want a sid", resp.StatusCode, err)
+	}
+	return url + "?sid=" + v.Sid
+}
+
+func poll(t *testing.T, url string) []event {
+	t.Helper()
+	resp := do(t, http.MethodGet, url, "", "")
+	defer resp.Body.Close()
+
+	var evs []event
+	if err := json.NewDecoder(resp.Body).Decode(&evs); err != nil {
+		t.Fatalf("got %d, %v", resp.StatusCode, err)
+	}
+	return evs
+}
+
+func TestPolling(t *testing.T) {
+	_, url := newTestServer(t)
+
+	req, _ := http.NewRequest(http.MethodPost, url, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("got status %d; want 401", resp.StatusCode)
+	}
+
+	sess := open(t, url)
+	if evs := poll(t, sess); len(evs) != 0 {
+		t.Fatalf("got %v; want no events", evs)
+	}
+
+	do(t, http.MethodPost, sess, "text/plain", "hello").Body.Close()
+	do(t, http.MethodPost, sess, "application/octet-stream", "\x00\x01").Body.Close()
+
+	var evs []event
+	for len(evs) < 2 {
+		evs = append(evs, poll(t, sess)...)
+	}
+	if evs[0] != (event{Type: "text", Data: "hello"}) || evs[1] != (event{Type: "binary", Data: "AAE="}) {
+		t.Fatalf("got %v", evs)
+	}
+
+	do(t, http.MethodDelete, sess, "", "").Body.Close()
+	evs = poll(t, sess)
+	if len(evs) != 1 || evs[0] != (event{Type: "close", Code: kiwi.CloseCodeNormalClosure}) {
+		t.Fatalf("got %v; want the close", evs)
+	}
+
+	resp = do(t, http.MethodGet, sess, "", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("got status %d; want 404 after the close", resp.StatusCode)
+	}
+}
+
+func TestStream(t *testing.T) {
+	_, url := newTestServer(t)
+	sess := open(t, url)
+
+	req, _ := http.NewRequest(http.MethodGet, sess, nil)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	do(t, http.MethodPost, sess, "", "one").Body.Close()
+	do(t, http.MethodPost, sess, "", "two").Body.Close()
+
+	br := bufio.NewReader(resp.Body)
+	var got []string
+	for len(got) < 2 {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data, ok := strings.CutPrefix(line, "data: "); ok {
+			var ev event
+			json.Unmarshal([]byte(data), &ev)
+			got = append(got, ev.Data)
+		}
+	}
+	if got[0] != "one" || got[1] != "two" {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	lp, url := newTestServer(t)
+	sess := open(t, url)
+	sid := sess[strings.Index(sess, "=")+1:]
+
+	// pending until the upgrade
+	do(t, http.MethodPost, sess, "", "before").Body.Close()
+	for lp.session(sid).pendingLen() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := kiwi.Dial(ctx, "ws"+strings.TrimPrefix(sess, "http"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	r := (&kiwi.DefaultMessageReceiver{}).SetConn(c)
+	if msg, err := r.ReadWhole(0); err != nil || string(msg.Data) != "before" {
+		t.Fatalf("got %v, %v; want before", msg, err)
+	}
+
+	(&kiwi.DefaultMessageSender{}).SetConn(c).SendWholeBytes([]byte("after"), false)
+	if msg, err := r.ReadWhole(0); err != nil || string(msg.Data) != "after" {
+		t.Fatalf("got %v, %v; want after", msg, err)
+	}
+
+	if evs := poll(t, sess); len(evs) != 1 || evs[0].Type != "upgrade" {
+		t.Fatalf("got %v; want the upgrade", evs)
+	}
+}
+
+func (sess *session) pendingLen() int {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return len(sess.pending)
+}
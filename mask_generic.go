@@ -0,0 +1,23 @@
+//go:build !(386 || amd64 || arm64 || loong64 || ppc64le || riscv64)
+
+package kiwi
+
+import (
+	"encoding/binary"
+)
+
+// maskWords masks the leading multiple of 8 bytes of data and returns
+// how many bytes were masked.
+func maskWords(data []byte, key [4]byte) int {
+	kw := binary.LittleEndian.Uint64([]byte{
+		key[0], key[1], key[2], key[3],
+		key[0], key[1], key[2], key[3],
+	})
+
+	n := len(data) &^ 7
+	for i := 0; i < n; i += 8 {
+		w := binary.LittleEndian.Uint64(data[i:])
+		binary.LittleEndian.PutUint64(data[i:], w^kw)
+	}
+	return n
+}
@@ -0,0 +1,37 @@
+//go:build 386 || amd64 || arm64 || loong64 || ppc64le || riscv64
+
+package kiwi
+
+import (
+	"unsafe"
+)
+
+// maskWords masks the leading multiple of 8 bytes of data and returns how
+// many bytes were masked. These architectures allow unaligned word access,
+// so data is XORed in place as native uint64s, 32 bytes per iteration.
+func maskWords(data []byte, key [4]byte) int {
+	kb := [8]byte{
+		key[0], key[1], key[2], key[3],
+		key[0], key[1], key[2], key[3],
+	}
+	kw := *(*uint64)(unsafe.Pointer(&kb[0]))
+
+	n := len(data) &^ 7
+	if n == 0 {
+		return 0
+	}
+
+	p := unsafe.Pointer(unsafe.SliceData(data))
+
+	i := 0
+	for ; i+32 <= n; i += 32 {
+		*(*uint64)(unsafe.Add(p, i)) ^= kw
+		*(*uint64)(unsafe.Add(p, i+8)) ^= kw
+		*(*uint64)(unsafe.Add(p, i+16)) ^= kw
+		*(*uint64)(unsafe.Add(p, i+24)) ^= kw
+	}
+	for ; i < n; i += 8 {
+		*(*uint64)(unsafe.Add(p, i)) ^= kw
+	}
+	return n
+}
@@ -0,0 +1,115 @@
+package kiwi
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrMemoryBudgetExceeded = errors.New("memory budget exceeded")
+
+// MemoryBudget limits the bytes of the messages read by all the conns of a
+// server and not yet handled, so many clients sending large messages at once
+// can't exhaust the memory of the process. The bytes of a message are held
+// from its first frame until the next read of its conn, or until the conn is
+// closed. A message larger than the whole budget fails its conn with
+// CloseCodeMessageTooBig, and one not fitting in what is left of the budget
+// fails it with CloseCodeTryAgainLater once Wait has passed.
+type MemoryBudget struct {
+	// how long a read waits for the other conns to release their messages,
+	// the reads of the waiting conn are paused meanwhile. Zero fails at once
+	Wait time.Duration
+
+	limit int64
+
+	mu    sync.Mutex
+	used  int64
+	freed chan struct{}
+}
+
+func NewMemoryBudget(limit int64, wait time.Duration) *MemoryBudget {
+	return &MemoryBudget{Wait: wait, limit: limit, freed: make(chan struct{})}
+}
+
+func (b *MemoryBudget) Limit() int64 {
+	return b.limit
+}
+
+// InUse returns the bytes held by the messages being read or handled.
+func (b *MemoryBudget) InUse() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used
+}
+
+// acquire holds n more bytes for a conn already holding held bytes, waiting
+// for them up to b.Wait of clk.
+func (b *MemoryBudget) acquire(n, held int64, clk Clock, done <-chan struct{}) error {
+	if held+n > b.limit {
+		return &SizeError{ErrMessageTooLarge, uint64(held + n), uint64(b.limit)}
+	}
+
+	var timeout <-chan time.Time
+	for {
+		b.mu.Lock()
+		if b.used+n <= b.limit {
+			b.used += n
+			b.mu.Unlock()
+			return nil
+		}
+		freed := b.freed
+		b.mu.Unlock()
+
+		if b.Wait <= 0 {
+			return ErrMemoryBudgetExceeded
+		}
+		if timeout == nil {
+			t := clk.NewTimer(b.Wait)
+			defer t.Stop()
+			timeout = t.C()
+		}
+
+		select {
+		case <-freed:
+		case <-timeout:
+			return ErrMemoryBudgetExceeded
+		case <-done:
+			return ErrConnIsNotOpen
+		}
+	}
+}
+
+func (b *MemoryBudget) release(n int64) {
+	if n == 0 {
+		return
+	}
+
+	b.mu.Lock()
+	b.used -= n
+	// wakes up all the waiting reads, the ones still not fitting wait again
+	close(b.freed)
+	b.freed = make(chan struct{})
+	b.mu.Unlock()
+}
+
+// holdMemory accounts n bytes of the message being read to the memory budget
+// of the server.
+func (c *Conn) holdMemory(n uint64) error {
+	b := c.Server.Memory
+	if b == nil || n == 0 {
+		return nil
+	}
+
+	if err := b.acquire(int64(n), c.memHeld.Load(), c.Server.clock(), c.ctx.Done()); err != nil {
+		return err
+	}
+	c.memHeld.Add(int64(n))
+	return nil
+}
+
+// releaseMemory releases the bytes held by the last message read.
+func (c *Conn) releaseMemory() {
+	if b := c.Server.Memory; b != nil {
+		b.release(c.memHeld.Swap(0))
+	}
+}
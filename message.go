@@ -3,12 +3,33 @@ package kiwi
 import (
 	"errors"
 	"io"
+	"iter"
 	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 )
 
 type Message struct {
 	Opcode uint8
 	Data   []byte
+
+	// Data is drawn from DefaultBufferPool
+	pooled bool
+
+	// set for the messages sent by SendWithAck, see Ack
+	ackID   uint64
+	ackConn *Conn
+}
+
+// Release gives the data of a message read by the receiver back to the
+// buffer pool, neither the message nor its data should be used after that.
+func (m *Message) Release() {
+	if m.pooled {
+		DefaultBufferPool.Put(m.Data)
+	}
+	m.Data = nil
+	m.pooled = false
 }
 
 func (m *Message) IsClose() bool {
@@ -36,6 +57,13 @@ type MessageReceiver interface {
 	GetConn() *Conn
 
 	ReadWhole(maxMsgDataLen uint64) (msg *Message, err error)
+	ReadWholeInto(buf []byte, maxMsgDataLen uint64) (msg *Message, err error)
+	ReadText(maxMsgDataLen uint64) (text string, err error)
+	ReadBinary(maxMsgDataLen uint64) (data []byte, err error)
+	Messages(maxMsgDataLen uint64) iter.Seq2[*Message, error]
+	ReadSpooled(maxMsgDataLen uint64) (msg *SpooledMessage, err error)
+	ReadMsg(v any) error
+	ReceiveFile(w io.Writer, maxLen uint64, progress func(received int64)) (n int64, err error)
 
 	BeginReadFrame()
 	ReadFrame(maxFramePayloadLen uint64) (frame *Frame, fin bool, err error)
@@ -45,13 +73,44 @@ type MessageReceiver interface {
 }
 
 var (
-	ErrConnIsNotOpen   = errors.New("conn is not open")
-	ErrMessageTooLarge = errors.New("message too large")
+	ErrConnIsNotOpen     = errors.New("conn is not open")
+	ErrMessageTooLarge   = errors.New("message too large")
+	ErrTooManyFragments  = &ProtocolError{"too many fragments"}
+	ErrFragmentsTooSmall = &ProtocolError{"fragments too small"}
+
+	// returned by ReadText and ReadBinary for a message of the other type
+	ErrUnexpectedMessageType = errors.New("unexpected message type")
+
+	// returned by SendClose if a close frame has been sent already
+	ErrCloseSent = errors.New("close frame already sent")
+
+	// returned by the writes to a conn whose frame was cut by a failed
+	// write, the peer can't find the frames after it. See Conn.Broken
+	ErrConnBroken = errors.New("conn broken by a partial frame write")
+
+	// returned by SendFrameWithReader for a non-positive frame size
+	ErrInvalidFrameSize = errors.New("non-positive frame size")
 )
 
+// the average fragment size is only checked for messages having more
+// fragments than this, so that a few small fragments are always fine
+const minAvgFragmentCheckAfter = 16
+
 type DefaultMessageReceiver struct {
+	// makes the reads of the whole messages return the text and binary ones
+	// only. The pings are answered, the pongs recorded for Conn.Stats, and
+	// the close of the peer is answered and returned as a *CloseError. It's
+	// set by Server.AutoControlFrames for the receivers of the routes
+	AutoControl bool
+
 	conn *Conn
 	mu   sync.Mutex
+
+	// the span of the message being handled, ended by the next read
+	msgSpan Span
+
+	// a fragmented message is being read, see nextFragment
+	fragmented bool
 }
 
 func (r *DefaultMessageReceiver) SetConn(c *Conn) MessageReceiver {
@@ -63,58 +122,390 @@ func (r *DefaultMessageReceiver) GetConn() *Conn {
 	return r.conn
 }
 
+// ReadWhole reads a whole message whose data is no more than maxMsgDataLen,
+// the conn limits are used if it's zero. An oversized message fails the conn
+// with CloseCodeMessageTooBig.
 func (r *DefaultMessageReceiver) ReadWhole(maxMsgDataLen uint64) (msg *Message, err error) {
 	defer r.mu.Unlock()
 	r.mu.Lock()
 
-	if r.conn.GetState() != StateOpen {
-		return nil, ErrConnIsNotOpen
+	return r.failOnError(r.readValid(maxMsgDataLen, nil, false))
+}
+
+// ReadWholeInto is like ReadWhole but the message data is read into buf,
+// growing it if needed, so a single buffer can be reused for every message.
+func (r *DefaultMessageReceiver) ReadWholeInto(buf []byte, maxMsgDataLen uint64) (msg *Message, err error) {
+	defer r.mu.Unlock()
+	r.mu.Lock()
+
+	return r.failOnError(r.readValid(maxMsgDataLen, buf, true))
+}
+
+// endMsgSpanLocked ends the span of the last message read, r.mu is held.
+func (r *DefaultMessageReceiver) endMsgSpanLocked() {
+	if r.msgSpan != nil {
+		r.msgSpan.End()
+		r.msgSpan = nil
+	}
+}
+
+func (r *DefaultMessageReceiver) endMsgSpan() {
+	r.mu.Lock()
+	r.endMsgSpanLocked()
+	r.mu.Unlock()
+}
+
+func (r *DefaultMessageReceiver) failOnError(msg *Message, err error) (*Message, error) {
+	r.endMsgSpanLocked()
+
+	var ve *ValidationError
+	switch {
+	case err == nil:
+		r.conn.emit(&Event{Type: EventMessageRead, Opcode: msg.Opcode, DataLen: len(msg.Data)})
+		// the handling of the message is traced until the next read
+		_, r.msgSpan = r.conn.startSpan("kiwi.message",
+			Attr{"websocket.opcode", opcodeName(msg.Opcode)}, Attr{"websocket.message.size", len(msg.Data)})
+	case errors.As(err, &ve):
+		r.conn.closeWithCode(ve.code)
+	case errors.Is(err, ErrMessageTooLarge), errors.Is(err, ErrFrameTooLarge):
+		r.conn.closeWithCode(CloseCodeMessageTooBig)
+	case errors.Is(err, ErrMemoryBudgetExceeded):
+		r.conn.closeWithCode(CloseCodeTryAgainLater)
+	case errors.Is(err, ErrTooManyFragments), errors.Is(err, ErrFragmentsTooSmall), errors.Is(err, ErrPayloadRejected):
+		r.conn.closeWithCode(CloseCodePolicyViolation)
+	case errors.As(err, new(*ExtensionError)):
+		r.conn.closeWithCode(CloseCodeProtocolError)
+	case errors.Is(err, ErrInvalidUTF8):
+		r.conn.closeWithCode(CloseCodeInvalidFramePayloadData)
+	case errors.Is(err, ErrReservedBits), errors.Is(err, ErrUnmaskedFrame), errors.Is(err, ErrMaskedFrame),
+		errors.Is(err, ErrInvalidControlFrame),
+		errors.Is(err, ErrUnexpectedContinuation), errors.Is(err, ErrExpectedContinuation),
+		errors.Is(err, ErrInvalidClosePayload):
+		r.conn.closeWithCode(CloseCodeProtocolError)
 	}
 
+	// the rest of a message given up is still on the wire, it can't be read
+	// as the next one
+	if err != nil && r.fragmented {
+		r.fragmented = false
+		r.conn.closeWithCode(CloseCodeInternalServerError)
+	}
+	return msg, err
+}
+
+// asMessageTooLarge turns a frame over the limits of readWhole into a
+// message over them.
+func asMessageTooLarge(err error) error {
+	var se *SizeError
+	if errors.As(err, &se) && se.Kind == ErrFrameTooLarge {
+		return &SizeError{ErrMessageTooLarge, se.Size, se.Limit}
+	}
+	return err
+}
+
+// readFragment reads the next frame of a message having msgLen bytes so
+// far, msgLen is no more than maxMsgDataLen. A frame over maxFrameLen fails
+// with ErrFrameTooLarge, and a data one taking the message over
+// maxMsgDataLen with ErrMessageTooLarge. Control frames may come before or
+// between the frames of the message, they're allowed up to
+// maxControlFramePayloadLen whatever is left of the message, so a data
+// frame under that is checked once it's read.
+func (r *DefaultMessageReceiver) readFragment(frame *Frame, maxFrameLen, msgLen, maxMsgDataLen uint64) error {
+	limit := max(min(maxFrameLen, maxMsgDataLen-msgLen), min(maxFrameLen, maxControlFramePayloadLen))
+
+	err := r.conn.readFrame(frame, limit)
+	var se *SizeError
+	if errors.As(err, &se) && se.Size <= maxFrameLen {
+		return &SizeError{ErrMessageTooLarge, msgLen + se.Size, maxMsgDataLen}
+	}
+	if err != nil {
+		return err
+	}
+
+	if size := msgLen + frame.PayloadLen; !isControlOpcode(frame.Opcode) && size > maxMsgDataLen {
+		DefaultBufferPool.Put(frame.PayloadData)
+		return &SizeError{ErrMessageTooLarge, size, maxMsgDataLen}
+	}
+	return nil
+}
+
+func (r *DefaultMessageReceiver) readWhole(maxMsgDataLen uint64, buf []byte, intoBuf bool) (msg *Message, err error) {
+	// nothing is read after the close frame of the peer
+	if r.conn.GetState() != StateOpen || r.conn.peerClose.Load() != nil {
+		return nil, r.conn.notOpenErr()
+	}
+
+	// the last message is handled once the next one is read
+	r.conn.releaseMemory()
+	defer func() {
+		if err != nil {
+			r.conn.releaseMemory()
+		}
+	}()
+
+	limits := r.conn.Limits()
+	if maxMsgDataLen == 0 {
+		maxMsgDataLen = limits.MaxMessageBytes
+	}
+
+	maxFrameLen := limits.MaxFramePayloadBytes
+
+	strict := r.conn.Server.protocolMode() == ProtocolStrict
 	msg = &Message{}
 
-	frame := &Frame{}
-	if err := frame.FromBufReader(r.conn.Buf, maxMsgDataLen); err != nil {
-		if err == ErrFrameTooLarge {
-			return nil, ErrMessageTooLarge
+	frame := AcquireFrame()
+	defer ReleaseFrame(frame)
+
+	if err := r.readFragment(frame, maxFrameLen, 0, maxMsgDataLen); err != nil {
+		return nil, err
+	}
+
+	if err := r.conn.holdMemory(frame.PayloadLen); err != nil {
+		DefaultBufferPool.Put(frame.PayloadData)
+		return nil, err
+	}
+
+	if strict {
+		if err := r.conn.checkFrame(frame, false); err != nil {
+			DefaultBufferPool.Put(frame.PayloadData)
+			return nil, err
 		}
+	}
+
+	if err := r.nextFragment(frame); err != nil {
+		DefaultBufferPool.Put(frame.PayloadData)
 		return nil, err
 	}
 
+	if len(r.conn.extensions) > 0 && !isControlOpcode(frame.Opcode) {
+		if err := r.conn.decodeFrame(frame, maxMsgDataLen); err != nil {
+			DefaultBufferPool.Put(frame.PayloadData)
+			return nil, err
+		}
+	}
+
+	var scan PayloadScan
+	if frame.Opcode == OpcodeBinary {
+		scan = r.conn.newPayloadScan()
+	}
+
+	if scan != nil {
+		// the scan is finished on success, aborted otherwise
+		defer func() {
+			if scan == nil {
+				return
+			}
+			if err != nil {
+				scan.Abort()
+			} else if scan.Finish() != nil {
+				msg.Release()
+				msg, err = nil, ErrPayloadRejected
+			}
+		}()
+
+		if scan.Write(frame.PayloadData) != nil {
+			DefaultBufferPool.Put(frame.PayloadData)
+			return nil, ErrPayloadRejected
+		}
+	}
+
 	msg.Opcode = frame.Opcode
-	msg.Data = frame.PayloadData
+	if intoBuf {
+		msg.Data = append(buf[:0], frame.PayloadData...)
+		DefaultBufferPool.Put(frame.PayloadData)
+	} else {
+		msg.Data = frame.PayloadData
+		msg.pooled = true
+	}
 
 	if frame.FIN == 1 {
-		return msg, nil
+		return r.checkMessage(msg, strict)
 	}
 
 	var msgLen uint64
 	msgLen += frame.PayloadLen
+	fragments := 1
 
 	for {
 		if r.conn.GetState() != StateOpen {
-			return nil, ErrConnIsNotOpen
+			return nil, r.conn.notOpenErr()
+		}
+
+		frame.Reset()
+		if err := r.readFragment(frame, maxFrameLen, msgLen, maxMsgDataLen); err != nil {
+			return nil, err
+		}
+
+		if strict {
+			if err := r.conn.checkFrame(frame, true); err != nil {
+				DefaultBufferPool.Put(frame.PayloadData)
+				return nil, err
+			}
 		}
 
-		if err := frame.FromBufReader(r.conn.Buf, maxMsgDataLen); err != nil {
-			if err == ErrFrameTooLarge {
-				return nil, ErrMessageTooLarge
+		if isControlOpcode(frame.Opcode) {
+			ctrl, done := r.handleControl(frame)
+			DefaultBufferPool.Put(frame.PayloadData)
+			if !done {
+				continue
+			}
+
+			// the fragmented message is given up for the close
+			if scan != nil {
+				scan.Abort()
+				scan = nil
 			}
+			msg.Release()
+			r.fragmented = false
+			return r.checkMessage(ctrl, strict)
+		}
+
+		if err := r.nextFragment(frame); err != nil {
+			DefaultBufferPool.Put(frame.PayloadData)
 			return nil, err
 		}
 
 		msgLen += frame.PayloadLen
-		if msgLen > maxMsgDataLen {
-			return nil, ErrMessageTooLarge
+		if err := r.conn.holdMemory(frame.PayloadLen); err != nil {
+			DefaultBufferPool.Put(frame.PayloadData)
+			return nil, err
 		}
 
-		msg.Data = append(msg.Data, frame.PayloadData...)
+		fragments++
+		if limits.MaxMessageFragments > 0 && fragments > limits.MaxMessageFragments {
+			return nil, ErrTooManyFragments
+		}
+
+		if limits.MinAvgFragmentBytes > 0 && fragments > minAvgFragmentCheckAfter &&
+			msgLen/uint64(fragments) < limits.MinAvgFragmentBytes {
+			return nil, ErrFragmentsTooSmall
+		}
+
+		if len(r.conn.extensions) > 0 && !isControlOpcode(frame.Opcode) {
+			if err := r.conn.decodeFrame(frame, maxMsgDataLen); err != nil {
+				DefaultBufferPool.Put(frame.PayloadData)
+				return nil, err
+			}
+		}
+
+		if scan != nil && scan.Write(frame.PayloadData) != nil {
+			DefaultBufferPool.Put(frame.PayloadData)
+			return nil, ErrPayloadRejected
+		}
+
+		if msg.pooled {
+			msg.Data = DefaultBufferPool.appendPooled(msg.Data, frame.PayloadData)
+		} else {
+			msg.Data = append(msg.Data, frame.PayloadData...)
+		}
+		DefaultBufferPool.Put(frame.PayloadData)
 		if frame.FIN == 1 {
-			return msg, nil
+			return r.checkMessage(msg, strict)
+		}
+	}
+}
+
+// checkMessage checks the payload of a close message, and the text message
+// is valid UTF-8 in the strict mode. The peer close is recorded for the
+// CloseError returned by the reads and sends after it.
+func (r *DefaultMessageReceiver) checkMessage(msg *Message, strict bool) (*Message, error) {
+	if msg.IsClose() {
+		if err := checkClosePayload(msg.Data); err != nil && r.conn.Server.protocolMode() != ProtocolLenient {
+			msg.Release()
+			return nil, err
 		}
+		r.conn.peerClose.Store(newCloseError(msg.Data))
 	}
 
-	return nil, nil
+	if strict && msg.IsText() && !utf8.Valid(msg.Data) {
+		msg.Release()
+		return nil, ErrInvalidUTF8
+	}
+	return msg, nil
+}
+
+// Messages yields each whole message read from the conn. The sequence ends
+// after a close message has been yielded, once the conn is no longer open,
+// or after the first read error.
+func (r *DefaultMessageReceiver) Messages(maxMsgDataLen uint64) iter.Seq2[*Message, error] {
+	return func(yield func(*Message, error) bool) {
+		defer r.endMsgSpan()
+
+		for {
+			msg, err := r.ReadWhole(maxMsgDataLen)
+			if err != nil {
+				if !errors.Is(err, ErrConnIsNotOpen) {
+					yield(nil, err)
+				}
+				return
+			}
+
+			if !yield(msg, nil) || msg.IsClose() {
+				return
+			}
+		}
+	}
+}
+
+// ReadText reads the next text message and returns its data. The pings are
+// answered and the pongs skipped, the close of the peer is answered and
+// returned as a *CloseError. A binary message fails with
+// ErrUnexpectedMessageType and closes the conn with
+// Server.UnexpectedTypeCloseCode.
+func (r *DefaultMessageReceiver) ReadText(maxMsgDataLen uint64) (text string, err error) {
+	data, err := r.readData(OpcodeText, maxMsgDataLen)
+	return string(data), err
+}
+
+// ReadBinary is ReadText for the binary messages.
+func (r *DefaultMessageReceiver) ReadBinary(maxMsgDataLen uint64) (data []byte, err error) {
+	return r.readData(OpcodeBinary, maxMsgDataLen)
+}
+
+func (r *DefaultMessageReceiver) readData(opcode uint8, maxMsgDataLen uint64) ([]byte, error) {
+	for {
+		msg, err := r.ReadWhole(maxMsgDataLen)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case !msg.IsText() && !msg.IsBinary():
+			if err := r.answerControl(msg); err != nil {
+				return nil, err
+			}
+		case msg.Opcode != opcode:
+			code := r.conn.Server.UnexpectedTypeCloseCode
+			if code == 0 {
+				code = CloseCodeUnsupportedData
+			}
+			r.conn.closeWithCode(code)
+			return nil, ErrUnexpectedMessageType
+		default:
+			return msg.Data, nil
+		}
+	}
+}
+
+// answerControl answers a ping, records the time of a pong for Conn.Stats,
+// and answers a close which is returned as a *CloseError.
+func (r *DefaultMessageReceiver) answerControl(msg *Message) error {
+	c := r.conn
+	switch {
+	case msg.IsPing():
+		c.Send(&Message{Opcode: OpcodePong, Data: msg.Data})
+	case msg.IsPong():
+		c.lastPong.Store(c.Server.clock().Now().UnixNano())
+	case msg.IsClose():
+		ce := msg.CloseError()
+		code := ce.Code
+		if code == CloseCodeNoStatusRcvd {
+			code = CloseCodeNormalClosure
+		}
+		c.CloseWithCode(code, "")
+		return ce
+	}
+	return nil
 }
 
 func (r *DefaultMessageReceiver) BeginReadFrame() {
@@ -125,13 +516,30 @@ func (r *DefaultMessageReceiver) EndReadFrame() {
 	r.mu.Unlock()
 }
 
+// ReadFrame reads a frame whose payload is no more than maxFramePayloadLen,
+// the conn limits are used if it's zero. The frame is drawn from the frame
+// pool and may be given back by ReleaseFrame when done.
 func (r *DefaultMessageReceiver) ReadFrame(maxFramePayloadLen uint64) (frame *Frame, fin bool, err error) {
 	if r.conn.GetState() != StateOpen {
-		return nil, false, ErrConnIsNotOpen
+		return nil, false, r.conn.notOpenErr()
 	}
 
-	frame = &Frame{}
-	if err := frame.FromBufReader(r.conn.Buf, maxFramePayloadLen); err != nil {
+	if maxFramePayloadLen == 0 {
+		maxFramePayloadLen = r.conn.Limits().MaxFramePayloadBytes
+	}
+
+	frame = AcquireFrame()
+	if err := r.conn.readFrame(frame, maxFramePayloadLen); err != nil {
+		ReleaseFrame(frame)
+		if errors.Is(err, ErrFrameTooLarge) {
+			r.conn.closeWithCode(CloseCodeMessageTooBig)
+		}
+		return nil, false, err
+	}
+
+	if err := r.nextFragment(frame); err != nil {
+		ReleaseFrame(frame)
+		r.conn.closeWithCode(CloseCodeProtocolError)
 		return nil, false, err
 	}
 
@@ -142,11 +550,10 @@ func (r *DefaultMessageReceiver) IsConnOpen() bool {
 	return r.conn.GetState() == StateOpen
 }
 
-type BufReader interface {
-	io.Reader
-	io.ByteScanner
-}
-
+// MessageSender sends messages to the conn. The n returned by the send
+// methods is the payload bytes written, excluding the frame headers, also
+// if the write fails in the middle. Conn.SendStats counts both the payload
+// and the wire bytes.
 type MessageSender interface {
 	SetConn(c *Conn) MessageSender
 	GetConn() *Conn
@@ -154,19 +561,34 @@ type MessageSender interface {
 	SendWhole(msg *Message, mask bool) (n int, err error)
 	SendWholeWithReader(r io.Reader, opcode uint8, mask bool) (n int, err error)
 	SendWholeBytes(byts []byte, mask bool) (n int, err error)
+	SendText(text string) (n int, err error)
+	SendBinary(byts []byte) (n int, err error)
+
+	// bounded sends for the broadcasters, see DefaultMessageSender
+	SendWholeTimeout(msg *Message, d time.Duration, mask bool) (n int, err error)
+	TrySend(msg *Message) bool
+	SendMsg(v any) error
+
+	// waits for the peer to ack msg, see Server.Acks
+	SendWithAck(msg *Message, timeout time.Duration) error
+
+	// streams a file in fragments, see ReceiveFile
+	SendFile(path string, chunkSize int, opts *SendFileOptions) (n int64, err error)
 
 	BeginSendFrame()
 	SendFrame(data []byte, opcode uint8, begin bool, end bool, mask bool) (n int, err error)
-	SendFrameWithReader(r BufReader, opcode uint8, perFrameSize int, mask bool) (n int, err error)
+	SendFrameWithReader(r io.Reader, opcode uint8, perFrameSize int, mask bool) (n int, err error)
 	EndSendFrame()
 
-	SendClose(code uint16, reason string, useCodeText bool, mask bool)
+	SendClose(code uint16, reason string, useCodeText bool, mask bool) (n int, err error)
 	IsConnOpen() bool
+
+	// writes out the coalesced frames, see Conn.SetWriteCoalescing
+	Flush() error
 }
 
 type DefaultMessageSender struct {
 	conn *Conn
-	mu   sync.Mutex
 }
 
 func (s *DefaultMessageSender) SetConn(c *Conn) MessageSender {
@@ -179,80 +601,222 @@ func (s *DefaultMessageSender) GetConn() *Conn {
 }
 
 func (s *DefaultMessageSender) SendWhole(msg *Message, mask bool) (n int, err error) {
-	defer s.mu.Unlock()
-	s.mu.Lock()
+	// checked before taking the lock too, the close handlers run by a
+	// sender closing the conn may send
+	if s.conn.closed.Load() {
+		return 0, s.conn.notOpenErr()
+	}
+	// a control frame may go between the frames of a message
+	if !isControlOpcode(msg.Opcode) {
+		defer s.conn.sendMu.Unlock()
+		s.conn.sendMu.Lock()
+	}
+	return s.sendEscaped(msg, mask)
+}
 
+// sendEscaped is sendWhole escaping msg for the ack protocol, n doesn't
+// count the escape.
+func (s *DefaultMessageSender) sendEscaped(msg *Message, mask bool) (n int, err error) {
+	data := s.conn.escapeAck(msg.Opcode, msg.Data, true)
+	if len(data) == len(msg.Data) {
+		return s.sendWhole(msg, mask)
+	}
+	n, err = s.sendWhole(&Message{Opcode: msg.Opcode, Data: data}, mask)
+	return max(n-1, 0), err
+}
+
+// sendWhole is SendWhole with the send lock held for a data message.
+func (s *DefaultMessageSender) sendWhole(msg *Message, mask bool) (n int, err error) {
 	if s.conn.GetState() != StateOpen {
-		return 0, ErrConnIsNotOpen
+		return 0, s.conn.notOpenErr()
 	}
 
-	frame := &Frame{}
+	frame := AcquireFrame()
+	defer ReleaseFrame(frame)
+
 	frame.FIN = 1
 	frame.Opcode = msg.Opcode
 	frame.PayloadData = msg.Data
 
-	return frame.WriteTo(s.conn, mask)
+	return s.writeDataFrame(frame, mask)
 }
 
-func (s *DefaultMessageSender) SendWholeBytes(byts []byte, mask bool) (n int, err error) {
-	msg := &Message{}
-	msg.Opcode = OpcodeText
-	msg.Data = byts
+// SendWholeTimeout is like SendWhole but fails with a timeout error if msg
+// is not written in d once the other senders are done, or by the deadline
+// set by Conn.SetWriteDeadline if it's earlier. That deadline is restored
+// after. The conn is closed on a timeout since the frame may be partially
+// written.
+func (s *DefaultMessageSender) SendWholeTimeout(msg *Message, d time.Duration, mask bool) (n int, err error) {
+	c := s.conn
+	if c.closed.Load() {
+		return 0, c.notOpenErr()
+	}
+	if !isControlOpcode(msg.Opcode) {
+		defer c.sendMu.Unlock()
+		c.sendMu.Lock()
+	}
 
-	return s.SendWhole(msg, mask)
+	deadline := time.Now().Add(d)
+	if prev := c.writeDeadline(); !prev.IsZero() && prev.Before(deadline) {
+		deadline = prev
+	}
+	c.rwc.SetWriteDeadline(deadline)
+	n, err = s.sendEscaped(msg, mask)
+	c.rwc.SetWriteDeadline(c.writeDeadline())
+
+	if IsTimeout(err) {
+		c.Close()
+	}
+	return
 }
 
-func (s *DefaultMessageSender) SendWholeWithReader(r io.Reader, opcode uint8, mask bool) (n int, err error) {
-	defer s.mu.Unlock()
-	s.mu.Lock()
+// TrySend queues msg to be sent by the send queue of the conn without
+// blocking, it returns false if the queue is full, e.g. the peer is not
+// reading, or the conn is not open. msg must not be changed once queued.
+func (s *DefaultMessageSender) TrySend(msg *Message) bool {
+	return s.conn.TrySend(msg)
+}
 
-	if s.conn.GetState() != StateOpen {
-		return 0, ErrConnIsNotOpen
+// TrySend is DefaultMessageSender.TrySend for the handlers of the callback
+// API, the queue holds Server.SendQueueSize messages.
+func (c *Conn) TrySend(msg *Message) bool {
+	if c.GetState() != StateOpen {
+		return false
 	}
 
-	data := make([]byte, 512)
-	buf := make([]byte, 512)
-	for {
-		i, err := r.Read(buf)
-
-		if i > 0 {
-			data = append(data, buf[:i]...)
+	c.sendqOnce.Do(func() {
+		size := c.Server.SendQueueSize
+		if size <= 0 {
+			size = defaultSendQueueSize
 		}
+		c.sendq = make(chan *Message, size)
+		go c.runSendQueue()
+	})
+
+	select {
+	case c.sendq <- msg:
+		return true
+	default:
+		return false
+	}
+}
 
-		if err != nil {
-			if err == io.EOF {
-				break
-			} else {
-				return 0, err
+func (c *Conn) runSendQueue() {
+	sender := &DefaultMessageSender{conn: c}
+	for {
+		select {
+		case msg := <-c.sendq:
+			if _, err := sender.SendWhole(msg, false); err != nil {
+				return
 			}
+		case <-c.ctx.Done():
+			return
 		}
 	}
+}
 
-	frame := &Frame{}
-	frame.FIN = 1
-	frame.Opcode = opcode
-	frame.PayloadData = data
+// writeFrame writes frame and returns the payload bytes of it written.
+func (s *DefaultMessageSender) writeFrame(frame *Frame, mask bool) (n int, err error) {
+	mask = mask || s.conn.client
+	var mkb []byte
+	if mask {
+		if mkb, err = s.conn.Server.maskingKey(); err != nil {
+			return 0, err
+		}
+	}
+	wire, err := frame.writeMasked(s.conn, mkb)
+	if s.conn.TraceFrameOut != nil && wire > 0 {
+		s.conn.TraceFrameOut(frame)
+	}
+
+	n = min(max(wire-frame.headerLen(mask), 0), len(frame.PayloadData))
+	s.conn.countSent(n, wire)
+	return n, err
+}
+
+// writeDataFrame writes frame encoded by the negotiated extensions, n is
+// of the payload before the encoding unless the write fails.
+func (s *DefaultMessageSender) writeDataFrame(frame *Frame, mask bool) (n int, err error) {
+	c := s.conn
+	if len(c.extensions) == 0 || isControlOpcode(frame.Opcode) {
+		return s.writeFrame(frame, mask)
+	}
+
+	c.extensionMu.Lock()
+	defer c.extensionMu.Unlock()
+
+	size := len(frame.PayloadData)
+	if err := c.encodeFrame(frame); err != nil {
+		return 0, err
+	}
+	if n, err = s.writeFrame(frame, mask); err != nil {
+		return n, err
+	}
+	return size, nil
+}
 
-	return frame.WriteTo(s.conn, mask)
+// SendWholeBytes sends byts as a text message without checking its UTF-8,
+// see SendText and SendBinary.
+func (s *DefaultMessageSender) SendWholeBytes(byts []byte, mask bool) (n int, err error) {
+	msg := &Message{}
+	msg.Opcode = OpcodeText
+	msg.Data = byts
+
+	return s.SendWhole(msg, mask)
+}
+
+// SendText sends text as a text message, it fails with ErrInvalidUTF8
+// without sending it if it's not in UTF-8.
+func (s *DefaultMessageSender) SendText(text string) (n int, err error) {
+	if !utf8.ValidString(text) {
+		return 0, ErrInvalidUTF8
+	}
+	return s.SendWhole(&Message{Opcode: OpcodeText, Data: []byte(text)}, false)
+}
+
+// SendBinary sends byts as a binary message, unlike SendWholeBytes which
+// sends a text one.
+func (s *DefaultMessageSender) SendBinary(byts []byte) (n int, err error) {
+	return s.SendWhole(&Message{Opcode: OpcodeBinary, Data: byts}, false)
 }
 
+// the frames of the messages sent by SendWholeWithReader
+const readerFrameSize = 32 << 10
+
+// SendWholeWithReader sends the data of r as a message, it's streamed in
+// frames of 32KB as it's read rather than buffered, see
+// SendFrameWithReader.
+func (s *DefaultMessageSender) SendWholeWithReader(r io.Reader, opcode uint8, mask bool) (n int, err error) {
+	defer s.EndSendFrame()
+	s.BeginSendFrame()
+
+	return s.SendFrameWithReader(r, opcode, readerFrameSize, mask)
+}
+
+// BeginSendFrame keeps the other senders of the conn from sending data
+// messages until EndSendFrame, so the frames sent by SendFrame in between
+// are not interleaved with theirs.
 func (s *DefaultMessageSender) BeginSendFrame() {
-	s.mu.Lock()
+	s.conn.sendMu.Lock()
 }
 
 func (s *DefaultMessageSender) EndSendFrame() {
-	s.mu.Unlock()
+	s.conn.sendMu.Unlock()
 }
 
 func (s *DefaultMessageSender) SendFrame(data []byte, opcode uint8, begin bool, end bool, mask bool) (n int, err error) {
 	if s.conn.GetState() != StateOpen {
-		return 0, ErrConnIsNotOpen
+		return 0, s.conn.notOpenErr()
 	}
 
-	frame := &Frame{}
+	frame := AcquireFrame()
+	defer ReleaseFrame(frame)
 
+	escaped := 0
 	if begin {
 		frame.Opcode = opcode
+		esc := s.conn.escapeAck(opcode, data, end)
+		escaped, data = len(esc)-len(data), esc
 	} else {
 		frame.Opcode = OpcodeContinue
 	}
@@ -262,60 +826,106 @@ func (s *DefaultMessageSender) SendFrame(data []byte, opcode uint8, begin bool,
 	}
 
 	frame.PayloadData = data
-	return frame.WriteTo(s.conn, mask)
+	n, err = s.writeDataFrame(frame, mask)
+	return max(n-escaped, 0), err
 }
 
-func (s *DefaultMessageSender) SendFrameWithReader(r BufReader, opcode uint8, perFrameSize int, mask bool) (n int, err error) {
+// SendFrameWithReader sends the data of r as a message fragmented in frames
+// of perFrameSize bytes, the last one is the rest and has FIN set, it's
+// empty if r has no data. The next frame is read before each one is sent so
+// the one at the EOF is known, n is of the payload of the frames sent. A
+// read or write error once a frame is sent leaves the message unfinished,
+// the conn is closed with CloseCodeInternalServerError then.
+func (s *DefaultMessageSender) SendFrameWithReader(r io.Reader, opcode uint8, perFrameSize int, mask bool) (n int, err error) {
 	if s.conn.GetState() != StateOpen {
-		return 0, ErrConnIsNotOpen
+		return 0, s.conn.notOpenErr()
+	}
+	if perFrameSize <= 0 {
+		return 0, ErrInvalidFrameSize
 	}
 
-	buf := make([]byte, perFrameSize)
-
-	si := 0
-	begin := true
-	end := false
-
-	for {
-		i, err := r.Read(buf)
-
-		if i > 0 {
-			// read one more byte to see if EOF is coming up
-			_, pre := r.ReadByte()
-			if pre == io.EOF {
-				end = true
-			} else {
-				r.UnreadByte()
-			}
-
-			if si, err = s.SendFrame(buf[:i], opcode, begin, end, mask); err != nil {
-				return 0, err
+	cur, next := make([]byte, perFrameSize), make([]byte, perFrameSize)
+	ci, cerr := readFrameData(r, cur)
+	for begin := true; ; begin = false {
+		if cerr != nil && cerr != io.EOF {
+			if begin {
+				return n, cerr
 			}
+			return n, s.abortMessage(cerr)
+		}
 
-			n += si
-			begin = false
-
-			if pre == io.EOF {
-				return n, nil
+		end := cerr == io.EOF
+		var ni int
+		var nerr error
+		if !end {
+			ni, nerr = readFrameData(r, next)
+			if nerr != nil && nerr != io.EOF {
+				return n, s.abortMessage(nerr)
 			}
+			end = ni == 0 && nerr == io.EOF
 		}
 
-		if err != nil {
-			if err == io.EOF {
-				return n, nil
-			}
-			return 0, err
+		si, err := s.SendFrame(cur[:ci], opcode, begin, end, mask)
+		n += si
+		if err != nil && !begin {
+			return n, s.abortMessage(err)
+		}
+		if err != nil || end {
+			return n, err
 		}
+
+		cur, next = next, cur
+		ci, cerr = ni, nerr
 	}
 }
 
-func (s *DefaultMessageSender) SendClose(code uint16, reason string, useCodeText bool, mask bool) {
-	s.conn.SetState(StateClosed)
+// abortMessage closes the conn of a message left unfinished.
+func (s *DefaultMessageSender) abortMessage(err error) error {
+	s.conn.closeWithCode(CloseCodeInternalServerError)
+	return err
+}
+
+// readFrameData fills b from r, err is io.EOF if r ends before b is full.
+func readFrameData(r io.Reader, b []byte) (n int, err error) {
+	n, err = io.ReadFull(r, b)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// SendClose sends a close frame and closes the conn, n is of the payload of
+// the frame and err is the first error of writing, flushing or closing. It's
+// safe to be called more than once, only the first call sends the frame and
+// closes the conn, the others return ErrCloseSent.
+func (s *DefaultMessageSender) SendClose(code uint16, reason string, useCodeText bool, mask bool) (n int, err error) {
+	return s.conn.sendClose(code, reason, useCodeText, mask)
+}
 
-	frame := MakeCloseFrame(code, reason, useCodeText)
-	frame.WriteTo(s.conn, mask)
+func (c *Conn) sendClose(code uint16, reason string, useCodeText bool, mask bool) (n int, err error) {
+	// the conn is closed by the sender of the first close frame, after the
+	// frame is written
+	if !c.closeSent.CompareAndSwap(false, true) {
+		return 0, ErrCloseSent
+	}
+
+	c.SetState(StateClosed)
+	atomic.StoreUint32(&c.closeCode, uint32(code))
+
+	sender := &DefaultMessageSender{}
+	sender.SetConn(c)
+	n, err = sender.writeFrame(MakeCloseFrame(code, reason, useCodeText), mask)
+	if ferr := c.Flush(); err == nil {
+		err = ferr
+	}
+	if cerr := c.Close(); err == nil {
+		err = cerr
+	}
+	return n, err
+}
 
-	s.conn.Close()
+func (s *DefaultMessageSender) Flush() error {
+	return s.conn.Flush()
 }
 
 func (s *DefaultMessageSender) IsConnOpen() bool {
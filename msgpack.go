@@ -0,0 +1,221 @@
+package kiwi
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+)
+
+// MsgpackCodec encodes the values as MessagePack in binary messages, the
+// struct fields are named by their msgpack tags. The extension types are not
+// supported.
+type MsgpackCodec struct{}
+
+func (MsgpackCodec) Marshal(v any) ([]byte, error) {
+	w := &msgpackWriter{}
+	if err := encodeValue(w, reflect.ValueOf(v), "msgpack"); err != nil {
+		return nil, err
+	}
+	return w.buf, nil
+}
+
+func (MsgpackCodec) Unmarshal(data []byte, v any) error {
+	return decodeTop(&msgpackReader{data: data}, v, "msgpack")
+}
+
+func (MsgpackCodec) Opcode() uint8 {
+	return OpcodeBinary
+}
+
+type msgpackWriter struct {
+	buf []byte
+}
+
+func (w *msgpackWriter) writeNil() {
+	w.buf = append(w.buf, 0xc0)
+}
+
+func (w *msgpackWriter) writeBool(b bool) {
+	if b {
+		w.buf = append(w.buf, 0xc3)
+	} else {
+		w.buf = append(w.buf, 0xc2)
+	}
+}
+
+func (w *msgpackWriter) writeInt(i int64) {
+	switch {
+	case i >= 0:
+		w.writeUint(uint64(i))
+	case i >= -32:
+		w.buf = append(w.buf, byte(i))
+	case i >= math.MinInt8:
+		w.buf = append(w.buf, 0xd0, byte(i))
+	case i >= math.MinInt16:
+		w.buf = binary.BigEndian.AppendUint16(append(w.buf, 0xd1), uint16(i))
+	case i >= math.MinInt32:
+		w.buf = binary.BigEndian.AppendUint32(append(w.buf, 0xd2), uint32(i))
+	default:
+		w.buf = binary.BigEndian.AppendUint64(append(w.buf, 0xd3), uint64(i))
+	}
+}
+
+func (w *msgpackWriter) writeUint(u uint64) {
+	switch {
+	case u <= 0x7f:
+		w.buf = append(w.buf, byte(u))
+	case u <= math.MaxUint8:
+		w.buf = append(w.buf, 0xcc, byte(u))
+	case u <= math.MaxUint16:
+		w.buf = binary.BigEndian.AppendUint16(append(w.buf, 0xcd), uint16(u))
+	case u <= math.MaxUint32:
+		w.buf = binary.BigEndian.AppendUint32(append(w.buf, 0xce), uint32(u))
+	default:
+		w.buf = binary.BigEndian.AppendUint64(append(w.buf, 0xcf), u)
+	}
+}
+
+func (w *msgpackWriter) writeFloat32(f float32) {
+	w.buf = binary.BigEndian.AppendUint32(append(w.buf, 0xca), math.Float32bits(f))
+}
+
+func (w *msgpackWriter) writeFloat64(f float64) {
+	w.buf = binary.BigEndian.AppendUint64(append(w.buf, 0xcb), math.Float64bits(f))
+}
+
+// writeHead writes the head of a string, binary, array or map of n, fix is
+// the fix type or 0 if there's none, the others are of 8, 16 and 32 bits.
+func (w *msgpackWriter) writeHead(n int, fix byte, fixMax int, t8, t16, t32 byte) {
+	switch {
+	case fix != 0 && n <= fixMax:
+		w.buf = append(w.buf, fix|byte(n))
+	case t8 != 0 && n <= math.MaxUint8:
+		w.buf = append(w.buf, t8, byte(n))
+	case n <= math.MaxUint16:
+		w.buf = binary.BigEndian.AppendUint16(append(w.buf, t16), uint16(n))
+	default:
+		w.buf = binary.BigEndian.AppendUint32(append(w.buf, t32), uint32(n))
+	}
+}
+
+func (w *msgpackWriter) writeString(s string) {
+	w.writeHead(len(s), 0xa0, 31, 0xd9, 0xda, 0xdb)
+	w.buf = append(w.buf, s...)
+}
+
+func (w *msgpackWriter) writeBytes(b []byte) {
+	w.writeHead(len(b), 0, 0, 0xc4, 0xc5, 0xc6)
+	w.buf = append(w.buf, b...)
+}
+
+func (w *msgpackWriter) writeArrayLen(n int) {
+	w.writeHead(n, 0x90, 15, 0, 0xdc, 0xdd)
+}
+
+func (w *msgpackWriter) writeMapLen(n int) {
+	w.writeHead(n, 0x80, 15, 0, 0xde, 0xdf)
+}
+
+type msgpackReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *msgpackReader) remaining() int {
+	return len(r.data) - r.pos
+}
+
+func (r *msgpackReader) next(n int) ([]byte, error) {
+	if n < 0 || n > r.remaining() {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+// uint reads a big-endian unsigned integer of n bytes.
+func (r *msgpackReader) uint(n int) (uint64, error) {
+	b, err := r.next(n)
+	if err != nil {
+		return 0, err
+	}
+	var u uint64
+	for _, c := range b {
+		u = u<<8 | uint64(c)
+	}
+	return u, nil
+}
+
+func (r *msgpackReader) readToken() (token, error) {
+	b, err := r.next(1)
+	if err != nil {
+		return token{}, err
+	}
+	c := b[0]
+
+	switch {
+	case c <= 0x7f:
+		return token{kind: tokUint, u: uint64(c)}, nil
+	case c >= 0xe0:
+		return token{kind: tokInt, i: int64(int8(c))}, nil
+	case c&0xe0 == 0xa0:
+		return r.str(tokString, uint64(c&0x1f), nil)
+	case c&0xf0 == 0x90:
+		return token{kind: tokArray, n: int(c & 0x0f)}, nil
+	case c&0xf0 == 0x80:
+		return token{kind: tokMap, n: int(c & 0x0f)}, nil
+	}
+
+	switch c {
+	case 0xc0:
+		return token{kind: tokNil}, nil
+	case 0xc2, 0xc3:
+		return token{kind: tokBool, b: c == 0xc3}, nil
+
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		u, err := r.uint(1 << (c - 0xcc))
+		return token{kind: tokUint, u: u}, err
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (c - 0xd0)
+		u, err := r.uint(size)
+		// sign-extended from its size
+		shift := 64 - 8*size
+		return token{kind: tokInt, i: int64(u<<shift) >> shift}, err
+
+	case 0xca:
+		u, err := r.uint(4)
+		return token{kind: tokFloat, f: float64(math.Float32frombits(uint32(u)))}, err
+	case 0xcb:
+		u, err := r.uint(8)
+		return token{kind: tokFloat, f: math.Float64frombits(u)}, err
+
+	case 0xd9, 0xda, 0xdb:
+		n, err := r.uint(1 << (c - 0xd9))
+		return r.str(tokString, n, err)
+	case 0xc4, 0xc5, 0xc6:
+		n, err := r.uint(1 << (c - 0xc4))
+		return r.str(tokBytes, n, err)
+
+	case 0xdc, 0xdd:
+		n, err := r.uint(2 << (c - 0xdc))
+		return token{kind: tokArray, n: int(n)}, err
+	case 0xde, 0xdf:
+		n, err := r.uint(2 << (c - 0xde))
+		return token{kind: tokMap, n: int(n)}, err
+	}
+	return token{}, fmt.Errorf("msgpack: unsupported type 0x%02x", c)
+}
+
+func (r *msgpackReader) str(kind tokenKind, n uint64, err error) (token, error) {
+	if err != nil {
+		return token{}, err
+	}
+	if n > uint64(r.remaining()) {
+		return token{}, io.ErrUnexpectedEOF
+	}
+	s, err := r.next(int(n))
+	return token{kind: kind, s: s}, err
+}
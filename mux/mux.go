@@ -0,0 +1,449 @@
+// Package mux multiplexes streams over a kiwi conn, so the independent
+// channels of an app share a single websocket. Each frame of the streams is
+// a binary message with a header of its type and stream id, and the data
+// sent on a stream is bounded by the window granted by its reader.
+package mux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/mconintet/kiwi"
+)
+
+var (
+	ErrClosed       = errors.New("mux: session closed")
+	ErrStreamClosed = errors.New("mux: stream closed")
+	ErrProtocol     = errors.New("mux: protocol error")
+)
+
+// the types of the frames
+const (
+	frameOpen byte = iota
+	frameData
+	frameClose
+	frameWindow
+)
+
+// the type and the stream id
+const headerLen = 5
+
+// the window of a stream when it's opened, the larger ones of the config
+// are granted by a window update after that
+const initialWindow = 64 << 10
+
+const (
+	defaultWindowSize    = 256 << 10
+	defaultMaxFrameSize  = 32 << 10
+	defaultAcceptBacklog = 64
+)
+
+// Config of a Session, the zero fields are replaced by the defaults.
+type Config struct {
+	// the bytes a stream can receive ahead of its reads, 256KB by default
+	// and at least 64KB
+	WindowSize uint32
+
+	// the largest data frame sent, 32KB by default
+	MaxFrameSize int
+
+	// the streams opened by the peer waiting for Accept, the ones over it
+	// are closed at once. 64 by default
+	AcceptBacklog int
+}
+
+// Session carries the streams over a conn. The streams opened by the
+// dialing side have odd ids, the ones of the accepting side even ids.
+type Session struct {
+	r   kiwi.MessageReceiver
+	s   kiwi.MessageSender
+	cfg Config
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	err     error
+
+	accept chan *Stream
+	done   chan struct{}
+}
+
+// NewSession makes a session over the conn of r and s, Serve must be
+// running for the streams to be read.
+func NewSession(r kiwi.MessageReceiver, s kiwi.MessageSender, cfg *Config) *Session {
+	c := Config{}
+	if cfg != nil {
+		c = *cfg
+	}
+	if c.WindowSize == 0 {
+		c.WindowSize = defaultWindowSize
+	}
+	c.WindowSize = max(c.WindowSize, initialWindow)
+	if c.MaxFrameSize <= 0 {
+		c.MaxFrameSize = defaultMaxFrameSize
+	}
+	if c.AcceptBacklog <= 0 {
+		c.AcceptBacklog = defaultAcceptBacklog
+	}
+
+	sess := &Session{
+		r:       r,
+		s:       s,
+		cfg:     c,
+		streams: make(map[uint32]*Stream),
+		nextID:  2,
+		accept:  make(chan *Stream, c.AcceptBacklog),
+		done:    make(chan struct{}),
+	}
+	if r.GetConn().IsClient() {
+		sess.nextID = 1
+	}
+	return sess
+}
+
+// Serve reads the frames of the streams until the conn is no longer
+// readable, the close of the peer is replied. The conn is closed once it
+// returns, the streams fail with ErrClosed then, or with the error of the
+// read.
+func (sess *Session) Serve() error {
+	conn := sess.r.GetConn()
+	defer conn.Close()
+
+	for msg, err := range sess.r.Messages(0) {
+		if err != nil {
+			sess.fail(err)
+			return err
+		}
+
+		if msg.IsClose() {
+			conn.CloseWithCode(kiwi.CloseCodeNormalClosure, "")
+			break
+		}
+		if !msg.IsBinary() {
+			continue
+		}
+
+		if err := sess.handle(msg.Data); err != nil {
+			conn.CloseWithCode(kiwi.CloseCodeProtocolError, "")
+			sess.fail(err)
+			return err
+		}
+	}
+
+	sess.fail(ErrClosed)
+	return nil
+}
+
+func (sess *Session) handle(data []byte) error {
+	if len(data) < headerLen {
+		return ErrProtocol
+	}
+	typ, id, payload := data[0], binary.BigEndian.Uint32(data[1:]), data[headerLen:]
+
+	if typ == frameOpen {
+		sess.mu.Lock()
+		if id == 0 || id%2 == sess.nextID%2 || sess.streams[id] != nil {
+			sess.mu.Unlock()
+			return ErrProtocol
+		}
+
+		st := sess.newStream(id)
+		select {
+		case sess.accept <- st:
+			sess.streams[id] = st
+			sess.mu.Unlock()
+			return nil
+		default:
+			sess.mu.Unlock()
+			return sess.send(frameClose, id, nil)
+		}
+	}
+
+	sess.mu.Lock()
+	st := sess.streams[id]
+	sess.mu.Unlock()
+	// the frames of the streams already forgotten are dropped
+	if st == nil {
+		return nil
+	}
+
+	switch typ {
+	case frameData:
+		return st.receive(payload)
+	case frameClose:
+		st.remoteClose()
+		return nil
+	case frameWindow:
+		if len(payload) != 4 {
+			return ErrProtocol
+		}
+		st.grow(binary.BigEndian.Uint32(payload))
+		return nil
+	}
+	return ErrProtocol
+}
+
+func (sess *Session) newStream(id uint32) *Stream {
+	st := &Stream{
+		id:         id,
+		sess:       sess,
+		recvAvail:  initialWindow,
+		sendWindow: initialWindow,
+	}
+	st.cond = sync.NewCond(&st.mu)
+	return st
+}
+
+func (sess *Session) send(typ byte, id uint32, payload []byte) error {
+	data := make([]byte, headerLen+len(payload))
+	data[0] = typ
+	binary.BigEndian.PutUint32(data[1:], id)
+	copy(data[headerLen:], payload)
+
+	_, err := sess.s.SendWhole(&kiwi.Message{Opcode: kiwi.OpcodeBinary, Data: data}, false)
+	return err
+}
+
+func (sess *Session) sendWindow(id, n uint32) error {
+	return sess.send(frameWindow, id, binary.BigEndian.AppendUint32(nil, n))
+}
+
+// grant grants the window of the config over the initial one to st.
+func (sess *Session) grant(st *Stream) error {
+	n := sess.cfg.WindowSize - initialWindow
+	if n == 0 {
+		return nil
+	}
+
+	st.mu.Lock()
+	st.recvAvail += n
+	st.mu.Unlock()
+	return sess.sendWindow(st.id, n)
+}
+
+// Open opens a stream to the peer.
+func (sess *Session) Open() (*Stream, error) {
+	sess.mu.Lock()
+	if sess.err != nil {
+		sess.mu.Unlock()
+		return nil, sess.err
+	}
+	id := sess.nextID
+	sess.nextID += 2
+	st := sess.newStream(id)
+	sess.streams[id] = st
+	sess.mu.Unlock()
+
+	if err := sess.send(frameOpen, id, nil); err != nil {
+		return nil, err
+	}
+	if err := sess.grant(st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// Accept waits for a stream opened by the peer.
+func (sess *Session) Accept() (*Stream, error) {
+	select {
+	case st := <-sess.accept:
+		if err := sess.grant(st); err != nil {
+			return nil, err
+		}
+		return st, nil
+	case <-sess.done:
+		return nil, sess.err
+	}
+}
+
+// Close closes the conn, the streams fail with ErrClosed.
+func (sess *Session) Close() error {
+	sess.fail(ErrClosed)
+	sess.r.GetConn().CloseWithCode(kiwi.CloseCodeNormalClosure, "")
+	return nil
+}
+
+func (sess *Session) fail(err error) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	if sess.err != nil {
+		return
+	}
+	sess.err = err
+	close(sess.done)
+	for _, st := range sess.streams {
+		st.fail(err)
+	}
+}
+
+func (sess *Session) forget(id uint32) {
+	sess.mu.Lock()
+	delete(sess.streams, id)
+	sess.mu.Unlock()
+}
+
+// Stream is a logical stream of a Session.
+type Stream struct {
+	id   uint32
+	sess *Session
+
+	// serializes the writes and the close
+	wmu sync.Mutex
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	buf  bytes.Buffer
+	// the bytes the peer may still send, and the ones read but not granted
+	// back yet
+	recvAvail uint32
+	unacked   uint32
+	// the bytes that may still be sent
+	sendWindow uint32
+
+	localClosed  bool
+	remoteClosed bool
+	err          error
+}
+
+var _ io.ReadWriteCloser = (*Stream)(nil)
+
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+func (st *Stream) receive(p []byte) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if uint32(len(p)) > st.recvAvail || st.remoteClosed {
+		return ErrProtocol
+	}
+	st.recvAvail -= uint32(len(p))
+	st.buf.Write(p)
+	st.cond.Broadcast()
+	return nil
+}
+
+// Read reads the data of the peer, io.EOF once it's closed the stream and
+// all of it has been read.
+func (st *Stream) Read(p []byte) (int, error) {
+	st.mu.Lock()
+	for st.buf.Len() == 0 && !st.remoteClosed && st.err == nil {
+		st.cond.Wait()
+	}
+
+	if st.buf.Len() == 0 {
+		err := st.err
+		if st.remoteClosed {
+			err = io.EOF
+		}
+		st.mu.Unlock()
+		return 0, err
+	}
+
+	n, _ := st.buf.Read(p)
+	st.unacked += uint32(n)
+	var grant uint32
+	if st.unacked >= st.sess.cfg.WindowSize/2 && !st.remoteClosed {
+		grant = st.unacked
+		st.unacked = 0
+		st.recvAvail += grant
+	}
+	st.mu.Unlock()
+
+	if grant > 0 {
+		st.sess.sendWindow(st.id, grant)
+	}
+	return n, nil
+}
+
+// Write writes p in the data frames allowed by the window of the peer,
+// waiting for the peer to read if it's run out.
+func (st *Stream) Write(p []byte) (n int, err error) {
+	st.wmu.Lock()
+	defer st.wmu.Unlock()
+
+	for len(p) > 0 {
+		st.mu.Lock()
+		for st.sendWindow == 0 && !st.localClosed && st.err == nil {
+			st.cond.Wait()
+		}
+		switch {
+		case st.localClosed:
+			err = ErrStreamClosed
+		case st.err != nil:
+			err = st.err
+		}
+		if err != nil {
+			st.mu.Unlock()
+			return n, err
+		}
+
+		k := min(len(p), int(st.sendWindow), st.sess.cfg.MaxFrameSize)
+		st.sendWindow -= uint32(k)
+		st.mu.Unlock()
+
+		if err := st.sess.send(frameData, st.id, p[:k]); err != nil {
+			return n, err
+		}
+		n += k
+		p = p[k:]
+	}
+	return n, nil
+}
+
+// Close closes the writing side of the stream, the peer reads io.EOF after
+// the data written. The stream is forgotten once both sides are closed.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.localClosed || st.err != nil {
+		st.mu.Unlock()
+		return nil
+	}
+	st.localClosed = true
+	remoteClosed := st.remoteClosed
+	// a write waiting for the window gives up
+	st.cond.Broadcast()
+	st.mu.Unlock()
+
+	st.wmu.Lock()
+	defer st.wmu.Unlock()
+
+	if remoteClosed {
+		st.sess.forget(st.id)
+	}
+	return st.sess.send(frameClose, st.id, nil)
+}
+
+func (st *Stream) remoteClose() {
+	st.mu.Lock()
+	st.remoteClosed = true
+	localClosed := st.localClosed
+	st.cond.Broadcast()
+	st.mu.Unlock()
+
+	if localClosed {
+		st.sess.forget(st.id)
+	}
+}
+
+func (st *Stream) grow(n uint32) {
+	st.mu.Lock()
+	st.sendWindow += n
+	st.cond.Broadcast()
+	st.mu.Unlock()
+}
+
+// fail fails the reads and the writes with err, sess.mu is held.
+func (st *Stream) fail(err error) {
+	st.mu.Lock()
+	if st.err == nil {
+		st.err = err
+	}
+	st.cond.Broadcast()
+	st.mu.Unlock()
+}
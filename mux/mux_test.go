@@ -0,0 +1,159 @@
+package mux
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mconintet/kiwi"
+)
+
+// newTestSession returns the client session of a conn whose streams are
+// given to handle by the server.
+func newTestSession(t *testing.T, handle func(st *Stream)) *Session {
+	srv := kiwi.NewServer()
+	srv.ApplyDefaultCfg()
+	srv.OnConnOpenFunc("/mux", func(r kiwi.MessageReceiver, s kiwi.MessageSender) {
+		sess := NewSession(r, s, nil)
+		go func() {
+			for {
+				st, err := sess.Accept()
+				if err != nil {
+					return
+				}
+				go handle(st)
+			}
+		}()
+		sess.Serve()
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go srv.Serve(ln)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	kc, err := kiwi.Dial(ctx, "ws://"+ln.Addr().String()+"/mux")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { kc.Close() })
+
+	sess := NewSession((&kiwi.DefaultMessageReceiver{}).SetConn(kc), (&kiwi.DefaultMessageSender{}).SetConn(kc), nil)
+	go sess.Serve()
+	return sess
+}
+
+func echo(st *Stream) {
+	io.Copy(st, st)
+	st.Close()
+}
+
+func TestStreams(t *testing.T) {
+	sess := newTestSession(t, echo)
+
+	var wg sync.WaitGroup
+	for range 8 {
+		st, err := sess.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.ID()%2 != 1 {
+			t.Fatalf("got id %d; want an odd one", st.ID())
+		}
+
+		// more than the windows of both sides
+		data := make([]byte, 1<<20)
+		rand.Read(data)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			go func() {
+				st.Write(data)
+				st.Close()
+			}()
+
+			got, err := io.ReadAll(st)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Errorf("stream %d: got %d bytes, %v; want the %d written", st.ID(), len(got), err, len(data))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestFlowControl(t *testing.T) {
+	release := make(chan struct{})
+	sess := newTestSession(t, func(st *Stream) {
+		<-release
+		echo(st)
+	})
+
+	st, err := sess.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 1<<20)
+	written := make(chan error, 1)
+	go func() {
+		_, err := st.Write(data)
+		written <- err
+	}()
+
+	select {
+	case <-written:
+		t.Fatal("the write is not held by the window of the peer")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	close(release)
+	go io.Copy(io.Discard, st)
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the write is not released by the reads of the peer")
+	}
+}
+
+func TestSessionClose(t *testing.T) {
+	sess := newTestSession(t, func(st *Stream) {})
+
+	st, err := sess.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	read := make(chan error, 1)
+	go func() {
+		_, err := st.Read(make([]byte, 1))
+		read <- err
+	}()
+
+	sess.Close()
+	if err := <-read; !errors.Is(err, ErrClosed) {
+		t.Fatalf("got %v; want ErrClosed", err)
+	}
+	if _, err := sess.Accept(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("got %v; want ErrClosed", err)
+	}
+	if _, err := sess.Open(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("got %v; want ErrClosed", err)
+	}
+	if _, err := st.Write([]byte("x")); !errors.Is(err, ErrClosed) {
+		t.Fatalf("got %v; want ErrClosed", err)
+	}
+}
@@ -0,0 +1,91 @@
+package kiwi
+
+import (
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// how long EpollWait blocks before the poller checks it's closed
+const pollTimeoutMillis = 1000
+
+// poller waits for the parked conns to be readable by epoll, each one is
+// armed for a single event until it's parked again.
+type poller struct {
+	epfd   int
+	closed atomic.Bool
+
+	mu    sync.Mutex
+	conns map[int]*pollConn
+}
+
+func newPoller() (*poller, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &poller{epfd: epfd, conns: make(map[int]*pollConn)}
+	go p.run()
+	return p, nil
+}
+
+func (p *poller) arm(pc *pollConn) error {
+	p.mu.Lock()
+	_, added := p.conns[pc.fd]
+	p.conns[pc.fd] = pc
+	p.mu.Unlock()
+
+	op := syscall.EPOLL_CTL_ADD
+	if added {
+		op = syscall.EPOLL_CTL_MOD
+	}
+
+	ev := &syscall.EpollEvent{
+		Events: syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT,
+		Fd:     int32(pc.fd),
+	}
+	return syscall.EpollCtl(p.epfd, op, pc.fd, ev)
+}
+
+// remove is called before the fd is closed, so it's not mistaken for the
+// conn reusing its number.
+func (p *poller) remove(pc *pollConn) {
+	p.mu.Lock()
+	if p.conns[pc.fd] != pc {
+		p.mu.Unlock()
+		return
+	}
+	delete(p.conns, pc.fd)
+	p.mu.Unlock()
+
+	syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_DEL, pc.fd, nil)
+}
+
+func (p *poller) run() {
+	events := make([]syscall.EpollEvent, 128)
+
+	for !p.closed.Load() {
+		n, err := syscall.EpollWait(p.epfd, events, pollTimeoutMillis)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return
+		}
+
+		p.mu.Lock()
+		for _, ev := range events[:n] {
+			if pc, ok := p.conns[int(ev.Fd)]; ok {
+				go pc.wake()
+			}
+		}
+		p.mu.Unlock()
+	}
+	syscall.Close(p.epfd)
+}
+
+// close stops the poller, the conns still parked are not woken up anymore.
+func (p *poller) close() {
+	p.closed.Store(true)
+}
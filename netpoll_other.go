@@ -0,0 +1,15 @@
+//go:build !linux
+
+package kiwi
+
+import "errors"
+
+type poller struct{}
+
+func newPoller() (*poller, error) {
+	return nil, errors.New("the event loop is only supported on linux")
+}
+
+func (p *poller) arm(pc *pollConn) error { return nil }
+func (p *poller) remove(pc *pollConn)    {}
+func (p *poller) close()                 {}
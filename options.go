@@ -0,0 +1,208 @@
+package kiwi
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+var ErrInvalidConfig = errors.New("invalid server config")
+
+// Option configures the Server created by NewServer, the fields not set by
+// the options get the defaults of ApplyDefaultCfg.
+type Option func(*Server)
+
+// WithAddr sets the tcp address of ListenAndServe, like ":8080".
+func WithAddr(addr string) Option {
+	return func(srv *Server) {
+		a, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			srv.optErr = fmt.Errorf("%w: addr %q: %v", ErrInvalidConfig, addr, err)
+			return
+		}
+		srv.Addr = a
+	}
+}
+
+// WithAddrs sets Addr to the first of addrs and ExtraAddrs to the others.
+func WithAddrs(addrs ...string) Option {
+	return func(srv *Server) {
+		srv.ExtraAddrs = nil
+		for i, addr := range addrs {
+			a, err := net.ResolveTCPAddr("tcp", addr)
+			if err != nil {
+				srv.optErr = fmt.Errorf("%w: addr %q: %v", ErrInvalidConfig, addr, err)
+				return
+			}
+			if i == 0 {
+				srv.Addr = a
+			} else {
+				srv.ExtraAddrs = append(srv.ExtraAddrs, a)
+			}
+		}
+	}
+}
+
+// WithReusePort binds the addresses with SO_REUSEPORT by acceptors listeners
+// each, see Server.ReusePort.
+func WithReusePort(acceptors int) Option {
+	return func(srv *Server) {
+		srv.ReusePort = true
+		srv.Acceptors = acceptors
+	}
+}
+
+// WithWorkerPool runs the handlers of OnMessage by a pool of workers, see
+// NewWorkerPool.
+func WithWorkerPool(workers, queue int) Option {
+	return func(srv *Server) {
+		srv.Workers = NewWorkerPool(workers, queue)
+	}
+}
+
+// WithTCPOptions tunes the sockets of the accepted conns.
+func WithTCPOptions(opts TCPOptions) Option {
+	return func(srv *Server) {
+		srv.TCP = &opts
+	}
+}
+
+// WithLimits sets the limits of the receivers, the zero fields keep the
+// defaults.
+func WithLimits(limits Limits) Option {
+	return func(srv *Server) {
+		if limits.MaxFramePayloadBytes > 0 {
+			srv.MaxFramePayloadBytes = limits.MaxFramePayloadBytes
+		}
+		if limits.MaxMessageBytes > 0 {
+			srv.MaxMessageBytes = limits.MaxMessageBytes
+		}
+		srv.MaxMessageFragments = limits.MaxMessageFragments
+		srv.MinAvgFragmentBytes = limits.MinAvgFragmentBytes
+	}
+}
+
+func WithMaxHandshakeBytes(n int) Option {
+	return func(srv *Server) {
+		srv.MaxHandshakeBytes = n
+	}
+}
+
+// WithHandshakeTimeout bounds the reading of the handshake request and the
+// writing of its response.
+func WithHandshakeTimeout(d time.Duration) Option {
+	return func(srv *Server) {
+		srv.HandshakeTimeout = d
+	}
+}
+
+// WithMaxConnectionAge closes the conns after age plus a random jitter in
+// [0, jitter).
+func WithMaxConnectionAge(age, jitter time.Duration) Option {
+	return func(srv *Server) {
+		srv.MaxConnectionAge = age
+		srv.MaxConnectionAgeJitter = jitter
+	}
+}
+
+// WithRouters replaces the routers of the server, the nil ones keep the
+// default routers.
+func WithRouters(hs OnHandshakeRequestRouter, open OnConnOpenRouter, close OnConnCloseRouter) Option {
+	return func(srv *Server) {
+		if hs != nil {
+			srv.handshakeReqRouter = hs
+		}
+		if open != nil {
+			srv.onConnOpenRouter = open
+		}
+		if close != nil {
+			srv.onConnCloseRouter = close
+		}
+	}
+}
+
+// WithLogger sets the logger of the server errors, see Server.ErrorLog.
+func WithLogger(l *log.Logger) Option {
+	return func(srv *Server) {
+		srv.ErrorLog = l
+	}
+}
+
+// WithTLSConfig makes ListenAndServe serve wss, cfg must have a certificate.
+func WithTLSConfig(cfg *tls.Config) Option {
+	return func(srv *Server) {
+		srv.TLSConfig = cfg
+	}
+}
+
+// WithClientCAs makes ListenAndServe require the client certificates
+// verified by pool, see Server.ClientCAs.
+func WithClientCAs(pool *x509.CertPool) Option {
+	return func(srv *Server) {
+		srv.ClientCAs = pool
+	}
+}
+
+// Validate checks the configuration of the server, it's called by Serve.
+func (srv *Server) Validate() error {
+	if srv.optErr != nil {
+		return srv.optErr
+	}
+
+	invalid := func(format string, args ...any) error {
+		return fmt.Errorf("%w: "+format, append([]any{ErrInvalidConfig}, args...)...)
+	}
+
+	switch {
+	case srv.handshakeReqRouter == nil || srv.onConnOpenRouter == nil || srv.onConnCloseRouter == nil:
+		return invalid("the routers are not set, see ApplyDefaultCfg")
+	case srv.ConnPool == nil:
+		return invalid("ConnPool is nil, see NewServer")
+	case srv.MaxHandshakeBytes <= 0:
+		return invalid("MaxHandshakeBytes must be positive")
+	case srv.MaxFramePayloadBytes == 0 || srv.MaxMessageBytes == 0:
+		return invalid("MaxFramePayloadBytes and MaxMessageBytes must be positive")
+	case srv.MaxMessageFragments < 0:
+		return invalid("MaxMessageFragments must not be negative")
+	case srv.MaxRequestLineBytes < 0 || srv.MaxHeaderLineBytes < 0 || srv.MaxHeaders < 0:
+		return invalid("the header limits must not be negative")
+	case srv.Acceptors < 0:
+		return invalid("Acceptors must not be negative")
+	case srv.ReadBufferSize < 0 || srv.WriteBufferSize < 0:
+		return invalid("the buffer sizes must not be negative")
+	case srv.HandshakeTimeout < 0 || srv.MaxConnectionAge < 0 || srv.MaxConnectionAgeJitter < 0 ||
+		srv.WriteCoalesceDelay < 0 || srv.PingInterval < 0:
+		return invalid("the durations must not be negative")
+	}
+
+	if code := srv.MaxConnectionAgeCloseCode; code != 0 && !ValidCloseCode(code) {
+		return invalid("invalid MaxConnectionAgeCloseCode")
+	}
+	if code := srv.UnexpectedTypeCloseCode; code != 0 && !ValidCloseCode(code) {
+		return invalid("invalid UnexpectedTypeCloseCode")
+	}
+
+	if srv.ClientCAs != nil && srv.TLSConfig == nil {
+		return invalid("ClientCAs needs TLSConfig")
+	}
+
+	if cfg := srv.TLSConfig; cfg != nil &&
+		len(cfg.Certificates) == 0 && cfg.GetCertificate == nil && cfg.GetConfigForClient == nil {
+		return invalid("TLSConfig has no certificate")
+	}
+	return nil
+}
+
+// logf logs by the ErrorLog of the server, or the standard logger if it's
+// nil.
+func (srv *Server) logf(format string, args ...any) {
+	if srv.ErrorLog != nil {
+		srv.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
@@ -0,0 +1,53 @@
+package kiwi
+
+import (
+	"strings"
+	"sync/atomic"
+)
+
+var ErrOriginNotAllowed = &ProtocolError{"origin not allowed"}
+
+// OriginPolicy checks the Origin header of the handshake requests against
+// origins like "https://app.example.com", "https://*.example.com" for the
+// subdomains, or "*" for any origin. All origins are allowed if the list is
+// empty, and the requests without an Origin, which are not sent by browsers,
+// are always allowed. The list can be replaced by Update while the server
+// is running.
+type OriginPolicy struct {
+	origins atomic.Pointer[[]string]
+}
+
+func NewOriginPolicy(origins ...string) *OriginPolicy {
+	op := &OriginPolicy{}
+	op.Update(origins)
+	return op
+}
+
+func (op *OriginPolicy) Update(origins []string) {
+	lower := make([]string, len(origins))
+	for i, o := range origins {
+		lower[i] = strings.ToLower(strings.TrimSpace(o))
+	}
+	op.origins.Store(&lower)
+}
+
+func (op *OriginPolicy) Allowed(origin string) bool {
+	origins := *op.origins.Load()
+	if len(origins) == 0 {
+		return true
+	}
+
+	origin = strings.ToLower(origin)
+	for _, o := range origins {
+		if o == "*" || o == origin {
+			return true
+		}
+
+		// https://*.example.com matches the subdomains only
+		scheme, host, ok := strings.Cut(o, "://*.")
+		if ok && strings.HasPrefix(origin, scheme+"://") && strings.HasSuffix(origin, "."+host) {
+			return true
+		}
+	}
+	return false
+}
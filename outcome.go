@@ -0,0 +1,86 @@
+package kiwi
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Outcome summarizes how a conn ended, it's derived from the close code or
+// the error by CloseCodeOutcome and ErrorOutcome and used by the SLO reports.
+type Outcome string
+
+const (
+	OutcomeNormal      Outcome = "normal"
+	OutcomeClientError Outcome = "client_error"
+	OutcomeServerError Outcome = "server_error"
+	OutcomePolicy      Outcome = "policy"
+	OutcomeAbnormal    Outcome = "abnormal"
+)
+
+var outcomeHTTPStatus = map[Outcome]int{
+	OutcomeNormal:      http.StatusOK,
+	OutcomeClientError: http.StatusBadRequest,
+	OutcomeServerError: http.StatusInternalServerError,
+	OutcomePolicy:      http.StatusForbidden,
+	OutcomeAbnormal:    http.StatusBadGateway,
+}
+
+// HTTPStatus returns the http status the outcome is summarized as.
+func (o Outcome) HTTPStatus() int {
+	if status, ok := outcomeHTTPStatus[o]; ok {
+		return status
+	}
+	return http.StatusBadGateway
+}
+
+// CloseCodeOutcome categorizes code, the codes not known are abnormal.
+func CloseCodeOutcome(code uint16) Outcome {
+	switch code {
+	case CloseCodeNormalClosure, CloseCodeGoingAway:
+		return OutcomeNormal
+	case CloseCodeProtocolError, CloseCodeUnsupportedData, CloseCodeInvalidFramePayloadData,
+		CloseCodeMessageTooBig, CloseCodeMandatoryExt:
+		return OutcomeClientError
+	case CloseCodePolicyViolation:
+		return OutcomePolicy
+	case CloseCodeInternalServerError, CloseCodeServiceRestart, CloseCodeTryAgainLater:
+		return OutcomeServerError
+	}
+	return OutcomeAbnormal
+}
+
+var closeCodeHTTPStatus = map[uint16]int{
+	CloseCodeUnsupportedData:         http.StatusUnsupportedMediaType,
+	CloseCodeInvalidFramePayloadData: http.StatusBadRequest,
+	CloseCodeMessageTooBig:           http.StatusRequestEntityTooLarge,
+	CloseCodeServiceRestart:          http.StatusServiceUnavailable,
+	CloseCodeTryAgainLater:           http.StatusServiceUnavailable,
+}
+
+// CloseCodeHTTPStatus returns the http status code is summarized as, it's
+// more specific than the status of its outcome for some codes.
+func CloseCodeHTTPStatus(code uint16) int {
+	if status, ok := closeCodeHTTPStatus[code]; ok {
+		return status
+	}
+	return CloseCodeOutcome(code).HTTPStatus()
+}
+
+// ErrorOutcome categorizes an error a conn ended with, a nil error is normal.
+func ErrorOutcome(err error) Outcome {
+	if err == nil {
+		return OutcomeNormal
+	}
+
+	var pe *ProtocolError
+	var se *ServerError
+	switch {
+	case errors.Is(err, ErrPayloadRejected):
+		return OutcomePolicy
+	case errors.Is(err, ErrMessageTooLarge), errors.Is(err, ErrFrameTooLarge), errors.As(err, &pe):
+		return OutcomeClientError
+	case errors.As(err, &se):
+		return OutcomeServerError
+	}
+	return OutcomeAbnormal
+}
@@ -0,0 +1,109 @@
+package kiwi
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+type presenceEvent struct {
+	topic string
+	key   string
+	join  bool
+}
+
+func (h *Hub) firePresence(events []presenceEvent) {
+	for _, e := range events {
+		if e.join && h.OnJoin != nil {
+			h.OnJoin(e.topic, e.key)
+		} else if !e.join && h.OnLeave != nil {
+			h.OnLeave(e.topic, e.key)
+		}
+	}
+}
+
+// Members returns the sorted keys of the members of topic connected to this
+// instance, the members joined with an empty key are not included.
+func (h *Hub) Members(topic string) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	t, ok := h.topics[topic]
+	if !ok {
+		return nil
+	}
+
+	keys := make([]string, 0, len(t.presence))
+	for key := range t.presence {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Notify sends msg to the members of topic connected to this instance,
+// without keeping it in the history nor publishing it through Broker.
+func (h *Hub) Notify(topic string, msg *Message) {
+	h.mu.Lock()
+	t, ok := h.topics[topic]
+	if !ok {
+		h.mu.Unlock()
+		return
+	}
+	senders, events := t.openSenders(topic)
+	h.mu.Unlock()
+
+	h.firePresence(events)
+	for _, s := range senders {
+		s.SendWhole(msg, false)
+	}
+}
+
+// PushPresence notifies the members of each topic of its Members every
+// interval, until ctx is done. The topics without members are skipped.
+func (h *Hub) PushPresence(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		h.mu.Lock()
+		topics := make([]string, 0, len(h.topics))
+		for name, t := range h.topics {
+			if len(t.members) > 0 {
+				topics = append(topics, name)
+			}
+		}
+		h.mu.Unlock()
+
+		for _, topic := range topics {
+			h.Notify(topic, h.presenceMessage(topic, h.Members(topic)))
+		}
+	}
+}
+
+func (h *Hub) presenceMessage(topic string, keys []string) *Message {
+	if h.PresenceMessage != nil {
+		return h.PresenceMessage(topic, keys)
+	}
+	return presenceJSON(topic, keys)
+}
+
+// presenceJSON is like {"type":"presence","topic":"lobby","members":["alice"]}.
+func presenceJSON(topic string, keys []string) *Message {
+	if keys == nil {
+		keys = []string{}
+	}
+	data, _ := json.Marshal(struct {
+		Type    string   `json:"type"`
+		Topic   string   `json:"topic"`
+		Members []string `json:"members"`
+	}{"presence", topic, keys})
+	return &Message{Opcode: OpcodeText, Data: data}
+}
@@ -0,0 +1,55 @@
+package kiwi
+
+import (
+	"encoding/binary"
+	"strconv"
+	"time"
+)
+
+const ProbePath = "/kiwi/probe"
+
+// EnableProbe serves a diagnostic route on ProbePath which echoes every data
+// message with the server receive and send times appended, as unix
+// nanoseconds. Text messages get " <recv> <send>" in decimal and binary ones
+// get both times as big endian int64s.
+func (srv *Server) EnableProbe() {
+	srv.OnConnOpenFunc(ProbePath, serveProbe)
+}
+
+func serveProbe(r MessageReceiver, s MessageSender) {
+	for msg, err := range r.Messages(0) {
+		recv := time.Now()
+
+		if err != nil {
+			s.SendClose(CloseCodeProtocolError, "", true, false)
+			return
+		}
+
+		switch {
+		case msg.IsClose():
+			s.SendClose(CloseCodeNormalClosure, "", true, false)
+			return
+		case msg.IsPing():
+			s.SendWhole(&Message{Opcode: OpcodePong, Data: msg.Data}, false)
+		case msg.IsText() || msg.IsBinary():
+			s.SendWhole(appendProbeTimes(msg, recv, time.Now()), false)
+		}
+	}
+}
+
+func appendProbeTimes(msg *Message, recv, send time.Time) *Message {
+	data := append([]byte(nil), msg.Data...)
+
+	if msg.IsText() {
+		data = append(data, ' ')
+		data = strconv.AppendInt(data, recv.UnixNano(), 10)
+		data = append(data, ' ')
+		data = strconv.AppendInt(data, send.UnixNano(), 10)
+	} else {
+		data = binary.BigEndian.AppendUint64(data, uint64(recv.UnixNano()))
+		data = binary.BigEndian.AppendUint64(data, uint64(send.UnixNano()))
+	}
+
+	msg.Release()
+	return &Message{Opcode: msg.Opcode, Data: data}
+}
@@ -0,0 +1,235 @@
+package kiwi
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+var (
+	ErrBadProxyScheme = errors.New("proxy scheme is not http, https, socks5 or socks5h")
+	ErrSOCKSRejected  = errors.New("socks5 proxy rejected the request")
+)
+
+// dial opens the tcp conn to addr, through the proxy of u if there is one.
+func (d *Dialer) dial(ctx context.Context, u *url.URL, addr string) (net.Conn, error) {
+	var proxyURL *url.URL
+	if d.Proxy != nil {
+		var err error
+		if proxyURL, err = d.Proxy(&http.Request{URL: httpURL(u)}); err != nil {
+			return nil, err
+		}
+	}
+
+	dial := d.NetDialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+
+	if proxyURL == nil {
+		return dial(ctx, "tcp", addr)
+	}
+
+	var proxyAddr string
+	switch proxyURL.Scheme {
+	case "http":
+		proxyAddr = hostPort(proxyURL, "80")
+	case "https":
+		proxyAddr = hostPort(proxyURL, "443")
+	case "socks5", "socks5h":
+		proxyAddr = hostPort(proxyURL, "1080")
+	default:
+		return nil, ErrBadProxyScheme
+	}
+
+	raw, err := dial(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	// the proxy handshake is interrupted by ctx
+	stop := context.AfterFunc(ctx, func() {
+		raw.Close()
+	})
+
+	nc := raw
+	switch proxyURL.Scheme {
+	case "https":
+		tc := tls.Client(raw, &tls.Config{ServerName: proxyURL.Hostname()})
+		if err = tc.HandshakeContext(ctx); err == nil {
+			nc, err = proxyConnect(tc, proxyURL, addr)
+		}
+	case "http":
+		nc, err = proxyConnect(raw, proxyURL, addr)
+	default:
+		err = socks5Connect(raw, proxyURL, addr)
+	}
+
+	if !stop() {
+		err = ctx.Err()
+	}
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+	return nc, nil
+}
+
+func hostPort(u *url.URL, defaultPort string) string {
+	if u.Port() == "" {
+		return net.JoinHostPort(u.Hostname(), defaultPort)
+	}
+	return u.Host
+}
+
+// bufferedConn keeps the bytes read ahead by the proxy response reader.
+type bufferedConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.br.Read(p)
+}
+
+// proxyConnect opens a tunnel to addr by the CONNECT method, it's used for
+// both ws and wss so the proxy never sees the handshake.
+func proxyConnect(nc net.Conn, proxyURL *url.URL, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if user := proxyURL.User; user != nil {
+		pass, _ := user.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+
+	if err := req.Write(nc); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(nc)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &HandshakeError{ErrorString: "proxy CONNECT failed: " + resp.Status, Status: resp.StatusCode}
+	}
+
+	if br.Buffered() > 0 {
+		return &bufferedConn{nc, br}, nil
+	}
+	return nc, nil
+}
+
+// socks5Connect does the RFC 1928 handshake, with the username/password
+// auth of RFC 1929 if the proxy url has a user. The host name is resolved
+// by the proxy.
+func socks5Connect(nc net.Conn, proxyURL *url.URL, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return err
+	}
+
+	method := byte(0x00)
+	if proxyURL.User != nil {
+		method = 0x02
+	}
+	if _, err = nc.Write([]byte{0x05, 0x01, method}); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+	if _, err = io.ReadFull(nc, reply); err != nil {
+		return err
+	}
+	if reply[0] != 0x05 || reply[1] != method {
+		return ErrSOCKSRejected
+	}
+
+	if method == 0x02 {
+		user := proxyURL.User.Username()
+		pass, _ := proxyURL.User.Password()
+		if len(user) > 255 || len(pass) > 255 {
+			return errors.New("socks5 username or password too long")
+		}
+
+		req := []byte{0x01, byte(len(user))}
+		req = append(req, user...)
+		req = append(req, byte(len(pass)))
+		req = append(req, pass...)
+		if _, err = nc.Write(req); err != nil {
+			return err
+		}
+
+		if _, err = io.ReadFull(nc, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return ErrSOCKSRejected
+		}
+	}
+
+	req := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.New("socks5 host name too long")
+		}
+		req = append(req, 0x03, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, 0x01)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, 0x04)
+		req = append(req, ip.To16()...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err = nc.Write(req); err != nil {
+		return err
+	}
+
+	// ver, rep, rsv and atyp, then the bound address which is discarded
+	head := make([]byte, 4)
+	if _, err = io.ReadFull(nc, head); err != nil {
+		return err
+	}
+	if head[1] != 0x00 {
+		return ErrSOCKSRejected
+	}
+
+	var n int
+	switch head[3] {
+	case 0x01:
+		n = net.IPv4len
+	case 0x04:
+		n = net.IPv6len
+	case 0x03:
+		if _, err = io.ReadFull(nc, head[:1]); err != nil {
+			return err
+		}
+		n = int(head[0])
+	default:
+		return ErrSOCKSRejected
+	}
+	_, err = io.ReadFull(nc, make([]byte, n+2))
+	return err
+}
@@ -0,0 +1,123 @@
+package kiwi
+
+import (
+	"math"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+var ErrRateLimited = &ProtocolError{"too many handshakes"}
+
+// RateLimiter is a token bucket allowing perSecond events on average with
+// bursts of burst events. Its rate can be changed by SetRate while the
+// server is running, and a nil or zero rate RateLimiter allows everything.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(perSecond float64, burst int) *RateLimiter {
+	rl := &RateLimiter{}
+	rl.SetRate(perSecond, burst)
+	return rl
+}
+
+// SetRate changes the rate, burst is at least 1 and defaults to the rate
+// rounded up if it's zero.
+func (rl *RateLimiter) SetRate(perSecond float64, burst int) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	b := float64(burst)
+	if b <= 0 {
+		b = max(1, math.Ceil(perSecond))
+	}
+
+	rl.rate = perSecond
+	rl.burst = b
+	rl.tokens = min(rl.tokens, b)
+	if rl.last.IsZero() {
+		rl.tokens = b
+	}
+}
+
+func (rl *RateLimiter) Allow() bool {
+	if rl == nil {
+		return true
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.rate <= 0 {
+		return true
+	}
+
+	now := time.Now()
+	if !rl.last.IsZero() {
+		rl.tokens = min(rl.burst, rl.tokens+now.Sub(rl.last).Seconds()*rl.rate)
+	}
+	rl.last = now
+
+	if rl.tokens < 1 {
+		return false
+	}
+	rl.tokens--
+	return true
+}
+
+// the limiters of ClientRateLimiter idle for this long are dropped
+const clientLimiterIdle = time.Minute
+
+// ClientRateLimiter is a RateLimiter per client address, see Conn.ClientIP.
+type ClientRateLimiter struct {
+	perSecond float64
+	burst     int
+
+	mu        sync.Mutex
+	limiters  map[netip.Addr]*RateLimiter
+	lastSweep time.Time
+}
+
+func NewClientRateLimiter(perSecond float64, burst int) *ClientRateLimiter {
+	return &ClientRateLimiter{
+		perSecond: perSecond,
+		burst:     burst,
+		limiters:  make(map[netip.Addr]*RateLimiter),
+	}
+}
+
+// Allow takes a token of the limiter of addr, the invalid addresses are
+// all limited by one.
+func (cl *ClientRateLimiter) Allow(addr netip.Addr) bool {
+	if cl == nil {
+		return true
+	}
+
+	cl.mu.Lock()
+	now := time.Now()
+	if now.Sub(cl.lastSweep) > clientLimiterIdle {
+		cl.lastSweep = now
+		for a, rl := range cl.limiters {
+			rl.mu.Lock()
+			idle := now.Sub(rl.last) > clientLimiterIdle
+			rl.mu.Unlock()
+			if idle {
+				delete(cl.limiters, a)
+			}
+		}
+	}
+
+	rl, ok := cl.limiters[addr]
+	if !ok {
+		rl = NewRateLimiter(cl.perSecond, cl.burst)
+		cl.limiters[addr] = rl
+	}
+	cl.mu.Unlock()
+
+	return rl.Allow()
+}
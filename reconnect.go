@@ -0,0 +1,190 @@
+package kiwi
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type ReconnectState int
+
+const (
+	ReconnectDialing ReconnectState = iota
+	ReconnectConnected
+	ReconnectWaiting
+	ReconnectStopped
+)
+
+var reconnectStateText = map[ReconnectState]string{
+	ReconnectDialing:   "dialing",
+	ReconnectConnected: "connected",
+	ReconnectWaiting:   "waiting",
+	ReconnectStopped:   "stopped",
+}
+
+func (s ReconnectState) String() string {
+	return reconnectStateText[s]
+}
+
+var defaultReconnectPolicy = &RetryPolicy{Backoff: 500 * time.Millisecond, MaxBackoff: 30 * time.Second}
+
+// ReconnectingConn keeps a client conn to URL, it re-dials after the conn
+// is closed other than by a normal closure, waiting a jittered exponential
+// backoff between the attempts.
+type ReconnectingConn struct {
+	URL    string
+	Dialer *Dialer
+
+	// the backoff between the attempts, it's reset once connected. The
+	// attempts never stop if MaxRetries is zero
+	Policy *RetryPolicy
+
+	// called with each new conn before Run's handle, e.g. to subscribe
+	// again, the conn is closed and re-dialed if it returns an error
+	OnConnect func(c *Conn) error
+
+	// called on each change of the state, err is the one of the last
+	// attempt or of the conn closed
+	OnStateChange func(state ReconnectState, err error)
+
+	// resumed by each dial if it's not nil, the messages read by handle
+	// should be passed to its Receive
+	Session *ClientSession
+
+	mu   sync.Mutex
+	conn *Conn
+}
+
+func (rc *ReconnectingConn) setState(state ReconnectState, err error) {
+	if rc.OnStateChange != nil {
+		rc.OnStateChange(state, err)
+	}
+}
+
+// Conn returns the current conn, nil if it's not connected.
+func (rc *ReconnectingConn) Conn() *Conn {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	return rc.conn
+}
+
+func (rc *ReconnectingConn) setConn(c *Conn) {
+	rc.mu.Lock()
+	rc.conn = c
+	rc.mu.Unlock()
+}
+
+// Run connects and calls handle with each conn until ctx is done, the conn
+// is closed by a normal closure, or the retries run out. The conn is closed
+// once handle returns, so handle should return once the conn is no longer
+// readable.
+func (rc *ReconnectingConn) Run(ctx context.Context, handle OnConnOpenFunc) (err error) {
+	dialer := rc.Dialer
+	if dialer == nil {
+		dialer = DefaultDialer
+	}
+	policy := rc.Policy
+	if policy == nil {
+		policy = defaultReconnectPolicy
+	}
+
+	defer func() {
+		rc.setConn(nil)
+		rc.setState(ReconnectStopped, err)
+	}()
+
+	for retry := 0; ; retry++ {
+		rc.setState(ReconnectDialing, err)
+
+		var c *Conn
+		if c, err = rc.dial(ctx, dialer); err == nil {
+			retry = 0
+
+			var normal bool
+			if normal, err = rc.serve(ctx, c, handle); normal {
+				return nil
+			}
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if policy.MaxRetries > 0 && retry >= policy.MaxRetries {
+			return err
+		}
+
+		rc.setState(ReconnectWaiting, err)
+		cfg := dialer.config()
+		t := cfg.clock().NewTimer(cfg.jitter(policy.backoff(retry)))
+		select {
+		case <-t.C():
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+func (rc *ReconnectingConn) dial(ctx context.Context, dialer *Dialer) (*Conn, error) {
+	if rc.Session == nil {
+		return dialer.Dial(ctx, rc.URL)
+	}
+
+	u, err := rc.Session.URL(rc.URL)
+	if err != nil {
+		return nil, err
+	}
+	return dialer.Dial(ctx, u)
+}
+
+// serve runs handle on c, normal reports if c was closed by a normal
+// closure from either side.
+func (rc *ReconnectingConn) serve(ctx context.Context, c *Conn, handle OnConnOpenFunc) (normal bool, err error) {
+	rc.setConn(c)
+	defer rc.setConn(nil)
+
+	// ctx closes the conn to stop handle
+	stop := context.AfterFunc(ctx, func() {
+		c.CloseWithCode(CloseCodeGoingAway, "")
+	})
+	defer stop()
+
+	if rc.OnConnect != nil {
+		if err := rc.OnConnect(c); err != nil {
+			c.Close()
+			return false, err
+		}
+	}
+
+	rc.setState(ReconnectConnected, nil)
+	handle((&DefaultMessageReceiver{}).SetConn(c), (&DefaultMessageSender{}).SetConn(c))
+
+	// the close of the peer is replied if handle has not
+	if ce := c.peerClose.Load(); ce != nil {
+		code := ce.Code
+		if code == CloseCodeNoStatusRcvd {
+			code = CloseCodeNormalClosure
+		}
+		c.CloseWithCode(code, "")
+		return ce.Code == CloseCodeNormalClosure, ce
+	}
+
+	c.Close()
+	code := uint16(atomic.LoadUint32(&c.closeCode))
+	return c.closeSent.Load() && code == CloseCodeNormalClosure, ErrConnIsNotOpen
+}
+
+// jitter returns a random duration between d/2 and d read from srv.Rand, d
+// if it fails.
+func (srv *Server) jitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+	j, err := srv.randN(d / 2)
+	if err != nil {
+		return d
+	}
+	return d/2 + j
+}
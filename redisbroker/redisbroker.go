@@ -0,0 +1,372 @@
+// Package redisbroker implements kiwi.Broker over the pub/sub of Redis, so
+// the hubs of several kiwi servers behind a load balancer share their topics.
+// It speaks the RESP protocol itself and needs no Redis client library.
+package redisbroker
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mconintet/kiwi"
+)
+
+var ErrClosed = errors.New("redisbroker: closed")
+
+const (
+	defaultPrefix      = "kiwi:"
+	defaultDialTimeout = 5 * time.Second
+	maxRetryDelay      = 30 * time.Second
+
+	// a bulk string of Redis is at most 512MB
+	maxBulkLen = 512 << 20
+)
+
+type Config struct {
+	// host:port of the Redis server
+	Addr string
+
+	// sent by AUTH if Password is not empty, Username may be empty for the
+	// servers before Redis 6
+	Username string
+	Password string
+
+	// prepended to the topics to make the Redis channels, "kiwi:" if empty
+	Prefix string
+
+	DialTimeout time.Duration
+
+	// called with the errors of the subscriber conn, which is dialed again
+	// after them
+	OnError func(err error)
+}
+
+// Broker publishes on one Redis conn and receives the messages of its
+// subscriptions on another, the latter is dialed again and resubscribed if
+// it's lost. The messages published meanwhile are missed, as with any
+// subscriber of Redis.
+type Broker struct {
+	cfg Config
+
+	pmu sync.Mutex
+	pub *respConn
+
+	smu      sync.Mutex
+	sub      *respConn
+	handlers map[string]func([]byte)
+	closed   bool
+}
+
+var _ kiwi.Broker = (*Broker)(nil)
+
+// Dial connects to the Redis server of cfg.
+func Dial(ctx context.Context, cfg Config) (*Broker, error) {
+	if cfg.Prefix == "" {
+		cfg.Prefix = defaultPrefix
+	}
+	if cfg.DialTimeout == 0 {
+		cfg.DialTimeout = defaultDialTimeout
+	}
+
+	b := &Broker{cfg: cfg, handlers: make(map[string]func([]byte))}
+
+	var err error
+	if b.pub, err = b.dial(ctx); err != nil {
+		return nil, err
+	}
+	if b.sub, err = b.dial(ctx); err != nil {
+		b.pub.Close()
+		return nil, err
+	}
+
+	go b.run(b.sub)
+	return b, nil
+}
+
+func (b *Broker) dial(ctx context.Context) (*respConn, error) {
+	d := net.Dialer{Timeout: b.cfg.DialTimeout}
+	nc, err := d.DialContext(ctx, "tcp", b.cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	c := newRespConn(nc)
+
+	if b.cfg.Password != "" {
+		args := []string{"AUTH", b.cfg.Password}
+		if b.cfg.Username != "" {
+			args = []string{"AUTH", b.cfg.Username, b.cfg.Password}
+		}
+		if _, err := c.do(args...); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (b *Broker) channel(topic string) string {
+	return b.cfg.Prefix + topic
+}
+
+// Publish publishes data on the channel of topic, the publisher conn is
+// dialed again once if it has been lost.
+func (b *Broker) Publish(topic string, data []byte) error {
+	b.pmu.Lock()
+	defer b.pmu.Unlock()
+
+	for retried := false; ; retried = true {
+		if b.pub == nil {
+			if b.isClosed() {
+				return ErrClosed
+			}
+
+			var err error
+			if b.pub, err = b.dial(context.Background()); err != nil {
+				return err
+			}
+		}
+
+		_, err := b.pub.do("PUBLISH", b.channel(topic), string(data))
+		var re respError
+		if err == nil || errors.As(err, &re) || retried {
+			return err
+		}
+
+		b.pub.Close()
+		b.pub = nil
+	}
+}
+
+// Subscribe subscribes to the channel of topic, replacing the fn of a former
+// subscription to it. It's kept and resubscribed with the subscriber conn
+// even if sending the command fails.
+func (b *Broker) Subscribe(topic string, fn func(data []byte)) error {
+	b.smu.Lock()
+	defer b.smu.Unlock()
+
+	if b.closed {
+		return ErrClosed
+	}
+	b.handlers[topic] = fn
+	return b.sub.send("SUBSCRIBE", b.channel(topic))
+}
+
+func (b *Broker) Unsubscribe(topic string) error {
+	b.smu.Lock()
+	defer b.smu.Unlock()
+
+	if b.closed {
+		return ErrClosed
+	}
+	delete(b.handlers, topic)
+	return b.sub.send("UNSUBSCRIBE", b.channel(topic))
+}
+
+func (b *Broker) isClosed() bool {
+	b.smu.Lock()
+	defer b.smu.Unlock()
+	return b.closed
+}
+
+// Close closes both conns, the subscriptions end.
+func (b *Broker) Close() error {
+	b.smu.Lock()
+	b.closed = true
+	err := b.sub.Close()
+	b.smu.Unlock()
+
+	b.pmu.Lock()
+	if b.pub != nil {
+		b.pub.Close()
+		b.pub = nil
+	}
+	b.pmu.Unlock()
+	return err
+}
+
+// run reads the messages of the subscriptions until the broker is closed.
+func (b *Broker) run(sub *respConn) {
+	for {
+		err := b.receive(sub)
+		sub.Close()
+
+		for delay := 100 * time.Millisecond; ; delay = min(2*delay, maxRetryDelay) {
+			if b.isClosed() {
+				return
+			}
+			if b.cfg.OnError != nil {
+				b.cfg.OnError(err)
+			}
+
+			if sub, err = b.resubscribe(); err == nil {
+				break
+			}
+			time.Sleep(delay)
+		}
+	}
+}
+
+func (b *Broker) receive(sub *respConn) error {
+	for {
+		v, err := sub.read()
+		if err != nil {
+			return err
+		}
+
+		// ["message", channel, data], the replies of SUBSCRIBE and
+		// UNSUBSCRIBE are ignored
+		push, ok := v.([]any)
+		if !ok || len(push) != 3 {
+			continue
+		}
+		kind, _ := push[0].([]byte)
+		channel, _ := push[1].([]byte)
+		data, _ := push[2].([]byte)
+		if string(kind) != "message" {
+			continue
+		}
+
+		topic, ok := strings.CutPrefix(string(channel), b.cfg.Prefix)
+		if !ok {
+			continue
+		}
+
+		b.smu.Lock()
+		fn := b.handlers[topic]
+		b.smu.Unlock()
+		if fn != nil {
+			fn(data)
+		}
+	}
+}
+
+// resubscribe dials a new subscriber conn and subscribes it to all the
+// topics.
+func (b *Broker) resubscribe() (*respConn, error) {
+	sub, err := b.dial(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	b.smu.Lock()
+	defer b.smu.Unlock()
+
+	if b.closed {
+		sub.Close()
+		return nil, ErrClosed
+	}
+
+	if len(b.handlers) > 0 {
+		args := []string{"SUBSCRIBE"}
+		for topic := range b.handlers {
+			args = append(args, b.channel(topic))
+		}
+		if err := sub.send(args...); err != nil {
+			sub.Close()
+			return nil, err
+		}
+	}
+	b.sub = sub
+	return sub, nil
+}
+
+// respError is an error reply of Redis.
+type respError string
+
+func (e respError) Error() string {
+	return "redis: " + string(e)
+}
+
+// respConn reads and writes the RESP2 protocol of Redis.
+type respConn struct {
+	nc net.Conn
+	r  *bufio.Reader
+	w  *bufio.Writer
+}
+
+func newRespConn(nc net.Conn) *respConn {
+	return &respConn{nc: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}
+}
+
+func (c *respConn) Close() error {
+	return c.nc.Close()
+}
+
+// send writes a command as an array of bulk strings.
+func (c *respConn) send(args ...string) error {
+	fmt.Fprintf(c.w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return c.w.Flush()
+}
+
+// do sends a command and reads its reply.
+func (c *respConn) do(args ...string) (any, error) {
+	if err := c.send(args...); err != nil {
+		return nil, err
+	}
+	return c.read()
+}
+
+// read reads a reply, an error reply is returned as a respError. The simple
+// strings are returned as string, the integers as int64, the bulk strings as
+// []byte and the arrays as []any, the null ones as nil.
+func (c *respConn) read() (any, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("redisbroker: invalid reply")
+	}
+	kind, line := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return nil, respError(line)
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line)
+		if err != nil || n > maxBulkLen {
+			return nil, errors.New("redisbroker: invalid bulk length")
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, errors.New("redisbroker: invalid array length")
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		arr := make([]any, 0, min(n, 64))
+		for range n {
+			v, err := c.read()
+			var re respError
+			if err != nil && !errors.As(err, &re) {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		return arr, nil
+	}
+	return nil, fmt.Errorf("redisbroker: unknown reply type %q", kind)
+}
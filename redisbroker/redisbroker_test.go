@@ -0,0 +1,214 @@
+package redisbroker
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mconintet/kiwi"
+)
+
+// fakeRedis serves AUTH, PUBLISH, SUBSCRIBE and UNSUBSCRIBE.
+type fakeRedis struct {
+	ln net.Listener
+
+	mu   sync.Mutex
+	subs map[string]map[*respConn]bool
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	fr := &fakeRedis{ln: ln, subs: make(map[string]map[*respConn]bool)}
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go fr.serve(newRespConn(nc))
+		}
+	}()
+	return fr
+}
+
+func (fr *fakeRedis) serve(c *respConn) {
+	defer fr.drop(c)
+
+	for {
+		v, err := c.read()
+		if err != nil {
+			return
+		}
+		var args []string
+		for _, a := range v.([]any) {
+			args = append(args, string(a.([]byte)))
+		}
+
+		fr.mu.Lock()
+		switch args[0] {
+		case "AUTH":
+			if args[len(args)-1] == "secret" {
+				c.w.WriteString("+OK\r\n")
+			} else {
+				c.w.WriteString("-WRONGPASS invalid password\r\n")
+			}
+		case "PUBLISH":
+			for sub := range fr.subs[args[1]] {
+				sub.send("message", args[1], args[2])
+			}
+			c.w.WriteString(":1\r\n")
+		case "SUBSCRIBE":
+			for _, ch := range args[1:] {
+				if fr.subs[ch] == nil {
+					fr.subs[ch] = make(map[*respConn]bool)
+				}
+				fr.subs[ch][c] = true
+				c.send("subscribe", ch, "1")
+			}
+		case "UNSUBSCRIBE":
+			for _, ch := range args[1:] {
+				delete(fr.subs[ch], c)
+				c.send("unsubscribe", ch, "0")
+			}
+		}
+		c.w.Flush()
+		fr.mu.Unlock()
+	}
+}
+
+func (fr *fakeRedis) drop(c *respConn) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+
+	c.Close()
+	for _, subs := range fr.subs {
+		delete(subs, c)
+	}
+}
+
+// kill drops all the subscriber conns.
+func (fr *fakeRedis) kill() {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+
+	for _, subs := range fr.subs {
+		for c := range subs {
+			c.Close()
+			delete(subs, c)
+		}
+	}
+}
+
+func (fr *fakeRedis) subscribers(channel string) int {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	return len(fr.subs[channel])
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestBroker(t *testing.T) {
+	fr := newFakeRedis(t)
+	ctx := context.Background()
+
+	if _, err := Dial(ctx, Config{Addr: fr.ln.Addr().String(), Password: "wrong"}); err == nil {
+		t.Fatal("got no error for the wrong password")
+	}
+
+	errs := make(chan error, 1)
+	b, err := Dial(ctx, Config{
+		Addr:     fr.ln.Addr().String(),
+		Password: "secret",
+		OnError: func(err error) {
+			select {
+			case errs <- err:
+			default:
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	got := make(chan string, 4)
+	if err := b.Subscribe("room", func(data []byte) { got <- string(data) }); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return fr.subscribers("kiwi:room") == 1 })
+
+	if err := b.Publish("room", []byte("hello\r\nworld")); err != nil {
+		t.Fatal(err)
+	}
+	if s := <-got; s != "hello\r\nworld" {
+		t.Fatalf("got %q", s)
+	}
+
+	// the subscriptions survive the loss of the subscriber conn
+	fr.kill()
+	<-errs
+	waitFor(t, func() bool { return fr.subscribers("kiwi:room") == 1 })
+	if err := b.Publish("room", []byte("again")); err != nil {
+		t.Fatal(err)
+	}
+	if s := <-got; s != "again" {
+		t.Fatalf("got %q", s)
+	}
+
+	if err := b.Unsubscribe("room"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return fr.subscribers("kiwi:room") == 0 })
+}
+
+func TestHubs(t *testing.T) {
+	fr := newFakeRedis(t)
+	ctx := context.Background()
+
+	hubs := make([]*kiwi.Hub, 2)
+	for i := range hubs {
+		b, err := Dial(ctx, Config{Addr: fr.ln.Addr().String()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Close()
+
+		hubs[i] = kiwi.NewHub()
+		hubs[i].Broker = b
+		hubs[i].Restore(&kiwi.HubSnapshot{Topics: map[string]*kiwi.TopicSnapshot{"room": {}}})
+	}
+	waitFor(t, func() bool { return fr.subscribers("kiwi:room") == 2 })
+
+	hubs[0].Publish("room", &kiwi.Message{Opcode: kiwi.OpcodeText, Data: []byte("1")})
+	hubs[1].Publish("room", &kiwi.Message{Opcode: kiwi.OpcodeBinary, Data: []byte("2")})
+
+	// each message once in both hubs
+	for _, h := range hubs {
+		waitFor(t, func() bool { return len(h.History("room")) >= 2 })
+		time.Sleep(20 * time.Millisecond)
+
+		got := map[string]uint8{}
+		for _, msg := range h.History("room") {
+			got[string(msg.Data)] = msg.Opcode
+		}
+		if len(h.History("room")) != 2 || got["1"] != kiwi.OpcodeText || got["2"] != kiwi.OpcodeBinary {
+			t.Fatalf("got history %v", got)
+		}
+	}
+}
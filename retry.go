@@ -0,0 +1,80 @@
+package kiwi
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+type RetryPolicy struct {
+	MaxRetries int
+
+	// backoff doubles after each retry and is capped by MaxBackoff if
+	// it's greater than zero
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+func (p *RetryPolicy) backoff(retry int) time.Duration {
+	d := p.Backoff << uint(retry)
+	if p.MaxBackoff > 0 && (d > p.MaxBackoff || d < p.Backoff) {
+		d = p.MaxBackoff
+	}
+	return d
+}
+
+func IsTransientError(err error) bool {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return false
+	}
+
+	if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.ENOBUFS) {
+		return true
+	}
+
+	ne, ok := err.(net.Error)
+	return ok && ne.Temporary()
+}
+
+// connWriter is the underlying writer of conn's bufio.Writer, the bufio.Writer
+// sticks to the first error, so retries must happen below it.
+type connWriter struct {
+	c *Conn
+}
+
+func (w *connWriter) Write(p []byte) (n int, err error) {
+	policy := w.c.Server.WriteRetry
+	if policy == nil {
+		n, err = w.c.rwc.Write(p)
+		w.c.wrote(int64(n), err)
+		return n, err
+	}
+
+	for retry := 0; ; retry++ {
+		i, err := w.c.rwc.Write(p[n:])
+		n += i
+
+		if err == nil {
+			w.c.wrote(int64(i), nil)
+			return n, nil
+		}
+
+		if retry >= policy.MaxRetries || !IsTransientError(err) {
+			// closed once the write lock is released
+			w.c.wrote(int64(i), err)
+			w.c.closeOnUnlock = true
+			return n, err
+		}
+		w.c.wrote(int64(i), nil)
+
+		timer := w.c.Server.clock().NewTimer(policy.backoff(retry))
+		select {
+		case <-timer.C():
+		case <-w.c.ctx.Done():
+			timer.Stop()
+			return n, err
+		}
+	}
+}
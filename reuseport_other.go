@@ -0,0 +1,12 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package kiwi
+
+import (
+	"errors"
+	"syscall"
+)
+
+func reusePortControl(network, address string, rc syscall.RawConn) error {
+	return errors.New("SO_REUSEPORT is not supported on this platform")
+}
@@ -0,0 +1,30 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package kiwi
+
+import (
+	"runtime"
+	"strings"
+	"syscall"
+)
+
+// SO_REUSEPORT is missing from syscall on some linux archs
+func soReusePort() int {
+	if runtime.GOOS == "linux" && !strings.HasPrefix(runtime.GOARCH, "mips") {
+		return 0xf
+	}
+	return 0x200
+}
+
+// reusePortControl sets SO_REUSEPORT on the listening sockets, so several
+// listeners of the same process or of other ones can share a port.
+func reusePortControl(network, address string, rc syscall.RawConn) error {
+	var serr error
+	err := rc.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort(), 1)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,104 @@
+package kiwi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+)
+
+// the pings of Server.PingInterval carry this prefix and the time they're
+// sent in unix nanoseconds of Server.Clock, the pongs echoing them give the
+// RTT
+var rttPingPrefix = []byte("kiwi-rtt")
+
+const rttPingLen = 16
+
+// ConnStats are the stats of a conn, see Conn.Stats.
+type ConnStats struct {
+	Sent SendStats
+	Recv RecvStats
+
+	// the RTT smoothed over the pongs like the SRTT of TCP, and the one of
+	// the last pong, zero before the first pong
+	RTT     time.Duration
+	LastRTT time.Duration
+	// when the last pong was read
+	LastPong time.Time
+}
+
+// Stats returns the bytes sent and read, and the RTT measured by the pings
+// of Server.PingInterval.
+func (c *Conn) Stats() ConnStats {
+	st := ConnStats{
+		Sent:    c.SendStats(),
+		Recv:    c.RecvStats(),
+		RTT:     time.Duration(c.srtt.Load()),
+		LastRTT: time.Duration(c.lastRTT.Load()),
+	}
+	if t := c.lastPong.Load(); t != 0 {
+		st.LastPong = time.Unix(0, t)
+	}
+	return st
+}
+
+// pingEvery pings the peer every interval until the conn is closed.
+func (c *Conn) pingEvery(interval time.Duration) {
+	clock := c.Server.clock()
+	t := clock.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C():
+		case <-c.ctx.Done():
+			return
+		}
+
+		sent := clock.Now().UnixNano()
+		payload := binary.BigEndian.AppendUint64(append([]byte(nil), rttPingPrefix...), uint64(sent))
+		c.lastPing.Store(sent)
+		if err := c.Send(&Message{Opcode: OpcodePing, Data: payload}); err != nil {
+			return
+		}
+	}
+}
+
+// startPings starts the pings of Server.PingInterval for an open conn.
+func (c *Conn) startPings() {
+	if interval := c.Server.PingInterval; interval > 0 {
+		go c.pingEvery(interval)
+	}
+}
+
+// measureRTT takes the RTT from a pong echoing the last ping sent.
+func (c *Conn) measureRTT(f *Frame) {
+	p := f.PayloadData
+	if len(p) != rttPingLen || !bytes.HasPrefix(p, rttPingPrefix) {
+		return
+	}
+	sent := int64(binary.BigEndian.Uint64(p[len(rttPingPrefix):]))
+	if sent == 0 || sent != c.lastPing.Load() {
+		return
+	}
+
+	now := c.Server.clock().Now().UnixNano()
+	rtt := now - sent
+	// the clock has been set back
+	if rtt < 0 {
+		return
+	}
+	c.lastRTT.Store(rtt)
+	c.lastPong.Store(now)
+
+	// srtt += (rtt - srtt) / 8
+	for {
+		old := c.srtt.Load()
+		srtt := rtt
+		if old != 0 {
+			srtt = old + (rtt-old)/8
+		}
+		if c.srtt.CompareAndSwap(old, srtt) {
+			return
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package kiwi
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Sampler decides which of the high-volume events, such as per message logs,
+// are kept. An event is kept if it's the first of every N events and the
+// events kept in the current second are under the rate limit. Both can be
+// changed at run time, and a nil Sampler keeps all the events.
+type Sampler struct {
+	every     atomic.Uint64
+	perSecond atomic.Uint64
+
+	seen    atomic.Uint64
+	dropped atomic.Uint64
+
+	mu    sync.Mutex
+	sec   int64
+	inSec uint64
+}
+
+// NewSampler returns a Sampler keeping 1 in every events and at most
+// perSecond events per second, zero disables either of them.
+func NewSampler(every, perSecond uint64) *Sampler {
+	s := &Sampler{}
+	s.SetEvery(every)
+	s.SetRate(perSecond)
+	return s
+}
+
+func (s *Sampler) SetEvery(n uint64) {
+	s.every.Store(n)
+}
+
+func (s *Sampler) SetRate(perSecond uint64) {
+	s.perSecond.Store(perSecond)
+}
+
+// Sample reports whether the current event should be kept.
+func (s *Sampler) Sample() bool {
+	if s == nil {
+		return true
+	}
+
+	if every := s.every.Load(); every > 1 && (s.seen.Add(1)-1)%every != 0 {
+		s.dropped.Add(1)
+		return false
+	}
+
+	if rate := s.perSecond.Load(); rate > 0 {
+		now := time.Now().Unix()
+
+		s.mu.Lock()
+		if now != s.sec {
+			s.sec, s.inSec = now, 0
+		}
+		ok := s.inSec < rate
+		if ok {
+			s.inSec++
+		}
+		s.mu.Unlock()
+
+		if !ok {
+			s.dropped.Add(1)
+			return false
+		}
+	}
+	return true
+}
+
+// Dropped returns the number of events not kept so far.
+func (s *Sampler) Dropped() uint64 {
+	if s == nil {
+		return 0
+	}
+	return s.dropped.Load()
+}
@@ -0,0 +1,54 @@
+package kiwi
+
+import (
+	"errors"
+)
+
+var ErrPayloadRejected = errors.New("payload rejected by scanner")
+
+// PayloadScanner inspects the payload of binary messages before they are
+// delivered to handlers, e.g. for antivirus or content policies. A rejected
+// message fails the conn with CloseCodePolicyViolation.
+type PayloadScanner interface {
+	NewScan(conn *Conn) PayloadScan
+}
+
+// PayloadScan is the scan of a single message. Chunks are written as the
+// fragments arrive so the scanning may go on asynchronously while the rest
+// of the message is still being read.
+type PayloadScan interface {
+	// a non-nil error rejects the message without reading the rest of it
+	Write(chunk []byte) error
+
+	// waits for the verdict after the last chunk, a non-nil error rejects
+	// the message
+	Finish() error
+
+	// called instead of Finish if the message is given up
+	Abort()
+}
+
+// SetScanner scans binary messages of conns opened on pattern by scanner.
+func (srv *Server) SetScanner(pattern string, scanner PayloadScanner) {
+	if srv.scanners == nil {
+		srv.scanners = make(map[string]PayloadScanner)
+	}
+
+	srv.scanners[pattern] = scanner
+
+	if pattern[len(pattern)-1] != '/' {
+		srv.scanners[pattern+"/"] = scanner
+	}
+}
+
+func (c *Conn) newPayloadScan() PayloadScan {
+	if c.HandshakeRequest == nil {
+		return nil
+	}
+
+	scanner, ok := c.Server.scanners[c.HandshakeRequest.RequestURL.Path]
+	if !ok {
+		return nil
+	}
+	return scanner.NewScan(c)
+}
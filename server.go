@@ -1,12 +1,29 @@
 package kiwi
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"log"
 	"net"
+	"net/http"
+	"sort"
 	"sync"
+	"syscall"
+	"time"
 )
 
 const (
-	defaultMaxHandshakeBytes = 1 << 20
+	defaultMaxHandshakeBytes    = 1 << 20
+	defaultMaxFramePayloadBytes = 1 << 20
+	defaultMaxMessageBytes      = 1 << 20
+	defaultSendQueueSize        = 64
+
+	defaultMaxRequestLineBytes = 8 << 10
+	defaultMaxHeaderLineBytes  = 16 << 10
+	defaultMaxHeaders          = 100
 )
 
 type ConnPool struct {
@@ -14,11 +31,47 @@ type ConnPool struct {
 	idx   uint64
 	mu    sync.Mutex
 	count uint64
+
+	// secondary indexes, see IndexPath, SetKey and Conn.AddTag
+	byPath connIndex
+	byKey  connIndex
+	byTag  connIndex
+}
+
+type connIndex map[string]map[uint64]*Conn
+
+func (ci connIndex) add(k string, c *Conn) {
+	m, ok := ci[k]
+	if !ok {
+		m = make(map[uint64]*Conn)
+		ci[k] = m
+	}
+	m[c.ID] = c
+}
+
+func (ci connIndex) del(k string, c *Conn) {
+	if m, ok := ci[k]; ok {
+		delete(m, c.ID)
+		if len(m) == 0 {
+			delete(ci, k)
+		}
+	}
+}
+
+func (ci connIndex) get(k string) []*Conn {
+	conns := make([]*Conn, 0, len(ci[k]))
+	for _, c := range ci[k] {
+		conns = append(conns, c)
+	}
+	return conns
 }
 
 func NewConnPool() *ConnPool {
 	cp := &ConnPool{}
 	cp.p = make(map[uint64]*Conn)
+	cp.byPath = make(connIndex)
+	cp.byKey = make(connIndex)
+	cp.byTag = make(connIndex)
 	return cp
 }
 
@@ -40,42 +93,505 @@ func (cp *ConnPool) Get(id uint64) (*Conn, bool) {
 
 func (cp *ConnPool) Del(c *Conn) {
 	cp.mu.Lock()
-	delete(cp.p, c.ID)
-	cp.count--
+	if _, ok := cp.p[c.ID]; ok {
+		delete(cp.p, c.ID)
+		cp.count--
+		cp.byPath.del(c.poolPath, c)
+		cp.byKey.del(c.poolKey, c)
+		for tag := range c.tags {
+			cp.byTag.del(tag, c)
+		}
+	}
 	cp.mu.Unlock()
 }
 
+// IndexPath indexes c by its request path for ByPath, it's called by the
+// server once the handshake of c is done.
+func (cp *ConnPool) IndexPath(c *Conn) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	if _, ok := cp.p[c.ID]; !ok || c.HandshakeRequest == nil {
+		return
+	}
+	cp.byPath.del(c.poolPath, c)
+	c.poolPath = c.HandshakeRequest.RequestURL.Path
+	cp.byPath.add(c.poolPath, c)
+}
+
+// SetKey indexes c by an application defined key for ByKey, such as a user
+// or session ID, an empty key removes c from the index.
+func (cp *ConnPool) SetKey(c *Conn, key string) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	if _, ok := cp.p[c.ID]; !ok {
+		return
+	}
+	cp.byKey.del(c.poolKey, c)
+	c.poolKey = key
+	if key != "" {
+		cp.byKey.add(key, c)
+	}
+}
+
+// ByPath returns the conns with their handshake done on path.
+func (cp *ConnPool) ByPath(path string) []*Conn {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	return cp.byPath.get(path)
+}
+
+// ByKey returns the conns set with key by SetKey.
+func (cp *ConnPool) ByKey(key string) []*Conn {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	return cp.byKey.get(key)
+}
+
+// ByTag returns the conns tagged with tag by Conn.AddTag.
+func (cp *ConnPool) ByTag(tag string) []*Conn {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	return cp.byTag.get(tag)
+}
+
+func (cp *ConnPool) tag(c *Conn, tag string, add bool) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	if add {
+		if c.tags == nil {
+			c.tags = make(map[string]bool)
+		}
+		c.tags[tag] = true
+	} else {
+		delete(c.tags, tag)
+	}
+
+	// conns not in the pool or removed from it are not indexed
+	if _, ok := cp.p[c.ID]; !ok {
+		return
+	}
+	if add {
+		cp.byTag.add(tag, c)
+	} else {
+		cp.byTag.del(tag, c)
+	}
+}
+
+func (cp *ConnPool) keyOf(c *Conn) string {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return c.poolKey
+}
+
+func (cp *ConnPool) hasTag(c *Conn, tag string) bool {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return c.tags[tag]
+}
+
+func (cp *ConnPool) tagsOf(c *Conn) []string {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	tags := make([]string, 0, len(c.tags))
+	for tag := range c.tags {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// Range calls fn for each conn in the pool until fn returns false. It works
+// on a snapshot of the pool, so fn can close conns or add new ones.
+func (cp *ConnPool) Range(fn func(c *Conn) bool) {
+	for _, c := range cp.snapshot() {
+		if !fn(c) {
+			return
+		}
+	}
+}
+
+// Filter returns the conns in the pool matching pred.
+func (cp *ConnPool) Filter(pred func(c *Conn) bool) []*Conn {
+	var conns []*Conn
+	for _, c := range cp.snapshot() {
+		if pred(c) {
+			conns = append(conns, c)
+		}
+	}
+	return conns
+}
+
+func (cp *ConnPool) snapshot() []*Conn {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	conns := make([]*Conn, 0, len(cp.p))
+	for _, c := range cp.p {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
 func (cp *ConnPool) Count() uint64 {
 	return cp.count
 }
 
+func (cp *ConnPool) countOpenBy(key func(c *Conn) string) map[string]uint64 {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	counts := make(map[string]uint64)
+	for _, c := range cp.p {
+		if c.GetState() == StateOpen && c.HandshakeRequest != nil {
+			counts[key(c)]++
+		}
+	}
+	return counts
+}
+
 type Server struct {
 	Addr              *net.TCPAddr
 	MaxHandshakeBytes int
 	ConnPool          *ConnPool
 
-	handshakeReqRouter OnHandshakeRequestRouter
-	onConnOpenRouter   OnConnOpenRouter
-	onConnCloseRouter  OnConnCloseRouter
+	// also served by ListenAndServe along with Addr, e.g. "0.0.0.0:80" and
+	// "[::]:80" for the IPv4 and the IPv6 wildcards bound separately
+	ExtraAddrs []*net.TCPAddr
+
+	// makes ListenAndServe bind each address with SO_REUSEPORT by Acceptors
+	// listeners, one if it's zero, each with its own accept loop. The kernel
+	// spreads the conns between them and the listeners of the other
+	// processes bound to the same port
+	ReusePort bool
+	Acceptors int
+
+	// bound the request line, each header line and the number of the header
+	// lines of the handshakes, the ones over them fail with 431. Zero means
+	// no limit, ApplyDefaultCfg sets 8KB, 16KB and 100
+	MaxRequestLineBytes int
+	MaxHeaderLineBytes  int
+	MaxHeaders          int
+
+	// bounds the handshake of each conn, zero means no timeout
+	HandshakeTimeout time.Duration
+
+	// the Server header of the handshake responses, none if it's empty. The
+	// Date header is written unless NoDateHeader is set
+	ServerHeader string
+	NoDateHeader bool
+
+	// parses the handshake requests by http.ReadRequest rather than the
+	// parser of kiwi, see HandshakeRequest.ReadFromStd
+	StdHandshakeParser bool
+
+	// ListenAndServe serves wss if it's not nil
+	TLSConfig *tls.Config
+
+	// makes ListenAndServe require the client certificates verified by
+	// them, for the mTLS. The http.Server of ServeHTTP must be configured
+	// for it by itself
+	ClientCAs *x509.CertPool
+
+	// checks the verified chains of the client certificate before the
+	// handshake func, an error rejects the handshake with 403. The chains
+	// are nil if the conn is not over tls or has no verified certificate
+	VerifyClientCert func(conn *Conn, chains [][]*x509.Certificate) error
+
+	// logs the errors of the conns, the standard logger is used if it's nil
+	ErrorLog *log.Logger
+
+	// the first error of the options, reported by Validate
+	optErr error
+
+	// serves requests not asking for a websocket upgrade, a 426 response
+	// is sent if it's nil. Request bodies are not supported, the handler
+	// always sees http.NoBody and the conn is closed after the response.
+	FallbackHandler http.Handler
+
+	// retries writes failed with transient errors, no retry if it's nil
+	WriteRetry *RetryPolicy
+
+	// messages queued by TrySend for each conn, 64 if it's zero
+	SendQueueSize int
+
+	// limits applied by the receivers, can be overridden per route
+	// by SetLimits
+	MaxFramePayloadBytes uint64
+	MaxMessageBytes      uint64
+
+	// zero means no limit on the fragments of a message
+	MaxMessageFragments int
+	MinAvgFragmentBytes uint64
+
+	// the data of the messages read by ReadSpooled over SpoolThreshold
+	// bytes, 1MB if it's zero, is written to a temp file in SpoolDir,
+	// os.TempDir if it's empty
+	SpoolThreshold int
+	SpoolDir       string
+
+	// shared by all the conns to bound the memory of the messages read by
+	// ReadWhole, nil means no bound
+	Memory *MemoryBudget
+
+	// of ReadMsg and SendMsg, can be overridden per route by SetCodec.
+	// JSONCodec if it's nil
+	Codec Codec
+
+	// enables the ack protocol of SendWithAck and Message.Ack, the peer
+	// must enable it too. The text and binary messages starting by the
+	// bytes 0x05, 0x06 or 0x07 are sent prefixed by 0x07 then, which is
+	// stripped on reading, the other messages read starting by 0x05 or 0x06
+	// are taken as the ones of the protocol
+	Acks bool
+
+	scanners map[string]PayloadScanner
+
+	// open conns are closed with CloseCodeServiceRestart after this age plus
+	// a random jitter in [0, MaxConnectionAgeJitter), zero means no limit.
+	// It spreads the reconnects of the long-lived conns over the instances
+	// after a scale-out, and has their auth checked again
+	MaxConnectionAge       time.Duration
+	MaxConnectionAgeJitter time.Duration
+
+	// the close code of the aged conns instead of CloseCodeServiceRestart,
+	// like CloseCodeGoingAway
+	MaxConnectionAgeCloseCode uint16
+
+	// sets DefaultMessageReceiver.AutoControl for the receivers of the
+	// handlers of OnConnOpenFunc, so they read the data messages only
+	AutoControlFrames bool
+
+	// the close code of the conns sent a message of the type not expected
+	// by ReadText or ReadBinary, CloseCodeUnsupportedData if it's zero
+	UnexpectedTypeCloseCode uint16
+
+	// the open conns, the ones of a Dialer too, ping the peer this often
+	// with the time in the payload, the pongs echoing it give the RTT of
+	// Conn.Stats. Zero means no pings
+	PingInterval time.Duration
+
+	// the entropy of the masking keys, the handshake keys and the jitters,
+	// crypto/rand.Reader if it's nil
+	Rand io.Reader
+
+	// the time of the pings, the connection age, the ack timeouts and the
+	// reconnect backoffs, SystemClock if it's nil. The tests can drive
+	// them by a fake one, see kiwitest.Clock
+	Clock Clock
+
+	// assigns conns to experiment buckets at upgrade time if it's not nil
+	Bucketing *Bucketing
+
+	// sizes of the bufio buffers of each conn, 4KB if they are zero
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// enables the full RFC 6455 checks of the received frames, such as the
+	// reserved bits, masking, control frame and fragmentation rules, valid
+	// close payloads and UTF-8 text. The control frames in the middle of a
+	// fragmented message are also answered by the receiver. It's needed by
+	// the Autobahn test suite, see cmd/autobahn-server. It's the same as
+	// Mode ProtocolStrict
+	Strict bool
+
+	// how closely the handshakes and the frames are checked, of the conns
+	// of a Dialer too
+	Mode ProtocolMode
+
+	// negotiated with the clients offering them by
+	// DefaultServerHandshakeFunc, in preference order
+	Extensions []Extension
+
+	// rejects the accepted conns by their remote addresses, before
+	// OnConnAccept
+	AccessList *AccessList
+
+	// rejects the handshakes by their Origin headers with 403
+	Origins *OriginPolicy
+
+	// rejects the handshakes over its rate with 429
+	HandshakeLimiter *RateLimiter
+
+	// rejects the handshakes of a client over its rate with 429, the
+	// clients are told by Conn.ClientIP
+	ClientHandshakeLimiter *ClientRateLimiter
+
+	// the proxies whose forwarding headers are believed by Conn.ClientIP.
+	// If it's set, the AccessList is checked again with the client address
+	// at the handshake, and it's logged by the AccessLog
+	TrustedProxies *TrustedProxies
+
+	// runs the handlers of OnMessage if it's not nil, see WorkerPool
+	Workers *WorkerPool
+
+	// parks the idle conns of OnMessage in an epoll poller, with no
+	// goroutine and, if PoolConnBuffers is set too, no read buffer, instead
+	// of a read loop on the goroutine of each conn. A goroutine is started
+	// when a conn is readable and ends once its data is handled. It's for
+	// many mostly idle conns on linux, the conns over tls and the other
+	// platforms are served by their goroutines
+	EventLoop  bool
+	poller     *poller
+	pollerOnce sync.Once
+	pollerErr  error
+
+	// tunes the sockets of the accepted conns if it's not nil
+	TCP *TCPOptions
+
+	// called with each accepted net.Conn before anything is read from it, the
+	// conn is closed if it returns false. It runs on the accept loop so it
+	// should return quickly
+	OnConnAccept func(net.Conn) bool
+
+	// called with each error of Accept and the delay before the next one,
+	// the delay is zero if Serve returns the error
+	OnAcceptError func(err error, delay time.Duration)
+
+	// called once the 101 response is sent, before the OnConnOpen handler
+	OnHandshakeComplete func(*Conn)
+
+	// receives the lifecycle events of the conns, no event is emitted if
+	// it's nil
+	Events EventSink
+
+	// samples the per message logs, all of them are logged if it's nil
+	LogSampler *Sampler
+
+	// coalesces the writes of each conn, see Conn.SetWriteCoalescing
+	WriteCoalesceDelay time.Duration
+
+	// called with every frame read from or written to the conns, for the
+	// wire-level debugging, see Conn.TraceFrameIn
+	TraceFrameIn  func(c *Conn, f *Frame)
+	TraceFrameOut func(c *Conn, f *Frame)
+
+	// starts the spans of the handshakes, the conns and the handling of
+	// the messages, nothing is traced if it's nil
+	Tracer Tracer
+
+	// logs each conn once its handshake failed or it's closed
+	AccessLog *AccessLog
+
+	// draws the bufio buffers of conns from pools shared by all the servers
+	// and gives them back once the conn is closed and its handler returned
+	PoolConnBuffers bool
+
+	// tracks handshake and close outcomes reported by the status endpoint,
+	// it's created by ApplyDefaultCfg if SLOWindows is not empty
+	SLOWindows []time.Duration
+	SLO        *SLOTracker
+
+	// the handlers of the handshakes not matching any of hosts, see Host
+	routes
+	hosts map[string]*VirtualHost
+
+	startedAt time.Time
+
+	// for Shutdown
+	mu        sync.Mutex
+	listeners map[net.Listener]bool
+	closed    bool
 }
 
-func NewServer() *Server {
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
+func isTemporaryAcceptError(err error) bool {
+	if isFDExhausted(err) {
+		return true
+	}
+	ne, ok := err.(net.Error)
+	return ok && ne.Temporary()
+}
+
+// isFDExhausted reports the errors of Accept which go away once some conns
+// are closed.
+func isFDExhausted(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) ||
+		errors.Is(err, syscall.ENOBUFS) || errors.Is(err, syscall.ENOMEM)
+}
+
+// ErrServerClosed is returned by Serve and ListenAndServe after Shutdown.
+var ErrServerClosed = errors.New("server closed")
+
+// NewServer creates a server configured by opts, with the defaults of
+// ApplyDefaultCfg for the rest. The invalid options are reported by Serve,
+// see Validate.
+func NewServer(opts ...Option) *Server {
 	srv := &Server{}
 	srv.ConnPool = NewConnPool()
+	for _, opt := range opts {
+		opt(srv)
+	}
+	srv.ApplyDefaultCfg()
 	return srv
 }
 
-func (srv *Server) serve(ln *net.TCPListener) error {
+// Serve accepts conns on ln until it's closed or the server is shut down.
+func (srv *Server) Serve(ln net.Listener) error {
 	defer ln.Close()
 
+	if err := srv.Validate(); err != nil {
+		return err
+	}
+
+	if !srv.trackListener(ln, true) {
+		return ErrServerClosed
+	}
+	defer srv.trackListener(ln, false)
+
+	// backoff of the temporary errors, like running out of fds
+	var delay time.Duration
+
 	for {
 		if cn, err := ln.Accept(); err != nil {
-			if ne, ok := err.(net.Error); ok && ne.Temporary() {
-				continue
-			} else {
+			if srv.isClosed() {
+				return ErrServerClosed
+			}
+			if !isTemporaryAcceptError(err) {
+				if srv.OnAcceptError != nil {
+					srv.OnAcceptError(err, 0)
+				}
 				return err
 			}
+
+			if delay == 0 {
+				delay = minAcceptDelay
+			} else {
+				delay = min(2*delay, maxAcceptDelay)
+			}
+			if srv.OnAcceptError != nil {
+				srv.OnAcceptError(err, delay)
+			}
+			if isFDExhausted(err) {
+				srv.logf("[Accept] out of fds or memory, pausing for %v: %s\n", delay, err.Error())
+			} else {
+				srv.logf("[Accept] %s, retrying in %v\n", err.Error(), delay)
+			}
+			time.Sleep(delay)
 		} else {
+			delay = 0
+
+			if srv.TCP != nil {
+				if err := srv.TCP.apply(cn); err != nil {
+					srv.logf("[Accept] tcp options: %s\n", err.Error())
+				}
+			}
+
+			if !srv.accepts(cn) {
+				cn.Close()
+				continue
+			}
+
 			conn := newConn(srv, cn)
 			srv.ConnPool.Add(conn)
 			go conn.serve()
@@ -83,50 +599,343 @@ func (srv *Server) serve(ln *net.TCPListener) error {
 	}
 }
 
+func (srv *Server) trackListener(ln net.Listener, add bool) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if add {
+		if srv.closed {
+			return false
+		}
+		if srv.listeners == nil {
+			srv.listeners = make(map[net.Listener]bool)
+		}
+		if srv.startedAt.IsZero() {
+			srv.startedAt = time.Now()
+		}
+		srv.listeners[ln] = true
+	} else {
+		delete(srv.listeners, ln)
+	}
+	return true
+}
+
+func (srv *Server) isClosed() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	return srv.closed
+}
+
+// Shutdown stops accepting new conns, closes the open ones with
+// CloseCodeGoingAway and waits for all the conns to be gone from the
+// ConnPool or ctx to be done.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.closeListeners()
+	srv.closeConns(CloseCodeGoingAway)
+	defer srv.closePoller()
+	return srv.waitConns(ctx)
+}
+
+// Drain stops accepting new conns like Shutdown but lets the open ones end
+// by themselves until ctx is done, the remaining ones are closed with
+// CloseCodeGoingAway then and ctx.Err() is returned.
+func (srv *Server) Drain(ctx context.Context) error {
+	srv.closeListeners()
+	defer srv.closePoller()
+	if err := srv.waitConns(ctx); err != nil {
+		srv.closeConns(CloseCodeGoingAway)
+		return err
+	}
+	return nil
+}
+
+func (srv *Server) closeListeners() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	srv.closed = true
+	for ln := range srv.listeners {
+		ln.Close()
+	}
+}
+
+func (srv *Server) closeConns(code uint16) {
+	srv.ConnPool.Range(func(c *Conn) bool {
+		if c.GetState() == StateOpen {
+			c.closeWithCode(code)
+		}
+		return true
+	})
+}
+
+func (srv *Server) waitConns(ctx context.Context) error {
+	t := time.NewTicker(10 * time.Millisecond)
+	defer t.Stop()
+
+	for srv.ConnPool.Count() > 0 {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// ApplyDefaultCfg sets the defaults of the zero fields, it's called by
+// NewServer and may be called again after changing the fields.
 func (srv *Server) ApplyDefaultCfg() {
 	if srv.MaxHandshakeBytes == 0 {
 		srv.MaxHandshakeBytes = defaultMaxHandshakeBytes
 	}
 
-	if srv.onConnOpenRouter == nil {
-		srv.onConnOpenRouter = DefaultOnConnOpenRouter{}
+	if srv.MaxRequestLineBytes == 0 {
+		srv.MaxRequestLineBytes = defaultMaxRequestLineBytes
+	}
+
+	if srv.MaxHeaderLineBytes == 0 {
+		srv.MaxHeaderLineBytes = defaultMaxHeaderLineBytes
+	}
+
+	if srv.MaxHeaders == 0 {
+		srv.MaxHeaders = defaultMaxHeaders
+	}
+
+	if srv.MaxFramePayloadBytes == 0 {
+		srv.MaxFramePayloadBytes = defaultMaxFramePayloadBytes
+	}
+
+	if srv.MaxMessageBytes == 0 {
+		srv.MaxMessageBytes = defaultMaxMessageBytes
+	}
+
+	if srv.SLO == nil && len(srv.SLOWindows) > 0 {
+		srv.SLO = NewSLOTracker(srv.SLOWindows...)
+	}
+
+	srv.routes.init()
+}
+
+// routes holds the handlers and the limits by path of a Server or of a
+// VirtualHost.
+type routes struct {
+	handshakeReqRouter OnHandshakeRequestRouter
+	onConnOpenRouter   OnConnOpenRouter
+	onConnCloseRouter  OnConnCloseRouter
+
+	routeLimits map[string]Limits
+	routeCodecs map[string]Codec
+	validations map[string]*Validation
+	callbacks   map[string]*callbacks
+
+	routeCompression map[string]CompressionPolicy
+}
+
+func (rt *routes) init() {
+	if rt.handshakeReqRouter == nil {
+		rt.handshakeReqRouter = OnHandshakeRequestRouter{}
+	}
+
+	if rt.onConnOpenRouter == nil {
+		rt.onConnOpenRouter = DefaultOnConnOpenRouter{}
+	}
+
+	if rt.onConnCloseRouter == nil {
+		rt.onConnCloseRouter = DefaultOnConnCloseRouter{}
 	}
+}
 
-	if srv.onConnCloseRouter == nil {
-		srv.onConnCloseRouter = DefaultOnConnCloseRouter{}
+// OnHandshakeRequestFunc replaces DefaultServerHandshakeFunc for pattern,
+// fn usually checks the request, e.g. for authentication, and then calls
+// DefaultServerHandshakeFunc.
+func (rt *routes) OnHandshakeRequestFunc(pattern string, fn OnHandshakeRequestFunc) {
+	if _, ok := rt.handshakeReqRouter[pattern]; ok {
+		panic("OnHandshakeRequestFunc already exist with pattern: " + pattern)
+	}
+
+	rt.handshakeReqRouter[pattern] = fn
+
+	if pattern[len(pattern)-1] != '/' {
+		rt.handshakeReqRouter[pattern+"/"] = fn
 	}
 }
 
-func (srv *Server) OnConnOpenFunc(pattern string, fn OnConnOpenFunc) {
-	if srv.onConnOpenRouter.HasHandler(pattern) {
+func (rt *routes) OnConnOpenFunc(pattern string, fn OnConnOpenFunc) {
+	if rt.onConnOpenRouter.HasHandler(pattern) {
 		panic("OnConnOpenFunc already exist with pattern: " + pattern)
 	}
 
-	srv.onConnOpenRouter.HandleFunc(pattern, fn)
+	rt.onConnOpenRouter.HandleFunc(pattern, fn)
 
 	if pattern[len(pattern)-1] != '/' {
 		pattern += "/"
-		srv.onConnOpenRouter.HandleFunc(pattern, fn)
+		rt.onConnOpenRouter.HandleFunc(pattern, fn)
 	}
 }
 
-func (srv *Server) OnConnCloseFunc(pattern string, fn OnConnCloseFunc) {
-	if srv.onConnCloseRouter.HasHandler(pattern) {
+func (rt *routes) OnConnCloseFunc(pattern string, fn OnConnCloseFunc) {
+	if rt.onConnCloseRouter.HasHandler(pattern) {
 		panic("OnConnCloseFunc already exist with pattern: " + pattern)
 	}
 
-	srv.onConnCloseRouter.HandleFunc(pattern, fn)
+	rt.onConnCloseRouter.HandleFunc(pattern, fn)
 
 	if pattern[len(pattern)-1] != '/' {
 		pattern += "/"
-		srv.onConnCloseRouter.HandleFunc(pattern, fn)
+		rt.onConnCloseRouter.HandleFunc(pattern, fn)
+	}
+}
+
+func (srv *Server) connBufferSizes() (readSize, writeSize int) {
+	readSize, writeSize = srv.ReadBufferSize, srv.WriteBufferSize
+	if readSize <= 0 {
+		readSize = defaultConnBufferSize
+	}
+	if writeSize <= 0 {
+		writeSize = defaultConnBufferSize
+	}
+	return
+}
+
+func (srv *Server) connectionAge() time.Duration {
+	if srv.MaxConnectionAge <= 0 {
+		return 0
+	}
+
+	age := srv.MaxConnectionAge
+	if srv.MaxConnectionAgeJitter > 0 {
+		// the jitter is left out if srv.Rand fails
+		j, _ := srv.randN(srv.MaxConnectionAgeJitter)
+		age += j
+	}
+	return age
+}
+
+type Limits struct {
+	MaxFramePayloadBytes uint64
+	MaxMessageBytes      uint64
+	MaxMessageFragments  int
+	MinAvgFragmentBytes  uint64
+}
+
+// SetLimits overrides the server limits for conns opened on pattern, zero
+// fields fall back to the server ones.
+func (rt *routes) SetLimits(pattern string, limits Limits) {
+	if rt.routeLimits == nil {
+		rt.routeLimits = make(map[string]Limits)
+	}
+
+	rt.routeLimits[pattern] = limits
+
+	if pattern[len(pattern)-1] != '/' {
+		rt.routeLimits[pattern+"/"] = limits
+	}
+}
+
+func (srv *Server) limitsFor(vh *VirtualHost, reqPath string) Limits {
+	limits := srv.routeLimits[reqPath]
+	if vh != nil {
+		limits = vh.limitsFor(reqPath)
+	}
+
+	if limits.MaxFramePayloadBytes == 0 {
+		limits.MaxFramePayloadBytes = srv.MaxFramePayloadBytes
+	}
+
+	if limits.MaxMessageBytes == 0 {
+		limits.MaxMessageBytes = srv.MaxMessageBytes
+	}
+
+	if limits.MaxMessageFragments == 0 {
+		limits.MaxMessageFragments = srv.MaxMessageFragments
+	}
+
+	if limits.MinAvgFragmentBytes == 0 {
+		limits.MinAvgFragmentBytes = srv.MinAvgFragmentBytes
 	}
+	return limits
 }
 
+// ListenAndServe serves on Addr and ExtraAddrs, over tls if TLSConfig is
+// set, see ServeListeners. The listeners inherited from systemd or from
+// Restart are served instead if there are any, see InheritedListeners.
 func (srv *Server) ListenAndServe() error {
-	if ln, err := net.ListenTCP("tcp", srv.Addr); err != nil {
+	lns, err := srv.listen()
+	if err != nil {
 		return err
-	} else {
-		return srv.serve(ln)
 	}
+	return srv.ServeListeners(lns...)
+}
+
+// ServeListeners serves on all of lns until one of them fails or the server
+// is shut down, the others are closed then. It returns the first error.
+func (srv *Server) ServeListeners(lns ...net.Listener) error {
+	if len(lns) == 1 {
+		return srv.Serve(lns[0])
+	}
+
+	errc := make(chan error, len(lns))
+	for _, ln := range lns {
+		go func() {
+			errc <- srv.Serve(ln)
+		}()
+	}
+
+	err := <-errc
+	for _, ln := range lns {
+		ln.Close()
+	}
+	for range len(lns) - 1 {
+		<-errc
+	}
+	return err
+}
+
+func (srv *Server) listen() ([]net.Listener, error) {
+	if lns, err := InheritedListeners(); err != nil || len(lns) > 0 {
+		for i, ln := range lns {
+			lns[i] = srv.wrapTLS(ln)
+		}
+		return lns, err
+	}
+
+	lc := net.ListenConfig{}
+	acceptors := 1
+	if srv.ReusePort {
+		lc.Control = reusePortControl
+		acceptors = max(1, srv.Acceptors)
+	}
+
+	var lns []net.Listener
+	closeAll := func() {
+		for _, ln := range lns {
+			ln.Close()
+		}
+	}
+
+	for _, a := range append([]*net.TCPAddr{srv.Addr}, srv.ExtraAddrs...) {
+		network, addr := "tcp", ""
+		if a != nil {
+			addr = a.String()
+			if a.IP.To4() != nil {
+				network = "tcp4"
+			} else if a.IP != nil {
+				network = "tcp6"
+			}
+		}
+
+		for i := 0; i < acceptors; i++ {
+			ln, err := lc.Listen(context.Background(), network, addr)
+			if err != nil {
+				closeAll()
+				return nil, err
+			}
+			// the other acceptors share the port picked for port 0
+			addr = ln.Addr().String()
+
+			lns = append(lns, srv.wrapTLS(ln))
+		}
+	}
+	return lns, nil
 }
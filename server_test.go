@@ -1,11 +1,43 @@
 package kiwi
 
 import (
+	"bufio"
 	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"math"
+	"math/big"
 	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestEcho(t *testing.T) {
@@ -180,3 +212,5396 @@ func TestMakeAcceptKey(t *testing.T) {
 		}
 	}
 }
+
+func newTestConn() (*Conn, net.Conn) {
+	srv := NewServer()
+	srv.ApplyDefaultCfg()
+
+	sc, cc := net.Pipe()
+	conn := newConn(srv, sc)
+	conn.SetState(StateOpen)
+	return conn, cc
+}
+
+func writeTestFrames(w io.Writer, frames ...*Frame) {
+	for _, f := range frames {
+		f.WriteTo(w, false)
+	}
+}
+
+func TestMessages(t *testing.T) {
+	conn, peer := newTestConn()
+	defer peer.Close()
+
+	go writeTestFrames(peer,
+		&Frame{FIN: 1, Opcode: OpcodeText, PayloadData: []byte("hello")},
+		&Frame{FIN: 0, Opcode: OpcodeBinary, PayloadData: []byte{1, 2}},
+		&Frame{FIN: 1, Opcode: OpcodeContinue, PayloadData: []byte{3}},
+		MakeCloseFrame(CloseCodeNormalClosure, "", false),
+		&Frame{FIN: 1, Opcode: OpcodeText, PayloadData: []byte("unread")},
+	)
+
+	r := (&DefaultMessageReceiver{}).SetConn(conn)
+
+	var got []*Message
+	for msg, err := range r.Messages(1 << 10) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, msg)
+	}
+
+	if len(got) != 3 {
+		t.Fatalf("got %d messages; want 3", len(got))
+	}
+	if string(got[0].Data) != "hello" || !reflect.DeepEqual(got[1].Data, []byte{1, 2, 3}) || !got[2].IsClose() {
+		t.Fatalf("unexpected messages: %v %v %v", got[0], got[1], got[2])
+	}
+}
+
+func serveTestRequest(srv *Server, req string) (*http.Response, error) {
+	sc, cc := net.Pipe()
+	defer cc.Close()
+
+	conn := newConn(srv, sc)
+	srv.ConnPool.Add(conn)
+	go conn.serve()
+
+	go io.WriteString(cc, req)
+	return http.ReadResponse(bufio.NewReader(cc), nil)
+}
+
+func TestNonUpgradeRequest(t *testing.T) {
+	srv := NewServer()
+	srv.ApplyDefaultCfg()
+
+	req := "GET /healthz HTTP/1.1\r\nHost: localhost\r\n\r\n"
+	resp, err := serveTestRequest(srv, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusUpgradeRequired || resp.Header.Get("Upgrade") != "websocket" {
+		t.Fatalf("unexpected response: %d %v", resp.StatusCode, resp.Header)
+	}
+
+	srv.FallbackHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok "+r.URL.Path)
+	})
+
+	resp, err = serveTestRequest(srv, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "ok /healthz" {
+		t.Fatalf("unexpected response: %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestIncoming(t *testing.T) {
+	conn, peer := newTestConn()
+	defer peer.Close()
+
+	go writeTestFrames(peer,
+		&Frame{FIN: 1, Opcode: OpcodeText, PayloadData: []byte(`{"n":1}`)},
+		&Frame{FIN: 1, Opcode: OpcodeText, PayloadData: []byte(`deformed`)},
+		&Frame{FIN: 1, Opcode: OpcodeText, PayloadData: []byte(`{"n":2}`)},
+		MakeCloseFrame(CloseCodeNormalClosure, "", false),
+	)
+
+	// consume the close reply
+	go io.Copy(io.Discard, peer)
+
+	type item struct{ N int }
+
+	r := (&DefaultMessageReceiver{}).SetConn(conn)
+
+	var got []int
+	for v := range Incoming[item](r, JSONCodec{}, 1<<10) {
+		got = append(got, v.N)
+	}
+
+	if !reflect.DeepEqual(got, []int{1, 2}) {
+		t.Fatalf("got %v; want [1 2]", got)
+	}
+
+	// the close has been replied and the conn closed
+	select {
+	case <-conn.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatal("conn is not closed after the peer's close")
+	}
+}
+
+func TestOutgoing(t *testing.T) {
+	conn, peer := newTestConn()
+	defer peer.Close()
+
+	type item struct{ N int }
+
+	s := (&DefaultMessageSender{}).SetConn(conn)
+	out := Outgoing[item](s, JSONCodec{})
+
+	go func() {
+		out <- item{1}
+		out <- item{2}
+	}()
+
+	br := bufio.NewReader(peer)
+	for _, want := range []string{`{"N":1}`, `{"N":2}`} {
+		f := &Frame{}
+		if err := f.FromBufReader(br, 1<<10); err != nil {
+			t.Fatal(err)
+		}
+		if f.Opcode != OpcodeText || string(f.PayloadData) != want {
+			t.Fatalf("got frame %d %q; want %q", f.Opcode, f.PayloadData, want)
+		}
+	}
+}
+
+type codecItem struct {
+	Name   string            `json:"name" msgpack:"n" cbor:"n"`
+	Count  int               `json:"count"`
+	Neg    int64             `json:"neg"`
+	Ratio  float64           `json:"ratio"`
+	Small  float32           `json:"small"`
+	Raw    []byte            `json:"raw"`
+	Tags   []string          `json:"tags,omitempty"`
+	Attrs  map[string]uint16 `json:"attrs"`
+	Next   *codecItem        `json:"next,omitempty"`
+	At     time.Time         `json:"at"`
+	Hidden string            `json:"-"`
+}
+
+func TestBinaryCodecs(t *testing.T) {
+	in := &codecItem{
+		Name: "kiwi", Count: 300, Neg: -70000, Ratio: 0.25, Small: 1.5,
+		Raw: []byte{0, 1, 2}, Attrs: map[string]uint16{"b": 2, "a": 65535},
+		Next: &codecItem{Name: "next", Count: -1}, At: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		Hidden: "x",
+	}
+
+	for _, codec := range []Codec{MsgpackCodec{}, CBORCodec{}} {
+		data, err := codec.Marshal(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		out := &codecItem{}
+		if err := codec.Unmarshal(data, out); err != nil {
+			t.Fatalf("%T: %v", codec, err)
+		}
+		want := *in
+		want.Hidden = ""
+		if !reflect.DeepEqual(out, &want) {
+			t.Fatalf("%T: got %+v; want %+v", codec, out, &want)
+		}
+
+		var generic map[string]any
+		if err := codec.Unmarshal(data, &generic); err != nil {
+			t.Fatal(err)
+		}
+		if generic["n"] != "kiwi" || generic["count"] != int64(300) || generic["neg"] != int64(-70000) {
+			t.Fatalf("%T: got %v", codec, generic)
+		}
+
+		// truncated, trailing and mismatched data fail
+		if err := codec.Unmarshal(data[:len(data)-1], out); err == nil {
+			t.Fatalf("%T: got no error for truncated data", codec)
+		}
+		if err := codec.Unmarshal(append(data, 0), out); !errors.Is(err, errCodecTrailingData) {
+			t.Fatalf("%T: got %v; want trailing data", codec, err)
+		}
+		var n int
+		if err := codec.Unmarshal(data, &n); err == nil {
+			t.Fatalf("%T: got no error decoding a map into an int", codec)
+		}
+	}
+
+	// the examples of the specs
+	vectors := []struct {
+		codec Codec
+		v     any
+		hex   string
+	}{
+		{MsgpackCodec{}, map[string]any{"compact": true, "schema": 0}, "82a7636f6d70616374c3a6736368656d6100"},
+		{MsgpackCodec{}, []int{-1, -33, 128}, "93ffd0dfcc80"},
+		{CBORCodec{}, []any{1, []int{2, 3}, []int{4, 5}}, "8301820203820405"},
+		{CBORCodec{}, map[string]string{"a": "A", "b": "B"}, "a26161614161626142"},
+		{CBORCodec{}, int64(-1000), "3903e7"},
+	}
+	for _, vec := range vectors {
+		data, err := vec.codec.Marshal(vec.v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hex.EncodeToString(data); got != vec.hex {
+			t.Fatalf("%T: got %s; want %s", vec.codec, got, vec.hex)
+		}
+	}
+
+	// a half float, a tag and undefined of CBOR
+	var f float64
+	if err := (CBORCodec{}).Unmarshal([]byte{0xf9, 0x3e, 0x00}, &f); err != nil || f != 1.5 {
+		t.Fatalf("got %v, %v; want 1.5", f, err)
+	}
+	var tagged any
+	if err := (CBORCodec{}).Unmarshal([]byte{0xc1, 0x1a, 0x51, 0x4b, 0x67, 0xb0}, &tagged); err != nil || tagged != int64(1363896240) {
+		t.Fatalf("got %v, %v", tagged, err)
+	}
+
+	// a deep nesting fails without exhausting the stack
+	deep := bytes.Repeat([]byte{0x91}, 100000)
+	var x any
+	if err := (MsgpackCodec{}).Unmarshal(deep, &x); err == nil {
+		t.Fatal("got no error for a deep nesting")
+	}
+}
+
+type protoItem struct{ data []byte }
+
+func (p *protoItem) Marshal() ([]byte, error) { return p.data, nil }
+func (p *protoItem) Unmarshal(b []byte) error { p.data = append(p.data[:0], b...); return nil }
+
+func TestRouteCodec(t *testing.T) {
+	srv := NewServer()
+	srv.ApplyDefaultCfg()
+	srv.SetCodec("/mp", MsgpackCodec{})
+	srv.SetCodec("/pb", ProtobufCodec{})
+
+	echo := func(v func() any) OnConnOpenFunc {
+		return func(r MessageReceiver, s MessageSender) {
+			for {
+				x := v()
+				if err := r.ReadMsg(x); err != nil {
+					return
+				}
+				s.SendMsg(x)
+			}
+		}
+	}
+	srv.OnConnOpenFunc("/json", echo(func() any { return &codecItem{} }))
+	srv.OnConnOpenFunc("/mp", echo(func() any { return &codecItem{} }))
+	srv.OnConnOpenFunc("/pb", echo(func() any { return &protoItem{} }))
+	url := listenTestServer(t, srv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, path := range []string{"/json", "/mp"} {
+		c, err := Dial(ctx, url+path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		// the client has no route, the codec is set on its server
+		if path == "/mp" {
+			c.Server.Codec = MsgpackCodec{}
+		}
+
+		r := (&DefaultMessageReceiver{}).SetConn(c)
+		s := (&DefaultMessageSender{}).SetConn(c)
+		if err := s.SendMsg(&codecItem{Name: "a", Count: 2}); err != nil {
+			t.Fatal(err)
+		}
+		got := &codecItem{}
+		if err := r.ReadMsg(got); err != nil || got.Name != "a" || got.Count != 2 {
+			t.Fatalf("%s: got %+v, %v", path, got, err)
+		}
+	}
+
+	c, err := Dial(ctx, url+"/pb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Server.Codec = ProtobufCodec{}
+
+	s := (&DefaultMessageSender{}).SetConn(c)
+	if err := s.SendMsg(&protoItem{[]byte{8, 150, 1}}); err != nil {
+		t.Fatal(err)
+	}
+	got := &protoItem{}
+	if err := (&DefaultMessageReceiver{}).SetConn(c).ReadMsg(got); err != nil || !bytes.Equal(got.data, []byte{8, 150, 1}) {
+		t.Fatalf("got %v, %v", got.data, err)
+	}
+	if err := s.SendMsg(42); !errors.Is(err, errNotProtobuf) {
+		t.Fatalf("got %v; want errNotProtobuf", err)
+	}
+}
+
+func TestValidation(t *testing.T) {
+	isJSON := func(msg *Message) error {
+		if !json.Valid(msg.Data) {
+			return errors.New("not json")
+		}
+		return nil
+	}
+
+	srv := NewServer()
+	srv.ApplyDefaultCfg()
+	echo := func(r MessageReceiver, s MessageSender) {
+		defer r.GetConn().Close()
+		for msg, err := range r.Messages(0) {
+			if err != nil || msg.IsClose() {
+				return
+			}
+			s.SendWhole(msg, false)
+		}
+	}
+	actions := map[string]Validation{
+		"/drop":   {Validators: []func(*Message) error{isJSON}, Action: ValidationDrop},
+		"/reply":  {Validators: []func(*Message) error{isJSON}, Action: ValidationReply},
+		"/policy": {Validators: []func(*Message) error{isJSON}},
+		"/data":   {Validators: []func(*Message) error{isJSON}, Action: ValidationCloseInvalidData},
+	}
+	for path, v := range actions {
+		srv.SetValidation(path, v)
+		srv.OnConnOpenFunc(path, echo)
+	}
+	url := listenTestServer(t, srv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cases := []struct {
+		path string
+		want []string
+		code uint16
+	}{
+		{"/drop", []string{`{"a":1}`}, 0},
+		{"/reply", []string{"not json", `{"a":1}`}, 0},
+		{"/policy", nil, CloseCodePolicyViolation},
+		{"/data", nil, CloseCodeInvalidFramePayloadData},
+	}
+	for _, tc := range cases {
+		c, err := Dial(ctx, url+tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		s := (&DefaultMessageSender{}).SetConn(c)
+		s.SendWholeBytes([]byte("{"), false)
+		s.SendWholeBytes([]byte(`{"a":1}`), false)
+
+		r := (&DefaultMessageReceiver{}).SetConn(c)
+		for _, want := range tc.want {
+			msg, err := r.ReadWhole(0)
+			if err != nil || string(msg.Data) != want {
+				t.Fatalf("%s: got %v, %v; want %s", tc.path, msg, err, want)
+			}
+		}
+		if tc.code != 0 {
+			msg, err := r.ReadWhole(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if code, _ := ParseCloseCode(msg.Data); !msg.IsClose() || code != tc.code {
+				t.Fatalf("%s: got %v; want close %d", tc.path, msg, tc.code)
+			}
+		}
+	}
+}
+
+func TestProxyConn(t *testing.T) {
+	forwardedFor := make(chan string, 1)
+	closed := make(chan *CloseError, 1)
+	upstream := NewServer()
+	upstream.ApplyDefaultCfg()
+	upstream.OnConnOpenFunc("/echo", func(r MessageReceiver, s MessageSender) {
+		c := r.GetConn()
+		forwardedFor <- strings.Join(c.HandshakeRequest.Header.Get("X-Forwarded-For"), ",")
+		for msg, err := range r.Messages(0) {
+			if err != nil {
+				return
+			}
+			if msg.IsClose() {
+				ce := msg.CloseError()
+				closed <- ce
+				c.CloseWithCode(ce.Code, ce.Reason)
+				return
+			}
+			s.SendWhole(msg, false)
+		}
+	})
+	upstream.OnConnOpenFunc("/drop", func(r MessageReceiver, s MessageSender) {
+		r.ReadWhole(0)
+		r.GetConn().Close()
+	})
+	upstreamURL := listenTestServer(t, upstream)
+
+	srv := NewServer()
+	srv.ApplyDefaultCfg()
+	srv.OnConnOpenFunc("/echo", ProxyTo(&Dialer{}, upstreamURL+"/echo"))
+	srv.OnConnOpenFunc("/drop", ProxyTo(&Dialer{}, upstreamURL+"/drop"))
+	srv.OnConnOpenFunc("/none", ProxyTo(&Dialer{}, "ws://127.0.0.1:1/"))
+	url := listenTestServer(t, srv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c, err := Dial(ctx, url+"/echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	if got := <-forwardedFor; got != "127.0.0.1" {
+		t.Fatalf("got X-Forwarded-For %q; want 127.0.0.1", got)
+	}
+
+	// the fragments are passed on as they are
+	s := (&DefaultMessageSender{}).SetConn(c)
+	s.SendFrame([]byte("hel"), OpcodeText, true, false, false)
+	s.SendFrame([]byte("lo"), OpcodeText, false, true, false)
+	r := (&DefaultMessageReceiver{}).SetConn(c)
+	if msg, err := r.ReadWhole(0); err != nil || string(msg.Data) != "hello" {
+		t.Fatalf("got %v, %v; want hello", msg, err)
+	}
+
+	s.SendClose(4000, "bye", false, false)
+	if ce := <-closed; ce.Code != 4000 || ce.Reason != "bye" {
+		t.Fatalf("got %v; want close 4000 bye", ce)
+	}
+
+	c2, err := Dial(ctx, url+"/drop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	c2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	(&DefaultMessageSender{}).SetConn(c2).SendWholeBytes([]byte("x"), false)
+	if code := readTestCloseCode(t, c2.Buf); code != CloseCodeBadGateway {
+		t.Fatalf("got close %d; want %d", code, CloseCodeBadGateway)
+	}
+
+	c3, err := Dial(ctx, url+"/none")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c3.Close()
+	c3.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if code := readTestCloseCode(t, c3.Buf); code != CloseCodeBadGateway {
+		t.Fatalf("got close %d; want %d", code, CloseCodeBadGateway)
+	}
+}
+
+// h2TestTransport serves the extended CONNECT requests by ServeHTTP of srv
+// in process, like an HTTP/2 transport and server would.
+type h2TestTransport struct {
+	srv *Server
+}
+
+func (tt h2TestTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	sreq := req.Clone(context.Background())
+	sreq.Proto, sreq.ProtoMajor, sreq.ProtoMinor = "HTTP/2.0", 2, 0
+	sreq.Host = req.URL.Host
+	sreq.RequestURI = req.URL.RequestURI()
+	sreq.RemoteAddr = "127.0.0.1:4321"
+	sreq.Header = make(http.Header)
+	for k, vs := range req.Header {
+		if !strings.HasPrefix(k, ":") {
+			k = http.CanonicalHeaderKey(k)
+		}
+		sreq.Header[k] = vs
+	}
+
+	pr, pw := io.Pipe()
+	w := &h2TestWriter{header: make(http.Header), body: pw, resp: make(chan *http.Response, 1)}
+	go func() {
+		tt.srv.ServeHTTP(w, sreq)
+		w.WriteHeader(http.StatusOK)
+		pw.Close()
+	}()
+
+	resp := <-w.resp
+	resp.Body = pr
+	return resp, nil
+}
+
+type h2TestWriter struct {
+	header http.Header
+	body   *io.PipeWriter
+	resp   chan *http.Response
+	once   sync.Once
+}
+
+func (w *h2TestWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *h2TestWriter) WriteHeader(code int) {
+	w.once.Do(func() {
+		w.resp <- &http.Response{StatusCode: code, Header: w.header.Clone()}
+	})
+}
+
+func (w *h2TestWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(p)
+}
+
+func (w *h2TestWriter) Flush() {}
+
+func TestServeHTTP(t *testing.T) {
+	srv := NewServer()
+	srv.ApplyDefaultCfg()
+	srv.OnHandshakeRequestFunc("/echo", func(hsReq *HandshakeRequest, conn *Conn) (int, error) {
+		if !hsReq.Header.HasKeyAndValEqual("Authorization", "Bearer x") {
+			return http.StatusUnauthorized, errors.New("unauthorized")
+		}
+		return DefaultServerHandshakeFunc(hsReq, conn)
+	})
+	srv.OnConnOpenFunc("/echo", func(r MessageReceiver, s MessageSender) {
+		defer r.GetConn().Close()
+		for msg, err := range r.Messages(0) {
+			if err != nil || msg.IsClose() {
+				return
+			}
+			s.SendWhole(msg, false)
+		}
+	})
+
+	hs := httptest.NewServer(srv)
+	defer hs.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	header := http.Header{"Authorization": {"Bearer x"}}
+	dialers := map[string]*Dialer{
+		"http/1.1": {Header: header},
+		"http/2":   {Header: header, HTTP2: h2TestTransport{srv}},
+	}
+	for name, d := range dialers {
+		c, err := d.Dial(ctx, "ws"+strings.TrimPrefix(hs.URL, "http")+"/echo")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		defer c.Close()
+
+		s := (&DefaultMessageSender{}).SetConn(c)
+		if _, err := s.SendWholeBytes([]byte("hello"), false); err != nil {
+			t.Fatal(err)
+		}
+		msg, err := (&DefaultMessageReceiver{}).SetConn(c).ReadWhole(0)
+		if err != nil || string(msg.Data) != "hello" {
+			t.Fatalf("%s: got %v, %v; want hello", name, msg, err)
+		}
+
+		// the handshake funcs fail the requests as they do the upgrades
+		d.Header = nil
+		var he *HandshakeError
+		if _, err := d.Dial(ctx, "ws"+strings.TrimPrefix(hs.URL, "http")+"/echo"); !errors.As(err, &he) || he.Status != http.StatusUnauthorized {
+			t.Fatalf("%s: got %v; want status 401", name, err)
+		}
+	}
+}
+
+func TestStatusHandler(t *testing.T) {
+	srv := NewServer()
+	srv.ApplyDefaultCfg()
+	srv.FallbackHandler = srv.StatusHandler(nil)
+
+	opened := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+
+	srv.OnConnOpenFunc("/echo", func(r MessageReceiver, s MessageSender) {
+		close(opened)
+		<-done
+	})
+
+	resp, err := serveTestRequest(srv, "GET /echo HTTP/1.1\r\nHost: localhost\r\n"+
+		"Connection: Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: M/A=\r\n\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got status %d; want 101", resp.StatusCode)
+	}
+	<-opened
+
+	resp, err = serveTestRequest(srv, "GET /statusz HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st := &ServerStatus{}
+	if err := json.NewDecoder(resp.Body).Decode(st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Status != "ok" || st.Connections != 1 || st.Paths["/echo"] != 1 {
+		t.Fatalf("unexpected status: %+v", st)
+	}
+}
+
+func TestNonUpgradeRequestEdgeCases(t *testing.T) {
+	srv := NewServer()
+	srv.ApplyDefaultCfg()
+	srv.FallbackHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/panic" {
+			panic("boom")
+		}
+		io.WriteString(w, "fallback")
+	})
+
+	// upgrading to other protocols is not a websocket handshake
+	resp, err := serveTestRequest(srv, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := io.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || string(body) != "fallback" {
+		t.Fatalf("unexpected response: %d %q", resp.StatusCode, body)
+	}
+
+	resp, err = serveTestRequest(srv, "GET /panic HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("got status %d; want 500", resp.StatusCode)
+	}
+}
+
+type tempError struct{}
+
+func (tempError) Error() string   { return "temporary" }
+func (tempError) Timeout() bool   { return false }
+func (tempError) Temporary() bool { return true }
+
+type flakyConn struct {
+	net.Conn
+	fails int
+}
+
+func (c *flakyConn) Write(p []byte) (int, error) {
+	if c.fails > 0 {
+		c.fails--
+		return 0, tempError{}
+	}
+	return c.Conn.Write(p)
+}
+
+func newFlakyTestConn(fails int) (*Conn, net.Conn) {
+	srv := NewServer()
+	srv.ApplyDefaultCfg()
+	srv.WriteRetry = &RetryPolicy{MaxRetries: 2, Backoff: time.Millisecond}
+
+	sc, cc := net.Pipe()
+	conn := newConn(srv, &flakyConn{Conn: sc, fails: fails})
+	srv.ConnPool.Add(conn)
+	conn.SetState(StateOpen)
+	return conn, cc
+}
+
+func TestWriteRetry(t *testing.T) {
+	conn, peer := newFlakyTestConn(2)
+	defer peer.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := conn.Write([]byte("hello"))
+		errc <- err
+	}()
+
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(peer, buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" || conn.GetState() != StateOpen {
+		t.Fatalf("got %q with state %d", buf, conn.GetState())
+	}
+}
+
+func TestWriteRetryExhausted(t *testing.T) {
+	conn, peer := newFlakyTestConn(3)
+	defer peer.Close()
+
+	if _, err := conn.Write([]byte("hello")); err == nil {
+		t.Fatal("expected an error after running out of retries")
+	}
+
+	select {
+	case <-conn.Context().Done():
+	default:
+		t.Fatal("conn is not closed after running out of retries")
+	}
+	if conn.Server.ConnPool.Count() != 0 {
+		t.Fatal("conn is still in the pool")
+	}
+}
+
+func TestReadWholeLimits(t *testing.T) {
+	conn, peer := newTestConn()
+	defer peer.Close()
+
+	conn.HandshakeRequest = &HandshakeRequest{RequestURL: &url.URL{Path: "/small"}}
+	conn.Server.SetLimits("/small", Limits{MaxMessageBytes: 4})
+
+	go writeTestFrames(peer,
+		&Frame{FIN: 1, Opcode: OpcodeText, PayloadData: []byte("1234")},
+		&Frame{FIN: 0, Opcode: OpcodeText, PayloadData: []byte("123")},
+		&Frame{FIN: 1, Opcode: OpcodeContinue, PayloadData: []byte("45")},
+	)
+
+	r := (&DefaultMessageReceiver{}).SetConn(conn)
+	if msg, err := r.ReadWhole(0); err != nil || string(msg.Data) != "1234" {
+		t.Fatalf("got %v, %v", msg, err)
+	}
+
+	closed := make(chan *Frame, 1)
+	go func() {
+		f := &Frame{}
+		f.FromBufReader(peer, 1<<10)
+		closed <- f
+	}()
+
+	var se *SizeError
+	if _, err := r.ReadWhole(0); !errors.Is(err, ErrMessageTooLarge) || !errors.As(err, &se) || se.Size <= se.Limit {
+		t.Fatalf("got %v; want ErrMessageTooLarge", err)
+	}
+
+	f := <-closed
+	if f.Opcode != OpcodeClose || closeCodeOf(f.PayloadData) != CloseCodeMessageTooBig {
+		t.Fatalf("got frame %d %v; want close 1009", f.Opcode, f.PayloadData)
+	}
+}
+
+func TestReadWholeFragmentLimits(t *testing.T) {
+	conn, peer := newTestConn()
+	defer peer.Close()
+
+	conn.Server.MaxMessageFragments = 3
+
+	frames := []*Frame{{FIN: 0, Opcode: OpcodeText, PayloadData: []byte("a")}}
+	for i := 0; i < 3; i++ {
+		frames = append(frames, &Frame{FIN: 0, Opcode: OpcodeContinue, PayloadData: []byte("a")})
+	}
+	go writeTestFrames(peer, frames...)
+
+	closed := make(chan *Frame, 1)
+	go func() {
+		f := &Frame{}
+		f.FromBufReader(peer, 1<<10)
+		closed <- f
+	}()
+
+	r := (&DefaultMessageReceiver{}).SetConn(conn)
+	if _, err := r.ReadWhole(0); !errors.Is(err, ErrTooManyFragments) {
+		t.Fatalf("got %v; want ErrTooManyFragments", err)
+	}
+
+	f := <-closed
+	if f.Opcode != OpcodeClose || closeCodeOf(f.PayloadData) != CloseCodePolicyViolation {
+		t.Fatalf("got frame %d %v; want close 1008", f.Opcode, f.PayloadData)
+	}
+}
+
+func TestSendTextBinary(t *testing.T) {
+	conn, peer := newTestConn()
+	defer peer.Close()
+
+	s := (&DefaultMessageSender{}).SetConn(conn)
+	if _, err := s.SendText("bad \xff"); err != ErrInvalidUTF8 {
+		t.Fatalf("got %v; want ErrInvalidUTF8", err)
+	}
+
+	go func() {
+		s.SendText("héllo")
+		s.SendBinary([]byte{0xff, 0})
+	}()
+
+	br := bufio.NewReader(peer)
+	for _, want := range []*Frame{{Opcode: OpcodeText, PayloadData: []byte("héllo")}, {Opcode: OpcodeBinary, PayloadData: []byte{0xff, 0}}} {
+		f := &Frame{}
+		if err := f.FromBufReader(br, 1<<10); err != nil {
+			t.Fatal(err)
+		}
+		if f.Opcode != want.Opcode || !bytes.Equal(f.PayloadData, want.PayloadData) {
+			t.Fatalf("got opcode %d %q; want opcode %d %q", f.Opcode, f.PayloadData, want.Opcode, want.PayloadData)
+		}
+	}
+}
+
+// shortConn fails the writes after n bytes.
+type shortConn struct {
+	net.Conn
+	n int
+}
+
+func (c *shortConn) Write(p []byte) (int, error) {
+	if len(p) <= c.n {
+		c.n -= len(p)
+		return c.Conn.Write(p)
+	}
+	var n int
+	if c.n > 0 {
+		n, _ = c.Conn.Write(p[:c.n])
+		c.n = 0
+	}
+	return n, io.ErrShortWrite
+}
+
+func TestPartialWrite(t *testing.T) {
+	tests := []struct {
+		name     string
+		n        int
+		coalesce bool
+		broken   bool
+	}{
+		{"direct", 10, false, true},
+		{"coalesced", 10, true, true},
+		{"between the frames", 4, false, false},
+		{"coalesced between the frames", 4, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := NewServer()
+			srv.ApplyDefaultCfg()
+			closed := make(chan struct{})
+			srv.OnConnCloseFunc("/", func(c *Conn) {
+				// writing from the close handler doesn't deadlock
+				c.Flush()
+				close(closed)
+			})
+			sc, cc := net.Pipe()
+			defer cc.Close()
+			go io.Copy(io.Discard, cc)
+
+			conn := newConn(srv, &shortConn{sc, tt.n})
+			conn.HandshakeRequest = &HandshakeRequest{RequestURL: &url.URL{Path: "/"}}
+			conn.SetState(StateOpen)
+			if tt.coalesce {
+				conn.SetWriteCoalescing(time.Hour)
+			}
+			s := (&DefaultMessageSender{}).SetConn(conn)
+			if _, err := s.SendWholeBytes([]byte("hi"), false); err != nil || conn.Broken() != nil {
+				t.Fatalf("got %v, %v; want the frame written", err, conn.Broken())
+			}
+			_, err := s.SendWholeBytes([]byte("hello kiwi"), false)
+			if tt.coalesce {
+				if err != nil {
+					t.Fatalf("got %v; want the frame buffered", err)
+				}
+				err = conn.Flush()
+			}
+			if err != io.ErrShortWrite {
+				t.Fatalf("got %v; want io.ErrShortWrite", err)
+			}
+
+			if !tt.broken {
+				if err := conn.Broken(); err != nil || conn.GetState() != StateOpen {
+					t.Fatalf("got %v, state %v; want the conn not broken", err, conn.GetState())
+				}
+				return
+			}
+			<-closed
+			if err := conn.Broken(); err != io.ErrShortWrite || conn.GetState() != StateClosed {
+				t.Fatalf("got %v, state %v; want the conn broken and closed", err, conn.GetState())
+			}
+			if _, err := conn.WriteBuffers(net.Buffers{[]byte("x")}); err != ErrConnBroken {
+				t.Fatalf("got %v; want ErrConnBroken", err)
+			}
+		})
+	}
+}
+
+func TestReadWholeBoundaries(t *testing.T) {
+	frag := func(fin uint8, opcode uint8, data string) *Frame {
+		return &Frame{FIN: fin, Opcode: opcode, PayloadData: []byte(data)}
+	}
+	tests := []struct {
+		name     string
+		maxFrame uint64
+		frames   []*Frame
+		data     string
+		kind     error
+		size     uint64
+		limit    uint64
+	}{
+		{"fragments under both", 6, []*Frame{frag(0, OpcodeText, "123456"), frag(1, OpcodeContinue, "78")}, "12345678", nil, 0, 0},
+		{"first at the limit", 10, []*Frame{frag(0, OpcodeText, "12345678"), frag(1, OpcodeContinue, "")}, "12345678", nil, 0, 0},
+		{"first at the limit and more", 10, []*Frame{frag(0, OpcodeText, "12345678"), frag(1, OpcodeContinue, "9")}, "", ErrMessageTooLarge, 9, 8},
+		{"continuation over", 10, []*Frame{frag(0, OpcodeText, "123"), frag(1, OpcodeContinue, "456789")}, "", ErrMessageTooLarge, 9, 8},
+		{"first over", 10, []*Frame{frag(1, OpcodeText, "123456789")}, "", ErrMessageTooLarge, 9, 8},
+		{"frame over", 6, []*Frame{frag(1, OpcodeText, "1234567")}, "", ErrFrameTooLarge, 7, 6},
+		{"continuation frame over", 6, []*Frame{frag(0, OpcodeText, "1"), frag(1, OpcodeContinue, "1234567")}, "", ErrFrameTooLarge, 7, 6},
+		{"ping at the limit", 10, []*Frame{frag(0, OpcodeText, "12345678"), frag(1, OpcodePing, "p"), frag(1, OpcodeContinue, "")}, "12345678", nil, 0, 0},
+		{"ping over the message limit", 10, []*Frame{frag(1, OpcodePing, "ping data"), frag(1, OpcodeText, "12345678")}, "12345678", nil, 0, 0},
+		{"ping over the frame limit", 6, []*Frame{frag(1, OpcodePing, "1234567")}, "", ErrFrameTooLarge, 7, 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, peer := newTestConn()
+			defer peer.Close()
+			conn.Server.Mode = ProtocolStrict
+			conn.Server.MaxMessageBytes = 8
+			conn.Server.MaxFramePayloadBytes = tt.maxFrame
+
+			// masked for the strict mode
+			go func() {
+				for _, f := range tt.frames {
+					f.WriteTo(peer, true)
+				}
+			}()
+			codes := make(chan uint16, 1)
+			go func() {
+				for {
+					f := &Frame{}
+					if f.FromBufReader(peer, 1<<10) != nil {
+						return
+					}
+					if f.Opcode == OpcodeClose {
+						codes <- closeCodeOf(f.PayloadData)
+						return
+					}
+				}
+			}()
+
+			r := &DefaultMessageReceiver{AutoControl: true}
+			r.SetConn(conn)
+			msg, err := r.ReadWhole(0)
+			if tt.kind == nil {
+				if err != nil || string(msg.Data) != tt.data {
+					t.Fatalf("got %v, %v; want %q", msg, err, tt.data)
+				}
+				return
+			}
+
+			var se *SizeError
+			if !errors.As(err, &se) || se.Kind != tt.kind || se.Size != tt.size || se.Limit != tt.limit {
+				t.Fatalf("got %v; want %v of %d over %d", err, tt.kind, tt.size, tt.limit)
+			}
+			if code := <-codes; code != CloseCodeMessageTooBig {
+				t.Fatalf("got close code %d; want %d", code, CloseCodeMessageTooBig)
+			}
+		})
+	}
+}
+
+func TestFragmentationState(t *testing.T) {
+	frag := func(fin uint8, opcode uint8, data string) *Frame {
+		return &Frame{FIN: fin, Opcode: opcode, PayloadData: []byte(data)}
+	}
+	tests := []struct {
+		name   string
+		frames bool
+		sent   []*Frame
+		data   string
+		err    error
+	}{
+		{"continuation first", false, []*Frame{frag(1, OpcodeContinue, "a")}, "", ErrUnexpectedContinuation},
+		{"data inside", false, []*Frame{frag(0, OpcodeText, "a"), frag(1, OpcodeText, "b")}, "", ErrExpectedContinuation},
+		{"ping inside", false, []*Frame{frag(0, OpcodeText, "a"), frag(1, OpcodePing, "p"), frag(1, OpcodeContinue, "b")}, "ab", nil},
+		{"frames continuation first", true, []*Frame{frag(0, OpcodeContinue, "a")}, "", ErrUnexpectedContinuation},
+		{"frames data inside", true, []*Frame{frag(0, OpcodeBinary, "a"), frag(1, OpcodeBinary, "b")}, "a", ErrExpectedContinuation},
+		{"frames", true, []*Frame{frag(0, OpcodeBinary, "a"), frag(1, OpcodePing, "p"), frag(1, OpcodeContinue, "b"), frag(1, OpcodeText, "c")}, "apbc", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the fragmentation is checked in every mode
+			conn, peer := newTestConn()
+			defer peer.Close()
+			go writeTestFrames(peer, tt.sent...)
+			codes := make(chan uint16, 1)
+			go func() {
+				for {
+					f := &Frame{}
+					if f.FromBufReader(peer, 1<<10) != nil {
+						return
+					}
+					if f.Opcode == OpcodeClose {
+						codes <- closeCodeOf(f.PayloadData)
+						return
+					}
+				}
+			}()
+
+			r := (&DefaultMessageReceiver{}).SetConn(conn)
+			var data []byte
+			var err error
+			if tt.frames {
+				for range tt.sent {
+					var f *Frame
+					if f, _, err = r.ReadFrame(0); err != nil {
+						break
+					}
+					data = append(data, f.PayloadData...)
+				}
+			} else {
+				var msg *Message
+				if msg, err = r.ReadWhole(0); err == nil {
+					data = msg.Data
+				}
+			}
+
+			if err != tt.err || string(data) != tt.data {
+				t.Fatalf("got %q, %v; want %q, %v", data, err, tt.data, tt.err)
+			}
+			if tt.err != nil {
+				if code := <-codes; code != CloseCodeProtocolError {
+					t.Fatalf("got close code %d; want %d", code, CloseCodeProtocolError)
+				}
+			}
+		})
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestAbandonedFragments(t *testing.T) {
+	tests := []struct {
+		name string
+		read func(r *DefaultMessageReceiver) error
+	}{
+		{"receive file", func(r *DefaultMessageReceiver) error {
+			_, err := r.ReceiveFile(failingWriter{}, 0, nil)
+			return err
+		}},
+		{"timeout", func(r *DefaultMessageReceiver) error {
+			r.conn.rwc.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+			_, err := r.ReadWhole(0)
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, peer := newTestConn()
+			defer peer.Close()
+
+			frames := []*Frame{{FIN: 0, Opcode: OpcodeText, PayloadData: []byte("a")}}
+			if tt.name != "timeout" {
+				frames = append(frames, &Frame{FIN: 1, Opcode: OpcodeContinue, PayloadData: []byte("b")})
+			}
+			go writeTestFrames(peer, frames...)
+			codes := make(chan uint16, 1)
+			go func() { codes <- readTestCloseCode(t, peer) }()
+
+			r := (&DefaultMessageReceiver{}).SetConn(conn).(*DefaultMessageReceiver)
+			if err := tt.read(r); err == nil {
+				t.Fatal("got no error")
+			}
+			// the rest of the message is not read as the next one
+			if code := <-codes; code != CloseCodeInternalServerError {
+				t.Fatalf("got close code %d; want %d", code, CloseCodeInternalServerError)
+			}
+			if msg, err := r.ReadWhole(0); err == nil {
+				t.Fatalf("got %v; want the conn closed", msg)
+			}
+		})
+	}
+}
+
+func TestSendCloseError(t *testing.T) {
+	conn, peer := newTestConn()
+	s := (&DefaultMessageSender{}).SetConn(conn)
+	go io.Copy(io.Discard, peer)
+	if n, err := s.SendClose(CloseCodeNormalClosure, "bye", false, false); n != 5 || err != nil {
+		t.Fatalf("got %d, %v; want 5, nil", n, err)
+	}
+	if _, err := s.SendClose(CloseCodeNormalClosure, "bye", false, false); err != ErrCloseSent {
+		t.Fatalf("got %v; want ErrCloseSent", err)
+	}
+
+	// the write to a peer gone fails
+	conn, peer = newTestConn()
+	peer.Close()
+	s = (&DefaultMessageSender{}).SetConn(conn)
+	if n, err := s.SendClose(CloseCodeNormalClosure, "", false, false); n != 0 || err == nil {
+		t.Fatalf("got %d, %v; want the error of the write", n, err)
+	}
+	if conn.GetState() != StateClosed {
+		t.Fatalf("got state %v; want it closed", conn.GetState())
+	}
+}
+
+func TestReadTextBinary(t *testing.T) {
+	conn, peer := newTestConn()
+	defer peer.Close()
+
+	// the frames written back by the conn
+	frames := make(chan *Frame, 4)
+	go func() {
+		br := bufio.NewReader(peer)
+		for {
+			f := &Frame{}
+			if err := f.FromBufReader(br, 1<<10); err != nil {
+				close(frames)
+				return
+			}
+			frames <- f
+		}
+	}()
+	expect := func(opcode uint8, data []byte) {
+		t.Helper()
+		if f := <-frames; f == nil || f.Opcode != opcode || !bytes.Equal(f.PayloadData, data) {
+			t.Fatalf("got %v; want opcode %d %q", f, opcode, data)
+		}
+	}
+
+	go writeTestFrames(peer,
+		&Frame{FIN: 1, Opcode: OpcodePing, PayloadData: []byte("p")},
+		&Frame{FIN: 1, Opcode: OpcodeText, PayloadData: []byte("a")},
+		&Frame{FIN: 1, Opcode: OpcodeBinary, PayloadData: []byte{1}},
+	)
+
+	r := (&DefaultMessageReceiver{}).SetConn(conn)
+	if text, err := r.ReadText(0); err != nil || text != "a" {
+		t.Fatalf("got %q, %v; want %q", text, err, "a")
+	}
+	expect(OpcodePong, []byte("p"))
+
+	if _, err := r.ReadText(0); err != ErrUnexpectedMessageType {
+		t.Fatalf("got %v; want ErrUnexpectedMessageType", err)
+	}
+	if f := <-frames; f == nil || f.Opcode != OpcodeClose || binary.BigEndian.Uint16(f.PayloadData) != CloseCodeUnsupportedData {
+		t.Fatalf("got %v; want a close of %d", f, CloseCodeUnsupportedData)
+	}
+
+	conn, peer = newTestConn()
+	defer peer.Close()
+	go writeTestFrames(peer,
+		&Frame{FIN: 1, Opcode: OpcodeBinary, PayloadData: []byte{1}},
+		MakeCloseFrame(4000, "", false),
+	)
+	go io.Copy(io.Discard, peer)
+
+	r = (&DefaultMessageReceiver{}).SetConn(conn)
+	if data, err := r.ReadBinary(0); err != nil || !bytes.Equal(data, []byte{1}) {
+		t.Fatalf("got %v, %v; want [1]", data, err)
+	}
+	var ce *CloseError
+	if _, err := r.ReadBinary(0); !errors.As(err, &ce) || ce.Code != 4000 {
+		t.Fatalf("got %v; want the close of the peer", err)
+	}
+}
+
+func TestSendWholeTimeout(t *testing.T) {
+	conn, peer := newTestConn()
+	defer peer.Close()
+
+	s := (&DefaultMessageSender{}).SetConn(conn)
+	start := time.Now()
+	_, err := s.SendWholeTimeout(&Message{Opcode: OpcodeText, Data: []byte("stuck")}, 20*time.Millisecond, false)
+	if !IsTimeout(err) {
+		t.Fatalf("got %v; want a timeout", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("expected the send to give up")
+	}
+	if conn.GetState() != StateClosed {
+		t.Fatal("expected the conn closed after a partial write")
+	}
+}
+
+func TestSendWholeTimeoutDeadline(t *testing.T) {
+	conn, peer := newTestConn()
+	defer peer.Close()
+	s := (&DefaultMessageSender{}).SetConn(conn)
+
+	conn.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	go (&Frame{}).FromBufReader(peer, 1<<10)
+	if _, err := s.SendWholeTimeout(&Message{Opcode: OpcodeText, Data: []byte("hello")}, time.Hour, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// the deadline of the user is restored after
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.SendWhole(&Message{Opcode: OpcodeText, Data: []byte("stuck")}, false)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !IsTimeout(err) {
+			t.Fatalf("got %v; want a timeout", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the deadline of the user to be kept")
+	}
+}
+
+func TestTrySend(t *testing.T) {
+	conn, peer := newTestConn()
+	defer conn.Close()
+	conn.Server.SendQueueSize = 2
+
+	s := (&DefaultMessageSender{}).SetConn(conn)
+	msg := func(i int) *Message {
+		return &Message{Opcode: OpcodeText, Data: []byte(strconv.Itoa(i))}
+	}
+
+	// the first one is taken by the writer stuck on the peer, then the queue
+	// is filled up
+	sent := 0
+	for i := 0; i < 10 && s.TrySend(msg(i)); i++ {
+		sent++
+		time.Sleep(5 * time.Millisecond)
+	}
+	if sent != 3 {
+		t.Fatalf("got %d messages queued; want 3", sent)
+	}
+
+	br := bufio.NewReader(peer)
+	for i := range sent {
+		f := &Frame{}
+		if err := f.FromBufReader(br, 1024); err != nil || string(f.PayloadData) != strconv.Itoa(i) {
+			t.Fatalf("got %q, %v; want %d", f.PayloadData, err, i)
+		}
+	}
+
+	conn.Close()
+	if s.TrySend(msg(0)) {
+		t.Fatal("expected no send on a closed conn")
+	}
+}
+
+func TestReadSpooled(t *testing.T) {
+	conn, peer := newTestConn()
+	defer conn.Close()
+	conn.Server.SpoolThreshold = 8
+	conn.Server.SpoolDir = t.TempDir()
+
+	go writeTestFrames(peer,
+		&Frame{FIN: 1, Opcode: OpcodeText, PayloadData: []byte("small")},
+		&Frame{FIN: 0, Opcode: OpcodeBinary, PayloadData: []byte("0123456")},
+		&Frame{FIN: 1, Opcode: OpcodePong, PayloadData: []byte("p")},
+		&Frame{FIN: 1, Opcode: OpcodeContinue, PayloadData: []byte("789abcdef")},
+		&Frame{FIN: 0, Opcode: OpcodeBinary, PayloadData: []byte("0123456789")},
+		&Frame{FIN: 1, Opcode: OpcodeContinue, PayloadData: []byte("0123456789")},
+	)
+	// the close frame sent for the message too large
+	go io.Copy(io.Discard, peer)
+
+	r := (&DefaultMessageReceiver{}).SetConn(conn)
+	read := func(max uint64) (*SpooledMessage, string, error) {
+		msg, err := r.ReadSpooled(max)
+		if err != nil {
+			return nil, "", err
+		}
+		data, err := io.ReadAll(msg)
+		return msg, string(data), err
+	}
+
+	msg, data, err := read(0)
+	if err != nil || msg.OnDisk() || data != "small" || msg.Opcode != OpcodeText {
+		t.Fatalf("got %+v, %q, %v; want small in memory", msg, data, err)
+	}
+
+	msg, data, err = read(0)
+	if err != nil || !msg.OnDisk() || data != "0123456789abcdef" || msg.Size != 16 || msg.Opcode != OpcodeBinary {
+		t.Fatalf("got %+v, %q, %v; want the message on disk", msg, data, err)
+	}
+	if _, err := msg.Seek(10, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if rest, _ := io.ReadAll(msg); string(rest) != "abcdef" {
+		t.Fatalf("got %q after seeking", rest)
+	}
+	if err := msg.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := os.ReadDir(conn.Server.SpoolDir); len(files) != 0 {
+		t.Fatalf("got %d files left", len(files))
+	}
+
+	// the temp file is removed if the message is over the limit
+	if _, _, err := read(15); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("got %v; want ErrMessageTooLarge", err)
+	}
+	if files, _ := os.ReadDir(conn.Server.SpoolDir); len(files) != 0 {
+		t.Fatalf("got %d files left", len(files))
+	}
+}
+
+func TestMemoryBudget(t *testing.T) {
+	c1, peer1 := newTestConn()
+	defer c1.Close()
+	srv := c1.Server
+	srv.Memory = NewMemoryBudget(10, 20*time.Millisecond)
+
+	sc, peer2 := net.Pipe()
+	c2 := newConn(srv, sc)
+	c2.SetState(StateOpen)
+	defer c2.Close()
+
+	go writeTestFrames(peer1,
+		&Frame{FIN: 0, Opcode: OpcodeBinary, PayloadData: []byte("0123")},
+		&Frame{FIN: 1, Opcode: OpcodeContinue, PayloadData: []byte("4567")},
+		&Frame{FIN: 1, Opcode: OpcodeText, PayloadData: []byte("0123456789a")},
+	)
+	go writeTestFrames(peer2,
+		&Frame{FIN: 1, Opcode: OpcodeText, PayloadData: []byte("hello")},
+	)
+
+	r1 := (&DefaultMessageReceiver{}).SetConn(c1)
+	r2 := (&DefaultMessageReceiver{}).SetConn(c2)
+
+	if msg, err := r1.ReadWhole(0); err != nil || string(msg.Data) != "01234567" {
+		t.Fatalf("got %v, %v", msg, err)
+	}
+	if n := srv.Memory.InUse(); n != 8 {
+		t.Fatalf("got %d bytes in use; want 8", n)
+	}
+
+	codes := make(chan uint16, 1)
+	go func() { codes <- readTestCloseCode(t, peer2) }()
+	if _, err := r2.ReadWhole(0); !errors.Is(err, ErrMemoryBudgetExceeded) {
+		t.Fatalf("got %v; want ErrMemoryBudgetExceeded", err)
+	}
+	if code := <-codes; code != CloseCodeTryAgainLater {
+		t.Fatalf("got close code %d; want %d", code, CloseCodeTryAgainLater)
+	}
+
+	// the next read releases the last message, the one larger than the
+	// whole budget is rejected
+	go io.Copy(io.Discard, peer1)
+	if _, err := r1.ReadWhole(0); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("got %v; want ErrMessageTooLarge", err)
+	}
+	if n := srv.Memory.InUse(); n != 0 {
+		t.Fatalf("got %d bytes in use; want 0", n)
+	}
+}
+
+func TestMemoryBudgetWait(t *testing.T) {
+	c1, peer1 := newTestConn()
+	srv := c1.Server
+	srv.Memory = NewMemoryBudget(10, 5*time.Second)
+
+	sc, peer2 := net.Pipe()
+	c2 := newConn(srv, sc)
+	c2.SetState(StateOpen)
+	defer c2.Close()
+
+	go writeTestFrames(peer1, &Frame{FIN: 1, Opcode: OpcodeText, PayloadData: []byte("01234567")})
+	go writeTestFrames(peer2, &Frame{FIN: 1, Opcode: OpcodeText, PayloadData: []byte("hello")})
+
+	if _, err := (&DefaultMessageReceiver{}).SetConn(c1).ReadWhole(0); err != nil {
+		t.Fatal(err)
+	}
+
+	// the read of c2 is paused until c1 is closed
+	time.AfterFunc(20*time.Millisecond, func() {
+		peer1.Close()
+		c1.Close()
+	})
+	msg, err := (&DefaultMessageReceiver{}).SetConn(c2).ReadWhole(0)
+	if err != nil || string(msg.Data) != "hello" {
+		t.Fatalf("got %v, %v", msg, err)
+	}
+	if n := srv.Memory.InUse(); n != 5 {
+		t.Fatalf("got %d bytes in use; want 5", n)
+	}
+}
+
+func TestHubSnapshotRestore(t *testing.T) {
+	conn, peer := newTestConn()
+	defer peer.Close()
+	go io.Copy(io.Discard, peer)
+
+	s := (&DefaultMessageSender{}).SetConn(conn)
+
+	h := NewHub()
+	h.HistorySize = 2
+	h.Join("room", "alice", s)
+	for _, text := range []string{"1", "2", "3"} {
+		h.Publish("room", &Message{Opcode: OpcodeText, Data: []byte(text)})
+	}
+
+	data, err := json.Marshal(h.Snapshot())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snap := &HubSnapshot{}
+	if err := json.Unmarshal(data, snap); err != nil {
+		t.Fatal(err)
+	}
+
+	h2 := NewHub()
+	h2.Restore(snap)
+
+	history := h2.History("room")
+	if len(history) != 2 || string(history[0].Data) != "2" || string(history[1].Data) != "3" {
+		t.Fatalf("unexpected history: %v", history)
+	}
+
+	if topics := h2.Resume("alice", s); !reflect.DeepEqual(topics, []string{"room"}) {
+		t.Fatalf("got topics %v; want [room]", topics)
+	}
+	if topics := h2.Resume("alice", s); len(topics) != 0 {
+		t.Fatalf("resumed twice: %v", topics)
+	}
+}
+
+func TestHubPresence(t *testing.T) {
+	senders := make([]MessageSender, 3)
+	peers := make([]net.Conn, 3)
+	for i := range senders {
+		conn, peer := newTestConn()
+		defer conn.Close()
+		conn.ID = uint64(i + 1)
+		senders[i] = (&DefaultMessageSender{}).SetConn(conn)
+		peers[i] = peer
+	}
+	for _, peer := range peers[1:] {
+		go io.Copy(io.Discard, peer)
+	}
+
+	var events []string
+	h := NewHub()
+	h.OnJoin = func(topic, key string) { events = append(events, "+"+key) }
+	h.OnLeave = func(topic, key string) { events = append(events, "-"+key) }
+
+	h.Join("room", "alice", senders[0])
+	h.Join("room", "alice", senders[1])
+	h.Join("room", "bob", senders[2])
+	h.Join("room", "", senders[2])
+	if got := h.Members("room"); !reflect.DeepEqual(got, []string{"alice"}) {
+		t.Fatalf("got members %v; want [alice]", got)
+	}
+	h.Join("room", "bob", senders[2])
+	if got := h.Members("room"); !reflect.DeepEqual(got, []string{"alice", "bob"}) {
+		t.Fatalf("got members %v; want [alice bob]", got)
+	}
+
+	// alice is present until her last conn leaves
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.PushPresence(ctx, 10*time.Millisecond)
+
+	f := &Frame{}
+	if err := f.FromBufReader(peers[0], 1<<10); err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"type":"presence","topic":"room","members":["alice","bob"]}`; string(f.PayloadData) != want {
+		t.Fatalf("got %s; want %s", f.PayloadData, want)
+	}
+	cancel()
+	go io.Copy(io.Discard, peers[0])
+
+	h.Leave("room", senders[0])
+	h.LeaveAll(senders[1])
+
+	// the closed conns leave on the next publish
+	senders[2].GetConn().Close()
+	h.Publish("room", &Message{Opcode: OpcodeText, Data: []byte("hi")})
+
+	want := []string{"+alice", "+bob", "-bob", "+bob", "-alice", "-bob"}
+	if !reflect.DeepEqual(events, want) {
+		t.Fatalf("got events %v; want %v", events, want)
+	}
+	if got := h.Members("room"); len(got) != 0 {
+		t.Fatalf("got members %v", got)
+	}
+}
+
+func TestBufferPool(t *testing.T) {
+	p := NewBufferPool()
+
+	for _, size := range []int{0, 1, 512, 513, 1 << 20, 1<<20 + 1} {
+		b := p.Get(size)
+		if len(b) != size {
+			t.Fatalf("got len %d; want %d", len(b), size)
+		}
+		p.Put(b)
+	}
+
+	b := p.appendPooled(p.Get(500), make([]byte, 100))
+	if len(b) != 600 || cap(b) != 1024 {
+		t.Fatalf("got len %d cap %d; want 600 1024", len(b), cap(b))
+	}
+}
+
+func TestAppendProbeTimes(t *testing.T) {
+	recv, send := time.Unix(0, 1), time.Unix(0, 2)
+
+	msg := appendProbeTimes(&Message{Opcode: OpcodeText, Data: []byte("hi")}, recv, send)
+	if string(msg.Data) != "hi 1 2" {
+		t.Fatalf("got %q; want \"hi 1 2\"", msg.Data)
+	}
+
+	msg = appendProbeTimes(&Message{Opcode: OpcodeBinary, Data: []byte{9}}, recv, send)
+	if !reflect.DeepEqual(msg.Data, []byte{9, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 2}) {
+		t.Fatalf("got %v", msg.Data)
+	}
+}
+
+// dialTestConn does the handshake on path and returns the client side
+func dialTestConn(t *testing.T, srv *Server, path string) (net.Conn, *bufio.Reader) {
+	sc, cc := net.Pipe()
+
+	conn := newConn(srv, sc)
+	srv.ConnPool.Add(conn)
+	go conn.serve()
+
+	go io.WriteString(cc, "GET "+path+" HTTP/1.1\r\nHost: localhost\r\n"+
+		"Connection: Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: M/A=\r\n\r\n")
+
+	br := bufio.NewReader(cc)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got status %d; want 101", resp.StatusCode)
+	}
+	return cc, br
+}
+
+func readTestCloseCode(t *testing.T, r io.Reader) uint16 {
+	f := &Frame{}
+	if err := f.FromBufReader(r, 1<<10); err != nil {
+		t.Fatal(err)
+	}
+	if f.Opcode != OpcodeClose || len(f.PayloadData) < 2 {
+		t.Fatalf("got frame %d %v; want a close frame", f.Opcode, f.PayloadData)
+	}
+	return closeCodeOf(f.PayloadData)
+}
+
+func closeCodeOf(payload []byte) uint16 {
+	code, _ := ParseCloseCode(payload)
+	return code
+}
+
+func TestMaxConnectionAge(t *testing.T) {
+	srv := NewServer()
+	srv.ApplyDefaultCfg()
+	srv.MaxConnectionAge = 10 * time.Millisecond
+	srv.MaxConnectionAgeJitter = 10 * time.Millisecond
+
+	srv.OnConnOpenFunc("/", func(r MessageReceiver, s MessageSender) {
+		<-s.GetConn().Context().Done()
+	})
+
+	cc, br := dialTestConn(t, srv, "/")
+	defer cc.Close()
+
+	if code := readTestCloseCode(t, br); code != CloseCodeServiceRestart {
+		t.Fatalf("got close code %d; want %d", code, CloseCodeServiceRestart)
+	}
+
+	srv.MaxConnectionAgeCloseCode = CloseCodeGoingAway
+	cc2, br2 := dialTestConn(t, srv, "/")
+	defer cc2.Close()
+
+	if code := readTestCloseCode(t, br2); code != CloseCodeGoingAway {
+		t.Fatalf("got close code %d; want %d", code, CloseCodeGoingAway)
+	}
+
+	srv.MaxConnectionAgeCloseCode = CloseCodeAbnormalClosure
+	if err := srv.Validate(); err == nil {
+		t.Fatal("got no error for an invalid close code")
+	}
+}
+
+func TestServerRand(t *testing.T) {
+	conn, peer := newTestConn()
+	defer peer.Close()
+	conn.client = true
+	conn.Server.Rand = bytes.NewReader([]byte{1, 2, 3, 4, 0, 0, 0, 0, 0, 0, 0, 7})
+
+	go (&DefaultMessageSender{conn: conn}).SendWhole(&Message{Opcode: OpcodeText, Data: []byte("hi")}, false)
+
+	b := make([]byte, 8)
+	if _, err := io.ReadFull(peer, b); err != nil {
+		t.Fatal(err)
+	}
+	if mkb := b[2:6]; !bytes.Equal(mkb, []byte{1, 2, 3, 4}) {
+		t.Fatalf("got masking key %v; want the bytes of Rand", mkb)
+	}
+	if MaskData(b[6:], b[2:6]); string(b[6:]) != "hi" {
+		t.Fatalf("got payload %q; want %q", b[6:], "hi")
+	}
+
+	srv := conn.Server
+	srv.MaxConnectionAge = time.Minute
+	srv.MaxConnectionAgeJitter = 5 * time.Nanosecond
+	if age := srv.connectionAge(); age != time.Minute+2 {
+		t.Fatalf("got age %v; want %v", age, time.Minute+2)
+	}
+}
+
+func TestFrameWriteTo(t *testing.T) {
+	for _, size := range []int{0, 125, 126, 1 << 16} {
+		for _, mask := range []bool{false, true} {
+			payload := bytes.Repeat([]byte{'x'}, size)
+			f := &Frame{FIN: 1, Opcode: OpcodeBinary, PayloadData: payload}
+
+			buf := &bytes.Buffer{}
+			if _, err := f.WriteTo(buf, mask); err != nil {
+				t.Fatal(err)
+			}
+
+			byts, _ := f.ToBytes(mask)
+			if buf.Len() != len(byts) {
+				t.Fatalf("[%d %v] WriteTo wrote %d bytes; ToBytes gives %d", size, mask, buf.Len(), len(byts))
+			}
+
+			got := &Frame{}
+			if err := got.FromBufReader(buf, 1<<20); err != nil {
+				t.Fatal(err)
+			}
+			if got.MASK == 1 != mask || !bytes.Equal(got.PayloadData, payload) {
+				t.Fatalf("[%d %v] payload mismatch", size, mask)
+			}
+		}
+	}
+}
+
+func TestBucketing(t *testing.T) {
+	b := &Bucketing{
+		Buckets: []Bucket{{"control", 1}, {"off", 0}, {"treatment", 3}},
+		Key: func(hsReq *HandshakeRequest, conn *Conn) string {
+			return hsReq.RequestURL.Query().Get("user")
+		},
+	}
+
+	counts := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		hsReq := &HandshakeRequest{RequestURL: &url.URL{RawQuery: "user=" + strconv.Itoa(i)}}
+		name := b.Assign(hsReq, &Conn{})
+		if name != b.Assign(hsReq, &Conn{ID: 1}) {
+			t.Fatal("assignment is not stable for the same key")
+		}
+		counts[name]++
+	}
+
+	if counts["off"] != 0 || counts["control"] < 150 || counts["treatment"] < 650 {
+		t.Fatalf("unexpected distribution: %v", counts)
+	}
+}
+
+func maskDataByByte(data, maskingKey []byte) {
+	for i := range data {
+		data[i] ^= maskingKey[i%4]
+	}
+}
+
+func TestMaskData(t *testing.T) {
+	key := []byte{0x12, 0x34, 0x56, 0x78}
+
+	for size := 0; size < 80; size++ {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i * 7)
+		}
+
+		want := append([]byte(nil), data...)
+		maskDataByByte(want, key)
+
+		// unaligned start
+		got := append([]byte{0}, data...)[1:]
+		MaskData(got, key)
+
+		if !bytes.Equal(got, want) {
+			t.Fatalf("[size %d] got %v; want %v", size, got, want)
+		}
+	}
+}
+
+func benchmarkMaskData(b *testing.B, size int, mask func(data, maskingKey []byte)) {
+	data := make([]byte, size)
+	key := []byte{0x12, 0x34, 0x56, 0x78}
+
+	b.SetBytes(int64(size))
+	for i := 0; i < b.N; i++ {
+		mask(data, key)
+	}
+}
+
+func BenchmarkMaskData(b *testing.B) {
+	for _, size := range []int{16, 512, 1 << 14, 1 << 20} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			benchmarkMaskData(b, size, MaskData)
+		})
+		b.Run(strconv.Itoa(size)+"/bytewise", func(b *testing.B) {
+			benchmarkMaskData(b, size, maskDataByByte)
+		})
+	}
+}
+
+func TestSLOTracker(t *testing.T) {
+	slo := NewSLOTracker(time.Minute, time.Hour)
+
+	slo.RecordHandshake(true)
+	slo.RecordHandshake(true)
+	slo.RecordHandshake(true)
+	slo.RecordHandshake(false)
+	slo.RecordClose(CloseCodeNormalClosure)
+	slo.RecordClose(CloseCodeAbnormalClosure)
+
+	reports := slo.Report()
+	if len(reports) != 2 {
+		t.Fatalf("got %d reports; want 2", len(reports))
+	}
+
+	for _, r := range reports {
+		if r.Handshakes != 4 || r.HandshakeSuccessRatio != 0.75 || r.CloseSuccessRatio != 0.5 {
+			t.Fatalf("unexpected report: %+v", r)
+		}
+		if r.Outcomes[OutcomeNormal] != 1 || r.Outcomes[OutcomeAbnormal] != 1 {
+			t.Fatalf("unexpected outcomes: %v", r.Outcomes)
+		}
+	}
+}
+
+func TestOutcome(t *testing.T) {
+	codes := []struct {
+		code    uint16
+		outcome Outcome
+		status  int
+	}{
+		{CloseCodeGoingAway, OutcomeNormal, http.StatusOK},
+		{CloseCodeMessageTooBig, OutcomeClientError, http.StatusRequestEntityTooLarge},
+		{CloseCodePolicyViolation, OutcomePolicy, http.StatusForbidden},
+		{CloseCodeTryAgainLater, OutcomeServerError, http.StatusServiceUnavailable},
+		{CloseCodeAbnormalClosure, OutcomeAbnormal, http.StatusBadGateway},
+		{4000, OutcomeAbnormal, http.StatusBadGateway},
+	}
+	for _, c := range codes {
+		if o := CloseCodeOutcome(c.code); o != c.outcome {
+			t.Errorf("code %d: got %s; want %s", c.code, o, c.outcome)
+		}
+		if s := CloseCodeHTTPStatus(c.code); s != c.status {
+			t.Errorf("code %d: got status %d; want %d", c.code, s, c.status)
+		}
+	}
+
+	errs := []struct {
+		err     error
+		outcome Outcome
+	}{
+		{nil, OutcomeNormal},
+		{ErrTooManyFragments, OutcomeClientError},
+		{ErrMessageTooLarge, OutcomeClientError},
+		{ErrPayloadRejected, OutcomePolicy},
+		{&ServerError{"oops"}, OutcomeServerError},
+		{io.ErrUnexpectedEOF, OutcomeAbnormal},
+	}
+	for _, e := range errs {
+		if o := ErrorOutcome(e.err); o != e.outcome {
+			t.Errorf("error %v: got %s; want %s", e.err, o, e.outcome)
+		}
+	}
+}
+
+func TestReadWholeInto(t *testing.T) {
+	conn, peer := newTestConn()
+	defer peer.Close()
+
+	go writeTestFrames(peer,
+		&Frame{FIN: 0, Opcode: OpcodeText, PayloadData: []byte("hel")},
+		&Frame{FIN: 1, Opcode: OpcodeContinue, PayloadData: []byte("lo")},
+		&Frame{FIN: 1, Opcode: OpcodeText, PayloadData: []byte("hi")},
+	)
+
+	r := (&DefaultMessageReceiver{}).SetConn(conn)
+	buf := make([]byte, 0, 16)
+
+	msg, err := r.ReadWholeInto(buf, 0)
+	if err != nil || string(msg.Data) != "hello" || &msg.Data[0] != &buf[:1][0] {
+		t.Fatalf("got %v, %v; want hello read into buf", msg, err)
+	}
+
+	msg, err = r.ReadWholeInto(msg.Data, 0)
+	if err != nil || string(msg.Data) != "hi" || &msg.Data[0] != &buf[:1][0] {
+		t.Fatalf("got %v, %v; want hi read into buf", msg, err)
+	}
+}
+
+func TestReleaseFrame(t *testing.T) {
+	f := AcquireFrame()
+	f.FIN, f.Opcode, f.PayloadData = 1, OpcodeText, []byte("x")
+	ReleaseFrame(f)
+
+	if f.FIN != 0 || f.Opcode != 0 || f.PayloadData != nil {
+		t.Fatalf("frame is not reset: %+v", f)
+	}
+}
+
+type testScanner struct {
+	chunks [][]byte
+}
+
+func (s *testScanner) NewScan(conn *Conn) PayloadScan { return s }
+func (s *testScanner) Abort()                         {}
+
+func (s *testScanner) Write(chunk []byte) error {
+	s.chunks = append(s.chunks, append([]byte(nil), chunk...))
+	return nil
+}
+
+func (s *testScanner) Finish() error {
+	for _, c := range s.chunks {
+		if bytes.Contains(c, []byte("virus")) {
+			return errors.New("infected")
+		}
+	}
+	return nil
+}
+
+func TestPayloadScanner(t *testing.T) {
+	conn, peer := newTestConn()
+	defer peer.Close()
+
+	scanner := &testScanner{}
+	conn.HandshakeRequest = &HandshakeRequest{RequestURL: &url.URL{Path: "/upload"}}
+	conn.Server.SetScanner("/upload", scanner)
+
+	go writeTestFrames(peer,
+		&Frame{FIN: 1, Opcode: OpcodeText, PayloadData: []byte("virus as text")},
+		&Frame{FIN: 0, Opcode: OpcodeBinary, PayloadData: []byte("clean")},
+		&Frame{FIN: 1, Opcode: OpcodeContinue, PayloadData: []byte("virus")},
+	)
+
+	r := (&DefaultMessageReceiver{}).SetConn(conn)
+	if msg, err := r.ReadWhole(0); err != nil || !msg.IsText() {
+		t.Fatalf("got %v, %v; want the text message", msg, err)
+	}
+
+	go io.Copy(io.Discard, peer)
+
+	if _, err := r.ReadWhole(0); !errors.Is(err, ErrPayloadRejected) {
+		t.Fatalf("got %v; want ErrPayloadRejected", err)
+	}
+	if len(scanner.chunks) != 2 {
+		t.Fatalf("got %d chunks; want 2", len(scanner.chunks))
+	}
+}
+
+func TestPooledConnBuffers(t *testing.T) {
+	srv := NewServer()
+	srv.ApplyDefaultCfg()
+	srv.PoolConnBuffers = true
+	srv.ReadBufferSize = 1024
+	srv.WriteBufferSize = 2048
+
+	sizes := make(chan [2]int, 1)
+	srv.OnConnOpenFunc("/", func(r MessageReceiver, s MessageSender) {
+		buf := s.GetConn().Buf
+		sizes <- [2]int{buf.Reader.Size(), buf.Writer.Size()}
+
+		msg, err := r.ReadWhole(0)
+		if err == nil {
+			s.SendWhole(msg, false)
+		}
+		s.SendClose(CloseCodeNormalClosure, "", true, false)
+	})
+
+	cc, br := dialTestConn(t, srv, "/")
+	defer cc.Close()
+
+	if got := <-sizes; got != [2]int{1024, 2048} {
+		t.Fatalf("got buffer sizes %v; want [1024 2048]", got)
+	}
+
+	go writeTestFrames(cc, &Frame{FIN: 1, Opcode: OpcodeText, PayloadData: []byte("hi")})
+
+	f := &Frame{}
+	if err := f.FromBufReader(br, 1<<10); err != nil || string(f.PayloadData) != "hi" {
+		t.Fatalf("got %q, %v; want the echo", f.PayloadData, err)
+	}
+	if code := readTestCloseCode(t, br); code != CloseCodeNormalClosure {
+		t.Fatalf("got close code %d", code)
+	}
+}
+
+func TestHandshakeRequestReadFrom(t *testing.T) {
+	pipelined := "GET /chat HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\n\r\n\x81\x02hi"
+	br := bufio.NewReader(strings.NewReader(pipelined))
+
+	hsReq := &HandshakeRequest{}
+	if err := hsReq.ReadFrom(br, 1<<10); err != nil {
+		t.Fatal(err)
+	}
+	if hsReq.RequestURL.Path != "/chat" || hsReq.Header.GetOne("Upgrade") != "websocket" {
+		t.Fatalf("unexpected request: %+v", hsReq)
+	}
+
+	f := &Frame{}
+	if err := f.FromBufReader(br, 1<<10); err != nil || string(f.PayloadData) != "hi" {
+		t.Fatalf("got %q, %v; want the pipelined frame", f.PayloadData, err)
+	}
+
+	for _, req := range []string{
+		"GET / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 2\r\n\r\nhi",
+		"GET / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+		"GET / HTTP/1.1\r\nHost: " + strings.Repeat("a", 1<<10) + "\r\n\r\n",
+	} {
+		err := (&HandshakeRequest{}).ReadFrom(bufio.NewReader(strings.NewReader(req)), 1<<10)
+		if err == nil {
+			t.Fatalf("no error for %q", req)
+		}
+	}
+}
+
+func TestHandshakeRequestReadFromStd(t *testing.T) {
+	req := "GET /a%20b?x=1 HTTP/1.1\r\nhost: localhost\r\nsec-websocket-key: k\r\nX-Folded: a\r\n b\r\n\r\n\x81\x02hi"
+	br := bufio.NewReader(strings.NewReader(req))
+
+	hsReq := &HandshakeRequest{}
+	if err := hsReq.ReadFromStd(br, 1<<10); err != nil {
+		t.Fatal(err)
+	}
+	if hsReq.Method != "GET" || hsReq.RequestURL.Path != "/a b" || hsReq.RequestURI != "/a%20b?x=1" || hsReq.ProtoVer != "1.1" {
+		t.Fatalf("unexpected request: %+v", hsReq)
+	}
+	h := hsReq.Header
+	if h.GetOne("Host") != "localhost" || h.GetOne("Sec-WebSocket-Key") != "k" || h.GetOne("X-Folded") != "a b" {
+		t.Fatalf("unexpected header: %v", h)
+	}
+
+	f := &Frame{}
+	if err := f.FromBufReader(br, 1<<10); err != nil || string(f.PayloadData) != "hi" {
+		t.Fatalf("got %q, %v; want the pipelined frame", f.PayloadData, err)
+	}
+
+	for _, req := range []string{
+		"GET / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 2\r\n\r\nhi",
+		"GET / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+		"GET / HTTP/1.1\r\nNoColon\r\n\r\n",
+		"GET / HTTP/1.1\r\nHost: " + strings.Repeat("a", 1<<10) + "\r\n\r\n",
+	} {
+		err := (&HandshakeRequest{}).ReadFromStd(bufio.NewReader(strings.NewReader(req)), 1<<10)
+		if err == nil {
+			t.Fatalf("no error for %q", req)
+		}
+	}
+
+	srv := NewServer()
+	srv.ApplyDefaultCfg()
+	srv.StdHandshakeParser = true
+	srv.OnConnOpenFunc("/", func(r MessageReceiver, s MessageSender) {
+		s.SendText("std")
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := Dial(ctx, listenTestServer(t, srv)+"/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if text, err := (&DefaultMessageReceiver{}).SetConn(c).ReadText(0); err != nil || text != "std" {
+		t.Fatalf("got %q, %v; want std", text, err)
+	}
+}
+
+func TestHeaderLimits(t *testing.T) {
+	srv := NewServer()
+	srv.MaxRequestLineBytes = 64
+	srv.MaxHeaderLineBytes = 64
+	srv.MaxHeaders = 6
+	srv.ApplyDefaultCfg()
+	srv.OnConnOpenFunc("/", func(r MessageReceiver, s MessageSender) {})
+
+	status := func(req string) int {
+		sc, cc := net.Pipe()
+		defer cc.Close()
+		conn := newConn(srv, sc)
+		srv.ConnPool.Add(conn)
+		go conn.serve()
+
+		go io.WriteString(cc, req)
+		resp, err := http.ReadResponse(bufio.NewReader(cc), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+
+	head := "Host: localhost\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n" +
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: M/A=\r\n"
+	tests := []struct {
+		req  string
+		want int
+	}{
+		{"GET / HTTP/1.1\r\n" + head + "\r\n", http.StatusSwitchingProtocols},
+		{"GET /" + strings.Repeat("a", 64) + " HTTP/1.1\r\n" + head + "\r\n", http.StatusRequestHeaderFieldsTooLarge},
+		{"GET / HTTP/1.1\r\n" + head + "X-Long: " + strings.Repeat("a", 64) + "\r\n\r\n", http.StatusRequestHeaderFieldsTooLarge},
+		{"GET / HTTP/1.1\r\n" + head + "X-A: 1\r\n\r\n", http.StatusSwitchingProtocols},
+		{"GET / HTTP/1.1\r\n" + head + "X-A: 1\r\nX-B: 2\r\n\r\n", http.StatusRequestHeaderFieldsTooLarge},
+	}
+	for _, tt := range tests {
+		if got := status(tt.req); got != tt.want {
+			t.Fatalf("got status %d for %q; want %d", got, tt.req, tt.want)
+		}
+	}
+}
+
+// testClock stops the time at now, its timers are real.
+type testClock struct {
+	systemClock
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+func TestHandshakeResponseWriteTo(t *testing.T) {
+	resp := &HandshakeResponse{StatusCode: http.StatusFound, Header: Header{"X-B": {"b"}, "X-A": {"a"}}, Body: []byte("moved\n")}
+	resp.AddHeader("Location", "/new")
+	resp.AddHeader("Cache-Control", "no-store")
+	resp.SetHeader("Location", "/newer")
+	resp.SetHeader("X-A", "aa")
+
+	var b bytes.Buffer
+	n, err := resp.WriteTo(&b)
+	want := "HTTP/1.1 302 Found\r\nLocation: /newer\r\nCache-Control: no-store\r\nX-A: aa\r\nX-B: b\r\nContent-Length: 6\r\n\r\nmoved\n"
+	if err != nil || b.String() != want || n != int64(len(want)) {
+		t.Fatalf("got %q, %d, %v; want %q", b.String(), n, err, want)
+	}
+
+	srv := NewServer()
+	srv.ApplyDefaultCfg()
+	srv.ServerHeader = "kiwi"
+	srv.Clock = &testClock{now: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+	srv.OnConnOpenFunc("/", func(r MessageReceiver, s MessageSender) {})
+	srv.OnHandshakeRequestFunc("/old", func(hsReq *HandshakeRequest, c *Conn) (int, error) {
+		resp := &HandshakeResponse{StatusCode: http.StatusMovedPermanently}
+		resp.AddHeader("Location", "/")
+		c.WriteHandshakeResponse(resp)
+		return http.StatusMovedPermanently, errors.New("moved to /")
+	})
+	url := listenTestServer(t, srv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := Dial(ctx, url+"/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	h := c.HandshakeResponse.Header
+	if h.Get("Date") != "Tue, 02 Jan 2024 03:04:05 GMT" || h.Get("Server") != "kiwi" {
+		t.Fatalf("got Date %q and Server %q", h.Get("Date"), h.Get("Server"))
+	}
+
+	var he *HandshakeError
+	if _, err := Dial(ctx, url+"/old"); !errors.As(err, &he) || he.Status != http.StatusMovedPermanently {
+		t.Fatalf("got %v; want the redirect", err)
+	}
+}
+
+func TestWriteCoalescing(t *testing.T) {
+	conn, peer := newTestConn()
+	defer peer.Close()
+
+	s := (&DefaultMessageSender{}).SetConn(conn)
+	conn.SetWriteCoalescing(time.Hour)
+
+	// nothing reads the pipe yet, so these block if they're not coalesced
+	s.SendWhole(&Message{Opcode: OpcodeText, Data: []byte("a")}, false)
+	s.SendWhole(&Message{Opcode: OpcodeText, Data: []byte("b")}, false)
+
+	go s.Flush()
+
+	r := bufio.NewReader(peer)
+	for _, want := range []string{"a", "b"} {
+		f := &Frame{}
+		if err := f.FromBufReader(r, 1<<10); err != nil {
+			t.Fatal(err)
+		}
+		if string(f.PayloadData) != want {
+			t.Fatalf("expected %q, got %q", want, f.PayloadData)
+		}
+	}
+
+	conn.SetWriteCoalescing(10 * time.Millisecond)
+	s.SendWhole(&Message{Opcode: OpcodeText, Data: []byte("c")}, false)
+
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	f := &Frame{}
+	if err := f.FromBufReader(r, 1<<10); err != nil {
+		t.Fatal("expected timed flush:", err)
+	}
+	if string(f.PayloadData) != "c" {
+		t.Fatalf("expected %q, got %q", "c", f.PayloadData)
+	}
+}
+
+func TestConnNetConn(t *testing.T) {
+	conn, peer := newTestConn()
+	defer peer.Close()
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	var ne net.Error
+	if _, err := conn.Read(make([]byte, 1)); !errors.As(err, &ne) || !ne.Timeout() {
+		t.Fatal("expected timeout, got", err)
+	}
+
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if conn.GetState() != StateClosed {
+		t.Fatal("expected closed state")
+	}
+}
+
+func TestConnPoolIndexes(t *testing.T) {
+	srv := NewServer()
+	srv.ApplyDefaultCfg()
+
+	opened := make(chan MessageSender)
+	done := make(chan struct{})
+	defer close(done)
+
+	handler := func(r MessageReceiver, s MessageSender) {
+		opened <- s
+		<-done
+	}
+	srv.OnConnOpenFunc("/a", handler)
+	srv.OnConnOpenFunc("/b", handler)
+
+	for _, path := range []string{"/a", "/a", "/b"} {
+		cc, _ := dialTestConn(t, srv, path)
+		defer cc.Close()
+
+		s := <-opened
+		if path == "/b" {
+			srv.ConnPool.SetKey(s.GetConn(), "user1")
+		}
+	}
+
+	if n := len(srv.ConnPool.ByPath("/a")); n != 2 {
+		t.Fatalf("got %d conns on /a; want 2", n)
+	}
+	user := srv.ConnPool.ByKey("user1")
+	if len(user) != 1 || user[0].HandshakeRequest.RequestURL.Path != "/b" {
+		t.Fatalf("unexpected conns of user1: %v", user)
+	}
+
+	n := 0
+	srv.ConnPool.Range(func(c *Conn) bool {
+		n++
+		return false
+	})
+	if n != 1 {
+		t.Fatalf("Range called fn %d times after false; want 1", n)
+	}
+
+	matched := srv.ConnPool.Filter(func(c *Conn) bool {
+		return c.HandshakeRequest.RequestURL.Path == "/a"
+	})
+	if len(matched) != 2 {
+		t.Fatalf("got %d filtered conns; want 2", len(matched))
+	}
+
+	user[0].AddTag("room1")
+	user[0].AddTag("admin")
+	matched[0].AddTag("room1")
+	if n := len(srv.ConnPool.ByTag("room1")); n != 2 {
+		t.Fatalf("got %d conns tagged room1; want 2", n)
+	}
+	matched[0].RemoveTag("room1")
+	if tagged := srv.ConnPool.ByTag("room1"); len(tagged) != 1 || tagged[0] != user[0] {
+		t.Fatalf("unexpected conns tagged room1: %v", tagged)
+	}
+	if tags := user[0].Tags(); !reflect.DeepEqual(tags, []string{"admin", "room1"}) {
+		t.Fatalf("got tags %v", tags)
+	}
+
+	user[0].Close()
+	if len(srv.ConnPool.ByTag("room1")) != 0 {
+		t.Fatal("expected closed conn removed from tag index")
+	}
+	if len(srv.ConnPool.ByKey("user1")) != 0 || len(srv.ConnPool.ByPath("/b")) != 0 {
+		t.Fatal("expected closed conn removed from indexes")
+	}
+}
+
+func TestSampler(t *testing.T) {
+	var nilSampler *Sampler
+	if !nilSampler.Sample() {
+		t.Fatal("expected nil sampler to keep all")
+	}
+
+	s := NewSampler(3, 0)
+	kept := 0
+	for i := 0; i < 9; i++ {
+		if s.Sample() {
+			kept++
+		}
+	}
+	if kept != 3 || s.Dropped() != 6 {
+		t.Fatalf("got %d kept, %d dropped; want 3, 6", kept, s.Dropped())
+	}
+
+	s.SetEvery(0)
+	s.SetRate(2)
+	kept = 0
+	for i := 0; i < 5; i++ {
+		if s.Sample() {
+			kept++
+		}
+	}
+	// the second may tick over in between
+	if kept < 2 || kept > 4 {
+		t.Fatalf("got %d kept under rate 2", kept)
+	}
+}
+
+func TestFrameString(t *testing.T) {
+	cases := []struct {
+		f    *Frame
+		want string
+	}{
+		{&Frame{FIN: 1, Opcode: OpcodeText, PayloadData: []byte("hi")}, `fin=1 rsv=000 op=text mask=0 len=2 "hi"`},
+		{&Frame{Opcode: OpcodeBinary, MASK: 1, MaskingKey: 0xa1b2c3d4, PayloadData: []byte{1, 2}}, "fin=0 rsv=000 op=binary mask=1 key=a1b2c3d4 len=2 0102"},
+		{MakeCloseFrame(CloseCodeGoingAway, "bye", false), `fin=1 rsv=000 op=close mask=0 len=5 code=1001 "bye"`},
+		{&Frame{FIN: 1, RSV1: 1, Opcode: 0x3}, "fin=1 rsv=100 op=0x3 mask=0 len=0"},
+		{&Frame{FIN: 1, Opcode: OpcodeText, PayloadData: bytes.Repeat([]byte("a"), 70)}, `fin=1 rsv=000 op=text mask=0 len=70 "` + strings.Repeat("a", 64) + `"...`},
+	}
+
+	for _, c := range cases {
+		if got := c.f.String(); got != c.want {
+			t.Errorf("got %s; want %s", got, c.want)
+		}
+	}
+}
+
+func TestTraceFrames(t *testing.T) {
+	var mu sync.Mutex
+	var in, out []string
+	trace := func(dst *[]string) func(*Conn, *Frame) {
+		return func(c *Conn, f *Frame) {
+			mu.Lock()
+			*dst = append(*dst, f.String())
+			mu.Unlock()
+		}
+	}
+
+	srv := NewServer()
+	srv.ApplyDefaultCfg()
+	srv.TraceFrameIn = trace(&in)
+	srv.TraceFrameOut = trace(&out)
+
+	done := make(chan struct{})
+	srv.OnConnOpenFunc("/echo", func(r MessageReceiver, s MessageSender) {
+		defer close(done)
+		for msg := range r.Messages(0) {
+			if msg.IsClose() {
+				s.SendClose(CloseCodeNormalClosure, "", false, false)
+				return
+			}
+			s.SendWhole(msg, false)
+		}
+	})
+	url := listenTestServer(t, srv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c, err := Dial(ctx, url+"/echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := (&DefaultMessageReceiver{}).SetConn(c)
+	s := (&DefaultMessageSender{}).SetConn(c)
+	s.SendWholeBytes([]byte("hi"), false)
+	r.ReadWhole(0)
+	s.SendClose(CloseCodeNormalClosure, "", false, false)
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(in) != 2 || !strings.HasPrefix(in[0], "fin=1 rsv=000 op=text mask=1 key=") ||
+		!strings.HasSuffix(in[0], ` len=2 "hi"`) || !strings.Contains(in[1], "op=close") {
+		t.Fatalf("unexpected frames in: %q", in)
+	}
+	want := []string{`fin=1 rsv=000 op=text mask=0 len=2 "hi"`, "fin=1 rsv=000 op=close mask=0 len=2 code=1000"}
+	if !reflect.DeepEqual(out, want) {
+		t.Fatalf("got frames out %q; want %q", out, want)
+	}
+}
+
+func TestCaptureReplay(t *testing.T) {
+	echo := func(r MessageReceiver, s MessageSender) {
+		for msg, err := range r.Messages(0) {
+			if err != nil {
+				return
+			}
+			if msg.IsClose() {
+				s.SendClose(CloseCodeNormalClosure, "", false, false)
+				return
+			}
+			s.SendWholeBytes(append([]byte("echo "), msg.Data...), false)
+		}
+	}
+
+	var capture bytes.Buffer
+	rec := NewRecorder(&capture)
+	done := make(chan struct{})
+
+	srv := NewServer()
+	srv.ApplyDefaultCfg()
+	srv.OnHandshakeComplete = func(c *Conn) { rec.Attach(c) }
+	srv.OnConnOpenFunc("/echo", func(r MessageReceiver, s MessageSender) {
+		defer close(done)
+		echo(r, s)
+	})
+	url := listenTestServer(t, srv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c, err := Dial(ctx, url+"/echo?room=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := (&DefaultMessageReceiver{}).SetConn(c)
+	s := (&DefaultMessageSender{}).SetConn(c)
+	for _, m := range []string{"a", "b"} {
+		s.SendWholeBytes([]byte(m), false)
+		r.ReadWhole(0)
+	}
+	s.SendClose(CloseCodeNormalClosure, "", false, false)
+	<-done
+
+	if rec.Err() != nil {
+		t.Fatal(rec.Err())
+	}
+
+	cr, err := NewCaptureReader(bytes.NewReader(capture.Bytes()))
+	if err != nil || cr.RequestURI != "/echo?room=1" {
+		t.Fatalf("got %v, %v", cr, err)
+	}
+
+	var got []string
+	for {
+		cf, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, cf.Dir.String()+" "+cf.Frame.String())
+	}
+	want := []string{
+		`in fin=1 rsv=000 op=text mask=0 len=1 "a"`,
+		`out fin=1 rsv=000 op=text mask=0 len=6 "echo a"`,
+		`in fin=1 rsv=000 op=text mask=0 len=1 "b"`,
+		`out fin=1 rsv=000 op=text mask=0 len=6 "echo b"`,
+		"in fin=1 rsv=000 op=close mask=0 len=2 code=1000",
+		"out fin=1 rsv=000 op=close mask=0 len=2 code=1000",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got capture %q; want %q", got, want)
+	}
+
+	// the session is replayed into a new handler
+	replaySrv := NewServer()
+	replaySrv.ApplyDefaultCfg()
+	replaySrv.OnConnOpenFunc("/echo", echo)
+
+	out, err := Replay(ctx, replaySrv, bytes.NewReader(capture.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = got[:0]
+	for _, cf := range out {
+		got = append(got, cf.Frame.String())
+	}
+	want = []string{
+		`fin=1 rsv=000 op=text mask=0 len=6 "echo a"`,
+		`fin=1 rsv=000 op=text mask=0 len=6 "echo b"`,
+		"fin=1 rsv=000 op=close mask=0 len=2 code=1000",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got replay %q; want %q", got, want)
+	}
+
+	if _, err := NewCaptureReader(strings.NewReader("nope")); err != ErrBadCapture {
+		t.Fatalf("got %v; want ErrBadCapture", err)
+	}
+}
+
+type testSpan struct {
+	name   string
+	parent string
+	attrs  map[string]any
+	err    error
+	ended  bool
+}
+
+func (s *testSpan) SetAttributes(attrs ...Attr) {
+	for _, a := range attrs {
+		s.attrs[a.Key] = a.Value
+	}
+}
+
+func (s *testSpan) RecordError(err error) { s.err = err }
+func (s *testSpan) End()                  { s.ended = true }
+
+type testSpanKey struct{}
+
+type testTracer struct {
+	mu    sync.Mutex
+	spans []*testSpan
+}
+
+func (tr *testTracer) Start(ctx context.Context, name string, attrs ...Attr) (context.Context, Span) {
+	s := &testSpan{name: name, attrs: make(map[string]any)}
+	if p, ok := ctx.Value(testSpanKey{}).(*testSpan); ok {
+		s.parent = p.name
+	} else if tc, ok := TraceContextFromContext(ctx); ok {
+		s.parent = hex.EncodeToString(tc.SpanID[:])
+	}
+	s.SetAttributes(attrs...)
+
+	tr.mu.Lock()
+	tr.spans = append(tr.spans, s)
+	tr.mu.Unlock()
+	return context.WithValue(ctx, testSpanKey{}, s), s
+}
+
+func TestTracer(t *testing.T) {
+	if _, ok := ParseTraceParent("00-00000000000000000000000000000000-00f067aa0ba902b7-01"); ok {
+		t.Fatal("expected the zero trace id rejected")
+	}
+
+	tracer := &testTracer{}
+	srv := NewServer()
+	srv.ApplyDefaultCfg()
+	srv.Tracer = tracer
+
+	done := make(chan struct{})
+	srv.OnConnOpenFunc("/traced", func(r MessageReceiver, s MessageSender) {
+		defer close(done)
+
+		// the handlers trace under the conn span
+		_, span := tracer.Start(s.GetConn().Context(), "handler")
+		span.End()
+
+		for msg, err := range r.Messages(0) {
+			if err != nil {
+				return
+			}
+			if msg.IsClose() {
+				s.SendClose(CloseCodeNormalClosure, "", false, false)
+			}
+		}
+	})
+	url := listenTestServer(t, srv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	d := &Dialer{Header: http.Header{
+		"traceparent": {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+	}}
+	c, err := d.Dial(ctx, url+"/traced")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := (&DefaultMessageSender{}).SetConn(c)
+	s.SendWholeBytes([]byte("hello"), false)
+	s.SendClose(CloseCodeNormalClosure, "", false, false)
+	<-done
+
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+
+	var got []string
+	for _, sp := range tracer.spans {
+		if !sp.ended {
+			t.Errorf("span %s not ended", sp.name)
+		}
+		got = append(got, sp.name+"<"+sp.parent)
+	}
+	want := []string{
+		"kiwi.handshake<00f067aa0ba902b7",
+		"kiwi.conn<00f067aa0ba902b7",
+		"handler<kiwi.conn",
+		"kiwi.message<kiwi.conn",
+		"kiwi.message<kiwi.conn",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got spans %q; want %q", got, want)
+	}
+
+	hs, conn, msg := tracer.spans[0], tracer.spans[1], tracer.spans[3]
+	if hs.attrs["url.path"] != "/traced" || hs.attrs["http.response.status_code"] != http.StatusSwitchingProtocols {
+		t.Errorf("unexpected handshake attrs: %v", hs.attrs)
+	}
+	if conn.attrs["websocket.close.code"] != int(CloseCodeNormalClosure) {
+		t.Errorf("unexpected conn attrs: %v", conn.attrs)
+	}
+	if msg.attrs["websocket.opcode"] != "text" || msg.attrs["websocket.message.size"] != 5 {
+		t.Errorf("unexpected message attrs: %v", msg.attrs)
+	}
+}
+
+type lockedBuffer struct {
+	mu sync.Mutex
+	bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.Buffer.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.Buffer.String()
+}
+
+func TestAccessLog(t *testing.T) {
+	e := &AccessLogEntry{
+		Time:        time.Date(2026, 10, 17, 10, 0, 0, 0, time.UTC),
+		RemoteAddr:  "127.0.0.1:5000",
+		Method:      "GET",
+		Path:        "/chat",
+		Proto:       "HTTP/1.1",
+		Status:      101,
+		Subprotocol: "chat.v2",
+		Duration:    5 * time.Second,
+		BytesIn:     96,
+		BytesOut:    2326,
+		CloseCode:   1000,
+	}
+	var clf bytes.Buffer
+	NewAccessLog(&clf, AccessLogCommon).Log(e)
+	if want := `127.0.0.1:5000 - - [17/Oct/2026:10:00:00 +0000] "GET /chat HTTP/1.1" 101 2326 96 5000 1000 "chat.v2"` + "\n"; clf.String() != want {
+		t.Fatalf("got %q; want %q", clf.String(), want)
+	}
+
+	var out lockedBuffer
+	srv := NewServer()
+	srv.ApplyDefaultCfg()
+	srv.AccessLog = NewAccessLog(&out, AccessLogJSON)
+
+	done := make(chan struct{})
+	srv.OnHandshakeRequestFunc("/chat", func(hsReq *HandshakeRequest, conn *Conn) (int, error) {
+		conn.SetSubprotocol("chat.v2")
+		return DefaultServerHandshakeFunc(hsReq, conn)
+	})
+	srv.OnConnOpenFunc("/chat", func(r MessageReceiver, s MessageSender) {
+		defer close(done)
+		for msg, err := range r.Messages(0) {
+			if err != nil {
+				return
+			}
+			if msg.IsClose() {
+				s.SendClose(CloseCodeNormalClosure, "", false, false)
+			}
+		}
+	})
+	url := listenTestServer(t, srv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := Dial(ctx, url+"/missing"); err == nil {
+		t.Fatal("expected the handshake to fail")
+	}
+
+	c, err := Dial(ctx, url+"/chat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := (&DefaultMessageSender{}).SetConn(c)
+	s.SendWholeBytes([]byte("hello"), false)
+	s.SendClose(CloseCodeNormalClosure, "", false, false)
+	<-done
+
+	var entries []AccessLogEntry
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var e AccessLogEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries; want 2", len(entries))
+	}
+
+	failed, closed := entries[0], entries[1]
+	if failed.Path != "/missing" || failed.Status != http.StatusNotFound || failed.Error == "" {
+		t.Errorf("unexpected failed entry: %+v", failed)
+	}
+	// "hello" and the close frame with the code, both masked
+	if closed.Path != "/chat" || closed.Status != http.StatusSwitchingProtocols || closed.Subprotocol != "chat.v2" ||
+		closed.CloseCode != CloseCodeNormalClosure || closed.BytesIn != 6+5+6+2 || closed.BytesOut != 4 || closed.Duration <= 0 {
+		t.Errorf("unexpected closed entry: %+v", closed)
+	}
+}
+
+func TestServerOptions(t *testing.T) {
+	if err := (&Server{}).Validate(); !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("got %v; want ErrInvalidConfig for the missing routers", err)
+	}
+	if err := NewServer(WithAddr("bad:addr:1")).ListenAndServe(); !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("got %v; want ErrInvalidConfig for the addr", err)
+	}
+	if err := NewServer(WithTLSConfig(&tls.Config{})).Validate(); !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("got %v; want ErrInvalidConfig for the certificate", err)
+	}
+
+	var logs lockedBuffer
+	srv := NewServer(
+		WithAddr("127.0.0.1:0"),
+		WithLimits(Limits{MaxMessageBytes: 10}),
+		WithHandshakeTimeout(50*time.Millisecond),
+		WithLogger(log.New(&logs, "", 0)),
+	)
+	if err := srv.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if srv.MaxMessageBytes != 10 || srv.MaxFramePayloadBytes != defaultMaxFramePayloadBytes || srv.Addr.Port != 0 {
+		t.Fatalf("unexpected config: %+v", srv)
+	}
+
+	// the routers are set without ApplyDefaultCfg
+	srv.OnConnOpenFunc("/", func(r MessageReceiver, s MessageSender) {})
+	url := listenTestServer(t, srv)
+
+	// a conn sending no handshake is closed by the timeout
+	cn, err := net.Dial("tcp", strings.TrimPrefix(url, "ws://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cn.Close()
+	cn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	io.Copy(io.Discard, cn)
+
+	if !strings.Contains(logs.String(), "[Handshake]") {
+		t.Fatalf("got logs %q; want the handshake failure", logs.String())
+	}
+}
+
+func TestParseYAML(t *testing.T) {
+	v, err := parseYAML([]byte(`
+# server
+addr: ":8080"   # inline comment
+limits:
+  max: 1024
+  ratio: 0.5
+origins:
+  - https://a.example
+  - 'it''s'
+empty:
+flow: [1, "two #2", true]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"addr":    ":8080",
+		"limits":  map[string]any{"max": int64(1024), "ratio": 0.5},
+		"origins": []any{"https://a.example", "it's"},
+		"empty":   nil,
+		"flow":    []any{int64(1), "two #2", true},
+	}
+	if !reflect.DeepEqual(v, want) {
+		t.Fatalf("got %#v; want %#v", v, want)
+	}
+
+	for _, bad := range []string{"a: 1\n   b: 2", "a: &x 1", "a: 1\na: 2", "\ta: 1"} {
+		if _, err := parseYAML([]byte(bad)); err == nil {
+			t.Errorf("expected %q rejected", bad)
+		}
+	}
+}
+
+func TestConfigLoader(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "kiwi.yaml")
+	write := func(s string) {
+		if err := os.WriteFile(path, []byte(s), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`
+addr: 127.0.0.1:0
+max_message_bytes: 4096
+handshake_timeout: 2s
+allowed_origins: [https://*.example.com]
+handshake_rate: 0.001
+handshake_burst: 2
+`)
+
+	var logs lockedBuffer
+	srv := NewServer(WithLogger(log.New(&logs, "", 0)))
+	l, err := NewConfigLoader(path, srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srv.MaxMessageBytes != 4096 || srv.HandshakeTimeout != 2*time.Second || srv.MaxFramePayloadBytes != defaultMaxFramePayloadBytes {
+		t.Fatalf("unexpected config: %+v", srv)
+	}
+
+	srv.OnConnOpenFunc("/", func(r MessageReceiver, s MessageSender) {})
+	url := listenTestServer(t, srv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	status := func(origin string) int {
+		d := &Dialer{Header: http.Header{"Origin": {origin}}}
+		c, err := d.Dial(ctx, url+"/")
+		if err != nil {
+			var he *HandshakeError
+			if !errors.As(err, &he) {
+				t.Fatal(err)
+			}
+			return he.Status
+		}
+		c.Close()
+		return http.StatusSwitchingProtocols
+	}
+
+	if got := status("https://evil.test"); got != http.StatusForbidden {
+		t.Fatalf("got %d; want 403 for the origin", got)
+	}
+	if got := status("https://app.example.com"); got != http.StatusSwitchingProtocols {
+		t.Fatalf("got %d; want 101", got)
+	}
+	// the burst of 2 is used up
+	if got := status("https://app.example.com"); got != http.StatusTooManyRequests {
+		t.Fatalf("got %d; want 429", got)
+	}
+
+	write(`{"addr": "127.0.0.1:1", "allowed_origins": ["https://evil.test"]}`)
+	if err := l.Reload(); err == nil {
+		t.Fatal("expected the JSON in a .yaml file rejected")
+	}
+
+	write(`
+addr: 127.0.0.1:1
+allowed_origins: [https://evil.test]
+`)
+	if err := l.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := status("https://evil.test"); got != http.StatusSwitchingProtocols {
+		t.Fatalf("got %d; want 101 after the reload", got)
+	}
+	if !strings.Contains(logs.String(), "applied on restart only") {
+		t.Fatalf("got logs %q; want the restart notice", logs.String())
+	}
+
+	write("deny_cidrs: [not-an-ip]")
+	if err := l.Reload(); !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("got %v; want ErrInvalidConfig", err)
+	}
+	if l.Config().AllowedOrigins[0] != "https://evil.test" {
+		t.Fatal("expected the config in use kept")
+	}
+}
+
+func TestSendByteCounts(t *testing.T) {
+	conn, peer := newTestConn()
+	defer peer.Close()
+	go io.Copy(io.Discard, peer)
+
+	s := (&DefaultMessageSender{}).SetConn(conn)
+
+	n, err := s.SendWhole(&Message{Opcode: OpcodeBinary, Data: make([]byte, 200)}, true)
+	if err != nil || n != 200 {
+		t.Fatalf("got %d, %v; want 200 payload bytes", n, err)
+	}
+
+	n, err = s.SendFrameWithReader(bufio.NewReader(strings.NewReader("hello world")), OpcodeText, 4, false)
+	if err != nil || n != 11 {
+		t.Fatalf("got %d, %v; want 11 payload bytes", n, err)
+	}
+
+	// 2+2+4 header bytes of the masked frame, 2 of each of the 3 fragments
+	want := SendStats{PayloadBytes: 211, WireBytes: 211 + 8 + 6}
+	if st := conn.SendStats(); st != want {
+		t.Fatalf("got %+v; want %+v", st, want)
+	}
+
+	peer.Close()
+	n, err = s.SendWhole(&Message{Opcode: OpcodeText, Data: []byte("lost")}, false)
+	if err == nil || n != 0 {
+		t.Fatalf("got %d, %v; want 0 payload bytes and an error", n, err)
+	}
+}
+
+// eofReader returns its last data with io.EOF.
+type eofReader struct{ data []byte }
+
+func (r *eofReader) Read(p []byte) (int, error) {
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	if len(r.data) == 0 {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func TestSendFrameWithReader(t *testing.T) {
+	conn, peer := newTestConn()
+	defer peer.Close()
+	s := (&DefaultMessageSender{}).SetConn(conn)
+
+	tests := []struct {
+		r      io.Reader
+		frames []string
+	}{
+		{&eofReader{[]byte("hello world")}, []string{"hell", "o wo", "rld"}},
+		{strings.NewReader("hellowor"), []string{"hell", "owor"}},
+		{&eofReader{[]byte("hi")}, []string{"hi"}},
+		{strings.NewReader(""), []string{""}},
+	}
+	br := bufio.NewReader(peer)
+	for _, tt := range tests {
+		done := make(chan error, 1)
+		go func() {
+			n, err := s.SendFrameWithReader(tt.r, OpcodeBinary, 4, false)
+			if err == nil && n != len(strings.Join(tt.frames, "")) {
+				err = fmt.Errorf("got %d payload bytes", n)
+			}
+			done <- err
+		}()
+
+		for i, want := range tt.frames {
+			f := &Frame{}
+			if err := f.FromBufReader(br, 1<<10); err != nil {
+				t.Fatal(err)
+			}
+			opcode, fin := uint8(OpcodeContinue), uint8(0)
+			if i == 0 {
+				opcode = OpcodeBinary
+			}
+			if i == len(tt.frames)-1 {
+				fin = 1
+			}
+			if string(f.PayloadData) != want || f.Opcode != opcode || f.FIN != fin {
+				t.Fatalf("got %v; want %q of opcode %d and fin %d", f, want, opcode, fin)
+			}
+		}
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := s.SendFrameWithReader(strings.NewReader("x"), OpcodeBinary, 0, false); err != ErrInvalidFrameSize {
+		t.Fatalf("got %v; want ErrInvalidFrameSize", err)
+	}
+}
+
+func TestSendWholeWithReader(t *testing.T) {
+	conn, peer := newTestConn()
+	defer peer.Close()
+	s := (&DefaultMessageSender{}).SetConn(conn)
+
+	big := make([]byte, 100<<10)
+	for i := range big {
+		big[i] = byte(i % 251)
+	}
+	br := bufio.NewReader(peer)
+	for _, data := range [][]byte{[]byte("hello"), big, {}} {
+		go s.SendWholeWithReader(bytes.NewReader(data), OpcodeBinary, false)
+
+		var got []byte
+		frames := 0
+		for {
+			f := &Frame{}
+			if err := f.FromBufReader(br, 1<<20); err != nil {
+				t.Fatal(err)
+			}
+			if frames == 0 && f.Opcode != OpcodeBinary {
+				t.Fatalf("got opcode %d; want binary", f.Opcode)
+			}
+			frames++
+			got = append(got, f.PayloadData...)
+			if f.FIN == 1 {
+				break
+			}
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("got %d bytes; want the %d bytes sent", len(got), len(data))
+		}
+		if want := max(1, (len(data)+readerFrameSize-1)/readerFrameSize); frames != want {
+			t.Fatalf("got %d frames; want %d", frames, want)
+		}
+	}
+}
+
+func TestSendWholeWithReaderFailure(t *testing.T) {
+	conn, peer := newTestConn()
+	defer peer.Close()
+	s := (&DefaultMessageSender{}).SetConn(conn)
+
+	// the read fails in the second frame, after the first one is sent
+	r := io.MultiReader(bytes.NewReader(make([]byte, 70<<10)), &errReader{errors.New("boom")})
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.SendWholeWithReader(r, OpcodeBinary, false)
+		done <- err
+	}()
+
+	br := bufio.NewReader(peer)
+	f := &Frame{}
+	if err := f.FromBufReader(br, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	if f.FIN != 0 || f.Opcode != OpcodeBinary {
+		t.Fatalf("got %v; want the first frame of the message", f)
+	}
+	if code := readTestCloseCode(t, br); code != CloseCodeInternalServerError {
+		t.Fatalf("got close code %d; want %d", code, CloseCodeInternalServerError)
+	}
+	if err := <-done; err == nil || err.Error() != "boom" {
+		t.Fatalf("got %v; want the read error", err)
+	}
+	if err := conn.Send(&Message{Opcode: OpcodeText, Data: []byte("late")}); err == nil {
+		t.Fatal("sent a message after the unfinished one")
+	}
+}
+
+type errReader struct{ err error }
+
+func (r *errReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+func TestSendersNotInterleaved(t *testing.T) {
+	conn, peer := newTestConn()
+	defer peer.Close()
+	s := (&DefaultMessageSender{}).SetConn(conn)
+
+	pr, pw := io.Pipe()
+	go s.SendWholeWithReader(pr, OpcodeBinary, false)
+	go pw.Write(make([]byte, 2*readerFrameSize))
+
+	br := bufio.NewReader(peer)
+	f := &Frame{}
+	if err := f.FromBufReader(br, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	if f.FIN != 0 {
+		t.Fatalf("got %v; want the first frame of the message", f)
+	}
+
+	// the senders of the conn wait for the rest of the message
+	if !conn.TrySend(&Message{Opcode: OpcodeText, Data: []byte("queued")}) {
+		t.Fatal("TrySend failed")
+	}
+	sent := make(chan error, 1)
+	go func() {
+		sent <- conn.Send(&Message{Opcode: OpcodeText, Data: []byte("sent")})
+	}()
+	time.Sleep(20 * time.Millisecond)
+	pw.Close()
+
+	if err := f.FromBufReader(br, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	if f.FIN != 1 || f.Opcode != OpcodeContinue {
+		t.Fatalf("got %v; want the last frame of the message", f)
+	}
+	for i := 0; i < 2; i++ {
+		if err := f.FromBufReader(br, 1<<20); err != nil {
+			t.Fatal(err)
+		}
+		if f.Opcode != OpcodeText || f.FIN != 1 {
+			t.Fatalf("got %v; want a whole text message", f)
+		}
+	}
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	srv := NewServer()
+	srv.ApplyDefaultCfg()
+
+	events := make(chan *Event, 16)
+	srv.Events = EventChan(events)
+
+	srv.OnConnOpenFunc("/echo", func(r MessageReceiver, s MessageSender) {
+		for msg := range r.Messages(0) {
+			if msg.IsClose() {
+				s.SendClose(CloseCodeNormalClosure, "", false, false)
+			}
+		}
+	})
+
+	cc, br := dialTestConn(t, srv, "/echo")
+	defer cc.Close()
+
+	writeTestFrames(cc,
+		&Frame{FIN: 1, Opcode: OpcodeText, PayloadData: []byte("hi")},
+		MakeCloseFrame(CloseCodeNormalClosure, "", false),
+	)
+	io.Copy(io.Discard, br)
+
+	var got []EventType
+	for len(got) < 5 {
+		e := <-events
+		got = append(got, e.Type)
+
+		if e.Path != "/echo" && e.Type != EventConnAccepted {
+			t.Fatalf("unexpected path of %s: %q", e.Type, e.Path)
+		}
+		if e.Type == EventMessageRead && e.DataLen != 2 && e.Opcode != OpcodeClose {
+			t.Fatalf("unexpected message event: %+v", e)
+		}
+		if e.Type == EventConnClosed && e.Outcome != OutcomeNormal {
+			t.Fatalf("unexpected close event: %+v", e)
+		}
+	}
+
+	want := []EventType{EventConnAccepted, EventConnOpened, EventMessageRead, EventMessageRead, EventConnClosed}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got events %v; want %v", got, want)
+	}
+}
+
+func TestAcceptAndHandshakeHooks(t *testing.T) {
+	srv := NewServer()
+	srv.ApplyDefaultCfg()
+
+	var allow atomic.Bool
+	srv.OnConnAccept = func(cn net.Conn) bool {
+		return allow.Load()
+	}
+
+	completed := make(chan string, 1)
+	srv.OnHandshakeComplete = func(c *Conn) {
+		completed <- c.HandshakeRequest.RequestURL.Path
+	}
+	srv.OnConnOpenFunc("/echo", func(r MessageReceiver, s MessageSender) {
+		for range r.Messages(0) {
+		}
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go srv.Serve(ln)
+
+	for _, ok := range []bool{false, true} {
+		allow.Store(ok)
+
+		cn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cn.Close()
+		cn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		io.WriteString(cn, "GET /echo HTTP/1.1\r\nHost: localhost\r\n"+
+			"Connection: Upgrade\r\nUpgrade: websocket\r\n"+
+			"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: M/A=\r\n\r\n")
+		_, err = http.ReadResponse(bufio.NewReader(cn), nil)
+
+		if !ok {
+			if err == nil {
+				t.Fatal("expected the conn to be rejected")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if path := <-completed; path != "/echo" {
+			t.Fatalf("got completed handshake of %q", path)
+		}
+	}
+}
+
+func TestAccessList(t *testing.T) {
+	al, err := NewAccessList([]string{"10.0.0.0/8", "::1"}, []string{"10.1.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addrs := map[string]bool{
+		"10.2.3.4":        true,
+		"10.1.2.3":        false,
+		"::ffff:10.2.3.4": true,
+		"::1":             true,
+		"192.168.0.1":     false,
+	}
+	for s, want := range addrs {
+		if got := al.Allowed(netip.MustParseAddr(s)); got != want {
+			t.Errorf("%s: got %v; want %v", s, got, want)
+		}
+	}
+
+	if err := al.Update([]string{"bogus"}, nil); err == nil {
+		t.Fatal("expected invalid cidr error")
+	}
+	if al.Allowed(netip.MustParseAddr("192.168.0.1")) {
+		t.Fatal("expected the lists kept after a failed update")
+	}
+
+	al.Update(nil, []string{"10.0.0.0/8"})
+	if !al.Allowed(netip.MustParseAddr("192.168.0.1")) || al.Allowed(netip.MustParseAddr("10.2.3.4")) {
+		t.Fatal("expected the reloaded lists applied")
+	}
+}
+
+func TestStrictMode(t *testing.T) {
+	masked := func(f *Frame) []byte {
+		b, _ := f.ToBytes(true)
+		return b
+	}
+	unmasked := func(f *Frame) []byte {
+		b, _ := f.ToBytes(false)
+		return b
+	}
+
+	cases := []struct {
+		name   string
+		frames [][]byte
+		code   uint16
+	}{
+		{"unmasked", [][]byte{unmasked(&Frame{FIN: 1, Opcode: OpcodeText, PayloadData: []byte("hi")})}, CloseCodeProtocolError},
+		{"rsv", [][]byte{masked(&Frame{FIN: 1, RSV1: 1, Opcode: OpcodeText})}, CloseCodeProtocolError},
+		{"utf8", [][]byte{masked(&Frame{FIN: 1, Opcode: OpcodeText, PayloadData: []byte{0xff}})}, CloseCodeInvalidFramePayloadData},
+		{"continuation", [][]byte{masked(&Frame{FIN: 1, Opcode: OpcodeContinue})}, CloseCodeProtocolError},
+		{"fragmented ping", [][]byte{masked(&Frame{FIN: 0, Opcode: OpcodePing})}, CloseCodeProtocolError},
+		{"close code", [][]byte{masked(&Frame{FIN: 1, Opcode: OpcodeClose, PayloadData: AppendCloseCode(nil, 1005)})}, CloseCodeProtocolError},
+		{"interleaved", [][]byte{
+			masked(&Frame{FIN: 0, Opcode: OpcodeText, PayloadData: []byte("a")}),
+			masked(&Frame{FIN: 1, Opcode: OpcodeBinary, PayloadData: []byte("b")}),
+		}, CloseCodeProtocolError},
+	}
+
+	for _, c := range cases {
+		conn, peer := newTestConn()
+		conn.Server.Strict = true
+
+		go func() {
+			for _, b := range c.frames {
+				peer.Write(b)
+			}
+		}()
+
+		r := (&DefaultMessageReceiver{}).SetConn(conn)
+		done := make(chan uint16)
+		go func() { done <- readTestCloseCode(t, peer) }()
+
+		if _, err := r.ReadWhole(0); err == nil {
+			t.Fatalf("%s: expected error", c.name)
+		}
+		if code := <-done; code != c.code {
+			t.Fatalf("%s: got close code %d; want %d", c.name, code, c.code)
+		}
+		peer.Close()
+	}
+
+	// control frames in the middle of a fragmented message are answered
+	conn, peer := newTestConn()
+	defer peer.Close()
+	conn.Server.Strict = true
+
+	go func() {
+		peer.Write(masked(&Frame{FIN: 0, Opcode: OpcodeText, PayloadData: []byte("hel")}))
+		peer.Write(masked(&Frame{FIN: 1, Opcode: OpcodePing, PayloadData: []byte("p")}))
+		peer.Write(masked(&Frame{FIN: 1, Opcode: OpcodeContinue, PayloadData: []byte("lo")}))
+	}()
+
+	pong := make(chan *Frame)
+	go func() {
+		f := &Frame{}
+		f.FromBufReader(peer, 1<<10)
+		pong <- f
+	}()
+
+	r := (&DefaultMessageReceiver{}).SetConn(conn)
+	msg, err := r.ReadWhole(0)
+	if err != nil || string(msg.Data) != "hello" {
+		t.Fatalf("got %v, %v; want hello", msg, err)
+	}
+	if f := <-pong; f.Opcode != OpcodePong || string(f.PayloadData) != "p" {
+		t.Fatalf("got frame %d %q; want pong", f.Opcode, f.PayloadData)
+	}
+}
+
+func TestProtocolMode(t *testing.T) {
+	legacy := "GET /echo HTTP/1.0\r\nconnection: keep-alive, upgrade\r\nupgrade: WebSocket\r\n" +
+		"sec-websocket-version: 13\r\nsec-websocket-key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n"
+	post := "POST /echo HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n" +
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n"
+	shortKey := "GET /echo HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n" +
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: M/A=\r\n\r\n"
+
+	cases := []struct {
+		mode ProtocolMode
+		req  string
+		want int
+	}{
+		{ProtocolDefault, legacy, http.StatusUpgradeRequired},
+		{ProtocolLenient, legacy, http.StatusSwitchingProtocols},
+		{ProtocolStrict, legacy, http.StatusUpgradeRequired},
+		{ProtocolDefault, post, http.StatusSwitchingProtocols},
+		{ProtocolStrict, post, http.StatusBadRequest},
+		{ProtocolDefault, shortKey, http.StatusSwitchingProtocols},
+		{ProtocolStrict, shortKey, http.StatusBadRequest},
+	}
+	for i, c := range cases {
+		srv := NewServer()
+		srv.ApplyDefaultCfg()
+		srv.Mode = c.mode
+		srv.OnConnOpenFunc("/echo", func(r MessageReceiver, s MessageSender) {})
+
+		resp, err := serveTestRequest(srv, c.req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != c.want {
+			t.Fatalf("%d: got status %d; want %d", i, resp.StatusCode, c.want)
+		}
+	}
+
+	// an invalid close payload is taken as no status
+	conn, peer := newTestConn()
+	conn.Server.Mode = ProtocolLenient
+	go writeTestFrames(peer, &Frame{FIN: 1, Opcode: OpcodeClose, PayloadData: []byte{3}})
+	msg, err := (&DefaultMessageReceiver{}).SetConn(conn).ReadWhole(0)
+	if err != nil || msg.CloseError().Code != CloseCodeNoStatusRcvd {
+		t.Fatalf("got %v, %v; want the close", msg, err)
+	}
+	peer.Close()
+
+	// the frames of a server must not be masked
+	conn, peer = newTestConn()
+	defer peer.Close()
+	conn.client = true
+	conn.Server.Mode = ProtocolStrict
+	go func() {
+		b, _ := (&Frame{FIN: 1, Opcode: OpcodeText, PayloadData: []byte("hi")}).ToBytes(true)
+		peer.Write(b)
+		io.Copy(io.Discard, peer)
+	}()
+	if _, err := (&DefaultMessageReceiver{}).SetConn(conn).ReadWhole(0); !errors.Is(err, ErrMaskedFrame) {
+		t.Fatalf("got %v; want ErrMaskedFrame", err)
+	}
+}
+
+func TestCloseError(t *testing.T) {
+	conn, peer := newTestConn()
+	defer peer.Close()
+
+	go writeTestFrames(peer, MakeCloseFrame(CloseCodeGoingAway, "bye", false))
+
+	r := (&DefaultMessageReceiver{}).SetConn(conn)
+	msg, err := r.ReadWhole(0)
+	if err != nil || !msg.IsClose() {
+		t.Fatalf("got %v, %v; want the close message", msg, err)
+	}
+	if ce := msg.CloseError(); ce.Code != CloseCodeGoingAway || ce.Reason != "bye" {
+		t.Fatalf("unexpected close error: %+v", ce)
+	}
+
+	_, err = r.ReadWhole(0)
+	var ce *CloseError
+	if !errors.As(err, &ce) || ce.Code != CloseCodeGoingAway || !errors.Is(err, ErrConnIsNotOpen) {
+		t.Fatalf("got %v; want the close error", err)
+	}
+
+	invalid := []struct {
+		payload []byte
+		code    uint16
+	}{
+		{[]byte{0x03}, CloseCodeProtocolError},
+		{AppendCloseCode(nil, 999), CloseCodeProtocolError},
+		{AppendCloseCode(nil, CloseCodeAbnormalClosure), CloseCodeProtocolError},
+		{append(AppendCloseCode(nil, CloseCodeNormalClosure), 0xff), CloseCodeInvalidFramePayloadData},
+	}
+	for _, c := range invalid {
+		conn, peer := newTestConn()
+		go writeTestFrames(peer, &Frame{FIN: 1, Opcode: OpcodeClose, PayloadData: c.payload})
+
+		done := make(chan uint16)
+		go func() { done <- readTestCloseCode(t, peer) }()
+
+		r := (&DefaultMessageReceiver{}).SetConn(conn)
+		if _, err := r.ReadWhole(0); err == nil {
+			t.Fatalf("%v: expected error", c.payload)
+		}
+		if code := <-done; code != c.code {
+			t.Fatalf("%v: got close code %d; want %d", c.payload, code, c.code)
+		}
+		peer.Close()
+	}
+}
+
+func TestErrorTaxonomy(t *testing.T) {
+	conn, peer := newTestConn()
+	r := (&DefaultMessageReceiver{}).SetConn(conn)
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err := r.ReadWhole(0)
+	if !IsTimeout(err) || IsProtocolError(err) || !errors.Is(err, ErrDeformedFirstTwoBytes) {
+		t.Fatalf("got %v; want a timeout", err)
+	}
+
+	conn.SetReadDeadline(time.Time{})
+	peer.Close()
+	if _, err := r.ReadWhole(0); !IsPeerClosed(err) || IsTimeout(err) {
+		t.Fatalf("got %v; want peer closed", err)
+	}
+
+	f := &Frame{}
+	err = f.FromBufReader(bytes.NewReader([]byte{0x81, 0x7e, 0x01, 0x00}), 100)
+	var se *SizeError
+	if !errors.As(err, &se) || !errors.Is(err, ErrFrameTooLarge) || se.Size != 256 || se.Limit != 100 {
+		t.Fatalf("got %v; want frame of 256 over 100", err)
+	}
+
+	err = f.FromBufReader(bytes.NewReader([]byte{0x8f, 0x00}), 100)
+	if !IsProtocolError(err) || IsPeerClosed(err) {
+		t.Fatalf("got %v; want a protocol error", err)
+	}
+
+	srv := NewServer()
+	srv.ApplyDefaultCfg()
+	events := make(chan *Event, 4)
+	srv.Events = EventChan(events)
+
+	serveTestRequest(srv, "GET /missing HTTP/1.1\r\nHost: localhost\r\n"+
+		"Connection: Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: M/A=\r\n\r\n")
+
+	for e := range events {
+		if e.Type != EventHandshakeFailed {
+			continue
+		}
+		var he *HandshakeError
+		if !errors.As(e.Err, &he) || he.Status != http.StatusNotFound || !IsProtocolError(e.Err) {
+			t.Fatalf("got %v; want a 404 handshake error", e.Err)
+		}
+		break
+	}
+}
+
+func TestMakeCloseFrameTruncates(t *testing.T) {
+	for _, reason := range []string{
+		strings.Repeat("a", 200),
+		strings.Repeat("a", 122) + "é",
+		strings.Repeat("€", 50),
+	} {
+		f := MakeCloseFrame(CloseCodeNormalClosure, reason, false)
+		if len(f.PayloadData) > maxControlFramePayloadLen {
+			t.Fatalf("got a payload of %d bytes; want at most %d", len(f.PayloadData), maxControlFramePayloadLen)
+		}
+		if err := checkClosePayload(f.PayloadData); err != nil {
+			t.Fatalf("got %v for reason %q", err, f.PayloadData[2:])
+		}
+		if !strings.HasPrefix(reason, string(f.PayloadData[2:])) {
+			t.Fatalf("got reason %q; want a prefix of %q", f.PayloadData[2:], reason)
+		}
+	}
+
+	if got := TruncateCloseReason(strings.Repeat("a", 122) + "é"); got != strings.Repeat("a", 122) {
+		t.Fatalf("got %q; want the rune left out", got)
+	}
+	if got := TruncateCloseReason("short"); got != "short" {
+		t.Fatalf("got %q; want it as is", got)
+	}
+}
+
+func TestCloseOnce(t *testing.T) {
+	srv := NewServer()
+	srv.ApplyDefaultCfg()
+
+	var closes atomic.Int32
+	srv.OnConnCloseFunc("/echo", func(c *Conn) {
+		closes.Add(1)
+		// closing again from the handler is a no-op
+		c.Close()
+	})
+
+	opened := make(chan MessageSender)
+	srv.OnConnOpenFunc("/echo", func(r MessageReceiver, s MessageSender) {
+		opened <- s
+	})
+
+	cc, br := dialTestConn(t, srv, "/echo")
+	defer cc.Close()
+	s := <-opened
+	conn := s.GetConn()
+
+	frames := make(chan *Frame, 2)
+	go func() {
+		for {
+			f := &Frame{}
+			if f.FromBufReader(br, 1<<10) != nil {
+				close(frames)
+				return
+			}
+			frames <- f
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if i%2 == 0 {
+				s.SendClose(CloseCodeNormalClosure, "", false, false)
+			} else {
+				conn.CloseWithCode(CloseCodeGoingAway, "bye")
+			}
+		}()
+	}
+	wg.Wait()
+
+	n := 0
+	for f := range frames {
+		if f.Opcode != OpcodeClose {
+			t.Fatalf("got frame %d; want close", f.Opcode)
+		}
+		n++
+	}
+	if n != 1 || closes.Load() != 1 {
+		t.Fatalf("got %d close frames and %d OnConnClose calls; want 1 and 1", n, closes.Load())
+	}
+	if _, ok := srv.ConnPool.Get(conn.ID); ok {
+		t.Fatal("expected the conn removed from the pool")
+	}
+}
+
+func listenTestServer(t *testing.T, srv *Server) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go srv.Serve(ln)
+	return "ws://" + ln.Addr().String()
+}
+
+func TestDial(t *testing.T) {
+	srv := NewServer()
+	srv.ApplyDefaultCfg()
+	srv.OnConnOpenFunc("/echo", func(r MessageReceiver, s MessageSender) {
+		for msg := range r.Messages(0) {
+			if msg.IsClose() {
+				s.SendClose(CloseCodeNormalClosure, "", false, false)
+				return
+			}
+			s.SendWhole(msg, false)
+		}
+	})
+	url := listenTestServer(t, srv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := Dial(ctx, url+"/missing"); err == nil {
+		t.Fatal("expected the handshake to fail")
+	}
+
+	c, err := Dial(ctx, url+"/echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := (&DefaultMessageReceiver{}).SetConn(c)
+	s := (&DefaultMessageSender{}).SetConn(c)
+	s.SendWholeBytes([]byte("hello"), false)
+
+	if msg, err := r.ReadWhole(0); err != nil || string(msg.Data) != "hello" {
+		t.Fatalf("got %v, %v; want the echo", msg, err)
+	}
+
+	s.SendClose(CloseCodeNormalClosure, "", false, false)
+	if c.GetState() != StateClosed {
+		t.Fatal("expected the conn closed")
+	}
+}
+
+func TestVirtualHosts(t *testing.T) {
+	greet := func(name string) OnConnOpenFunc {
+		return func(r MessageReceiver, s MessageSender) {
+			c := s.GetConn()
+			s.SendWholeBytes([]byte(fmt.Sprintf("%s %d", name, c.Limits().MaxMessageBytes)), false)
+			for _, err := range r.Messages(0) {
+				if err != nil {
+					return
+				}
+			}
+		}
+	}
+
+	srv := NewServer()
+	srv.OnConnOpenFunc("/", greet("default"))
+
+	a := srv.Host("WS.A.example")
+	a.Limits.MaxMessageBytes = 100
+	a.Origins = NewOriginPolicy("https://a.example")
+	a.OnConnOpenFunc("/", greet("a"))
+	a.OnConnOpenFunc("/only-a", greet("a"))
+	if srv.Host("ws.a.example") != a {
+		t.Fatal("expected the same virtual host")
+	}
+
+	b := srv.Host("*.b.example")
+	b.SetLimits("/", Limits{MaxMessageBytes: 200})
+	b.OnConnOpenFunc("/", greet("b"))
+
+	url := listenTestServer(t, srv)
+	addr := strings.TrimPrefix(url, "ws://")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	d := &Dialer{
+		NetDialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}
+	dial := func(url, origin string) (string, error) {
+		d.Header = http.Header{"Origin": {origin}}
+		c, err := d.Dial(ctx, url)
+		if err != nil {
+			return "", err
+		}
+		defer c.Close()
+
+		msg, err := (&DefaultMessageReceiver{}).SetConn(c).ReadWhole(0)
+		if err != nil {
+			return "", err
+		}
+		return string(msg.Data), nil
+	}
+
+	for _, tc := range []struct{ url, origin, want string }{
+		{"ws://ws.a.example:8080/", "https://a.example", "a 100"},
+		{"ws://ws.a.example/only-a", "https://a.example", "a 100"},
+		{"ws://x.y.b.example/", "https://evil.test", "b 200"},
+		{"ws://other.example/", "https://evil.test", fmt.Sprintf("default %d", defaultMaxMessageBytes)},
+	} {
+		if got, err := dial(tc.url, tc.origin); err != nil || got != tc.want {
+			t.Errorf("%s: got %q, %v; want %q", tc.url, got, err, tc.want)
+		}
+	}
+
+	var he *HandshakeError
+	if _, err := dial("ws://ws.a.example/", "https://evil.test"); !errors.As(err, &he) || he.Status != http.StatusForbidden {
+		t.Errorf("got %v; want 403 by the origin policy of the host", err)
+	}
+	if _, err := dial("ws://other.example/only-a", ""); !errors.As(err, &he) || he.Status != http.StatusNotFound {
+		t.Errorf("got %v; want 404 outside of the host", err)
+	}
+}
+
+func TestMultipleListeners(t *testing.T) {
+	srv := NewServer(WithAddrs("127.0.0.1:0", "127.0.0.1:0"), WithReusePort(3))
+	srv.OnConnOpenFunc("/", func(r MessageReceiver, s MessageSender) {
+		s.SendWholeBytes([]byte("hi"), false)
+		for _, err := range r.Messages(0) {
+			if err != nil {
+				return
+			}
+		}
+	})
+
+	lns, err := srv.listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lns) != 6 {
+		t.Fatalf("got %d listeners; want 6", len(lns))
+	}
+	// the acceptors of an address share its port
+	if lns[0].Addr().String() != lns[2].Addr().String() || lns[0].Addr().String() == lns[3].Addr().String() {
+		t.Fatalf("unexpected addrs %v, %v, %v", lns[0].Addr(), lns[2].Addr(), lns[3].Addr())
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.ServeListeners(lns...)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, ln := range []net.Listener{lns[0], lns[3]} {
+		c, err := Dial(ctx, "ws://"+ln.Addr().String()+"/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg, err := (&DefaultMessageReceiver{}).SetConn(c).ReadWhole(0); err != nil || string(msg.Data) != "hi" {
+			t.Fatalf("got %v, %v; want hi", msg, err)
+		}
+		c.Close()
+	}
+
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != ErrServerClosed {
+		t.Fatalf("got %v; want ErrServerClosed", err)
+	}
+}
+
+type errListener struct {
+	net.Listener
+	errs []error
+}
+
+func (ln *errListener) Accept() (net.Conn, error) {
+	err := ln.errs[0]
+	ln.errs = ln.errs[1:]
+	return nil, err
+}
+
+func (ln *errListener) Close() error { return nil }
+
+func TestAcceptBackoff(t *testing.T) {
+	fatal := errors.New("fatal")
+	ln := &errListener{errs: []error{
+		tempError{},
+		&net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept4", syscall.EMFILE)},
+		tempError{},
+		fatal,
+	}}
+
+	var logs lockedBuffer
+	var delays []time.Duration
+	srv := NewServer(WithLogger(log.New(&logs, "", 0)))
+	srv.OnAcceptError = func(err error, delay time.Duration) {
+		delays = append(delays, delay)
+	}
+
+	if err := srv.Serve(ln); err != fatal {
+		t.Fatalf("got %v; want the fatal error", err)
+	}
+	want := []time.Duration{minAcceptDelay, 2 * minAcceptDelay, 4 * minAcceptDelay, 0}
+	if !reflect.DeepEqual(delays, want) {
+		t.Fatalf("got delays %v; want %v", delays, want)
+	}
+	if !strings.Contains(logs.String(), "out of fds") {
+		t.Fatalf("got logs %q; want the fd exhaustion logged", logs.String())
+	}
+}
+
+func TestDrainAndInheritListeners(t *testing.T) {
+	handler := func(name string) OnConnOpenFunc {
+		return func(r MessageReceiver, s MessageSender) {
+			s.SendWholeBytes([]byte(name), false)
+			for msg, err := range r.Messages(0) {
+				if err != nil {
+					return
+				}
+				if msg.IsClose() {
+					s.SendClose(CloseCodeNormalClosure, "", false, false)
+					return
+				}
+			}
+		}
+	}
+
+	old := NewServer()
+	old.OnConnOpenFunc("/", handler("old"))
+	url := listenTestServer(t, old)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	dial := func() (*Conn, string) {
+		c, err := Dial(ctx, url+"/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := (&DefaultMessageReceiver{}).SetConn(c).ReadWhole(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c, string(msg.Data)
+	}
+
+	kept, name := dial()
+	if name != "old" {
+		t.Fatalf("got %q; want old", name)
+	}
+
+	// what Restart passes to the new process
+	files, err := old.listenerFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lns, err := listenersFromFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := NewServer()
+	srv.OnConnOpenFunc("/", handler("new"))
+	go srv.Serve(lns[0])
+	defer srv.Shutdown(ctx)
+
+	drainCtx, drainCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer drainCancel()
+	if err := old.Drain(drainCtx); err != context.DeadlineExceeded {
+		t.Fatalf("got %v; want DeadlineExceeded", err)
+	}
+	if code := readTestCloseCode(t, kept.Buf); code != CloseCodeGoingAway {
+		t.Fatalf("got close code %d; want going away", code)
+	}
+
+	// the address is still served, by the new server
+	c, name := dial()
+	if name != "new" {
+		t.Fatalf("got %q; want new", name)
+	}
+	c.Close()
+}
+
+type remoteAddrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *remoteAddrConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func TestClientIP(t *testing.T) {
+	tp, err := NewTrustedProxies([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		remote string
+		header Header
+		want   string
+	}{
+		{"192.0.2.1:1234", Header{"X-Forwarded-For": {"203.0.113.9"}}, "192.0.2.1"},
+		{"10.0.0.1:1234", Header{}, "10.0.0.1"},
+		{"10.0.0.1:1234", Header{"X-Forwarded-For": {"203.0.113.9, 10.0.0.2"}}, "203.0.113.9"},
+		{"10.0.0.1:1234", Header{"x-forwarded-for": {"198.51.100.1, 203.0.113.9", "10.0.0.2"}}, "203.0.113.9"},
+		{"10.0.0.1:1234", Header{"Forwarded": {`for=192.0.2.60;proto=http, for="[2001:db8::1]:4711"`}, "X-Forwarded-For": {"192.0.2.1"}}, "2001:db8::1"},
+		{"10.0.0.1:1234", Header{"Forwarded": {"for=192.0.2.60, for=unknown"}}, "10.0.0.1"},
+	}
+	for _, c := range cases {
+		srv := NewServer()
+		srv.ApplyDefaultCfg()
+		srv.TrustedProxies = tp
+
+		sc, cc := net.Pipe()
+		conn := newConn(srv, &remoteAddrConn{sc, net.TCPAddrFromAddrPort(netip.MustParseAddrPort(c.remote))})
+		conn.HandshakeRequest = &HandshakeRequest{Header: c.header}
+		if got := conn.ClientIP().String(); got != c.want {
+			t.Errorf("%s %v: got %s; want %s", c.remote, c.header, got, c.want)
+		}
+		cc.Close()
+	}
+
+	srv := NewServer()
+	srv.ApplyDefaultCfg()
+	srv.TrustedProxies, _ = NewTrustedProxies([]string{"127.0.0.1"})
+	srv.AccessList, _ = NewAccessList(nil, []string{"203.0.113.0/24"})
+	srv.ClientHandshakeLimiter = NewClientRateLimiter(0.001, 1)
+	srv.OnConnOpenFunc("/", func(r MessageReceiver, s MessageSender) {})
+	url := listenTestServer(t, srv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	dial := func(client string) int {
+		d := &Dialer{Header: http.Header{"X-Forwarded-For": {client}}}
+		c, err := d.Dial(ctx, url+"/")
+		if err != nil {
+			var he *HandshakeError
+			if !errors.As(err, &he) {
+				t.Fatal(err)
+			}
+			return he.Status
+		}
+		c.Close()
+		return http.StatusSwitchingProtocols
+	}
+
+	for _, c := range []struct {
+		client string
+		want   int
+	}{
+		{"203.0.113.9", http.StatusForbidden},
+		{"198.51.100.1", http.StatusSwitchingProtocols},
+		{"198.51.100.1", http.StatusTooManyRequests},
+		{"198.51.100.2", http.StatusSwitchingProtocols},
+	} {
+		if got := dial(c.client); got != c.want {
+			t.Fatalf("%s: got status %d; want %d", c.client, got, c.want)
+		}
+	}
+}
+
+type testTCPConn struct {
+	net.Conn
+	noDelay   []bool
+	keepAlive []net.KeepAliveConfig
+	linger    []int
+}
+
+func (c *testTCPConn) SetNoDelay(noDelay bool) error {
+	c.noDelay = append(c.noDelay, noDelay)
+	return nil
+}
+
+func (c *testTCPConn) SetKeepAliveConfig(cfg net.KeepAliveConfig) error {
+	c.keepAlive = append(c.keepAlive, cfg)
+	return nil
+}
+
+func (c *testTCPConn) SetLinger(sec int) error {
+	c.linger = append(c.linger, sec)
+	return nil
+}
+
+func TestTCPOptions(t *testing.T) {
+	ka := net.KeepAliveConfig{Enable: true, Idle: time.Minute, Interval: 10 * time.Second, Count: 3}
+
+	for _, tc := range []struct {
+		opts      TCPOptions
+		noDelay   []bool
+		keepAlive []net.KeepAliveConfig
+		linger    []int
+	}{
+		{TCPOptions{}, nil, nil, nil},
+		{TCPOptions{Delay: true, KeepAlive: ka, Linger: 1500 * time.Millisecond}, []bool{false}, []net.KeepAliveConfig{ka}, []int{2}},
+		{TCPOptions{NoKeepAlive: true, Linger: -1}, nil, []net.KeepAliveConfig{{}}, []int{0}},
+	} {
+		c := &testTCPConn{}
+		if err := tc.opts.apply(tls.Server(c, &tls.Config{})); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(c.noDelay, tc.noDelay) || !reflect.DeepEqual(c.keepAlive, tc.keepAlive) || !reflect.DeepEqual(c.linger, tc.linger) {
+			t.Errorf("%+v: got %v %v %v", tc.opts, c.noDelay, c.keepAlive, c.linger)
+		}
+	}
+
+	// applied to the real conns
+	srv := NewServer(WithTCPOptions(TCPOptions{Delay: true, KeepAlive: ka}))
+	accepted := make(chan net.Conn, 1)
+	srv.OnConnAccept = func(cn net.Conn) bool {
+		accepted <- cn
+		return false
+	}
+	url := listenTestServer(t, srv)
+
+	cn, err := net.Dial("tcp", strings.TrimPrefix(url, "ws://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cn.Close()
+	if _, ok := (<-accepted).(*net.TCPConn); !ok {
+		t.Fatal("expected a tcp conn")
+	}
+}
+
+func TestCallbackAPI(t *testing.T) {
+	closed := make(chan *CloseError, 2)
+	failed := make(chan error, 2)
+
+	srv := NewServer()
+	srv.OnMessage("/upper", func(c *Conn, msg *Message) {
+		c.Send(&Message{Opcode: msg.Opcode, Data: bytes.ToUpper(msg.Data)})
+	})
+	srv.OnClose("/upper", func(c *Conn, ce *CloseError) {
+		closed <- ce
+	})
+	srv.OnError("/upper", func(c *Conn, err error) {
+		failed <- err
+	})
+	url := listenTestServer(t, srv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c, err := Dial(ctx, url+"/upper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := (&DefaultMessageReceiver{}).SetConn(c)
+	s := (&DefaultMessageSender{}).SetConn(c)
+
+	s.SendWholeBytes([]byte("hi"), false)
+	s.SendWhole(&Message{Opcode: OpcodePing, Data: []byte("p")}, false)
+	for _, want := range []*Message{{Opcode: OpcodeText, Data: []byte("HI")}, {Opcode: OpcodePong, Data: []byte("p")}} {
+		if msg, err := r.ReadWhole(0); err != nil || msg.Opcode != want.Opcode || string(msg.Data) != string(want.Data) {
+			t.Fatalf("got %v, %v; want %v", msg, err, want)
+		}
+	}
+
+	s.SendWhole(&Message{Opcode: OpcodeClose, Data: MakeCloseFrame(4000, "bye", false).PayloadData}, false)
+	if msg, err := r.ReadWhole(0); err != nil || msg.CloseError().Code != 4000 {
+		t.Fatalf("got %v, %v; want the close echoed", msg, err)
+	}
+	if ce := <-closed; ce.Code != 4000 || ce.Reason != "bye" {
+		t.Fatalf("got %v; want 4000 bye", ce)
+	}
+	c.Close()
+
+	// the peer going away without a close frame
+	c, err = Dial(ctx, url+"/upper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.rwc.Close()
+	if err := <-failed; !IsPeerClosed(err) {
+		t.Fatalf("got %v; want the peer closed", err)
+	}
+	if ce := <-closed; ce.Code != CloseCodeAbnormalClosure {
+		t.Fatalf("got %v; want abnormal closure", ce)
+	}
+}
+
+type testRunHandler struct {
+	events chan string
+}
+
+func (h *testRunHandler) OnOpen(c *Conn) {
+	c.Send(&Message{Opcode: OpcodeText, Data: []byte("welcome")})
+}
+
+func (h *testRunHandler) OnMessage(c *Conn, msg *Message) {
+	h.events <- "message " + string(msg.Data)
+	c.Send(msg)
+}
+
+func (h *testRunHandler) OnClose(c *Conn, ce *CloseError) {
+	h.events <- "close " + strconv.Itoa(int(ce.Code))
+}
+
+func (h *testRunHandler) OnError(c *Conn, err error) {
+	h.events <- "error"
+}
+
+func TestConnRun(t *testing.T) {
+	h := &testRunHandler{events: make(chan string, 4)}
+	srv := NewServer()
+	srv.OnConnOpenFunc("/", func(r MessageReceiver, s MessageSender) {
+		r.GetConn().Run(h)
+	})
+	url := listenTestServer(t, srv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c, err := Dial(ctx, url+"/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	r := (&DefaultMessageReceiver{}).SetConn(c)
+	s := (&DefaultMessageSender{}).SetConn(c)
+
+	s.SendWholeBytes([]byte("hi"), false)
+	s.SendWhole(&Message{Opcode: OpcodePing, Data: []byte("p")}, false)
+	for _, want := range []string{"welcome", "hi", "p"} {
+		if msg, err := r.ReadWhole(0); err != nil || string(msg.Data) != want {
+			t.Fatalf("got %v, %v; want %q", msg, err, want)
+		}
+	}
+
+	s.SendWhole(&Message{Opcode: OpcodeClose, Data: AppendCloseCode(nil, 4000)}, false)
+	if msg, err := r.ReadWhole(0); err != nil || msg.CloseError().Code != 4000 {
+		t.Fatalf("got %v, %v; want the close echoed", msg, err)
+	}
+	for _, want := range []string{"message hi", "close 4000"} {
+		if got := <-h.events; got != want {
+			t.Fatalf("got event %q; want %q", got, want)
+		}
+	}
+}
+
+func TestAutoControlFrames(t *testing.T) {
+	type result struct {
+		msgs   []string
+		err    error
+		ponged bool
+	}
+	done := make(chan result, 1)
+
+	srv := NewServer()
+	srv.ApplyDefaultCfg()
+	srv.AutoControlFrames = true
+	srv.OnConnOpenFunc("/", func(r MessageReceiver, s MessageSender) {
+		var res result
+		for {
+			msg, err := r.ReadWhole(0)
+			if err != nil {
+				res.err = err
+				break
+			}
+			res.msgs = append(res.msgs, string(msg.Data))
+		}
+		res.ponged = !r.GetConn().Stats().LastPong.IsZero()
+		done <- res
+	})
+
+	cc, br := dialTestConn(t, srv, "/")
+	defer cc.Close()
+	go writeTestFrames(cc,
+		&Frame{FIN: 1, Opcode: OpcodePing, PayloadData: []byte("p")},
+		&Frame{FIN: 1, Opcode: OpcodePong},
+		&Frame{FIN: 1, Opcode: OpcodeText, PayloadData: []byte("a")},
+		MakeCloseFrame(4000, "bye", false),
+	)
+
+	f := &Frame{}
+	if err := f.FromBufReader(br, 1<<10); err != nil || f.Opcode != OpcodePong || string(f.PayloadData) != "p" {
+		t.Fatalf("got %v, %v; want the pong", f, err)
+	}
+	if code := readTestCloseCode(t, br); code != 4000 {
+		t.Fatalf("got close code %d; want 4000", code)
+	}
+
+	res := <-done
+	var ce *CloseError
+	if !slices.Equal(res.msgs, []string{"a"}) || !errors.As(res.err, &ce) || ce.Code != 4000 || ce.Reason != "bye" || !res.ponged {
+		t.Fatalf("got %q, %v, ponged %v; want the text only and the close of the peer", res.msgs, res.err, res.ponged)
+	}
+}
+
+func TestWorkerPool(t *testing.T) {
+	srv := NewServer(WithWorkerPool(2, 4))
+	defer srv.Workers.Close()
+
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var got []string
+	srv.OnMessage("/", func(c *Conn, msg *Message) {
+		if string(msg.Data) == "slow" {
+			<-release
+		}
+		mu.Lock()
+		got = append(got, string(msg.Data))
+		mu.Unlock()
+		c.Send(&Message{Opcode: OpcodeText, Data: msg.Data})
+	})
+	url := listenTestServer(t, srv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	dial := func() (MessageReceiver, MessageSender) {
+		c, err := Dial(ctx, url+"/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		return (&DefaultMessageReceiver{}).SetConn(c), (&DefaultMessageSender{}).SetConn(c)
+	}
+
+	r1, s1 := dial()
+	s1.SendWholeBytes([]byte("slow"), false)
+	for i := range 20 {
+		s1.SendWholeBytes([]byte(strconv.Itoa(i)), false)
+	}
+
+	// served while the handler of the first conn is stuck
+	r2, s2 := dial()
+	s2.SendWholeBytes([]byte("fast"), false)
+	if msg, err := r2.ReadWhole(0); err != nil || string(msg.Data) != "fast" {
+		t.Fatalf("got %v, %v; want fast", msg, err)
+	}
+
+	close(release)
+	for i := -1; i < 20; i++ {
+		want := strconv.Itoa(i)
+		if i < 0 {
+			want = "slow"
+		}
+		if msg, err := r1.ReadWhole(0); err != nil || string(msg.Data) != want {
+			t.Fatalf("got %v, %v; want %s in order", msg, err, want)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != 22 {
+		t.Fatalf("got %d messages handled; want 22", len(got))
+	}
+}
+
+func TestEventLoop(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("the event loop is only supported on linux")
+	}
+
+	const n = 50
+	closed := make(chan *CloseError, n)
+
+	srv := NewServer()
+	srv.EventLoop = true
+	srv.PoolConnBuffers = true
+	srv.OnMessage("/", func(c *Conn, msg *Message) {
+		c.Send(&Message{Opcode: msg.Opcode, Data: msg.Data})
+	})
+	srv.OnClose("/", func(c *Conn, ce *CloseError) {
+		closed <- ce
+	})
+	url := listenTestServer(t, srv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	before := runtime.NumGoroutine()
+	var conns []*Conn
+	for range n {
+		c, err := Dial(ctx, url+"/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, c)
+	}
+
+	for i, c := range conns {
+		s := (&DefaultMessageSender{}).SetConn(c)
+		s.SendWholeBytes([]byte(strconv.Itoa(i)), false)
+		// a message split over two wake ups
+		c.Write([]byte{0x81, 0x85})
+		c.Write([]byte{0, 0, 0, 0, 'h'})
+		time.Sleep(time.Millisecond)
+		c.Write([]byte("ello"))
+		c.Flush()
+	}
+	for i, c := range conns {
+		r := (&DefaultMessageReceiver{}).SetConn(c)
+		for _, want := range []string{strconv.Itoa(i), "hello"} {
+			if msg, err := r.ReadWhole(0); err != nil || string(msg.Data) != want {
+				t.Fatalf("got %v, %v; want %s", msg, err, want)
+			}
+		}
+	}
+
+	// the idle conns have no goroutine
+	time.Sleep(50 * time.Millisecond)
+	if grown := runtime.NumGoroutine() - before; grown > n/2 {
+		t.Fatalf("got %d more goroutines for %d idle conns", grown, n)
+	}
+
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for range n {
+		if ce := <-closed; ce.Code != CloseCodeAbnormalClosure {
+			t.Fatalf("got %v; want no close frame from the peer", ce)
+		}
+	}
+}
+
+func TestDialerOptions(t *testing.T) {
+	srv := NewServer()
+	srv.ApplyDefaultCfg()
+
+	var gotAuth, gotCookie string
+	srv.OnHandshakeRequestFunc("/chat", func(hsReq *HandshakeRequest, conn *Conn) (int, error) {
+		gotAuth = hsReq.Header.GetOne("Authorization")
+		gotCookie = strings.Join(hsReq.Header.Get("Cookie"), "; ")
+
+		buf := conn.Buf
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+		buf.WriteString("Upgrade: websocket\r\n")
+		buf.WriteString("Connection: Upgrade\r\n")
+		buf.WriteString("Sec-WebSocket-Accept: " + MakeAcceptKey(hsReq.Header.GetOne("Sec-WebSocket-Key")) + "\r\n")
+		buf.WriteString("Sec-WebSocket-Protocol: chat.v2\r\n")
+		buf.WriteString("Set-Cookie: session=abc\r\n")
+		buf.WriteString("\r\n")
+		return 0, buf.Flush()
+	})
+	srv.OnConnOpenFunc("/chat", func(r MessageReceiver, s MessageSender) {
+		s.SendClose(CloseCodeNormalClosure, "", false, false)
+	})
+	url := listenTestServer(t, srv)
+
+	jar, _ := cookiejar.New(nil)
+	var dials atomic.Int32
+	d := &Dialer{
+		Header:       http.Header{"Authorization": {"Bearer t0k"}},
+		Jar:          jar,
+		Subprotocols: []string{"chat.v1", "chat.v2"},
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dials.Add(1)
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for i := 0; i < 2; i++ {
+		c, err := d.Dial(ctx, url+"/chat")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Subprotocol() != "chat.v2" || c.HandshakeResponse.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("unexpected handshake response: %+v", c.HandshakeResponse)
+		}
+		c.Close()
+	}
+
+	if dials.Load() != 2 {
+		t.Fatalf("got %d dials; want 2", dials.Load())
+	}
+	if gotAuth != "Bearer t0k" || gotCookie != "session=abc" {
+		t.Fatalf("got Authorization %q and Cookie %q", gotAuth, gotCookie)
+	}
+
+	// a subprotocol not asked for is rejected
+	d.Subprotocols = []string{"chat.v1"}
+	if _, err := d.Dial(ctx, url+"/chat"); err == nil {
+		t.Fatal("expected the unexpected subprotocol rejected")
+	}
+}
+
+// serveTestProxy accepts one conn on a new listener, lets handshake read
+// the target address from it and then pipes the conn to the target.
+func serveTestProxy(t *testing.T, handshake func(net.Conn, *bufio.Reader) string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+
+		br := bufio.NewReader(c)
+		target, err := net.Dial("tcp", handshake(c, br))
+		if err != nil {
+			return
+		}
+		defer target.Close()
+
+		go io.Copy(target, br)
+		io.Copy(c, target)
+	}()
+	return ln.Addr().String()
+}
+
+func TestDialProxy(t *testing.T) {
+	srv := NewServer()
+	srv.ApplyDefaultCfg()
+	srv.OnConnOpenFunc("/echo", func(r MessageReceiver, s MessageSender) {
+		for msg := range r.Messages(0) {
+			if msg.IsClose() {
+				s.SendClose(CloseCodeNormalClosure, "", false, false)
+				return
+			}
+			s.SendWhole(msg, false)
+		}
+	})
+	target := listenTestServer(t, srv) + "/echo"
+
+	var gotAuth string
+	httpProxy := serveTestProxy(t, func(c net.Conn, br *bufio.Reader) string {
+		req, err := http.ReadRequest(br)
+		if err != nil || req.Method != http.MethodConnect {
+			return ""
+		}
+		gotAuth = req.Header.Get("Proxy-Authorization")
+		io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+		return req.Host
+	})
+
+	socksProxy := serveTestProxy(t, func(c net.Conn, br *bufio.Reader) string {
+		// no auth, then a connect request with an ipv4 address
+		head := make([]byte, 3)
+		io.ReadFull(br, head)
+		c.Write([]byte{0x05, 0x00})
+
+		req := make([]byte, 10)
+		io.ReadFull(br, req)
+		c.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+
+		ip := net.IP(req[4:8])
+		return net.JoinHostPort(ip.String(), strconv.Itoa(int(req[8])<<8|int(req[9])))
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, proxy := range []string{"http://u:p@" + httpProxy, "socks5://" + socksProxy} {
+		pu, _ := url.Parse(proxy)
+		d := &Dialer{Proxy: http.ProxyURL(pu)}
+
+		c, err := d.Dial(ctx, target)
+		if err != nil {
+			t.Fatalf("%s: %v", proxy, err)
+		}
+
+		r := (&DefaultMessageReceiver{}).SetConn(c)
+		s := (&DefaultMessageSender{}).SetConn(c)
+		s.SendWholeBytes([]byte("via proxy"), false)
+		if msg, err := r.ReadWhole(0); err != nil || string(msg.Data) != "via proxy" {
+			t.Fatalf("%s: got %v, %v; want the echo", proxy, msg, err)
+		}
+		c.Close()
+	}
+
+	if gotAuth != "Basic dTpw" {
+		t.Fatalf("got Proxy-Authorization %q", gotAuth)
+	}
+
+	d := &Dialer{Proxy: http.ProxyURL(&url.URL{Scheme: "ftp", Host: httpProxy})}
+	if _, err := d.Dial(ctx, target); err != ErrBadProxyScheme {
+		t.Fatalf("got %v; want ErrBadProxyScheme", err)
+	}
+}
+
+func TestSessionResume(t *testing.T) {
+	store := NewSessionStore()
+	store.TTL = 20 * time.Millisecond
+
+	srv := NewServer()
+	srv.ApplyDefaultCfg()
+	sessions := make(chan *Session, 1)
+	srv.OnConnOpenFunc("/events", func(r MessageReceiver, s MessageSender) {
+		defer s.GetConn().Close()
+		sess, err := store.Attach(s)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		sessions <- sess
+		for _, err := range r.Messages(0) {
+			if err != nil {
+				return
+			}
+		}
+	})
+	url := listenTestServer(t, srv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cs := &ClientSession{}
+	dial := func() (*Conn, *Session) {
+		u, err := cs.URL(url + "/events")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := Dial(ctx, u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c, <-sessions
+	}
+	receive := func(c *Conn, n int) []string {
+		r := (&DefaultMessageReceiver{}).SetConn(c)
+		var got []string
+		for len(got) < n {
+			msg, err := r.ReadWhole(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, ok, err := cs.Receive(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok {
+				got = append(got, string(data))
+			}
+		}
+		return got
+	}
+
+	c1, sess := dial()
+	sess.Send(&Message{Opcode: OpcodeText, Data: []byte("a")})
+	if got := receive(c1, 1); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Fatalf("got %q", got)
+	}
+	if cs.Token() != sess.Token || cs.LastID() != 1 {
+		t.Fatalf("got token %q and last ID %d", cs.Token(), cs.LastID())
+	}
+	c1.Close()
+
+	// sent while the client is away
+	sess.Send(&Message{Opcode: OpcodeText, Data: []byte("b")})
+	sess.Send(&Message{Opcode: OpcodeBinary, Data: []byte("c")})
+
+	c2, resumed := dial()
+	if resumed != sess {
+		t.Fatal("got a new session; want the resumed one")
+	}
+	if got := receive(c2, 2); !reflect.DeepEqual(got, []string{"b", "c"}) {
+		t.Fatalf("got %q; want the missed messages", got)
+	}
+	if cs.LastID() != 3 {
+		t.Fatalf("got last ID %d; want 3", cs.LastID())
+	}
+
+	// the session expires once its conn is closed for TTL
+	c2.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for store.Len() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("session not expired")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	c3, fresh := dial()
+	defer c3.Close()
+	if fresh == sess {
+		t.Fatal("got the expired session")
+	}
+	msg, err := (&DefaultMessageReceiver{}).SetConn(c3).ReadWhole(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := cs.Receive(msg); ok || err != nil {
+		t.Fatalf("got %v, %v; want the token", ok, err)
+	}
+	if cs.Token() != fresh.Token || cs.LastID() != 0 {
+		t.Fatalf("got token %q and last ID %d; want the new session", cs.Token(), cs.LastID())
+	}
+}
+
+func TestReconnectingConn(t *testing.T) {
+	srv := NewServer()
+	srv.ApplyDefaultCfg()
+
+	var opens atomic.Int32
+	srv.OnConnOpenFunc("/feed", func(r MessageReceiver, s MessageSender) {
+		if opens.Add(1) < 3 {
+			// dropped without a close frame
+			s.GetConn().Close()
+			return
+		}
+		s.SendClose(CloseCodeNormalClosure, "done", false, false)
+	})
+	url := listenTestServer(t, srv)
+
+	var connects int
+	var states []ReconnectState
+	rc := &ReconnectingConn{
+		URL:    url + "/feed",
+		Policy: &RetryPolicy{Backoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond},
+		OnConnect: func(c *Conn) error {
+			connects++
+			return nil
+		},
+		OnStateChange: func(state ReconnectState, err error) {
+			states = append(states, state)
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := rc.Run(ctx, func(r MessageReceiver, s MessageSender) {
+		for range r.Messages(0) {
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if connects != 3 {
+		t.Fatalf("got %d connects; want 3", connects)
+	}
+
+	want := []ReconnectState{
+		ReconnectDialing, ReconnectConnected, ReconnectWaiting,
+		ReconnectDialing, ReconnectConnected, ReconnectWaiting,
+		ReconnectDialing, ReconnectConnected, ReconnectStopped,
+	}
+	if !reflect.DeepEqual(states, want) {
+		t.Fatalf("got states %v; want %v", states, want)
+	}
+}
+
+// xorExtension flips the payload bits of the messages by RSV3.
+type xorExtension struct{}
+
+func (xorExtension) Name() string { return "x-xor" }
+func (xorExtension) RSV() uint8   { return ExtensionRSV3 }
+func (xorExtension) Accept(ExtensionParams) (ExtensionParams, ExtensionConn, bool) {
+	return nil, xorExtension{}, true
+}
+func (xorExtension) Offer() ExtensionParams { return nil }
+func (xorExtension) Accepted(ExtensionParams) (ExtensionConn, error) {
+	return xorExtension{}, nil
+}
+
+func (xorExtension) EncodeFrame(f *Frame) error {
+	f.RSV3 = 1
+	f.PayloadData = bytes.Clone(f.PayloadData)
+	for i := range f.PayloadData {
+		f.PayloadData[i] ^= 0xff
+	}
+	return nil
+}
+
+func (xorExtension) DecodeFrame(f *Frame, maxLen uint64) error {
+	if f.RSV3 != 1 {
+		return errors.New("RSV3 not set")
+	}
+	f.RSV3 = 0
+	for i := range f.PayloadData {
+		f.PayloadData[i] ^= 0xff
+	}
+	return nil
+}
+
+func TestExtensions(t *testing.T) {
+	srv := NewServer()
+	srv.ApplyDefaultCfg()
+	srv.Strict = true
+	srv.Extensions = []Extension{&PerMessageDeflate{}, xorExtension{}}
+	srv.OnConnOpenFunc("/echo", func(r MessageReceiver, s MessageSender) {
+		for msg, err := range r.Messages(0) {
+			if err != nil || msg.IsClose() {
+				return
+			}
+			s.SendWhole(msg, false)
+		}
+	})
+	url := listenTestServer(t, srv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tests := []struct {
+		name     string
+		exts     []Extension
+		resp     string
+		compress bool
+	}{
+		{"none", nil, "", false},
+		{"deflate", []Extension{&PerMessageDeflate{}}, "permessage-deflate", true},
+		{"both", []Extension{xorExtension{}, &PerMessageDeflate{Level: flate.BestSpeed}}, "x-xor, permessage-deflate", true},
+		{"xor", []Extension{xorExtension{}}, "x-xor", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := (&Dialer{Extensions: tt.exts}).Dial(ctx, url+"/echo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			c.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+			if got := c.HandshakeResponse.Header.Get("Sec-WebSocket-Extensions"); got != tt.resp {
+				t.Fatalf("got extensions %q; want %q", got, tt.resp)
+			}
+
+			var wire int
+			c.TraceFrameOut = func(f *Frame) {
+				wire += len(f.PayloadData)
+			}
+
+			big := strings.Repeat("hello kiwi ", 1000)
+			s := (&DefaultMessageSender{}).SetConn(c)
+			r := (&DefaultMessageReceiver{}).SetConn(c)
+			for _, data := range []string{big, big, "", "x"} {
+				wire = 0
+				if _, err := s.SendWholeBytes([]byte(data), false); err != nil {
+					t.Fatal(err)
+				}
+				if compressed := wire < len(data); compressed != tt.compress && len(data) > 100 {
+					t.Fatalf("wrote %d bytes of %d; want compressed %v", wire, len(data), tt.compress)
+				}
+				if msg, err := r.ReadWhole(0); err != nil || string(msg.Data) != data {
+					t.Fatalf("got %v, %v; want the echo of %d bytes", msg, err, len(data))
+				}
+			}
+
+			// the fragments are decoded as a whole
+			s.SendFrame([]byte(big[:100]), OpcodeBinary, true, false, false)
+			s.SendFrame([]byte(big[100:]), OpcodeBinary, false, true, false)
+			if msg, err := r.ReadWhole(0); err != nil || !msg.IsBinary() || string(msg.Data) != big {
+				t.Fatalf("got %v, %v; want the echo of the fragments", msg, err)
+			}
+		})
+	}
+
+	// the example of RFC 7692
+	_, ec, _ := (&PerMessageDeflate{}).Accept(nil)
+	f := &Frame{FIN: 1, RSV1: 1, Opcode: OpcodeText, PayloadData: []byte{0xf2, 0x48, 0xcd, 0xc9, 0xc9, 0x07, 0x00}}
+	if err := ec.DecodeFrame(f, 100); err != nil || string(f.PayloadData) != "Hello" || f.RSV1 != 0 {
+		t.Fatalf("got %q, %v; want Hello", f.PayloadData, err)
+	}
+
+	// a response of an extension not offered fails the dial
+	c, _ := newTestConn()
+	c.client = true
+	if err := c.acceptExtensions([]Extension{xorExtension{}}, "permessage-deflate"); err == nil {
+		t.Fatal("got no error; want the unexpected extension")
+	}
+}
+
+func TestParseExtensions(t *testing.T) {
+	offers, err := ParseExtensions(
+		`permessage-deflate; client_max_window_bits, x-foo; bar="a, \"b\""`,
+		` , permessage-deflate ;server_no_context_takeover= ; x = 10`,
+	)
+	if err == nil {
+		t.Fatalf("got %v; want the error of the empty value", offers)
+	}
+
+	offers, err = ParseExtensions(
+		`permessage-deflate; client_max_window_bits, x-foo; bar="a, \"b\""`,
+		` , permessage-deflate ;server_no_context_takeover ; x = 10`,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ExtensionOffer{
+		{"permessage-deflate", ExtensionParams{"client_max_window_bits": ""}},
+		{"x-foo", ExtensionParams{"bar": `a, "b"`}},
+		{"permessage-deflate", ExtensionParams{"server_no_context_takeover": "", "x": "10"}},
+	}
+	if !reflect.DeepEqual(offers, want) {
+		t.Fatalf("got %v; want %v", offers, want)
+	}
+
+	got := FormatExtensions(offers)
+	if got != `permessage-deflate; client_max_window_bits, x-foo; bar="a, \"b\"", permessage-deflate; server_no_context_takeover; x=10` {
+		t.Fatalf("got %s", got)
+	}
+	if again, err := ParseExtensions(got); err != nil || !reflect.DeepEqual(again, want) {
+		t.Fatalf("got %v, %v; want %v", again, err, want)
+	}
+
+	for _, v := range []string{`x; a="b`, `x y`, `;a`, `x; =1`, `x; a=b c`} {
+		if _, err := ParseExtensions(v); err == nil {
+			t.Errorf("%s: got no error", v)
+		}
+	}
+}
+
+func TestCompressionPolicy(t *testing.T) {
+	srv := NewServer()
+	srv.ApplyDefaultCfg()
+	srv.Extensions = []Extension{&PerMessageDeflate{Policy: CompressionPolicy{Threshold: 64}}}
+	echo := func(r MessageReceiver, s MessageSender) {
+		for msg, err := range r.Messages(0) {
+			if err != nil || msg.IsClose() {
+				return
+			}
+			s.SendWhole(msg, false)
+		}
+	}
+	srv.OnConnOpenFunc("/", echo)
+	srv.OnConnOpenFunc("/raw", echo)
+	srv.SetCompression("/raw", CompressionPolicy{SkipBinary: true})
+	url := listenTestServer(t, srv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	big := strings.Repeat("hello kiwi ", 100)
+	tests := []struct {
+		path       string
+		opcode     uint8
+		data       string
+		compressed bool
+	}{
+		{"/", OpcodeText, "tiny", false},
+		{"/", OpcodeText, big, true},
+		{"/", OpcodeBinary, big, true},
+		{"/raw", OpcodeText, "tiny", true},
+		{"/raw", OpcodeBinary, big, false},
+	}
+	for _, tt := range tests {
+		c, err := (&Dialer{Extensions: []Extension{&PerMessageDeflate{}}}).Dial(ctx, url+tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rsv1 uint8
+		c.TraceFrameIn = func(f *Frame) {
+			rsv1 = f.RSV1
+		}
+
+		s := (&DefaultMessageSender{}).SetConn(c)
+		r := (&DefaultMessageReceiver{}).SetConn(c)
+		s.SendWhole(&Message{Opcode: tt.opcode, Data: []byte(tt.data)}, false)
+		if msg, err := r.ReadWhole(0); err != nil || string(msg.Data) != tt.data {
+			t.Fatalf("%s: got %v, %v; want the echo", tt.path, msg, err)
+		}
+		if compressed := rsv1 == 1; compressed != tt.compressed {
+			t.Fatalf("%s: got compressed %v for opcode %d of %d bytes; want %v", tt.path, compressed, tt.opcode, len(tt.data), tt.compressed)
+		}
+		c.Close()
+	}
+}
+
+func TestDeflateContextTakeover(t *testing.T) {
+	srv := NewServer()
+	srv.ApplyDefaultCfg()
+	srv.Extensions = []Extension{&PerMessageDeflate{ServerNoContextTakeover: true, ClientMaxWindowBits: 10}}
+	srv.OnConnOpenFunc("/", func(r MessageReceiver, s MessageSender) {
+		for msg, err := range r.Messages(0) {
+			if err != nil || msg.IsClose() {
+				return
+			}
+			s.SendWhole(msg, false)
+		}
+	})
+	url := listenTestServer(t, srv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tests := []struct {
+		name string
+		pmd  *PerMessageDeflate
+		resp string
+	}{
+		{"default", &PerMessageDeflate{}, "permessage-deflate; client_max_window_bits=10; server_no_context_takeover"},
+		{"client", &PerMessageDeflate{ClientNoContextTakeover: true}, "permessage-deflate; client_max_window_bits=10; client_no_context_takeover; server_no_context_takeover"},
+		{"window", &PerMessageDeflate{ServerMaxWindowBits: 12}, "permessage-deflate; client_max_window_bits=10; server_max_window_bits=12; server_no_context_takeover"},
+	}
+	for _, tt := range tests {
+		c, err := (&Dialer{Extensions: []Extension{tt.pmd}}).Dial(ctx, url+"/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := c.HandshakeResponse.Header.Get("Sec-WebSocket-Extensions"); got != tt.resp {
+			t.Fatalf("%s: got %q; want %q", tt.name, got, tt.resp)
+		}
+
+		var lens []uint64
+		c.TraceFrameIn = func(f *Frame) {
+			lens = append(lens, f.PayloadLen)
+		}
+		s := (&DefaultMessageSender{}).SetConn(c)
+		r := (&DefaultMessageReceiver{}).SetConn(c)
+		data := strings.Repeat("hello kiwi ", 100)
+		for range 2 {
+			s.SendWhole(&Message{Opcode: OpcodeText, Data: []byte(data)}, false)
+			if msg, err := r.ReadWhole(0); err != nil || string(msg.Data) != data {
+				t.Fatalf("%s: got %v, %v; want the echo", tt.name, msg, err)
+			}
+		}
+		// without the context the second echo is compressed like the first
+		if len(lens) != 2 || lens[0] != lens[1] {
+			t.Fatalf("%s: got the lengths %v; want the same two", tt.name, lens)
+		}
+		c.Close()
+	}
+
+	// the server must accept the offers of a client
+	pmd := &PerMessageDeflate{ServerNoContextTakeover: true, ServerMaxWindowBits: 12}
+	if offer := formatExtension(pmd.Name(), pmd.Offer()); offer != "permessage-deflate; client_max_window_bits; server_max_window_bits=12; server_no_context_takeover" {
+		t.Fatalf("got the offer %s", offer)
+	}
+	for _, resp := range []ExtensionParams{
+		{"server_max_window_bits": "12"},
+		{"server_no_context_takeover": "", "server_max_window_bits": "13"},
+	} {
+		if _, err := pmd.Accepted(resp); err == nil {
+			t.Errorf("%v: got no error", resp)
+		}
+	}
+	ec, err := pmd.Accepted(ExtensionParams{"server_no_context_takeover": "", "server_max_window_bits": "9"})
+	if err != nil || ec.(*deflateConn).window != 1<<9 || !ec.(*deflateConn).noDecompressTakeover {
+		t.Fatalf("got %+v, %v; want a window of 9 bits without the takeover", ec, err)
+	}
+}
+
+func TestConnExtensions(t *testing.T) {
+	srv := NewServer()
+	srv.ApplyDefaultCfg()
+	srv.Extensions = []Extension{&PerMessageDeflate{ServerNoContextTakeover: true}}
+	srv.OnConnOpenFunc("/", func(r MessageReceiver, s MessageSender) {
+		r.ReadWhole(0)
+	})
+	srv.OnHandshakeRequestFunc("/", func(hsReq *HandshakeRequest, c *Conn) (int, error) {
+		resp := &HandshakeResponse{StatusCode: http.StatusSwitchingProtocols}
+		resp.AddHeader("Upgrade", "websocket")
+		resp.AddHeader("Connection", "Upgrade")
+		resp.AddHeader("Sec-WebSocket-Accept", string(MakeAcceptKey(hsReq.Header.GetOne("Sec-WebSocket-Key"))))
+		resp.AddHeader("Sec-WebSocket-Protocol", "chat")
+		resp.AddHeader("Sec-WebSocket-Extensions", c.negotiateExtensions(hsReq))
+		return 0, c.WriteHandshakeResponse(resp)
+	})
+	type agreed struct {
+		subprotocol string
+		exts        []NegotiatedExtension
+	}
+	got := make(chan agreed, 1)
+	srv.OnHandshakeComplete = func(c *Conn) {
+		got <- agreed{c.Subprotocol(), c.Extensions()}
+	}
+	url := listenTestServer(t, srv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := (&Dialer{Subprotocols: []string{"chat"}, Extensions: []Extension{&PerMessageDeflate{}}}).Dial(ctx, url+"/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	want := []NegotiatedExtension{{Name: "permessage-deflate", Params: ExtensionParams{"server_no_context_takeover": ""}}}
+	equal := func(a, b NegotiatedExtension) bool {
+		return a.Name == b.Name && reflect.DeepEqual(a.Params, b.Params)
+	}
+	if s := <-got; s.subprotocol != "chat" || !slices.EqualFunc(s.exts, want, equal) {
+		t.Fatalf("got %q, %v on the server; want chat, %v", s.subprotocol, s.exts, want)
+	}
+	if p := c.Subprotocol(); p != "chat" || !slices.EqualFunc(c.Extensions(), want, equal) {
+		t.Fatalf("got %q, %v on the client; want chat, %v", p, c.Extensions(), want)
+	}
+	if ne, ok := c.Extension("permessage-deflate"); !ok || ne.Name != "permessage-deflate" {
+		t.Fatalf("got %v, %v; want permessage-deflate", ne, ok)
+	}
+	if _, ok := c.Extension("x-xor"); ok {
+		t.Fatal("got x-xor; want it not negotiated")
+	}
+}
+
+func TestTickets(t *testing.T) {
+	tickets := NewTickets([]byte("secret"))
+	subjects := make(chan string, 1)
+
+	srv := NewServer()
+	srv.ApplyDefaultCfg()
+	srv.OnHandshakeRequestFunc("/chat", tickets.HandshakeFunc(nil))
+	srv.OnConnOpenFunc("/chat", func(r MessageReceiver, s MessageSender) {
+		subjects <- r.GetConn().Ticket().Subject
+	})
+	url := listenTestServer(t, srv)
+
+	issuer := httptest.NewServer(tickets.Handler(func(r *http.Request) (string, bool) {
+		return "alice", r.Header.Get("Authorization") == "Bearer x"
+	}))
+	defer issuer.Close()
+
+	issue := func(path string) string {
+		req, _ := http.NewRequest(http.MethodPost, issuer.URL+"?path="+path, nil)
+		req.Header.Set("Authorization", "Bearer x")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		var v struct{ Ticket string }
+		if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+			t.Fatal(err)
+		}
+		return v.Ticket
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	dial := func(d *Dialer, rawURL string) int {
+		c, err := d.Dial(ctx, rawURL)
+		if err != nil {
+			var he *HandshakeError
+			if !errors.As(err, &he) {
+				t.Fatal(err)
+			}
+			return he.Status
+		}
+		c.Close()
+		return http.StatusSwitchingProtocols
+	}
+
+	ticket := issue("/chat")
+	if got := dial(&Dialer{}, url+"/chat?ticket="+ticket); got != http.StatusSwitchingProtocols {
+		t.Fatalf("got status %d; want 101", got)
+	}
+	if got := <-subjects; got != "alice" {
+		t.Fatalf("got subject %q; want alice", got)
+	}
+
+	// a ticket is accepted once
+	if got := dial(&Dialer{}, url+"/chat?ticket="+ticket); got != http.StatusUnauthorized {
+		t.Fatalf("got status %d for the reused ticket; want 401", got)
+	}
+
+	if got := dial(&Dialer{}, url+"/chat?ticket="+issue("/other")); got != http.StatusUnauthorized {
+		t.Fatalf("got status %d for another path; want 401", got)
+	}
+
+	forged := issue("/chat")
+	forged = forged[:len(forged)-2] + "AA"
+	if got := dial(&Dialer{}, url+"/chat?ticket="+forged); got != http.StatusUnauthorized {
+		t.Fatalf("got status %d for a forged ticket; want 401", got)
+	}
+
+	d := &Dialer{Header: http.Header{"X-Websocket-Ticket": {issue("/chat")}}}
+	if got := dial(d, url+"/chat"); got != http.StatusSwitchingProtocols {
+		t.Fatalf("got status %d for the header; want 101", got)
+	}
+	<-subjects
+
+	tickets.TTL = time.Nanosecond
+	if got := dial(&Dialer{}, url+"/chat?ticket="+issue("/chat")); got != http.StatusUnauthorized {
+		t.Fatalf("got status %d for an expired ticket; want 401", got)
+	}
+}
+
+// newTestCert returns a certificate signed by parent, self-signed if it's
+// nil.
+func newTestCert(t *testing.T, name string, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	signer, signerKey := tmpl, any(key)
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestClientCert(t *testing.T) {
+	ca := newTestCert(t, "ca", nil)
+	serverCert := newTestCert(t, "127.0.0.1", &ca)
+	clientCert := newTestCert(t, "billing", &ca)
+	otherCert := newTestCert(t, "billing", nil)
+	unknownCert := newTestCert(t, "search", &ca)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	identities := make(chan string, 1)
+	srv := NewServer(WithTLSConfig(&tls.Config{Certificates: []tls.Certificate{serverCert}}), WithClientCAs(pool))
+	srv.ApplyDefaultCfg()
+	srv.VerifyClientCert = func(conn *Conn, chains [][]*x509.Certificate) error {
+		if len(chains) == 0 || chains[0][0].Subject.CommonName != "billing" {
+			return errors.New("unknown service")
+		}
+		return nil
+	}
+	srv.OnConnOpenFunc("/", func(r MessageReceiver, s MessageSender) {
+		identities <- r.GetConn().VerifiedChains()[0][0].Subject.CommonName
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go srv.Serve(srv.wrapTLS(ln))
+	url := "wss://" + ln.Addr().String() + "/"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	dial := func(certs ...tls.Certificate) error {
+		c, err := (&Dialer{TLSConfig: &tls.Config{RootCAs: pool, Certificates: certs}}).Dial(ctx, url)
+		if err == nil {
+			c.Close()
+		}
+		return err
+	}
+
+	if err := dial(clientCert); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-identities; got != "billing" {
+		t.Fatalf("got %q; want billing", got)
+	}
+
+	if err := dial(); err == nil {
+		t.Fatal("got no error without a client certificate")
+	}
+	if err := dial(otherCert); err == nil {
+		t.Fatal("got no error with an unknown issuer")
+	}
+
+	var he *HandshakeError
+	if err := dial(unknownCert); !errors.As(err, &he) || he.Status != http.StatusForbidden {
+		t.Fatalf("got %v; want 403 by VerifyClientCert", err)
+	}
+}
+
+func TestAcks(t *testing.T) {
+	received := make(chan string, 2)
+
+	srv := NewServer()
+	srv.ApplyDefaultCfg()
+	srv.Acks = true
+	srv.OnConnOpenFunc("/ack", func(r MessageReceiver, s MessageSender) {
+		for msg, err := range r.Messages(0) {
+			if err != nil || msg.IsClose() {
+				return
+			}
+			received <- string(msg.Data)
+			if string(msg.Data) != "drop" {
+				msg.Ack()
+			}
+		}
+	})
+	url := listenTestServer(t, srv)
+
+	cfg := NewServer()
+	cfg.ApplyDefaultCfg()
+	cfg.Acks = true
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := (&Dialer{Config: cfg}).Dial(ctx, url+"/ack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	go func() {
+		for range (&DefaultMessageReceiver{}).SetConn(c).Messages(0) {
+		}
+	}()
+
+	s := (&DefaultMessageSender{}).SetConn(c)
+	if err := s.SendWithAck(&Message{Opcode: OpcodeText, Data: []byte("hello")}, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-received; got != "hello" {
+		t.Fatalf("got %q; want the data without the ack id", got)
+	}
+
+	if err := s.SendWithAck(&Message{Opcode: OpcodeBinary, Data: []byte("drop")}, 100*time.Millisecond); err != ErrAckTimeout {
+		t.Fatalf("got %v; want ErrAckTimeout", err)
+	}
+	<-received
+
+	// the app data looking like the ack protocol is escaped
+	for _, data := range []string{"\x051\nx", "\x061", "\x07", ""} {
+		if _, err := s.SendBinary([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		if got := <-received; got != data {
+			t.Fatalf("got %q; want %q", got, data)
+		}
+	}
+	s.BeginSendFrame()
+	s.SendFrame(nil, OpcodeBinary, true, false, false)
+	s.SendFrame([]byte("\x061"), OpcodeBinary, false, true, false)
+	s.EndSendFrame()
+	if got := <-received; got != "\x061" {
+		t.Fatalf("got %q; want the fragmented message", got)
+	}
+
+	cfg.Acks = false
+	if err := s.SendWithAck(&Message{Opcode: OpcodeText, Data: []byte("x")}, time.Second); err != ErrAcksDisabled {
+		t.Fatalf("got %v; want ErrAcksDisabled", err)
+	}
+}
+
+func TestMemoryMessageStore(t *testing.T) {
+	ms := NewMemoryMessageStore()
+	for id := uint64(1); id <= 5; id++ {
+		if err := ms.Append("a", id, &Message{Opcode: OpcodeText, Data: []byte{byte('0' + id)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ms.Append("b", 1, &Message{Opcode: OpcodeText, Data: []byte("b")})
+
+	ids := func(key string, after uint64) []uint64 {
+		sms, err := ms.ReadFrom(key, after)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []uint64
+		for _, sm := range sms {
+			ids = append(ids, sm.ID)
+		}
+		return ids
+	}
+
+	if got := ids("a", 2); !slices.Equal(got, []uint64{3, 4, 5}) {
+		t.Fatalf("got %v; want [3 4 5]", got)
+	}
+	if got := ids("c", 0); got != nil {
+		t.Fatalf("got %v; want none", got)
+	}
+
+	ms.Trim("a", 3)
+	if got := ids("a", 0); !slices.Equal(got, []uint64{4, 5}) {
+		t.Fatalf("got %v; want [4 5]", got)
+	}
+	ms.Trim("a", math.MaxUint64)
+	if got := ids("a", 0); got != nil || len(ms.outboxes) != 1 {
+		t.Fatalf("got %v and %d outboxes; want the empty one deleted", got, len(ms.outboxes))
+	}
+	if got := ids("b", 0); !slices.Equal(got, []uint64{1}) {
+		t.Fatalf("got %v; want [1]", got)
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	srv := NewServer()
+	srv.ApplyDefaultCfg()
+	srv.OnConnOpenFunc("/chat", func(r MessageReceiver, s MessageSender) {
+		c := r.GetConn()
+		c.AddTag("room:" + c.HandshakeRequest.RequestURL.Query().Get("room"))
+		for _, err := range r.Messages(0) {
+			if err != nil {
+				return
+			}
+		}
+	})
+	url := listenTestServer(t, srv)
+
+	admin := httptest.NewServer(srv.AdminHandler(func(r *http.Request) bool {
+		return r.Header.Get("Authorization") == "Bearer admin"
+	}))
+	defer admin.Close()
+
+	do := func(method, path, body string) (int, string) {
+		req, _ := http.NewRequest(method, admin.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer admin")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var clients []MessageReceiver
+	for _, room := range []string{"a", "a", "b"} {
+		c, err := Dial(ctx, url+"/chat?room="+room)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		clients = append(clients, (&DefaultMessageReceiver{}).SetConn(c))
+	}
+	read := func(r MessageReceiver) string {
+		msg, err := r.ReadWhole(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(msg.Data)
+	}
+
+	// the tags are added by the open handlers
+	var conns []ConnInfo
+	for deadline := time.Now().Add(5 * time.Second); len(conns) < 2 && time.Now().Before(deadline); {
+		_, body := do(http.MethodGet, "/conns?tag=room:a", "")
+		if err := json.Unmarshal([]byte(body), &conns); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(conns) != 2 || conns[0].Path != "/chat" || conns[0].Tags[0] != "room:a" {
+		t.Fatalf("got %+v; want the 2 conns of room a", conns)
+	}
+
+	if code, body := do(http.MethodPost, "/rooms/room:a/send", "hi a"); code != http.StatusOK || !strings.Contains(body, `"sent":2`) {
+		t.Fatalf("got %d %s; want 2 sent", code, body)
+	}
+	if got := read(clients[0]) + read(clients[1]); got != "hi ahi a" {
+		t.Fatalf("got %q", got)
+	}
+
+	_, body := do(http.MethodGet, "/conns?tag=room:b", "")
+	json.Unmarshal([]byte(body), &conns)
+	if len(conns) != 1 {
+		t.Fatalf("got %+v; want the conn of room b", conns)
+	}
+	id := strconv.FormatUint(conns[0].ID, 10)
+
+	if code, _ := do(http.MethodPost, "/conns/"+id+"/send", "hi b"); code != http.StatusNoContent {
+		t.Fatalf("got %d; want 204", code)
+	}
+	if got := read(clients[2]); got != "hi b" {
+		t.Fatalf("got %q", got)
+	}
+
+	if code, _ := do(http.MethodPost, "/conns/"+id+"/close?code=999", ""); code != http.StatusBadRequest {
+		t.Fatalf("got %d; want 400", code)
+	}
+	if code, _ := do(http.MethodPost, "/conns/"+id+"/close?code=4001&reason=kicked", ""); code != http.StatusNoContent {
+		t.Fatalf("got %d; want 204", code)
+	}
+	msg, err := clients[2].ReadWhole(0)
+	if err != nil || msg.CloseError().Code != 4001 || msg.CloseError().Reason != "kicked" {
+		t.Fatalf("got %v, %v; want the close 4001", msg, err)
+	}
+	if code, _ := do(http.MethodPost, "/conns/12345/send", "x"); code != http.StatusNotFound {
+		t.Fatalf("got %d; want 404", code)
+	}
+
+	resp, err := http.Get(admin.URL + "/conns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("got %d; want 401", resp.StatusCode)
+	}
+}
+
+func TestPingRTT(t *testing.T) {
+	srv := NewServer()
+	srv.ApplyDefaultCfg()
+	srv.PingInterval = 10 * time.Millisecond
+	srv.OnConnOpenFunc("/", func(r MessageReceiver, s MessageSender) {
+		for _, err := range r.Messages(0) {
+			if err != nil {
+				return
+			}
+		}
+	})
+	url := listenTestServer(t, srv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := Dial(ctx, url+"/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// the pings of the server are answered by the reads of the client
+	r := (&DefaultMessageReceiver{}).SetConn(c)
+	for range 3 {
+		msg, err := r.ReadWhole(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !msg.IsPing() || !bytes.HasPrefix(msg.Data, rttPingPrefix) {
+			t.Fatalf("got %v; want a timestamped ping", msg)
+		}
+		c.Send(&Message{Opcode: OpcodePong, Data: msg.Data})
+	}
+
+	var sc *Conn
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		srv.ConnPool.Range(func(c *Conn) bool {
+			sc = c
+			return false
+		})
+		if sc != nil && sc.Stats().RTT > 0 {
+			break
+		}
+	}
+	st := sc.Stats()
+	if st.RTT <= 0 || st.LastRTT <= 0 || st.LastPong.IsZero() || st.RTT > time.Second {
+		t.Fatalf("got %+v; want the RTT measured", st)
+	}
+	if srv.Status().RTTMillis <= 0 {
+		t.Fatal("got no RTT in the status")
+	}
+
+	// a pong not echoing the last ping is ignored
+	sc.measureRTT(&Frame{Opcode: OpcodePong, PayloadData: binary.BigEndian.AppendUint64(append([]byte(nil), rttPingPrefix...), 1)})
+	if got := sc.Stats().LastRTT; got > time.Second {
+		t.Fatalf("got %v; want the forged pong ignored", got)
+	}
+}
+
+func TestSendFile(t *testing.T) {
+	data := make([]byte, 100<<10+123)
+	rand.Read(data)
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		data     []byte
+		n        int64
+		progress int64
+		err      error
+	}
+	results := make(chan result, 1)
+
+	srv := NewServer()
+	srv.ApplyDefaultCfg()
+	srv.OnConnOpenFunc("/upload", func(r MessageReceiver, s MessageSender) {
+		var buf bytes.Buffer
+		var res result
+		res.n, res.err = r.ReceiveFile(&buf, 1<<20, func(received int64) {
+			res.progress = received
+		})
+		res.data = buf.Bytes()
+		results <- res
+	})
+	url := listenTestServer(t, srv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := Dial(ctx, url+"/upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	s := (&DefaultMessageSender{}).SetConn(c)
+	// a ping before the file is skipped by ReceiveFile
+	c.Send(&Message{Opcode: OpcodePing, Data: []byte("x")})
+
+	var calls int
+	start := time.Now()
+	n, err := s.SendFile(path, 16<<10, &SendFileOptions{
+		Rate: 1 << 20,
+		Progress: func(sent, total int64) {
+			calls++
+			if total != int64(len(data)) {
+				t.Errorf("got total %d; want %d", total, len(data))
+			}
+		},
+	})
+	if err != nil || n != int64(len(data)) {
+		t.Fatalf("got %d, %v; want %d sent", n, err, len(data))
+	}
+	if calls != 7 {
+		t.Fatalf("got %d progress calls; want 7 for the frames", calls)
+	}
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Fatalf("got %v; want the sending paced to 1MB/s", elapsed)
+	}
+
+	res := <-results
+	if res.err != nil || res.n != int64(len(data)) || res.progress != res.n || !bytes.Equal(res.data, data) {
+		t.Fatalf("got %d bytes, progress %d, %v; want the file", res.n, res.progress, res.err)
+	}
+}
@@ -0,0 +1,342 @@
+package kiwi
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// the query parameters of the handshake resuming a session
+const (
+	SessionTokenParam  = "session"
+	SessionLastIDParam = "last_id"
+)
+
+const (
+	defaultSessionReplaySize = 256
+	defaultSessionTTL        = 2 * time.Minute
+)
+
+var ErrInvalidSessionMessage = errors.New("invalid session message")
+
+// SessionStore keeps the sessions of the conns, so a client reconnecting
+// with the token of its session and the ID of the last message it has seen
+// gets the messages it has missed.
+//
+// Each message sent by a session is prefixed by its ID in decimal and a
+// "\n", the IDs start from 1. The message of ID 0 is sent first on each
+// attach and carries the token of the session. The clients resume it by
+// the SessionTokenParam and SessionLastIDParam query parameters of the
+// handshake, see ClientSession.
+type SessionStore struct {
+	// max messages kept per session for the replay, defaultSessionReplaySize
+	// if it's zero
+	ReplaySize int
+
+	// how long a session is kept once its conn is closed,
+	// defaultSessionTTL if it's zero
+	TTL time.Duration
+
+	// keeps the messages of the sessions for the replay, the outbox of a
+	// session is named by its token. A MemoryMessageStore if it's nil
+	Messages MessageStore
+
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+func NewSessionStore() *SessionStore {
+	return &SessionStore{sessions: make(map[string]*Session)}
+}
+
+// Len returns the number of sessions kept.
+func (st *SessionStore) Len() int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return len(st.sessions)
+}
+
+// Attach resumes the session named by the handshake of the conn of s, or
+// starts a new one if it has none or it has expired. The token is sent
+// first, then the messages after the last ID seen by the client which are
+// still kept. The session is detached once the conn is closed.
+func (st *SessionStore) Attach(s MessageSender) (*Session, error) {
+	c := s.GetConn()
+
+	var token string
+	var lastID uint64
+	if h := c.HandshakeRequest; h != nil && h.RequestURL != nil {
+		q := h.RequestURL.Query()
+		token = q.Get(SessionTokenParam)
+		lastID, _ = strconv.ParseUint(q.Get(SessionLastIDParam), 10, 64)
+	}
+
+	st.mu.Lock()
+	sess, ok := st.sessions[token]
+	if !ok {
+		var err error
+		if sess, err = st.newSession(); err != nil {
+			st.mu.Unlock()
+			return nil, err
+		}
+		lastID = 0
+	}
+	// keeps it from expiring before it's attached
+	sess.mu.Lock()
+	sess.stopExpiry()
+	sess.mu.Unlock()
+	st.mu.Unlock()
+
+	if err := sess.attach(s, lastID); err != nil {
+		return nil, err
+	}
+	context.AfterFunc(c.Context(), func() { sess.detach(s) })
+	return sess, nil
+}
+
+// newSession is called with st.mu held.
+func (st *SessionStore) newSession() (*Session, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	if st.sessions == nil {
+		st.sessions = make(map[string]*Session)
+	}
+	if st.Messages == nil {
+		st.Messages = NewMemoryMessageStore()
+	}
+	sess := &Session{Token: hex.EncodeToString(b), store: st}
+	st.sessions[sess.Token] = sess
+	return sess, nil
+}
+
+func (st *SessionStore) replaySize() int {
+	if st.ReplaySize == 0 {
+		return defaultSessionReplaySize
+	}
+	return st.ReplaySize
+}
+
+func (st *SessionStore) ttl() time.Duration {
+	if st.TTL == 0 {
+		return defaultSessionTTL
+	}
+	return st.TTL
+}
+
+// Session numbers the messages sent to a client and keeps the last ones for
+// the replay, it outlives its conns until SessionStore.TTL has passed.
+type Session struct {
+	Token string
+
+	store *SessionStore
+
+	mu     sync.Mutex
+	lastID uint64
+	sender MessageSender
+	// stops the expiry of the detached session
+	stopTimer func()
+
+	// bumped by each attach and detach, an expiry of a former detach is
+	// ignored
+	gen uint64
+}
+
+// Send numbers msg and sends it, msg must not be modified after that. A
+// message sent while the session is detached, or failing to be sent, is
+// kept for the replay only. It fails without sending msg if it can't be
+// kept by SessionStore.Messages.
+func (sess *Session) Send(msg *Message) (id uint64, err error) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	id = sess.lastID + 1
+	ms := sess.store.Messages
+	if err := ms.Append(sess.Token, id, msg); err != nil {
+		return 0, err
+	}
+	sess.lastID = id
+
+	if size := uint64(sess.store.replaySize()); id > size {
+		if err := ms.Trim(sess.Token, id-size); err != nil {
+			return id, err
+		}
+	}
+
+	if sess.sender == nil {
+		return id, nil
+	}
+	_, err = sess.sender.SendWhole(encodeSessionMessage(id, msg), false)
+	return id, err
+}
+
+// LastID returns the ID of the last message sent.
+func (sess *Session) LastID() uint64 {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return sess.lastID
+}
+
+func (sess *Session) attach(s MessageSender, lastID uint64) error {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	sess.stopExpiry()
+
+	// the conn resumed previously is replaced
+	if old := sess.sender; old != nil && old.GetConn() != s.GetConn() {
+		old.GetConn().CloseWithCode(CloseCodePolicyViolation, "session resumed elsewhere")
+	}
+	sess.sender = s
+
+	token := &Message{Opcode: OpcodeText, Data: []byte(sess.Token)}
+	if _, err := s.SendWhole(encodeSessionMessage(0, token), false); err != nil {
+		return err
+	}
+
+	replay, err := sess.store.Messages.ReadFrom(sess.Token, lastID)
+	if err != nil {
+		return err
+	}
+	for _, sm := range replay {
+		if _, err := s.SendWhole(encodeSessionMessage(sm.ID, sm.Msg), false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sess *Session) detach(s MessageSender) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	if sess.sender == nil || sess.sender.GetConn() != s.GetConn() {
+		return
+	}
+	sess.sender = nil
+	sess.gen++
+	gen := sess.gen
+	clk := s.GetConn().Server.clock()
+	sess.stopTimer = afterFunc(clk, sess.store.ttl(), func() { sess.expire(gen) })
+}
+
+// stopExpiry is called with sess.mu held.
+func (sess *Session) stopExpiry() {
+	sess.gen++
+	if sess.stopTimer != nil {
+		sess.stopTimer()
+		sess.stopTimer = nil
+	}
+}
+
+func (sess *Session) expire(gen uint64) {
+	st := sess.store
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	// not resumed meanwhile
+	if sess.gen == gen {
+		delete(st.sessions, sess.Token)
+		st.Messages.Trim(sess.Token, sess.lastID)
+	}
+}
+
+func encodeSessionMessage(id uint64, msg *Message) *Message {
+	data := strconv.AppendUint(nil, id, 10)
+	data = append(data, '\n')
+	return &Message{Opcode: msg.Opcode, Data: append(data, msg.Data...)}
+}
+
+// ParseSessionMessage splits a message sent by a Session into its ID and
+// data.
+func ParseSessionMessage(msg *Message) (id uint64, data []byte, err error) {
+	i := bytes.IndexByte(msg.Data, '\n')
+	if i < 0 {
+		return 0, nil, ErrInvalidSessionMessage
+	}
+	if id, err = strconv.ParseUint(string(msg.Data[:i]), 10, 64); err != nil {
+		return 0, nil, ErrInvalidSessionMessage
+	}
+	return id, msg.Data[i+1:], nil
+}
+
+// ClientSession is the client side of a Session, it tracks the token and the
+// last ID seen to resume the session on reconnect, see
+// ReconnectingConn.Session.
+type ClientSession struct {
+	mu     sync.Mutex
+	token  string
+	lastID uint64
+}
+
+func (cs *ClientSession) Token() string {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.token
+}
+
+func (cs *ClientSession) LastID() uint64 {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.lastID
+}
+
+// URL adds the query parameters resuming the session to rawURL, it's
+// returned as is before the first token is received.
+func (cs *ClientSession) URL(rawURL string) (string, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if cs.token == "" {
+		return rawURL, nil
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set(SessionTokenParam, cs.token)
+	q.Set(SessionLastIDParam, strconv.FormatUint(cs.lastID, 10))
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// Receive parses a message read from the session and returns its data, ok
+// is false for the token message and for the messages already seen, which
+// should be skipped. The last ID is reset if the server has started a new
+// session.
+func (cs *ClientSession) Receive(msg *Message) (data []byte, ok bool, err error) {
+	id, data, err := ParseSessionMessage(msg)
+	if err != nil {
+		return nil, false, err
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if id == 0 {
+		if token := string(data); token != cs.token {
+			cs.token = token
+			cs.lastID = 0
+		}
+		return nil, false, nil
+	}
+
+	if id <= cs.lastID {
+		return nil, false, nil
+	}
+	cs.lastID = id
+	return data, true, nil
+}
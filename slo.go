@@ -0,0 +1,135 @@
+package kiwi
+
+import (
+	"sync"
+	"time"
+)
+
+type sloSlot struct {
+	sec               int64
+	handshakes        uint64
+	handshakeFailures uint64
+	closes            uint64
+	abnormalCloses    uint64
+	outcomes          map[Outcome]uint64
+}
+
+// SLOTracker counts handshake and close outcomes in per-second slots, so
+// success ratios can be reported over rolling windows up to the largest of
+// Windows.
+type SLOTracker struct {
+	Windows []time.Duration
+
+	slots []sloSlot
+	mu    sync.Mutex
+}
+
+func NewSLOTracker(windows ...time.Duration) *SLOTracker {
+	var max time.Duration
+	for _, w := range windows {
+		if w > max {
+			max = w
+		}
+	}
+
+	return &SLOTracker{
+		Windows: windows,
+		slots:   make([]sloSlot, int(max/time.Second)+1),
+	}
+}
+
+func (t *SLOTracker) slot(now time.Time) *sloSlot {
+	sec := now.Unix()
+	s := &t.slots[sec%int64(len(t.slots))]
+	if s.sec != sec {
+		*s = sloSlot{sec: sec}
+	}
+	return s
+}
+
+func (t *SLOTracker) RecordHandshake(ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := t.slot(time.Now())
+	s.handshakes++
+	if !ok {
+		s.handshakeFailures++
+	}
+}
+
+// RecordClose counts the close of an open conn by the outcome of code, the
+// closes with outcomes other than OutcomeNormal are abnormal.
+func (t *SLOTracker) RecordClose(code uint16) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := t.slot(time.Now())
+	s.closes++
+
+	o := CloseCodeOutcome(code)
+	if o != OutcomeNormal {
+		s.abnormalCloses++
+	}
+	if s.outcomes == nil {
+		s.outcomes = make(map[Outcome]uint64)
+	}
+	s.outcomes[o]++
+}
+
+type SLOReport struct {
+	Window                string  `json:"window"`
+	Handshakes            uint64  `json:"handshakes"`
+	HandshakeFailures     uint64  `json:"handshake_failures"`
+	HandshakeSuccessRatio float64 `json:"handshake_success_ratio"`
+	Closes                uint64  `json:"closes"`
+	AbnormalCloses        uint64  `json:"abnormal_closes"`
+	CloseSuccessRatio     float64 `json:"close_success_ratio"`
+
+	Outcomes map[Outcome]uint64 `json:"outcomes,omitempty"`
+}
+
+func successRatio(total, failures uint64) float64 {
+	if total == 0 {
+		return 1
+	}
+	return float64(total-failures) / float64(total)
+}
+
+// Report returns one report per window, the ratios are 1 if nothing has
+// happened in the window.
+func (t *SLOTracker) Report() []*SLOReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now().Unix()
+	reports := make([]*SLOReport, 0, len(t.Windows))
+
+	for _, w := range t.Windows {
+		r := &SLOReport{Window: w.String()}
+		from := now - int64(w/time.Second)
+
+		for i := range t.slots {
+			s := &t.slots[i]
+			if s.sec <= from || s.sec > now {
+				continue
+			}
+			r.Handshakes += s.handshakes
+			r.HandshakeFailures += s.handshakeFailures
+			r.Closes += s.closes
+			r.AbnormalCloses += s.abnormalCloses
+
+			for o, n := range s.outcomes {
+				if r.Outcomes == nil {
+					r.Outcomes = make(map[Outcome]uint64)
+				}
+				r.Outcomes[o] += n
+			}
+		}
+
+		r.HandshakeSuccessRatio = successRatio(r.Handshakes, r.HandshakeFailures)
+		r.CloseSuccessRatio = successRatio(r.Closes, r.AbnormalCloses)
+		reports = append(reports, r)
+	}
+	return reports
+}
@@ -0,0 +1,260 @@
+package kiwi
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+const defaultSpoolThreshold = 1 << 20
+
+// SpooledMessage is a message read by ReadSpooled, its data is in memory or
+// in a temp file if it's over Server.SpoolThreshold. It must be closed to
+// remove the file.
+type SpooledMessage struct {
+	Opcode uint8
+	Size   int64
+
+	// reads the data
+	io.ReadSeeker
+
+	file *os.File
+}
+
+// OnDisk reports whether the data is spooled to a temp file.
+func (m *SpooledMessage) OnDisk() bool {
+	return m.file != nil
+}
+
+// Close removes the temp file of the data, if any.
+func (m *SpooledMessage) Close() error {
+	if m.file == nil {
+		return nil
+	}
+
+	err := m.file.Close()
+	if rerr := os.Remove(m.file.Name()); err == nil {
+		err = rerr
+	}
+	m.file = nil
+	return err
+}
+
+// spooler keeps the data written to it in memory until it's over limit,
+// then in a temp file.
+type spooler struct {
+	dir   string
+	limit int
+	mem   []byte
+	file  *os.File
+	size  int64
+}
+
+func (s *spooler) Write(p []byte) (int, error) {
+	s.size += int64(len(p))
+
+	if s.file == nil {
+		if len(s.mem)+len(p) <= s.limit {
+			s.mem = append(s.mem, p...)
+			return len(p), nil
+		}
+
+		f, err := os.CreateTemp(s.dir, "kiwi-spool-*")
+		if err != nil {
+			return 0, err
+		}
+		s.file = f
+		if _, err := f.Write(s.mem); err != nil {
+			return 0, err
+		}
+		s.mem = nil
+	}
+	return s.file.Write(p)
+}
+
+func (s *spooler) discard() {
+	if s.file != nil {
+		s.file.Close()
+		os.Remove(s.file.Name())
+	}
+}
+
+func (s *spooler) message(opcode uint8) (*SpooledMessage, error) {
+	m := &SpooledMessage{Opcode: opcode, Size: s.size}
+	if s.file == nil {
+		m.ReadSeeker = bytes.NewReader(s.mem)
+		return m, nil
+	}
+
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		s.discard()
+		return nil, err
+	}
+	m.ReadSeeker, m.file = s.file, s.file
+	return m, nil
+}
+
+// ReadSpooled reads a whole message like ReadWhole, but its data over
+// Server.SpoolThreshold bytes is written to a temp file in Server.SpoolDir
+// instead of being held in memory, so big uploads can be accepted by a
+// maxMsgDataLen over the memory of the server. The control frames in the
+// middle of the message are answered, a close one is returned instead of
+// the message. The text is not checked to be UTF-8 in the strict mode.
+func (r *DefaultMessageReceiver) ReadSpooled(maxMsgDataLen uint64) (msg *SpooledMessage, err error) {
+	defer r.mu.Unlock()
+	r.mu.Lock()
+
+	msg, err = r.readSpooled(maxMsgDataLen)
+	if err != nil {
+		r.failOnError(nil, err)
+	}
+	return
+}
+
+func (r *DefaultMessageReceiver) readSpooled(maxMsgDataLen uint64) (*SpooledMessage, error) {
+	srv := r.conn.Server
+	sp := &spooler{dir: srv.SpoolDir, limit: srv.SpoolThreshold}
+	if sp.limit <= 0 {
+		sp.limit = defaultSpoolThreshold
+	}
+
+	opcode, ctrl, err := r.readStream(sp, maxMsgDataLen, nil)
+	if err != nil {
+		sp.discard()
+		return nil, err
+	}
+	if ctrl != nil {
+		// the message is given up for the close
+		sp.discard()
+		return &SpooledMessage{Opcode: ctrl.Opcode, Size: int64(len(ctrl.Data)), ReadSeeker: bytes.NewReader(ctrl.Data)}, nil
+	}
+	return sp.message(opcode)
+}
+
+// readStream reads the next message writing its data to w frame by frame,
+// progress is called with the bytes written after each one if it's not
+// nil. A control message on its own, or a close in the middle of the
+// message, is returned as ctrl instead.
+func (r *DefaultMessageReceiver) readStream(w io.Writer, maxMsgDataLen uint64, progress func(written int64)) (opcode uint8, ctrl *Message, err error) {
+	if r.conn.GetState() != StateOpen || r.conn.peerClose.Load() != nil {
+		return 0, nil, r.conn.notOpenErr()
+	}
+
+	limits := r.conn.Limits()
+	if maxMsgDataLen == 0 {
+		maxMsgDataLen = limits.MaxMessageBytes
+	}
+	maxFrameLen := min(limits.MaxFramePayloadBytes, maxMsgDataLen)
+
+	var (
+		scan      PayloadScan
+		msgLen    uint64
+		written   int64
+		fragments int
+	)
+
+	fail := func(err error) (uint8, *Message, error) {
+		if scan != nil {
+			scan.Abort()
+		}
+		return 0, nil, err
+	}
+
+	frame := AcquireFrame()
+	defer ReleaseFrame(frame)
+
+	for {
+		frame.Reset()
+		if err := r.conn.readFrame(frame, maxFrameLen); err != nil {
+			return fail(asMessageTooLarge(err))
+		}
+		payload := frame.PayloadData
+		putPayload := func() { DefaultBufferPool.Put(payload) }
+
+		if r.conn.Server.protocolMode() == ProtocolStrict {
+			if err := r.conn.checkFrame(frame, fragments > 0); err != nil {
+				putPayload()
+				return fail(err)
+			}
+		}
+
+		if isControlOpcode(frame.Opcode) {
+			if fragments == 0 {
+				// a control message on its own
+				ctrl = &Message{Opcode: frame.Opcode, Data: payload}
+			} else {
+				var done bool
+				ctrl, done = r.handleControl(frame)
+				putPayload()
+				if !done {
+					continue
+				}
+				// the message is given up for the close
+				if scan != nil {
+					scan.Abort()
+				}
+				r.fragmented = false
+			}
+
+			if _, err := r.checkMessage(ctrl, false); err != nil {
+				return 0, nil, err
+			}
+			return ctrl.Opcode, ctrl, nil
+		}
+
+		if err := r.nextFragment(frame); err != nil {
+			putPayload()
+			return fail(err)
+		}
+		if fragments == 0 {
+			opcode = frame.Opcode
+			if opcode == OpcodeBinary {
+				scan = r.conn.newPayloadScan()
+			}
+		}
+
+		fragments++
+		msgLen += frame.PayloadLen
+		if msgLen > maxMsgDataLen {
+			putPayload()
+			return fail(&SizeError{ErrMessageTooLarge, msgLen, maxMsgDataLen})
+		}
+		if limits.MaxMessageFragments > 0 && fragments > limits.MaxMessageFragments {
+			putPayload()
+			return fail(ErrTooManyFragments)
+		}
+
+		if len(r.conn.extensions) > 0 {
+			err := r.conn.decodeFrame(frame, maxMsgDataLen)
+			payload = frame.PayloadData
+			if err != nil {
+				putPayload()
+				return fail(err)
+			}
+		}
+
+		if scan != nil && scan.Write(payload) != nil {
+			putPayload()
+			return fail(ErrPayloadRejected)
+		}
+
+		n, err := w.Write(payload)
+		written += int64(n)
+		putPayload()
+		if err != nil {
+			return fail(err)
+		}
+		if progress != nil {
+			progress(written)
+		}
+
+		if frame.FIN == 1 {
+			break
+		}
+	}
+
+	if scan != nil && scan.Finish() != nil {
+		return 0, nil, ErrPayloadRejected
+	}
+	return opcode, nil, nil
+}
@@ -0,0 +1,93 @@
+package kiwi
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+const (
+	HealthPath = "/healthz"
+	StatusPath = "/statusz"
+)
+
+type ServerStatus struct {
+	Status        string            `json:"status"`
+	UptimeSeconds float64           `json:"uptime_seconds"`
+	Connections   uint64            `json:"connections"`
+	Paths         map[string]uint64 `json:"paths"`
+	Buckets       map[string]uint64 `json:"buckets,omitempty"`
+	SLO           []*SLOReport      `json:"slo,omitempty"`
+
+	// the mean of the smoothed RTTs of the open conns measured by the pings
+	// of PingInterval
+	RTTMillis float64 `json:"rtt_ms,omitempty"`
+}
+
+func (srv *Server) Status() *ServerStatus {
+	st := &ServerStatus{
+		Status: "ok",
+		Paths: srv.ConnPool.countOpenBy(func(c *Conn) string {
+			return c.HandshakeRequest.RequestURL.Path
+		}),
+	}
+
+	if srv.Bucketing != nil {
+		st.Buckets = srv.ConnPool.countOpenBy(func(c *Conn) string {
+			return c.Bucket
+		})
+	}
+
+	// only open websocket conns are counted, not the ones still in
+	// handshake or serving plain http requests
+	for _, n := range st.Paths {
+		st.Connections += n
+	}
+
+	if srv.PingInterval > 0 {
+		var sum time.Duration
+		var n int
+		srv.ConnPool.Range(func(c *Conn) bool {
+			if rtt := time.Duration(c.srtt.Load()); rtt > 0 && c.GetState() == StateOpen {
+				sum += rtt
+				n++
+			}
+			return true
+		})
+		if n > 0 {
+			st.RTTMillis = float64(sum/time.Duration(n)) / float64(time.Millisecond)
+		}
+	}
+
+	if srv.SLO != nil {
+		st.SLO = srv.SLO.Report()
+	}
+
+	if !srv.startedAt.IsZero() {
+		st.UptimeSeconds = time.Since(srv.startedAt).Seconds()
+	}
+	return st
+}
+
+// StatusHandler serves HealthPath and StatusPath and passes other requests
+// to next, it's intended to be used as the FallbackHandler:
+//
+//	srv.FallbackHandler = srv.StatusHandler(nil)
+func (srv *Server) StatusHandler(next http.Handler) http.Handler {
+	if next == nil {
+		next = http.NotFoundHandler()
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case HealthPath:
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Write([]byte("ok\n"))
+		case StatusPath:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(srv.Status())
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
@@ -0,0 +1,88 @@
+package kiwi
+
+import (
+	"cmp"
+	"slices"
+	"sync"
+)
+
+// StoredMessage is a message kept by a MessageStore.
+type StoredMessage struct {
+	ID  uint64
+	Msg *Message
+}
+
+// MessageStore keeps the outboxes of the messages to be sent, each named by
+// a key, like the ones of the sessions of SessionStore. The messages are
+// numbered by the callers in increasing order. Implementations over Bolt,
+// SQLite and such make the outboxes durable, they must be safe for
+// concurrent use.
+type MessageStore interface {
+	// appends msg of id to the outbox of key
+	Append(key string, id uint64, msg *Message) error
+
+	// returns the messages of the outbox of key whose IDs are greater than
+	// after, in order
+	ReadFrom(key string, after uint64) ([]StoredMessage, error)
+
+	// drops the messages of the outbox of key whose IDs are up to upTo, the
+	// outbox is deleted once it's empty
+	Trim(key string, upTo uint64) error
+}
+
+// MemoryMessageStore is a MessageStore in memory, the messages are kept as
+// they are so they must not be modified once appended.
+type MemoryMessageStore struct {
+	mu       sync.Mutex
+	outboxes map[string][]StoredMessage
+}
+
+func NewMemoryMessageStore() *MemoryMessageStore {
+	return &MemoryMessageStore{outboxes: make(map[string][]StoredMessage)}
+}
+
+func (ms *MemoryMessageStore) Append(key string, id uint64, msg *Message) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if ms.outboxes == nil {
+		ms.outboxes = make(map[string][]StoredMessage)
+	}
+	ms.outboxes[key] = append(ms.outboxes[key], StoredMessage{id, msg})
+	return nil
+}
+
+func (ms *MemoryMessageStore) ReadFrom(key string, after uint64) ([]StoredMessage, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	outbox := ms.outboxes[key]
+	i := outboxAfter(outbox, after)
+	return slices.Clone(outbox[i:]), nil
+}
+
+func (ms *MemoryMessageStore) Trim(key string, upTo uint64) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	outbox := ms.outboxes[key]
+	i := outboxAfter(outbox, upTo)
+	if i == len(outbox) {
+		delete(ms.outboxes, key)
+		return nil
+	}
+	// copied so the trimmed messages can be collected
+	ms.outboxes[key] = append(outbox[:0:0], outbox[i:]...)
+	return nil
+}
+
+// outboxAfter returns the index of the first message of outbox after id.
+func outboxAfter(outbox []StoredMessage, id uint64) int {
+	i, found := slices.BinarySearchFunc(outbox, id, func(sm StoredMessage, id uint64) int {
+		return cmp.Compare(sm.ID, id)
+	})
+	if found {
+		i++
+	}
+	return i
+}
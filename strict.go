@@ -0,0 +1,113 @@
+package kiwi
+
+// ProtocolMode is how closely the handshakes and the frames of the peers
+// are held to RFC 6455, see Server.Mode.
+type ProtocolMode uint8
+
+const (
+	// the checks kiwi has always done, the frames are not checked but for
+	// the fragmentation, like in every mode
+	ProtocolDefault ProtocolMode = iota
+
+	// every rule of RFC 6455, like Server.Strict. The handshake must be a
+	// GET with a key of 16 bytes, and the frames are checked by the rules
+	// of the reserved bits, masking, control frames, fragmentation, close
+	// payloads and UTF-8 text
+	ProtocolStrict
+
+	// tolerates the known deviations of the embedded and legacy peers:
+	// HTTP/1.0 handshakes, a missing Host, header names and Connection and
+	// Upgrade values in any case, a response without Connection, unmasked
+	// frames and invalid close payloads
+	ProtocolLenient
+)
+
+func (srv *Server) protocolMode() ProtocolMode {
+	if srv.Strict {
+		return ProtocolStrict
+	}
+	return srv.Mode
+}
+
+// errors of the checks enabled by ProtocolStrict, the continuation ones are
+// of every mode. The conn is failed with CloseCodeInvalidFramePayloadData
+// for ErrInvalidUTF8 and with CloseCodeProtocolError for the others
+var (
+	ErrReservedBits           = &ProtocolError{"reserved bits set without extension"}
+	ErrUnmaskedFrame          = &ProtocolError{"frame from client is not masked"}
+	ErrMaskedFrame            = &ProtocolError{"frame from server is masked"}
+	ErrInvalidControlFrame    = &ProtocolError{"control frame fragmented or too long"}
+	ErrUnexpectedContinuation = &ProtocolError{"continuation frame without a message to continue"}
+	ErrExpectedContinuation   = &ProtocolError{"data frame inside a fragmented message"}
+	ErrInvalidUTF8            = &ProtocolError{"invalid utf-8 in text message"}
+)
+
+const maxControlFramePayloadLen = 125
+
+func isControlOpcode(opcode uint8) bool {
+	return opcode&0x8 != 0
+}
+
+// checkFrame checks the frame read by the receiver of c, fragmented tells
+// if it is read in the middle of a fragmented message.
+func (c *Conn) checkFrame(f *Frame, fragmented bool) error {
+	if f.rsvBits()&^c.extensionRSV != 0 {
+		return ErrReservedBits
+	}
+
+	if c.client && f.MASK == 1 {
+		return ErrMaskedFrame
+	}
+	if !c.client && f.MASK != 1 {
+		return ErrUnmaskedFrame
+	}
+
+	if isControlOpcode(f.Opcode) {
+		if f.FIN != 1 || f.PayloadLen > maxControlFramePayloadLen {
+			return ErrInvalidControlFrame
+		}
+		if f.Opcode == OpcodeClose {
+			return checkClosePayload(f.PayloadData)
+		}
+		return nil
+	}
+
+	if fragmented && f.Opcode != OpcodeContinue {
+		return ErrExpectedContinuation
+	}
+	if !fragmented && f.Opcode == OpcodeContinue {
+		return ErrUnexpectedContinuation
+	}
+	return nil
+}
+
+// nextFragment moves the fragmentation state of r by the frame f read, a
+// continuation without a message to continue or a data frame inside a
+// fragmented message fails.
+func (r *DefaultMessageReceiver) nextFragment(f *Frame) error {
+	if isControlOpcode(f.Opcode) {
+		return nil
+	}
+	if cont := f.Opcode == OpcodeContinue; cont != r.fragmented {
+		if cont {
+			return ErrUnexpectedContinuation
+		}
+		return ErrExpectedContinuation
+	}
+	r.fragmented = f.FIN == 0
+	return nil
+}
+
+// handleControl answers a control frame read in the middle of a fragmented
+// message, a close frame is returned as the message instead.
+func (r *DefaultMessageReceiver) handleControl(f *Frame) (msg *Message, done bool) {
+	switch f.Opcode {
+	case OpcodePing:
+		sender := &DefaultMessageSender{}
+		sender.SetConn(r.conn)
+		sender.writeFrame(&Frame{FIN: 1, Opcode: OpcodePong, PayloadData: f.PayloadData}, false)
+	case OpcodeClose:
+		return &Message{Opcode: OpcodeClose, Data: append([]byte(nil), f.PayloadData...)}, true
+	}
+	return nil, false
+}
@@ -0,0 +1,67 @@
+package kiwi
+
+import (
+	"net"
+	"time"
+)
+
+// TCPOptions tunes the sockets of the accepted conns, see Server.TCP.
+type TCPOptions struct {
+	// enables Nagle's algorithm, Go sets TCP_NODELAY by default so the small
+	// frames are sent at once
+	Delay bool
+
+	// the keepalive probes of the OS, the Go defaults are used if it's not
+	// enabled, and NoKeepAlive disables them
+	KeepAlive   net.KeepAliveConfig
+	NoKeepAlive bool
+
+	// SO_LINGER, zero keeps the OS default of closing in the background, a
+	// negative value resets the conn by discarding the unsent data on close,
+	// and a positive one makes close block until the data is sent or it
+	// expires, rounded up to seconds
+	Linger time.Duration
+}
+
+// tcpConn is implemented by *net.TCPConn.
+type tcpConn interface {
+	net.Conn
+
+	SetNoDelay(noDelay bool) error
+	SetKeepAliveConfig(config net.KeepAliveConfig) error
+	SetLinger(sec int) error
+}
+
+func (o *TCPOptions) apply(cn net.Conn) error {
+	// the tls conns are not started yet
+	if nc, ok := cn.(interface{ NetConn() net.Conn }); ok {
+		cn = nc.NetConn()
+	}
+
+	tc, ok := cn.(tcpConn)
+	if !ok {
+		return nil
+	}
+
+	if o.Delay {
+		if err := tc.SetNoDelay(false); err != nil {
+			return err
+		}
+	}
+
+	if o.KeepAlive.Enable || o.NoKeepAlive {
+		cfg := o.KeepAlive
+		cfg.Enable = !o.NoKeepAlive
+		if err := tc.SetKeepAliveConfig(cfg); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case o.Linger < 0:
+		return tc.SetLinger(0)
+	case o.Linger > 0:
+		return tc.SetLinger(int((o.Linger + time.Second - 1) / time.Second))
+	}
+	return nil
+}
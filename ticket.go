@@ -0,0 +1,200 @@
+package kiwi
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrInvalidTicket = errors.New("invalid ticket")
+
+const (
+	defaultTicketTTL    = 30 * time.Second
+	defaultTicketParam  = "ticket"
+	defaultTicketHeader = "X-WebSocket-Ticket"
+)
+
+// Ticket is the payload of a ticket issued by Tickets.
+type Ticket struct {
+	ID       string    `json:"jti"`
+	Subject  string    `json:"sub"`
+	Audience string    `json:"aud"`
+	Expires  time.Time `json:"exp"`
+}
+
+// Tickets issues the short-lived one-time tickets authenticating the
+// handshakes, against the cross-site WebSocket hijacking: the app issues a
+// ticket to the authenticated user over HTTPS, e.g. by Handler, and the
+// client passes it by the query param or the header of the handshake,
+// which is rejected with 401 unless the ticket is valid for its path. The
+// tickets are signed by HMAC-SHA256 with Key and each is accepted once.
+type Tickets struct {
+	Key []byte
+
+	// how long the tickets are valid, 30 seconds if it's zero
+	TTL time.Duration
+
+	// the query param and the header carrying the ticket, "ticket" and
+	// X-WebSocket-Ticket if they're empty
+	Param  string
+	Header string
+
+	mu sync.Mutex
+	// the IDs of the tickets accepted until they expire
+	used map[string]time.Time
+}
+
+func NewTickets(key []byte) *Tickets {
+	return &Tickets{Key: key}
+}
+
+// Issue returns a ticket of subject for the handshakes on the path
+// audience.
+func (t *Tickets) Issue(subject, audience string) (string, error) {
+	ticket, _, err := t.issue(subject, audience)
+	return ticket, err
+}
+
+func (t *Tickets) issue(subject, audience string) (string, *Ticket, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", nil, err
+	}
+
+	ttl := t.TTL
+	if ttl <= 0 {
+		ttl = defaultTicketTTL
+	}
+
+	tk := &Ticket{
+		ID:       hex.EncodeToString(id),
+		Subject:  subject,
+		Audience: audience,
+		Expires:  time.Now().Add(ttl),
+	}
+	payload, err := json.Marshal(tk)
+	if err != nil {
+		return "", nil, err
+	}
+
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(payload) + "." + enc.EncodeToString(t.sign(payload)), tk, nil
+}
+
+func (t *Tickets) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, t.Key)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// Verify checks the signature, the expiry and the audience of ticket, and
+// that it's not been accepted before.
+func (t *Tickets) Verify(ticket, audience string) (*Ticket, error) {
+	enc := base64.RawURLEncoding
+	p, s, ok := strings.Cut(ticket, ".")
+	if !ok {
+		return nil, ErrInvalidTicket
+	}
+	payload, err := enc.DecodeString(p)
+	if err != nil {
+		return nil, ErrInvalidTicket
+	}
+	sig, err := enc.DecodeString(s)
+	if err != nil || !hmac.Equal(sig, t.sign(payload)) {
+		return nil, ErrInvalidTicket
+	}
+
+	tk := &Ticket{}
+	if err := json.Unmarshal(payload, tk); err != nil {
+		return nil, ErrInvalidTicket
+	}
+
+	now := time.Now()
+	if !now.Before(tk.Expires) || tk.Audience != audience {
+		return nil, ErrInvalidTicket
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.used == nil {
+		t.used = make(map[string]time.Time)
+	}
+	if _, ok := t.used[tk.ID]; ok {
+		return nil, ErrInvalidTicket
+	}
+	for id, exp := range t.used {
+		if !now.Before(exp) {
+			delete(t.used, id)
+		}
+	}
+	t.used[tk.ID] = tk.Expires
+	return tk, nil
+}
+
+// HandshakeFunc checks the ticket of the handshake before next, which is
+// DefaultServerHandshakeFunc if it's nil. The verified ticket is kept by
+// Conn.Ticket.
+func (t *Tickets) HandshakeFunc(next OnHandshakeRequestFunc) OnHandshakeRequestFunc {
+	if next == nil {
+		next = DefaultServerHandshakeFunc
+	}
+
+	param, header := t.Param, t.Header
+	if param == "" {
+		param = defaultTicketParam
+	}
+	if header == "" {
+		header = defaultTicketHeader
+	}
+
+	return func(hsReq *HandshakeRequest, conn *Conn) (int, error) {
+		ticket := hsReq.RequestURL.Query().Get(param)
+		if vs, ok := hsReq.Header.getFold(header); ok && ticket == "" {
+			ticket = vs[0]
+		}
+
+		tk, err := t.Verify(ticket, hsReq.RequestURL.Path)
+		if err != nil {
+			return http.StatusUnauthorized, err
+		}
+		conn.ticket = tk
+		return next(hsReq, conn)
+	}
+}
+
+// Ticket returns the ticket verified by Tickets.HandshakeFunc, nil if none.
+func (c *Conn) Ticket() *Ticket {
+	return c.ticket
+}
+
+// Handler issues the tickets to the requests authenticated by auth, for the
+// path given by the query param "path". The response is JSON like
+// {"ticket": "...", "expires": "2026-10-17T10:00:30Z"}.
+func (t *Tickets) Handler(auth func(r *http.Request) (subject string, ok bool)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subject, ok := auth(r)
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		ticket, tk, err := t.issue(subject, r.URL.Query().Get("path"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(map[string]any{"ticket": ticket, "expires": tk.Expires})
+	})
+}
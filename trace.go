@@ -0,0 +1,129 @@
+package kiwi
+
+import (
+	"context"
+	"encoding/hex"
+	"strings"
+)
+
+// Attr is a span attribute, the keys follow the OpenTelemetry semantic
+// conventions where there is one.
+type Attr struct {
+	Key   string
+	Value any
+}
+
+// Tracer starts the spans of the conns, it's implemented by a small adapter
+// over an OpenTelemetry tracer so kiwi itself does not depend on it. The
+// adapter should use the TraceContext of ctx, if any, as the remote parent.
+type Tracer interface {
+	Start(ctx context.Context, name string, attrs ...Attr) (context.Context, Span)
+}
+
+type Span interface {
+	SetAttributes(attrs ...Attr)
+	RecordError(err error)
+	End()
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttributes(...Attr) {}
+func (noopSpan) RecordError(error)     {}
+func (noopSpan) End()                  {}
+
+// TraceContext is the W3C trace context propagated by the traceparent and
+// tracestate headers of the handshake request.
+type TraceContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Flags   byte
+	State   string
+}
+
+func (tc TraceContext) Sampled() bool {
+	return tc.Flags&1 == 1
+}
+
+// ParseTraceParent parses a traceparent header like
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01.
+func ParseTraceParent(s string) (tc TraceContext, ok bool) {
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return tc, false
+	}
+	// only version 00 has exactly four parts
+	if parts[0] == "00" && len(parts) != 4 {
+		return tc, false
+	}
+
+	var flags [1]byte
+	if _, err := hex.Decode(tc.TraceID[:], []byte(parts[1])); err != nil {
+		return tc, false
+	}
+	if _, err := hex.Decode(tc.SpanID[:], []byte(parts[2])); err != nil {
+		return tc, false
+	}
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return tc, false
+	}
+	tc.Flags = flags[0]
+
+	if tc.TraceID == [16]byte{} || tc.SpanID == [8]byte{} {
+		return tc, false
+	}
+	return tc, true
+}
+
+type traceContextKey struct{}
+
+func ContextWithTraceContext(ctx context.Context, tc TraceContext) context.Context {
+	return context.WithValue(ctx, traceContextKey{}, tc)
+}
+
+func TraceContextFromContext(ctx context.Context) (TraceContext, bool) {
+	tc, ok := ctx.Value(traceContextKey{}).(TraceContext)
+	return tc, ok
+}
+
+// headerValue returns the first value of key, the trace headers are usually
+// sent in lower case.
+func headerValue(h Header, keys ...string) string {
+	for _, k := range keys {
+		if vs := h.Get(k); len(vs) > 0 {
+			return vs[0]
+		}
+	}
+	return ""
+}
+
+// extractTraceContext adds the trace context of the handshake request to
+// the conn context.
+func (c *Conn) extractTraceContext() {
+	h := c.HandshakeRequest.Header
+	tc, ok := ParseTraceParent(headerValue(h, "traceparent", "Traceparent"))
+	if !ok {
+		return
+	}
+	tc.State = headerValue(h, "tracestate", "Tracestate")
+	c.ctx = ContextWithTraceContext(c.ctx, tc)
+}
+
+// startSpan starts a span under the conn context, the context is not
+// changed.
+func (c *Conn) startSpan(name string, attrs ...Attr) (context.Context, Span) {
+	tracer := c.Server.Tracer
+	if tracer == nil {
+		return c.ctx, noopSpan{}
+	}
+	return tracer.Start(c.ctx, name, attrs...)
+}
+
+func (c *Conn) spanAttrs() []Attr {
+	attrs := []Attr{{"network.peer.address", c.rwc.RemoteAddr().String()}}
+	if c.HandshakeRequest != nil && c.HandshakeRequest.RequestURL != nil {
+		attrs = append(attrs, Attr{"url.path", c.HandshakeRequest.RequestURL.Path})
+	}
+	return attrs
+}
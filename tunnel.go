@@ -0,0 +1,174 @@
+package kiwi
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// the headers of the handshake of a client passed on by DialUpstream
+var upstreamHeaders = []string{"Authorization", "Cookie", "Origin", "User-Agent"}
+
+// ProxyConn pipes the frames between client and upstream as they are read,
+// the pings and pongs pass through so the peers see each other's liveness.
+// Both sides should have negotiated the same extensions, the reserved bits
+// are passed on. It returns nil once the close frame of a side has been
+// passed on to the other, and both conns are closed then. If a side fails,
+// the other is closed with CloseCodeBadGateway, or CloseCodeGoingAway if
+// it's the client failing, and the error is returned.
+func ProxyConn(client, upstream *Conn) error {
+	errc := make(chan error, 2)
+	go func() {
+		errc <- pipeFrames(upstream, client)
+	}()
+	go func() {
+		if err := pipeFrames(client, upstream); err != nil {
+			errc <- &upstreamError{err}
+			return
+		}
+		errc <- nil
+	}()
+
+	err := <-errc
+	var ue *upstreamError
+	switch {
+	case errors.As(err, &ue):
+		client.CloseWithCode(CloseCodeBadGateway, "")
+		upstream.Close()
+		err = ue.err
+	case err != nil:
+		upstream.CloseWithCode(CloseCodeGoingAway, "")
+		client.Close()
+	}
+
+	// the other pipe fails once its conn is closed
+	<-errc
+	return err
+}
+
+// upstreamError is an error of the upstream side of ProxyConn.
+type upstreamError struct {
+	err error
+}
+
+func (e *upstreamError) Error() string {
+	return e.err.Error()
+}
+
+// pipeFrames writes the frames read from src to dst until src sends a close
+// frame, which is passed on to dst and replied to src.
+func pipeFrames(dst, src *Conn) error {
+	s := &DefaultMessageSender{conn: dst}
+	frame := AcquireFrame()
+	defer ReleaseFrame(frame)
+
+	// the send lock of dst is held from the first frame of a data message
+	// to its last one
+	locked := false
+	defer func() {
+		if locked {
+			dst.sendMu.Unlock()
+		}
+	}()
+
+	for {
+		if err := src.readFrame(frame, src.Limits().MaxFramePayloadBytes); err != nil {
+			return err
+		}
+
+		if frame.Opcode == OpcodeClose {
+			err := checkClosePayload(frame.PayloadData)
+			ce := newCloseError(frame.PayloadData)
+			DefaultBufferPool.Put(frame.PayloadData)
+			if err != nil {
+				src.closeWithCode(CloseCodeProtocolError)
+				return err
+			}
+
+			if ce.Code == CloseCodeNoStatusRcvd {
+				ce.Code = CloseCodeNormalClosure
+			}
+			dst.CloseWithCode(ce.Code, ce.Reason)
+			src.CloseWithCode(ce.Code, ce.Reason)
+			return nil
+		}
+
+		data := !isControlOpcode(frame.Opcode)
+		if data && !locked {
+			dst.sendMu.Lock()
+			locked = true
+		}
+		_, err := s.writeFrame(frame, false)
+		if data && frame.FIN == 1 {
+			dst.sendMu.Unlock()
+			locked = false
+		}
+		DefaultBufferPool.Put(frame.PayloadData)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// DialUpstream dials rawURL for proxying client by ProxyConn. The
+// subprotocol selected for client is asked, the Authorization, Cookie,
+// Origin and User-Agent headers of its handshake are passed on after the
+// ones of d, and its address is added to X-Forwarded-For.
+func (d *Dialer) DialUpstream(ctx context.Context, rawURL string, client *Conn) (*Conn, error) {
+	ud := *d
+	ud.Header = make(http.Header)
+	for k, vs := range d.Header {
+		ud.Header[k] = append([]string(nil), vs...)
+	}
+
+	if p := client.Subprotocol(); p != "" {
+		ud.Subprotocols = []string{p}
+	}
+
+	var forwardedFor []string
+	if req := client.HandshakeRequest; req != nil {
+		for k, vs := range req.Header {
+			k = http.CanonicalHeaderKey(k)
+			switch {
+			case k == "X-Forwarded-For":
+				forwardedFor = append(forwardedFor, vs...)
+			case slices.Contains(upstreamHeaders, k) && ud.Header.Get(k) == "":
+				ud.Header[k] = append([]string(nil), vs...)
+			}
+		}
+	}
+	if host, _, err := net.SplitHostPort(client.RemoteAddr().String()); err == nil {
+		forwardedFor = append(forwardedFor, host)
+	}
+	if len(forwardedFor) > 0 {
+		ud.Header.Set("X-Forwarded-For", strings.Join(forwardedFor, ", "))
+	}
+
+	return ud.Dial(ctx, rawURL)
+}
+
+// ProxyTo returns an OnConnOpenFunc proxying the conns to rawURL by
+// DialUpstream of d, DefaultDialer if it's nil. The conns failing to dial
+// the upstream are closed with CloseCodeBadGateway.
+func ProxyTo(d *Dialer, rawURL string) OnConnOpenFunc {
+	if d == nil {
+		d = DefaultDialer
+	}
+
+	return func(r MessageReceiver, s MessageSender) {
+		client := r.GetConn()
+		upstream, err := d.DialUpstream(client.Context(), rawURL, client)
+		if err != nil {
+			client.Server.logf("[Proxy] %s\n", err.Error())
+			client.CloseWithCode(CloseCodeBadGateway, "")
+			return
+		}
+
+		if err := ProxyConn(client, upstream); err != nil {
+			client.Server.logf("[Proxy] %s\n", err.Error())
+		}
+	}
+}
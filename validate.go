@@ -0,0 +1,130 @@
+package kiwi
+
+import (
+	"errors"
+)
+
+var ErrInvalidMessage = errors.New("invalid message")
+
+// ValidationAction is what's done with a message failing the validation of
+// its route.
+type ValidationAction uint8
+
+const (
+	// the conn is closed with CloseCodePolicyViolation
+	ValidationClosePolicyViolation ValidationAction = iota
+	// the conn is closed with CloseCodeInvalidFramePayloadData
+	ValidationCloseInvalidData
+	// the message is dropped and the next one is read
+	ValidationDrop
+	// the message is dropped, the error is replied and the next one is read
+	ValidationReply
+)
+
+// Validation checks the text and binary messages of a route before the
+// handlers see them, e.g. for enforcing a schema centrally.
+type Validation struct {
+	// called in order, the first error fails the message
+	Validators []func(*Message) error
+
+	Action ValidationAction
+
+	// builds the reply of ValidationReply, a text message of the error if
+	// it's nil
+	Reply func(msg *Message, err error) *Message
+}
+
+// ValidationError is returned by the reads of a message failing the
+// validation of its route, the conn has been closed.
+type ValidationError struct {
+	Err error
+
+	code uint16
+}
+
+func (e *ValidationError) Error() string {
+	return ErrInvalidMessage.Error() + ": " + e.Err.Error()
+}
+
+func (e *ValidationError) Unwrap() []error {
+	return []error{ErrInvalidMessage, e.Err}
+}
+
+// SetValidation validates the messages read by ReadWhole, ReadWholeInto and
+// the callback API from the conns opened on pattern.
+func (rt *routes) SetValidation(pattern string, v Validation) {
+	if rt.validations == nil {
+		rt.validations = make(map[string]*Validation)
+	}
+
+	rt.validations[pattern] = &v
+
+	if pattern[len(pattern)-1] != '/' {
+		rt.validations[pattern+"/"] = &v
+	}
+}
+
+func (c *Conn) validation() *Validation {
+	if c.HandshakeRequest == nil {
+		return nil
+	}
+	return c.routes().validations[c.HandshakeRequest.RequestURL.Path]
+}
+
+func (v *Validation) validate(msg *Message) error {
+	for _, fn := range v.Validators {
+		if err := fn(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readValid reads the next message passing the validation of the route of
+// the conn, the failing ones are handled by the action of the validation.
+func (r *DefaultMessageReceiver) readValid(maxMsgDataLen uint64, buf []byte, intoBuf bool) (*Message, error) {
+	v := r.conn.validation()
+
+	for {
+		msg, err := r.readWhole(maxMsgDataLen, buf, intoBuf)
+		if err == nil && !r.conn.unwrapAck(msg) {
+			continue
+		}
+		if err == nil && r.AutoControl && !msg.IsText() && !msg.IsBinary() {
+			err := r.answerControl(msg)
+			msg.Release()
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil || v == nil || (!msg.IsText() && !msg.IsBinary()) {
+			return msg, err
+		}
+
+		err = v.validate(msg)
+		if err == nil {
+			return msg, nil
+		}
+
+		switch v.Action {
+		case ValidationDrop:
+		case ValidationReply:
+			reply := &Message{Opcode: OpcodeText, Data: []byte(err.Error())}
+			if v.Reply != nil {
+				reply = v.Reply(msg, err)
+			}
+			if err := r.conn.Send(reply); err != nil {
+				msg.Release()
+				return nil, err
+			}
+		case ValidationCloseInvalidData:
+			msg.Release()
+			return nil, &ValidationError{err, CloseCodeInvalidFramePayloadData}
+		default:
+			msg.Release()
+			return nil, &ValidationError{err, CloseCodePolicyViolation}
+		}
+		msg.Release()
+	}
+}
@@ -0,0 +1,96 @@
+package kiwi
+
+import (
+	"net"
+	"strings"
+)
+
+// VirtualHost serves the handshakes whose Host header matches it by its own
+// handlers, limits and origin policy, so one listener can serve several
+// applications. It's created by Server.Host and has the same methods to
+// register the handlers as the Server.
+type VirtualHost struct {
+	// overrides the server limits, the zero fields fall back to them
+	Limits Limits
+
+	// overrides Server.Origins if it's not nil
+	Origins *OriginPolicy
+
+	routes
+}
+
+func (vh *VirtualHost) limitsFor(reqPath string) Limits {
+	limits := vh.routeLimits[reqPath]
+
+	if limits.MaxFramePayloadBytes == 0 {
+		limits.MaxFramePayloadBytes = vh.Limits.MaxFramePayloadBytes
+	}
+
+	if limits.MaxMessageBytes == 0 {
+		limits.MaxMessageBytes = vh.Limits.MaxMessageBytes
+	}
+
+	if limits.MaxMessageFragments == 0 {
+		limits.MaxMessageFragments = vh.Limits.MaxMessageFragments
+	}
+
+	if limits.MinAvgFragmentBytes == 0 {
+		limits.MinAvgFragmentBytes = vh.Limits.MinAvgFragmentBytes
+	}
+	return limits
+}
+
+// Host returns the virtual host of host, creating it on the first call. host
+// is matched against the Host header without its port and case-insensitively,
+// "*.example.com" matches the subdomains of example.com if no host matches
+// exactly. The handshakes not matching any host are served by the handlers of
+// the server itself. It must be called before the server is serving.
+func (srv *Server) Host(host string) *VirtualHost {
+	host = normalizeHost(host)
+
+	if vh, ok := srv.hosts[host]; ok {
+		return vh
+	}
+
+	if srv.hosts == nil {
+		srv.hosts = make(map[string]*VirtualHost)
+	}
+
+	vh := &VirtualHost{}
+	vh.routes.init()
+	srv.hosts[host] = vh
+	return vh
+}
+
+func (srv *Server) virtualHost(hostHeader string) *VirtualHost {
+	if len(srv.hosts) == 0 {
+		return nil
+	}
+
+	host := normalizeHost(hostHeader)
+	if vh, ok := srv.hosts[host]; ok {
+		return vh
+	}
+
+	// the closest wildcard first, a.b.example.com tries *.b.example.com,
+	// then *.example.com and *.com
+	for {
+		i := strings.IndexByte(host, '.')
+		if i < 0 {
+			return nil
+		}
+		host = host[i+1:]
+		if vh, ok := srv.hosts["*."+host]; ok {
+			return vh
+		}
+	}
+}
+
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(host, ".")
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	return strings.ToLower(host)
+}
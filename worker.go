@@ -0,0 +1,131 @@
+package kiwi
+
+import (
+	"runtime"
+	"sync"
+)
+
+const (
+	defaultWorkerQueue = 16
+
+	// messages of a conn handled in a row before the worker lets the other
+	// conns go first
+	workerBatch = 32
+)
+
+// WorkerPool runs the message handlers of the callback API off the read
+// goroutines of the conns, so a slow handler doesn't stall the reads, see
+// Server.Workers. The messages of a conn are handled one at a time in the
+// order they are read, those of different conns run in parallel on at most
+// workers goroutines.
+type WorkerPool struct {
+	queue int
+	tasks chan *mailbox
+	wg    sync.WaitGroup
+}
+
+// NewWorkerPool starts workers goroutines, GOMAXPROCS if it's zero. Up to queue messages, 16 if it's
+// zero, wait for the handler of each conn, its reads are blocked once they
+// are queued.
+func NewWorkerPool(workers, queue int) *WorkerPool {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if queue <= 0 {
+		queue = defaultWorkerQueue
+	}
+
+	p := &WorkerPool{queue: queue, tasks: make(chan *mailbox, workers)}
+	p.wg.Add(workers)
+	for range workers {
+		go p.work()
+	}
+	return p
+}
+
+// Close stops the workers once the queued messages are handled, it should
+// be called after the server is shut down.
+func (p *WorkerPool) Close() {
+	close(p.tasks)
+	p.wg.Wait()
+}
+
+func (p *WorkerPool) work() {
+	defer p.wg.Done()
+
+	for mb := range p.tasks {
+		mb.run()
+	}
+}
+
+// mailbox queues the messages of a conn, it's given to a worker while it's
+// not empty.
+type mailbox struct {
+	pool   *WorkerPool
+	handle func(*Message)
+
+	mu      sync.Mutex
+	cond    sync.Cond
+	msgs    []*Message
+	running bool
+}
+
+func (p *WorkerPool) newMailbox(handle func(*Message)) *mailbox {
+	mb := &mailbox{pool: p, handle: handle}
+	mb.cond.L = &mb.mu
+	return mb
+}
+
+func (mb *mailbox) put(msg *Message) {
+	mb.mu.Lock()
+	for len(mb.msgs) >= mb.pool.queue {
+		mb.cond.Wait()
+	}
+	mb.msgs = append(mb.msgs, msg)
+
+	start := !mb.running
+	mb.running = true
+	mb.mu.Unlock()
+
+	if start {
+		mb.pool.tasks <- mb
+	}
+}
+
+func (mb *mailbox) run() {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	for n := 0; len(mb.msgs) > 0; n++ {
+		// requeued behind the other conns if a worker can take it
+		if n == workerBatch {
+			select {
+			case mb.pool.tasks <- mb:
+				return
+			default:
+				n = 0
+			}
+		}
+
+		msg := mb.msgs[0]
+		mb.msgs[0] = nil
+		mb.msgs = mb.msgs[1:]
+		mb.cond.Broadcast()
+
+		mb.mu.Unlock()
+		mb.handle(msg)
+		mb.mu.Lock()
+	}
+
+	mb.running = false
+	mb.cond.Broadcast()
+}
+
+// wait returns once the queued messages are handled.
+func (mb *mailbox) wait() {
+	mb.mu.Lock()
+	for mb.running {
+		mb.cond.Wait()
+	}
+	mb.mu.Unlock()
+}
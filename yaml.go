@@ -0,0 +1,173 @@
+package kiwi
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type yamlLine struct {
+	num    int
+	indent int
+	text   string
+}
+
+// parseYAML parses the subset of YAML used by the config files: nested
+// block mappings, block sequences of scalars, flow sequences like [a, b],
+// plain, single and double quoted scalars, and comments. Anchors, multi-line
+// strings and multiple documents are not supported.
+func parseYAML(data []byte) (any, error) {
+	var lines []yamlLine
+	for i, raw := range strings.Split(string(data), "\n") {
+		text := strings.TrimRight(stripYAMLComment(raw), " \t\r")
+		trimmed := strings.TrimLeft(text, " ")
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+		if strings.HasPrefix(text, "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed for indentation", i+1)
+		}
+		lines = append(lines, yamlLine{i + 1, len(text) - len(trimmed), trimmed})
+	}
+
+	if len(lines) == 0 {
+		return map[string]any{}, nil
+	}
+
+	v, next, err := parseYAMLBlock(lines, 0, lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if next < len(lines) {
+		return nil, fmt.Errorf("line %d: unexpected indentation", lines[next].num)
+	}
+	return v, nil
+}
+
+// stripYAMLComment removes a comment starting by " #" or at the beginning of
+// the line, outside of the quotes.
+func stripYAMLComment(s string) string {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || s[i-1] == ' ' || s[i-1] == '\t'):
+			return s[:i]
+		}
+	}
+	return s
+}
+
+func parseYAMLBlock(lines []yamlLine, i, indent int) (any, int, error) {
+	if strings.HasPrefix(lines[i].text, "- ") || lines[i].text == "-" {
+		var seq []any
+		for i < len(lines) && lines[i].indent == indent && strings.HasPrefix(lines[i].text, "-") {
+			v, err := parseYAMLScalar(strings.TrimSpace(lines[i].text[1:]))
+			if err != nil {
+				return nil, i, fmt.Errorf("line %d: %w", lines[i].num, err)
+			}
+			seq = append(seq, v)
+			i++
+		}
+		return seq, i, nil
+	}
+
+	m := make(map[string]any)
+	for i < len(lines) && lines[i].indent == indent {
+		l := lines[i]
+
+		key, rest, ok := strings.Cut(l.text, ":")
+		if !ok || (rest != "" && rest[0] != ' ') {
+			return nil, i, fmt.Errorf("line %d: expected a key: value pair", l.num)
+		}
+		key = strings.TrimSpace(key)
+		if uq, err := parseYAMLScalar(key); err == nil {
+			if s, ok := uq.(string); ok {
+				key = s
+			}
+		}
+		if _, dup := m[key]; dup {
+			return nil, i, fmt.Errorf("line %d: duplicate key %q", l.num, key)
+		}
+
+		rest = strings.TrimSpace(rest)
+		i++
+
+		if rest != "" {
+			v, err := parseYAMLScalar(rest)
+			if err != nil {
+				return nil, i, fmt.Errorf("line %d: %w", l.num, err)
+			}
+			m[key] = v
+			continue
+		}
+
+		// the value is the nested block, a sequence may be at the same
+		// indentation as its key
+		if i < len(lines) && (lines[i].indent > indent ||
+			lines[i].indent == indent && strings.HasPrefix(lines[i].text, "-")) {
+			v, next, err := parseYAMLBlock(lines, i, lines[i].indent)
+			if err != nil {
+				return nil, next, err
+			}
+			m[key] = v
+			i = next
+		} else {
+			m[key] = nil
+		}
+	}
+
+	if i < len(lines) && lines[i].indent > indent {
+		return nil, i, fmt.Errorf("line %d: unexpected indentation", lines[i].num)
+	}
+	return m, i, nil
+}
+
+func parseYAMLScalar(s string) (any, error) {
+	switch {
+	case s == "" || s == "~" || s == "null":
+		return nil, nil
+	case s == "true":
+		return true, nil
+	case s == "false":
+		return false, nil
+	case s[0] == '"':
+		return strconv.Unquote(s)
+	case s[0] == '\'':
+		if len(s) < 2 || s[len(s)-1] != '\'' {
+			return nil, errors.New("unterminated quoted string")
+		}
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	case s[0] == '[':
+		if s[len(s)-1] != ']' {
+			return nil, errors.New("unterminated flow sequence")
+		}
+		seq := []any{}
+		if inner := strings.TrimSpace(s[1 : len(s)-1]); inner != "" {
+			for _, item := range strings.Split(inner, ",") {
+				v, err := parseYAMLScalar(strings.TrimSpace(item))
+				if err != nil {
+					return nil, err
+				}
+				seq = append(seq, v)
+			}
+		}
+		return seq, nil
+	case s[0] == '{' || s[0] == '&' || s[0] == '*' || s[0] == '|' || s[0] == '>':
+		return nil, fmt.Errorf("unsupported yaml: %s", s)
+	}
+
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n, nil
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f, nil
+	}
+	return s, nil
+}